@@ -0,0 +1,167 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/automationbroker/bundle-lib/clients"
+	"github.com/openshift/ansible-service-broker/pkg/backup"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/openshift/ansible-service-broker/pkg/migration"
+	"github.com/sirupsen/logrus"
+)
+
+var options struct {
+	ConfigFile           string
+	ArchiveFile          string
+	KeyFile              string
+	Restore              bool
+	Namespace            string
+	CredentialsNamespace string
+	DryRun               bool
+	Verify               bool
+	OverwriteSpecs       bool
+}
+
+func init() {
+	flag.StringVar(&options.ConfigFile, "config", "", "broker config file of the dao to back up or restore to")
+	flag.StringVar(&options.ArchiveFile, "file", "", "archive file to write, or to read with --restore")
+	flag.StringVar(&options.KeyFile, "key-file", "", "file holding the key the archive is encrypted with, the archive is not encrypted without one")
+	flag.BoolVar(&options.Restore, "restore", false, "restore the archive instead of backing up")
+	flag.StringVar(&options.Namespace, "namespace", "", "only restore the service instances of this namespace")
+	flag.StringVar(&options.CredentialsNamespace, "credentials-namespace", "", "namespace of the secrets holding the extracted credentials, they are not referenced without one")
+	flag.BoolVar(&options.DryRun, "dry-run", false, "print what would be restored without writing it")
+	flag.BoolVar(&options.Verify, "verify", true, "compare every restored record with the archive")
+	flag.BoolVar(&options.OverwriteSpecs, "overwrite-specs", false, "restore the specs the dao already has instead of keeping them")
+	flag.Parse()
+}
+
+func fail(format string, args ...interface{}) {
+	logrus.Errorf(format, args...)
+	os.Exit(2)
+}
+
+func main() {
+	if options.ConfigFile == "" || options.ArchiveFile == "" {
+		fmt.Fprintln(os.Stderr, "both --config and --file are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	var key []byte
+	if options.KeyFile != "" {
+		var err error
+		key, err = ioutil.ReadFile(options.KeyFile)
+		if err != nil {
+			fail("Unable to read the key file - %v", err)
+		}
+		if len(key) == 0 {
+			fail("The key file %s is empty", options.KeyFile)
+		}
+	}
+	d, err := migration.NewDao(options.ConfigFile)
+	if err != nil {
+		fail("Unable to create the dao - %v", err)
+	}
+	var credentials backup.CredentialStore
+	if options.CredentialsNamespace != "" {
+		k8scli, err := clients.Kubernetes()
+		if err != nil {
+			fail("Unable to get kubernetes client - %v", err)
+		}
+		credentials = migration.NewSecretCredentials(k8scli, options.CredentialsNamespace)
+	}
+
+	if options.Restore {
+		restore(d, credentials, key)
+		return
+	}
+
+	a, err := backup.Export(d, credentials)
+	if err != nil {
+		fail("Unable to back up - %v", err)
+	}
+	f, err := os.OpenFile(options.ArchiveFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fail("Unable to create the archive - %v", err)
+	}
+	if err := backup.Write(f, a, key); err != nil {
+		f.Close()
+		fail("Unable to write the archive - %v", err)
+	}
+	if err := f.Close(); err != nil {
+		fail("Unable to write the archive - %v", err)
+	}
+	fmt.Printf("backed up %d specs, %d service instances, %d bind instances, %d job states and %d extracted credentials references to %s\n",
+		len(a.Specs), len(a.ServiceInstances), len(a.BindInstances), len(a.JobStates),
+		len(a.ExtractedCredentials), options.ArchiveFile)
+}
+
+func restore(d dao.Dao, credentials backup.CredentialStore, key []byte) {
+	f, err := os.Open(options.ArchiveFile)
+	if err != nil {
+		fail("Unable to open the archive - %v", err)
+	}
+	a, err := backup.Read(f, key)
+	f.Close()
+	if err != nil {
+		fail("Unable to read the archive - %v", err)
+	}
+	if options.Namespace != "" {
+		a = a.Select(options.Namespace)
+		if len(a.ServiceInstances) == 0 {
+			fail("The archive has no service instance in namespace %s", options.Namespace)
+		}
+	}
+	source, err := a.Dao()
+	if err != nil {
+		fail("Unable to load the archive - %v", err)
+	}
+
+	m := &migration.Migrator{Source: source, Target: d, KeepTargetSpecs: !options.OverwriteSpecs}
+	plan := m.Plan()
+	if options.DryRun {
+		plan.Write(os.Stdout)
+		return
+	}
+	report := m.Migrate(plan)
+	fmt.Println("Restore")
+	report.Write(os.Stdout)
+	failed := report.Failed()
+	if options.Verify {
+		report = m.Verify(plan)
+		fmt.Println("\nVerification")
+		report.Write(os.Stdout)
+		failed = failed || report.Failed()
+	}
+
+	if credentials != nil {
+		missing, err := a.MissingCredentials(credentials)
+		if err != nil {
+			fail("Unable to look for the extracted credentials - %v", err)
+		}
+		for _, ref := range missing {
+			fmt.Printf("extracted credentials %s: secret missing from namespace %s\n", ref.ID, credentials.Namespace())
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
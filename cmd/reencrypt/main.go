@@ -0,0 +1,95 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/automationbroker/bundle-lib/clients"
+	"github.com/automationbroker/config"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/openshift/ansible-service-broker/pkg/encryption"
+	"github.com/sirupsen/logrus"
+)
+
+var options struct {
+	Config string
+	KeyDir string
+	DryRun bool
+}
+
+func init() {
+	flag.StringVar(&options.Config, "config", "", "broker config file of the dao to re-encrypt")
+	flag.StringVar(&options.KeyDir, "key-dir", "", "directory the encryption keys secret is mounted in, defaults to broker.encryption.key_dir of the config")
+	flag.BoolVar(&options.DryRun, "dry-run", false, "count the records that would be encrypted again without writing them")
+	flag.Parse()
+}
+
+func main() {
+	if options.Config == "" {
+		fmt.Fprintln(os.Stderr, "--config is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	c, err := config.CreateConfig(options.Config)
+	if err != nil {
+		logrus.Errorf("Unable to read the config - %v", err)
+		os.Exit(2)
+	}
+	keyDir := options.KeyDir
+	if keyDir == "" {
+		keyDir = c.GetString("broker.encryption.key_dir")
+	}
+	if keyDir == "" {
+		fmt.Fprintln(os.Stderr, "no --key-dir and no broker.encryption.key_dir in the config")
+		os.Exit(2)
+	}
+	keyring, err := encryption.LoadKeyring(keyDir)
+	if err != nil {
+		logrus.Errorf("Unable to load the encryption keys - %v", err)
+		os.Exit(2)
+	}
+
+	if daoType := strings.ToLower(c.GetString("dao.type")); daoType != "crd" && daoType != "memory" && daoType != "sql" {
+		clients.InitEtcdConfig(clients.EtcdConfig{
+			EtcdHost:       c.GetString("dao.etcd_host"),
+			EtcdPort:       c.GetInt("dao.etcd_port"),
+			EtcdCaFile:     c.GetString("dao.etcd_ca_file"),
+			EtcdClientKey:  c.GetString("dao.etcd_client_key"),
+			EtcdClientCert: c.GetString("dao.etcd_client_cert"),
+		})
+	}
+	d, err := dao.NewDao(c)
+	if err != nil {
+		logrus.Errorf("Unable to create the dao - %v", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("Encrypting with key %s\n", keyring.Primary())
+	report, err := encryption.NewCipher(keyring).Reencrypt(d, options.DryRun)
+	if err != nil {
+		logrus.Errorf("Unable to list the service instances - %v", err)
+		os.Exit(2)
+	}
+	report.Write(os.Stdout)
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
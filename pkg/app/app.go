@@ -46,6 +46,7 @@ import (
 	"github.com/openshift/ansible-service-broker/pkg/broker"
 	"github.com/openshift/ansible-service-broker/pkg/dao"
 	"github.com/openshift/ansible-service-broker/pkg/handler"
+	"github.com/openshift/ansible-service-broker/pkg/leader"
 	logutil "github.com/openshift/ansible-service-broker/pkg/util/logging"
 	"github.com/openshift/ansible-service-broker/pkg/version"
 	"github.com/prometheus/client_golang/prometheus"
@@ -233,6 +234,9 @@ func CreateApp(args Args, regs []registries.Registry) App {
 	log.Debug("Initializing WorkEngine")
 	stateSubscriber := broker.NewJobStateSubscriber(app.dao)
 	app.engine = broker.NewWorkEngine(MsgBufferSize, SubscriberTimeout, app.dao)
+	app.engine.SetConcurrencyLimits(broker.NewConcurrencyLimits(app.config.GetSubConfig("broker")))
+	app.engine.SetJobDeadlines(broker.NewJobDeadlines(app.config.GetSubConfig("broker")))
+	broker.NewDeadLetterQueue(app.engine, app.dao, broker.NewDeadLetterSettings(app.config.GetSubConfig("broker")))
 	err = app.engine.AttachSubscriber(
 		stateSubscriber,
 		broker.ProvisionTopic)
@@ -269,6 +273,40 @@ func CreateApp(args Args, regs []registries.Registry) App {
 		os.Exit(1)
 	}
 
+	for _, webhookConfig := range app.config.GetSubConfigArray("webhooks") {
+		wc, err := broker.NewWebhookConfig(webhookConfig)
+		if err != nil {
+			log.Errorf("Failed to configure webhook: %s", err.Error())
+			os.Exit(1)
+		}
+		webhook := broker.NewWebhookSubscriber(wc)
+		for _, topic := range webhook.Topics() {
+			if err := app.engine.AttachSubscriber(webhook, topic); err != nil {
+				log.Errorf("Failed to attach subscriber to WorkEngine: %s", err.Error())
+				os.Exit(1)
+			}
+		}
+		log.Infof("Publishing job events to webhook %v", wc.Name)
+	}
+
+	if app.config.GetBool("broker.job_events") {
+		k8scli, err := clients.Kubernetes()
+		if err != nil {
+			log.Errorf("Failed to get kubernetes client for job events: %s", err.Error())
+			os.Exit(1)
+		}
+		eventSubscriber := broker.NewEventSubscriber(k8scli.Client.CoreV1())
+		for _, topic := range []broker.WorkTopic{
+			broker.ProvisionTopic, broker.DeprovisionTopic, broker.UpdateTopic,
+			broker.BindingTopic, broker.UnbindingTopic,
+		} {
+			if err := app.engine.AttachSubscriber(eventSubscriber, topic); err != nil {
+				log.Errorf("Failed to attach subscriber to WorkEngine: %s", err.Error())
+				os.Exit(1)
+			}
+		}
+	}
+
 	rules := []bundle.AssociationRule{}
 	for _, secretConfig := range app.config.GetSubConfigArray("secrets") {
 		rules = append(rules, bundle.AssociationRule{
@@ -290,7 +328,7 @@ func CreateApp(args Args, regs []registries.Registry) App {
 	bundle.InitializeClusterConfig(clusterConfig)
 
 	// initialize the work factory
-	workFactory := broker.NewWorkFactory()
+	workFactory := broker.NewWorkFactory(broker.NewRetryPolicies(app.config.GetSubConfig("broker")), clusterConfig)
 	if app.broker, err = broker.NewAnsibleBroker(
 		app.dao, app.registry, *app.engine, app.config.GetSubConfig("broker"), brokerNS, workFactory,
 	); err != nil {
@@ -315,14 +353,10 @@ func (a *App) Recover() {
 	log.Info(msg)
 }
 
-// Start - Will start the application to listen on the specified port.
-func (a *App) Start() {
-	// TODO: probably return an error or some sort of message such that we can
-	// see if we need to go any further.
-	fmt.Println("============================================================")
-	fmt.Println("==           Starting Ansible Service Broker...           ==")
-	fmt.Println("============================================================")
-
+// lead - runs the tasks of the broker that must only run on one replica
+// until stopped: the recovery, the bootstrap and the refresh of the specs,
+// the retries of the dead letters and the reconciler of the jobs.
+func (a *App) lead(stop <-chan struct{}) {
 	if a.config.GetBool("broker.recovery") {
 		log.Info("Initiating Recovery Process")
 		a.Recover()
@@ -346,8 +380,6 @@ func (a *App) Start() {
 		log.Error("Not using a refresh interval")
 	} else {
 		ticker := time.NewTicker(interval)
-		ctx, cancelFunc := context.WithCancel(context.Background())
-		defer cancelFunc()
 		go func() {
 			for {
 				select {
@@ -359,13 +391,81 @@ func (a *App) Start() {
 						log.Error(err.Error())
 					}
 					log.Info("Broker successfully bootstrapped")
-				case <-ctx.Done():
+				case <-stop:
 					ticker.Stop()
 					return
 				}
 			}
 		}()
 	}
+	// retry the job messages the subscribers failed to handle
+	go a.engine.DeadLetters().Run(stop)
+
+	// drop the job states past their retention
+	if compactor, ok := a.dao.(dao.JobCompactor); ok && compactor.CompactionInterval() > 0 {
+		go func() {
+			ticker := time.NewTicker(compactor.CompactionInterval())
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := compactor.CompactJobs(); err != nil {
+						log.Errorf("unable to compact the job states - %v", err)
+					}
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	// bring the records stored by an older broker to the current schema
+	if rewriter, ok := a.dao.(dao.RecordRewriter); ok && a.config.GetBool("dao.rewrite_outdated_records") {
+		go func() {
+			n, err := rewriter.RewriteOutdatedRecords()
+			if err != nil {
+				log.Errorf("unable to rewrite the outdated records - %v", err)
+			}
+			log.Infof("Rewrote %d outdated records", n)
+		}()
+	}
+
+	// resume, finalize or fail the jobs the engine lost track of
+	if interval := broker.JobReconcileInterval(a.config.GetSubConfig("broker")); interval > 0 {
+		go broker.NewJobReconciler(a.broker, interval).Run(stop)
+	}
+}
+
+// Start - Will start the application to listen on the specified port.
+func (a *App) Start() {
+	// TODO: probably return an error or some sort of message such that we can
+	// see if we need to go any further.
+	fmt.Println("============================================================")
+	fmt.Println("==           Starting Ansible Service Broker...           ==")
+	fmt.Println("============================================================")
+
+	election, err := newLeaderElection(a.config)
+	if err != nil {
+		log.Errorf("unable to configure leader election - %v", err)
+		os.Exit(1)
+	}
+	var elector *leader.Elector
+	if election == nil {
+		a.lead(wait.NeverStop)
+	} else {
+		// only the leader runs jobs, the followers serve the read requests
+		elector, err = election.newElector(a.config.GetString("openshift.namespace"), a.lead, func() {
+			// the jobs in progress are taken over by the new leader
+			log.Error("Lost the lead, exiting")
+			os.Exit(1)
+		})
+		if err != nil {
+			log.Errorf("unable to create the leader elector - %v", err)
+			os.Exit(1)
+		}
+		go elector.Run(wait.NeverStop)
+	}
+
 	//Retrieve the auth providers if basic auth is configured.
 	providers := auth.GetProviders(a.config)
 
@@ -384,10 +484,16 @@ func (a *App) Start() {
 	authorizer, err := k8sauthorization.NewAuthorizer("automationbroker.io", userAuthRuleToCheck, "create")
 	var clusterURL = ClusterURLPreFix
 
-	daHandler := prometheus.InstrumentHandler(
-		"ansible-service-broker",
-		handler.NewHandler(a.broker, a.config, clusterURL, providers, authorizer),
-	)
+	brokerHandler := handler.NewHandler(a.broker, a.config, clusterURL, providers, authorizer)
+	if elector != nil {
+		transport, err := election.transport()
+		if err != nil {
+			log.Errorf("unable to create the transport to the leader - %v", err)
+			os.Exit(1)
+		}
+		brokerHandler = handler.NewLeaderForwardingHandler(brokerHandler, elector, election.identity, transport)
+	}
+	daHandler := prometheus.InstrumentHandler("ansible-service-broker", brokerHandler)
 
 	genericserver.Handler.NonGoRestfulMux.HandlePrefix(fmt.Sprintf("%v/", clusterURL), daHandler)
 
@@ -415,7 +521,7 @@ func initClients(c *config.Config) error {
 	// dependencies / make sure things are ready.
 	log.Info("Initializing clients...")
 
-	if strings.ToLower(c.GetString("dao.type")) != "crd" {
+	if daoType := strings.ToLower(c.GetString("dao.type")); daoType != "crd" && daoType != "memory" && daoType != "sql" {
 
 		log.Debug("Trying to connect to etcd")
 		// Initialize the etcd configuration
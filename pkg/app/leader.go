@@ -0,0 +1,175 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/clients"
+	"github.com/automationbroker/config"
+	"github.com/openshift/ansible-service-broker/pkg/leader"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultLeaderLockName - the config map holding the leader election
+	// record.
+	defaultLeaderLockName = "broker-leader"
+	// the port the broker serves on, see apiServer
+	brokerPort = 1338
+)
+
+// leaderElection - the settings of the leader_election section of the broker
+// config.
+type leaderElection struct {
+	identity           string
+	address            string
+	lockName           string
+	leaseDuration      time.Duration
+	renewDeadline      time.Duration
+	retryPeriod        time.Duration
+	caFile             string
+	serverName         string
+	insecureSkipVerify bool
+}
+
+// newLeaderElection - reads the leader election settings. Returns nil if
+// leader election is not enabled.
+func newLeaderElection(c *config.Config) (*leaderElection, error) {
+	le := c.GetSubConfig("broker.leader_election")
+	if !le.GetBool("enabled") {
+		return nil, nil
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	settings := &leaderElection{
+		identity:           identity,
+		address:            os.ExpandEnv(le.GetString("advertise_address")),
+		lockName:           le.GetString("lock_name"),
+		leaseDuration:      15 * time.Second,
+		renewDeadline:      10 * time.Second,
+		retryPeriod:        2 * time.Second,
+		caFile:             le.GetString("ca_file"),
+		serverName:         le.GetString("server_name"),
+		insecureSkipVerify: le.GetBool("insecure_skip_verify"),
+	}
+	if settings.lockName == "" {
+		settings.lockName = defaultLeaderLockName
+	}
+	if settings.caFile == "" {
+		// the replicas share the certificate they serve
+		settings.caFile = c.GetString("broker.ssl_cert")
+	}
+	for key, d := range map[string]*time.Duration{
+		"lease_duration": &settings.leaseDuration,
+		"renew_deadline": &settings.renewDeadline,
+		"retry_period":   &settings.retryPeriod,
+	} {
+		if v := le.GetString(key); v != "" {
+			if *d, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("invalid leader_election.%s %q - %v", key, v, err)
+			}
+		}
+	}
+	if settings.address == "" {
+		ip, err := podIP(identity)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find the address to advertise, set leader_election.advertise_address - %v", err)
+		}
+		settings.address = fmt.Sprintf("https://%s", net.JoinHostPort(ip, fmt.Sprintf("%d", brokerPort)))
+	}
+	return settings, nil
+}
+
+// podIP - the address of the pod, from the POD_IP environment variable set
+// with the downward API, or else from its hostname.
+func podIP(hostname string) (string, error) {
+	if ip := os.Getenv("POD_IP"); ip != "" {
+		return ip, nil
+	}
+	ips, err := net.LookupIP(hostname)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no address found for %s", hostname)
+}
+
+// newElector - creates the elector of the broker, using a config map of the
+// broker namespace as the lock.
+func (le *leaderElection) newElector(
+	namespace string, onStartedLeading func(stop <-chan struct{}), onStoppedLeading func(),
+) (*leader.Elector, error) {
+	k8scli, err := clients.Kubernetes()
+	if err != nil {
+		return nil, err
+	}
+	return leader.NewElector(leader.Config{
+		Lock: &leader.ConfigMapLock{
+			Namespace: namespace,
+			Name:      le.lockName,
+			Client:    k8scli.Client.CoreV1(),
+		},
+		Identity:         le.identity,
+		Address:          le.address,
+		LeaseDuration:    le.leaseDuration,
+		RenewDeadline:    le.renewDeadline,
+		RetryPeriod:      le.retryPeriod,
+		OnStartedLeading: onStartedLeading,
+		OnStoppedLeading: onStoppedLeading,
+	})
+}
+
+// transport - the transport requests are forwarded to the leader with.
+func (le *leaderElection) transport() (http.RoundTripper, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         le.serverName,
+		InsecureSkipVerify: le.insecureSkipVerify,
+	}
+	if le.caFile != "" && !le.insecureSkipVerify {
+		pem, err := ioutil.ReadFile(le.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", le.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if le.insecureSkipVerify {
+		log.Warning("the certificate of the leader is not verified when forwarding requests to it")
+	}
+	return &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}, nil
+}
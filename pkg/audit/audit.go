@@ -0,0 +1,206 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/automationbroker/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// The types of records.
+const (
+	// TypeRequest - a request to the OSB API.
+	TypeRequest = "request"
+	// TypeJob - the outcome of a job.
+	TypeJob = "job"
+)
+
+// The results of the requests.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// ErrorQueryNotSupported - returned when querying a sink that only writes.
+var ErrorQueryNotSupported = errors.New("the audit sink does not support queries")
+
+// User - the user a record is attributed to.
+type User struct {
+	Username string   `json:"username"`
+	UID      string   `json:"uid,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+// Record - an entry of the audit trail. Parameter values are never
+// recorded, only their names.
+type Record struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Operation  string    `json:"operation"`
+	User       User      `json:"user"`
+	Namespace  string    `json:"namespace,omitempty"`
+	InstanceID string    `json:"instance_id,omitempty"`
+	BindingID  string    `json:"binding_id,omitempty"`
+	ServiceID  string    `json:"service_id,omitempty"`
+	Plan       string    `json:"plan,omitempty"`
+	Parameters []string  `json:"parameters,omitempty"`
+	JobToken   string    `json:"job_token,omitempty"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Filter - selects records, empty fields match every record.
+type Filter struct {
+	User      string
+	Namespace string
+	Since     time.Time
+	Until     time.Time
+}
+
+// Match - true if the record is selected by the filter.
+func (f Filter) Match(r Record) bool {
+	switch {
+	case f.User != "" && r.User.Username != f.User:
+		return false
+	case f.Namespace != "" && r.Namespace != f.Namespace:
+		return false
+	case !f.Since.IsZero() && r.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && r.Time.After(f.Until):
+		return false
+	}
+	return true
+}
+
+// Sink - where the records are written.
+type Sink interface {
+	Write(Record) error
+}
+
+// Querier - a sink the records can be read back from.
+type Querier interface {
+	Query(Filter) ([]Record, error)
+}
+
+// SinkFactory - creates a sink from the audit config.
+type SinkFactory func(c *config.Config) (Sink, error)
+
+var (
+	sinksMutex sync.RWMutex
+	sinks      = map[string]SinkFactory{
+		"file": newFileSinkFromConfig,
+		"log":  func(*config.Config) (Sink, error) { return LogSink{}, nil },
+	}
+)
+
+// RegisterSink - makes a sink type available to the audit config.
+func RegisterSink(name string, factory SinkFactory) {
+	sinksMutex.Lock()
+	defer sinksMutex.Unlock()
+	sinks[name] = factory
+}
+
+// NewSink - creates the sink of the type set in the sink field of the audit
+// config, a file by default.
+func NewSink(c *config.Config) (Sink, error) {
+	name := c.GetString("sink")
+	if name == "" {
+		name = "file"
+	}
+	sinksMutex.RLock()
+	factory, ok := sinks[name]
+	sinksMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown audit sink %q", name)
+	}
+	return factory(c)
+}
+
+// Trail - records the operations of the broker to a sink. A nil trail
+// records nothing.
+type Trail struct {
+	sink Sink
+}
+
+// NewTrail - creates a trail writing to the sink.
+func NewTrail(sink Sink) *Trail {
+	return &Trail{sink: sink}
+}
+
+// Record - writes the record, timestamped now if it has no time. Records
+// that can not be written are logged.
+func (t *Trail) Record(r Record) {
+	if t == nil {
+		return
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now().UTC()
+	}
+	if err := t.sink.Write(r); err != nil {
+		b, _ := json.Marshal(r)
+		log.Errorf("unable to write audit record %s - %v", b, err)
+	}
+}
+
+// Query - returns the records selected by the filter, oldest first.
+func (t *Trail) Query(f Filter) ([]Record, error) {
+	if t == nil {
+		return []Record{}, nil
+	}
+	q, ok := t.sink.(Querier)
+	if !ok {
+		return nil, ErrorQueryNotSupported
+	}
+	records, err := q.Query(f)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records, nil
+}
+
+// ParameterNames - the sorted names of the parameters of a request.
+func ParameterNames(params map[string]interface{}) []string {
+	names := []string{}
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LogSink - writes the records to the broker log.
+type LogSink struct{}
+
+// Write - logs the record as JSON.
+func (LogSink) Write(r Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	log.WithField("audit", true).Info(string(b))
+	return nil
+}
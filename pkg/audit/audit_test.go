@@ -0,0 +1,132 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFilterMatch(t *testing.T) {
+	now := time.Now()
+	r := Record{Time: now, User: User{Username: "developer"}, Namespace: "project"}
+
+	assert.True(t, Filter{}.Match(r))
+	assert.True(t, Filter{User: "developer", Namespace: "project"}.Match(r))
+	assert.False(t, Filter{User: "admin"}.Match(r))
+	assert.False(t, Filter{Namespace: "other"}.Match(r))
+	assert.True(t, Filter{Since: now.Add(-time.Minute), Until: now.Add(time.Minute)}.Match(r))
+	assert.False(t, Filter{Since: now.Add(time.Minute)}.Match(r))
+	assert.False(t, Filter{Until: now.Add(-time.Minute)}.Match(r))
+}
+
+func TestFileSinkQuery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	sink, err := NewFileSink(filepath.Join(dir, "audit.log"), 0, 0)
+	assert.NoError(t, err)
+	defer sink.Close()
+	trail := NewTrail(sink)
+
+	trail.Record(Record{Type: TypeRequest, Operation: "provision", User: User{Username: "developer"}, Namespace: "project"})
+	trail.Record(Record{Type: TypeRequest, Operation: "provision", User: User{Username: "admin"}, Namespace: "other"})
+	trail.Record(Record{Type: TypeJob, Operation: "provision", Namespace: "project", Result: "succeeded"})
+
+	records, err := trail.Query(Filter{Namespace: "project"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "developer", records[0].User.Username)
+	assert.Equal(t, TypeJob, records[1].Type)
+	assert.False(t, records[0].Time.IsZero())
+
+	records, err = trail.Query(Filter{User: "admin"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// every record is bigger than half of the max size, each one rotates
+	sink, err := NewFileSink(path, 150, 2)
+	assert.NoError(t, err)
+	defer sink.Close()
+	for _, op := range []string{"provision", "update", "bind", "unbind"} {
+		assert.NoError(t, sink.Write(Record{Time: time.Now(), Type: TypeRequest, Operation: op}))
+	}
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		_, err := os.Stat(p)
+		assert.NoError(t, err)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "only max_backups files are kept")
+
+	records, err := sink.Query(Filter{})
+	assert.NoError(t, err)
+	ops := []string{}
+	for _, r := range records {
+		ops = append(ops, r.Operation)
+	}
+	assert.Equal(t, []string{"update", "bind", "unbind"}, ops)
+}
+
+func TestNewSink(t *testing.T) {
+	sink, err := NewSink(config.NewConfigFromMap(map[string]interface{}{"sink": "log"}))
+	assert.NoError(t, err)
+	assert.Equal(t, LogSink{}, sink)
+	_, err = NewTrail(sink).Query(Filter{})
+	assert.Equal(t, ErrorQueryNotSupported, err)
+
+	_, err = NewSink(config.NewConfigFromMap(map[string]interface{}{"sink": "syslog"}))
+	assert.Error(t, err)
+
+	RegisterSink("memory", func(*config.Config) (Sink, error) { return LogSink{}, nil })
+	_, err = NewSink(config.NewConfigFromMap(map[string]interface{}{"sink": "memory"}))
+	assert.NoError(t, err)
+}
+
+func TestNilTrail(t *testing.T) {
+	var trail *Trail
+	trail.Record(Record{Type: TypeRequest})
+	records, err := trail.Query(Filter{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(records))
+}
+
+func TestParameterNames(t *testing.T) {
+	assert.Equal(t, []string{"admin_password", "size"},
+		ParameterNames(map[string]interface{}{"size": 1, "admin_password": "secret"}))
+	assert.Equal(t, []string{}, ParameterNames(nil))
+}
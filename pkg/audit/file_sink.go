@@ -0,0 +1,187 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/automationbroker/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultFilePath    = "/var/log/ansible-service-broker/audit.log"
+	defaultFileMaxSize = 100
+	defaultFileBackups = 5
+	megabyte           = 1024 * 1024
+)
+
+// FileSink - appends the records as JSON lines to a file. Once the file
+// reaches its maximum size it is rotated to <path>.1, and older files are
+// shifted up to <path>.<maxBackups>.
+type FileSink struct {
+	mutex      sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newFileSinkFromConfig(c *config.Config) (Sink, error) {
+	path := c.GetString("path")
+	if path == "" {
+		path = defaultFilePath
+	}
+	maxSize := defaultFileMaxSize
+	if c.GetInt("max_size_mb") > 0 {
+		maxSize = c.GetInt("max_size_mb")
+	}
+	backups := defaultFileBackups
+	if c.GetInt("max_backups") > 0 {
+		backups = c.GetInt("max_backups")
+	}
+	return NewFileSink(path, int64(maxSize)*megabyte, backups)
+}
+
+// NewFileSink - opens the file the records are appended to. A maxSize of 0
+// never rotates the file.
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+// Write - appends the record, rotating the file first if it would grow
+// past its maximum size.
+func (s *FileSink) Write(r Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("unable to rotate %v - %v", s.path, err)
+		}
+	}
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if s.maxBackups > 0 {
+		os.Remove(s.backup(s.maxBackups))
+		for i := s.maxBackups - 1; i >= 1; i-- {
+			if err := os.Rename(s.backup(i), s.backup(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(s.path, s.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileSink) backup(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
+
+// Query - reads the records selected by the filter from the backups and the
+// current file.
+func (s *FileSink) Query(f Filter) ([]Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	files := []string{}
+	for i := s.maxBackups; i >= 1; i-- {
+		files = append(files, s.backup(i))
+	}
+	files = append(files, s.path)
+
+	records := []Record{}
+	for _, path := range files {
+		read, err := readRecords(path, f)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, read...)
+	}
+	return records, nil
+}
+
+func readRecords(path string, f Filter) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []Record{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), megabyte)
+	for scanner.Scan() {
+		r := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Warningf("skipping unreadable audit record in %v - %v", path, err)
+			continue
+		}
+		if f.Match(r) {
+			records = append(records, r)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// Close - closes the file.
+func (s *FileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
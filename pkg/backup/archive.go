@@ -0,0 +1,168 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package backup
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+)
+
+// ArchiveVersion - the version of the archives written, archives of a later
+// version are refused.
+const ArchiveVersion = 1
+
+// encryptionAESGCM - the only encryption supported, AES-256 in GCM mode with
+// the sha256 of the key.
+const encryptionAESGCM = "aes-256-gcm"
+
+// ErrDecrypt - the archive could not be decrypted, the key is wrong or the
+// archive was altered.
+var ErrDecrypt = errors.New("unable to decrypt the archive, wrong key or altered archive")
+
+// Archive - the state of a broker.
+type Archive struct {
+	Version          int                       `json:"version"`
+	Created          time.Time                 `json:"created"`
+	Specs            []*bundle.Spec            `json:"specs"`
+	ServiceInstances []*bundle.ServiceInstance `json:"service_instances"`
+	BindInstances    []*bundle.BindInstance    `json:"bind_instances"`
+	JobStates        []JobState                `json:"job_states"`
+	DeadLetters      []*types.DeadLetter       `json:"dead_letters,omitempty"`
+	// ExtractedCredentials - the secrets holding the credentials of the
+	// instances and bindings. Only the references are archived, never the
+	// credentials.
+	ExtractedCredentials []CredentialReference `json:"extracted_credentials,omitempty"`
+}
+
+// JobState - the job state of an instance or a binding.
+type JobState struct {
+	ID    string          `json:"id"`
+	State bundle.JobState `json:"state"`
+}
+
+// CredentialReference - the secret holding the extracted credentials of an
+// instance or a binding.
+type CredentialReference struct {
+	ID        string `json:"id"`
+	Namespace string `json:"namespace"`
+}
+
+// envelope - the file an archive is written to. The archive is either in
+// Archive or, encrypted, in Sealed.
+type envelope struct {
+	Version    int             `json:"version"`
+	Encryption string          `json:"encryption,omitempty"`
+	Nonce      []byte          `json:"nonce,omitempty"`
+	Sealed     []byte          `json:"sealed,omitempty"`
+	Archive    json.RawMessage `json:"archive,omitempty"`
+}
+
+// Write - writes the archive, encrypted if a key is given.
+func Write(w io.Writer, a *Archive, key []byte) error {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	e := envelope{Version: a.Version, Archive: payload}
+	if len(key) > 0 {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return err
+		}
+		e.Encryption = encryptionAESGCM
+		e.Nonce = make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, e.Nonce); err != nil {
+			return err
+		}
+		e.Sealed = aead.Seal(nil, e.Nonce, payload, nil)
+		e.Archive = nil
+	}
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// Read - reads an archive written by Write, decrypting it with the key if it
+// is encrypted, and validates it.
+func Read(r io.Reader, key []byte) (*Archive, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	e := envelope{}
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("invalid archive - %v", err)
+	}
+	if e.Version < 1 || e.Version > ArchiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d, supported up to %d", e.Version, ArchiveVersion)
+	}
+	payload := []byte(e.Archive)
+	switch e.Encryption {
+	case "":
+	case encryptionAESGCM:
+		if len(key) == 0 {
+			return nil, errors.New("the archive is encrypted, a key is required")
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(e.Nonce) != aead.NonceSize() {
+			return nil, ErrDecrypt
+		}
+		payload, err = aead.Open(nil, e.Nonce, e.Sealed, nil)
+		if err != nil {
+			return nil, ErrDecrypt
+		}
+	default:
+		return nil, fmt.Errorf("unsupported archive encryption %q", e.Encryption)
+	}
+	a := &Archive{}
+	if err := json.Unmarshal(payload, a); err != nil {
+		return nil, fmt.Errorf("invalid archive - %v", err)
+	}
+	if a.Version != e.Version {
+		return nil, fmt.Errorf("archive version %d does not match its envelope %d", a.Version, e.Version)
+	}
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	sum := sha256.Sum256(key)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
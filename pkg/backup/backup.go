@@ -0,0 +1,299 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package backup - exports the state of the broker from a dao.Dao to an
+// archive and loads it back. An archive is restored to any dao with the
+// migration package.
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	memory "github.com/openshift/ansible-service-broker/pkg/dao/memory"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// listPageSize - how many job states are read from the dao at once.
+const listPageSize = 500
+
+// CredentialStore - the secrets holding the extracted credentials.
+type CredentialStore interface {
+	// Namespace - the namespace of the secrets.
+	Namespace() string
+	// Exists - whether there is a secret for the instance or binding.
+	Exists(id string) (bool, error)
+}
+
+// ValidationError - the problems found in an archive.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("invalid archive:\n  %s", strings.Join(e.Problems, "\n  "))
+}
+
+// Export - reads the state of the broker from the dao. The references to the
+// extracted credentials are only looked for when a store is given. Service
+// instances without a spec, and bindings and job states whose owner no longer
+// exists, are left out.
+func Export(d dao.Dao, credentials CredentialStore) (*Archive, error) {
+	a := &Archive{Version: ArchiveVersion, Created: time.Now().UTC()}
+
+	specs, err := d.BatchGetSpecs("/spec")
+	if err != nil && !d.IsNotFoundError(err) {
+		return nil, fmt.Errorf("unable to list the specs - %v", err)
+	}
+	a.Specs = specs
+	sort.Slice(a.Specs, func(i, j int) bool { return a.Specs[i].ID < a.Specs[j].ID })
+
+	instances, err := d.BatchGetBundleInstances()
+	if err != nil && !d.IsNotFoundError(err) {
+		return nil, fmt.Errorf("unable to list the service instances - %v", err)
+	}
+	for _, si := range instances {
+		if si == nil || si.ID == nil || si.Spec == nil {
+			log.Warningf("service instance %v without an id or a spec, not exported", si)
+			continue
+		}
+		a.ServiceInstances = append(a.ServiceInstances, si)
+	}
+	sort.Slice(a.ServiceInstances, func(i, j int) bool {
+		return a.ServiceInstances[i].ID.String() < a.ServiceInstances[j].ID.String()
+	})
+
+	owners := map[string]bool{}
+	for _, si := range a.ServiceInstances {
+		owners[si.ID.String()] = true
+		for _, id := range boundIDs(si.BindingIDs) {
+			bi, err := d.GetBindInstance(id)
+			if d.IsNotFoundError(err) {
+				log.Warningf("binding %s of service instance %s does not exist, not exported", id, si.ID)
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("unable to get binding %s - %v", id, err)
+			}
+			owners[id] = true
+			a.BindInstances = append(a.BindInstances, bi)
+		}
+	}
+
+	statuses, err := types.AllJobStates(d, types.JobStateFilter{}, listPageSize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the job states - %v", err)
+	}
+	for _, status := range statuses {
+		owner := status.InstanceID.String()
+		if !owners[owner] {
+			log.Warningf("job state %s of %s belongs to no instance or binding, not exported", status.State.Token, owner)
+			continue
+		}
+		a.JobStates = append(a.JobStates, JobState{ID: owner, State: status.State})
+	}
+
+	letters, err := d.BatchGetDeadLetters()
+	if err != nil && !d.IsNotFoundError(err) {
+		return nil, fmt.Errorf("unable to list the dead letters - %v", err)
+	}
+	a.DeadLetters = letters
+
+	if credentials != nil {
+		ids := []string{}
+		for id := range owners {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			ok, err := credentials.Exists(id)
+			if err != nil {
+				return nil, fmt.Errorf("unable to look for the credentials of %s - %v", id, err)
+			}
+			if ok {
+				a.ExtractedCredentials = append(a.ExtractedCredentials,
+					CredentialReference{ID: id, Namespace: credentials.Namespace()})
+			}
+		}
+	}
+	return a, a.Validate()
+}
+
+// Validate - checks every record has an id and refers to records of the
+// archive.
+func (a *Archive) Validate() error {
+	problems := []string{}
+	specs, owners := map[string]bool{}, map[string]bool{}
+	for _, spec := range a.Specs {
+		switch {
+		case spec == nil || spec.ID == "":
+			problems = append(problems, "spec without an id")
+		case specs[spec.ID]:
+			problems = append(problems, fmt.Sprintf("spec %s is archived twice", spec.ID))
+		default:
+			specs[spec.ID] = true
+		}
+	}
+	for _, si := range a.ServiceInstances {
+		switch {
+		case si == nil || si.ID == nil:
+			problems = append(problems, "service instance without an id")
+		case si.Spec == nil:
+			problems = append(problems, fmt.Sprintf("service instance %s has no spec", si.ID))
+		case owners[si.ID.String()]:
+			problems = append(problems, fmt.Sprintf("service instance %s is archived twice", si.ID))
+		default:
+			owners[si.ID.String()] = true
+		}
+	}
+	for _, bi := range a.BindInstances {
+		switch {
+		case bi == nil || bi.ID == nil:
+			problems = append(problems, "bind instance without an id")
+		case bi.ServiceID == nil || !owners[bi.ServiceID.String()]:
+			problems = append(problems, fmt.Sprintf("bind instance %s belongs to no archived service instance", bi.ID))
+		case owners[bi.ID.String()]:
+			problems = append(problems, fmt.Sprintf("bind instance %s is archived twice", bi.ID))
+		default:
+			owners[bi.ID.String()] = true
+		}
+	}
+	for _, js := range a.JobStates {
+		switch {
+		case js.State.Token == "":
+			problems = append(problems, fmt.Sprintf("job state of %s without a token", js.ID))
+		case !owners[js.ID]:
+			problems = append(problems, fmt.Sprintf("job state %s belongs to no archived instance or binding", js.State.Token))
+		}
+	}
+	for _, letter := range a.DeadLetters {
+		if letter == nil || letter.ID == "" {
+			problems = append(problems, "dead letter without an id")
+		}
+	}
+	for _, ref := range a.ExtractedCredentials {
+		if !owners[ref.ID] {
+			problems = append(problems, fmt.Sprintf("extracted credentials %s belong to no archived instance or binding", ref.ID))
+		}
+	}
+	if len(problems) > 0 {
+		return ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// Select - the part of the archive about the service instances of the
+// namespace: the instances, their bindings, job states and credentials, and
+// the specs they use. Dead letters are left out.
+func (a *Archive) Select(namespace string) *Archive {
+	selected := &Archive{Version: a.Version, Created: a.Created}
+	owners, specIDs := map[string]bool{}, map[string]bool{}
+	for _, si := range a.ServiceInstances {
+		if si.Context == nil || si.Context.Namespace != namespace {
+			continue
+		}
+		selected.ServiceInstances = append(selected.ServiceInstances, si)
+		owners[si.ID.String()] = true
+		specIDs[si.Spec.ID] = true
+	}
+	for _, spec := range a.Specs {
+		if specIDs[spec.ID] {
+			selected.Specs = append(selected.Specs, spec)
+		}
+	}
+	for _, bi := range a.BindInstances {
+		if owners[bi.ServiceID.String()] {
+			selected.BindInstances = append(selected.BindInstances, bi)
+			owners[bi.ID.String()] = true
+		}
+	}
+	for _, js := range a.JobStates {
+		if owners[js.ID] {
+			selected.JobStates = append(selected.JobStates, js)
+		}
+	}
+	for _, ref := range a.ExtractedCredentials {
+		if owners[ref.ID] {
+			selected.ExtractedCredentials = append(selected.ExtractedCredentials, ref)
+		}
+	}
+	return selected
+}
+
+// Dao - an in-memory dao holding the records of the archive, to migrate them
+// to the dao restored.
+func (a *Archive) Dao() (dao.Dao, error) {
+	d, err := memory.NewDao("")
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range a.Specs {
+		if err := d.SetSpec(spec.ID, spec); err != nil {
+			return nil, err
+		}
+	}
+	for _, si := range a.ServiceInstances {
+		if err := d.SetServiceInstance(si.ID.String(), si); err != nil {
+			return nil, err
+		}
+	}
+	for _, bi := range a.BindInstances {
+		if err := d.SetBindInstance(bi.ID.String(), bi); err != nil {
+			return nil, err
+		}
+	}
+	for _, js := range a.JobStates {
+		if _, err := d.SetState(js.ID, js.State); err != nil {
+			return nil, err
+		}
+	}
+	for _, letter := range a.DeadLetters {
+		if err := d.SetDeadLetter(letter); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// MissingCredentials - the references of the archive to secrets that do not
+// exist in the store.
+func (a *Archive) MissingCredentials(credentials CredentialStore) ([]CredentialReference, error) {
+	missing := []CredentialReference{}
+	for _, ref := range a.ExtractedCredentials {
+		ok, err := credentials.Exists(ref.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			missing = append(missing, ref)
+		}
+	}
+	return missing, nil
+}
+
+func boundIDs(bindings map[string]bool) []string {
+	ids := []string{}
+	for id, bound := range bindings {
+		if bound {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
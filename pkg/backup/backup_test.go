@@ -0,0 +1,188 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package backup
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	memory "github.com/openshift/ansible-service-broker/pkg/dao/memory"
+	"github.com/openshift/ansible-service-broker/pkg/migration"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCredentials map[string]bool
+
+func (c fakeCredentials) Namespace() string {
+	return "ansible-service-broker"
+}
+
+func (c fakeCredentials) Exists(id string) (bool, error) {
+	return c[id], nil
+}
+
+func newMemoryDao(t *testing.T) dao.Dao {
+	d, err := memory.NewDao("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// provision - saves an instance of the spec in the namespace, with a binding
+// and a job state for each.
+func provision(t *testing.T, d dao.Dao, spec *bundle.Spec, namespace string) (*bundle.ServiceInstance, *bundle.BindInstance) {
+	si := &bundle.ServiceInstance{
+		ID:         uuid.NewRandom(),
+		Spec:       spec,
+		Context:    &bundle.Context{Platform: "kubernetes", Namespace: namespace},
+		Parameters: &bundle.Parameters{"plan": "dev"},
+		BindingIDs: map[string]bool{},
+	}
+	bi := &bundle.BindInstance{ID: uuid.NewRandom(), ServiceID: si.ID}
+	si.AddBinding(bi.ID)
+	assert.NoError(t, d.SetServiceInstance(si.ID.String(), si))
+	assert.NoError(t, d.SetBindInstance(bi.ID.String(), bi))
+	for _, id := range []string{si.ID.String(), bi.ID.String()} {
+		_, err := d.SetState(id, bundle.JobState{Token: uuid.New(), State: bundle.StateSucceeded})
+		assert.NoError(t, err)
+	}
+	return si, bi
+}
+
+func newSource(t *testing.T) (dao.Dao, *bundle.ServiceInstance, *bundle.ServiceInstance) {
+	d := newMemoryDao(t)
+	mysql := &bundle.Spec{ID: "spec-mysql", FQName: "dh-mysql"}
+	postgres := &bundle.Spec{ID: "spec-postgres", FQName: "dh-postgresql"}
+	assert.NoError(t, d.SetSpec(mysql.ID, mysql))
+	assert.NoError(t, d.SetSpec(postgres.ID, postgres))
+	first, _ := provision(t, d, mysql, "first")
+	second, _ := provision(t, d, postgres, "second")
+	return d, first, second
+}
+
+func TestExport(t *testing.T) {
+	d, first, _ := newSource(t)
+	// a job state left behind by a deleted instance
+	_, err := d.SetState(uuid.New(), bundle.JobState{Token: uuid.New(), State: bundle.StateFailed})
+	assert.NoError(t, err)
+
+	a, err := Export(d, fakeCredentials{first.ID.String(): true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ArchiveVersion, a.Version)
+	assert.Len(t, a.Specs, 2)
+	assert.Len(t, a.ServiceInstances, 2)
+	assert.Len(t, a.BindInstances, 2)
+	assert.Len(t, a.JobStates, 4)
+	assert.Equal(t, []CredentialReference{{ID: first.ID.String(), Namespace: "ansible-service-broker"}},
+		a.ExtractedCredentials)
+}
+
+func TestWriteAndRead(t *testing.T) {
+	d, _, _ := newSource(t)
+	a, err := Export(d, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	plain := &bytes.Buffer{}
+	assert.NoError(t, Write(plain, a, nil))
+	read, err := Read(bytes.NewReader(plain.Bytes()), nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, a.ServiceInstances[0].ID, read.ServiceInstances[0].ID)
+		assert.Len(t, read.JobStates, 4)
+	}
+
+	key := []byte("a passphrase")
+	sealed := &bytes.Buffer{}
+	assert.NoError(t, Write(sealed, a, key))
+	assert.NotContains(t, sealed.String(), "dh-mysql")
+	read, err = Read(bytes.NewReader(sealed.Bytes()), key)
+	if assert.NoError(t, err) {
+		assert.Len(t, read.Specs, 2)
+	}
+	_, err = Read(bytes.NewReader(sealed.Bytes()), []byte("another passphrase"))
+	assert.Equal(t, ErrDecrypt, err)
+	_, err = Read(bytes.NewReader(sealed.Bytes()), nil)
+	assert.Error(t, err)
+}
+
+func TestReadRefusesInvalidArchives(t *testing.T) {
+	testCases := []struct {
+		name    string
+		archive string
+		err     string
+	}{
+		{name: "not json", archive: "specs", err: "invalid archive"},
+		{name: "later version", archive: `{"version": 2, "archive": {"version": 2}}`, err: "unsupported archive version 2"},
+		{name: "unknown encryption", archive: `{"version": 1, "encryption": "rot13"}`, err: "unsupported archive encryption"},
+		{
+			name:    "orphan binding",
+			archive: `{"version": 1, "archive": {"version": 1, "bind_instances": [{"id": "` + uuid.New() + `", "service_id": "` + uuid.New() + `"}]}}`,
+			err:     "belongs to no archived service instance",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Read(strings.NewReader(tc.archive), nil)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.err)
+			}
+		})
+	}
+}
+
+func TestSelectAndRestore(t *testing.T) {
+	source, first, second := newSource(t)
+	a, err := Export(source, fakeCredentials{first.ID.String(): true, second.ID.String(): true})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	selected := a.Select("second")
+	assert.NoError(t, selected.Validate())
+	assert.Len(t, selected.Specs, 1)
+	assert.Len(t, selected.ServiceInstances, 1)
+	assert.Len(t, selected.BindInstances, 1)
+	assert.Len(t, selected.JobStates, 2)
+	assert.Len(t, selected.ExtractedCredentials, 1)
+
+	restored, err := selected.Dao()
+	if !assert.NoError(t, err) {
+		return
+	}
+	target := newMemoryDao(t)
+	m := &migration.Migrator{Source: restored, Target: target}
+	plan := m.Plan()
+	assert.False(t, m.Migrate(plan).Failed())
+	assert.False(t, m.Verify(plan).Failed())
+
+	_, err = target.GetServiceInstance(second.ID.String())
+	assert.NoError(t, err)
+	_, err = target.GetServiceInstance(first.ID.String())
+	assert.True(t, target.IsNotFoundError(err), "instances of other namespaces are not restored")
+
+	missing, err := selected.MissingCredentials(fakeCredentials{})
+	assert.NoError(t, err)
+	assert.Equal(t, selected.ExtractedCredentials, missing)
+}
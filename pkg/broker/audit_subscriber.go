@@ -0,0 +1,86 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/audit"
+)
+
+// AuditSubscriber - records the outcome of every job in the audit trail.
+type AuditSubscriber struct {
+	trail *audit.Trail
+}
+
+// NewAuditSubscriber - creates a subscriber recording to the trail.
+func NewAuditSubscriber(trail *audit.Trail) *AuditSubscriber {
+	return &AuditSubscriber{trail: trail}
+}
+
+// ID - the id of the subscriber.
+func (s *AuditSubscriber) ID() string {
+	return "audit"
+}
+
+// Notify - records the jobs that succeeded or failed.
+func (s *AuditSubscriber) Notify(msg JobMsg) {
+	if !isTerminalState(msg.State.State) {
+		return
+	}
+	result := audit.ResultSuccess
+	if msg.State.State == bundle.StateFailed {
+		result = audit.ResultFailure
+	}
+	errMsg := msg.Error
+	if errMsg == "" {
+		errMsg = msg.State.Error
+	}
+	s.trail.Record(audit.Record{
+		Type:       audit.TypeJob,
+		Operation:  string(msg.State.Method),
+		Namespace:  msg.Namespace,
+		InstanceID: msg.InstanceUUID,
+		BindingID:  msg.BindingUUID,
+		Plan:       msg.PlanName,
+		JobToken:   msg.JobToken,
+		Result:     result,
+		Error:      errMsg,
+	})
+}
+
+// auditRequest - records an OSB request made by the user.
+func (a AnsibleBroker) auditRequest(method bundle.JobMethod, userInfo UserInfo, record audit.Record, err error) {
+	record.Type = audit.TypeRequest
+	record.Operation = string(method)
+	record.User = audit.User{
+		Username: userInfo.Username,
+		UID:      userInfo.UID,
+		Groups:   userInfo.Groups,
+	}
+	record.Result = audit.ResultSuccess
+	if err != nil {
+		record.Result = audit.ResultFailure
+		record.Error = err.Error()
+	}
+	a.audit.Record(record)
+}
+
+// AuditRecords - returns the records of the audit trail selected by the
+// filter.
+func (a AnsibleBroker) AuditRecords(filter audit.Filter) ([]audit.Record, error) {
+	return a.audit.Query(filter)
+}
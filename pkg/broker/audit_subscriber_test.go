@@ -0,0 +1,98 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/audit"
+	"github.com/stretchr/testify/assert"
+)
+
+// memorySink - keeps the audit records in memory.
+type memorySink struct {
+	records []audit.Record
+}
+
+func (s *memorySink) Write(r audit.Record) error {
+	s.records = append(s.records, r)
+	return nil
+}
+
+func TestAuditSubscriber(t *testing.T) {
+	sink := &memorySink{}
+	subscriber := NewAuditSubscriber(audit.NewTrail(sink))
+
+	subscriber.Notify(JobMsg{
+		InstanceUUID: "instance",
+		JobToken:     "token",
+		Namespace:    "project",
+		PlanName:     "dev",
+		State:        bundle.JobState{State: bundle.StateInProgress, Method: bundle.JobMethodProvision},
+	})
+	assert.Empty(t, sink.records, "only finished jobs are recorded")
+
+	subscriber.Notify(JobMsg{
+		InstanceUUID: "instance",
+		BindingUUID:  "binding",
+		JobToken:     "token",
+		Namespace:    "project",
+		PlanName:     "dev",
+		State:        bundle.JobState{State: bundle.StateFailed, Method: bundle.JobMethodBind, Error: "bind failed"},
+	})
+	if assert.Len(t, sink.records, 1) {
+		r := sink.records[0]
+		assert.Equal(t, audit.TypeJob, r.Type)
+		assert.Equal(t, "bind", r.Operation)
+		assert.Equal(t, "project", r.Namespace)
+		assert.Equal(t, "binding", r.BindingID)
+		assert.Equal(t, "dev", r.Plan)
+		assert.Equal(t, audit.ResultFailure, r.Result)
+		assert.Equal(t, "bind failed", r.Error)
+		assert.False(t, r.Time.IsZero())
+	}
+}
+
+func TestAuditRequest(t *testing.T) {
+	sink := &memorySink{}
+	a := AnsibleBroker{audit: audit.NewTrail(sink)}
+	user := UserInfo{Username: "developer", UID: "uid", Groups: []string{"system:authenticated"}}
+
+	a.auditRequest(bundle.JobMethodProvision, user, audit.Record{
+		InstanceID: "instance",
+		Parameters: audit.ParameterNames(bundle.Parameters{"password": "secret", "size": 1}),
+	}, nil)
+	a.auditRequest(bundle.JobMethodDeprovision, user, audit.Record{InstanceID: "instance"}, ErrorBindingExists)
+
+	if assert.Len(t, sink.records, 2) {
+		assert.Equal(t, audit.TypeRequest, sink.records[0].Type)
+		assert.Equal(t, "provision", sink.records[0].Operation)
+		assert.Equal(t, audit.User{Username: "developer", UID: "uid", Groups: []string{"system:authenticated"}}, sink.records[0].User)
+		assert.Equal(t, []string{"password", "size"}, sink.records[0].Parameters)
+		assert.Equal(t, audit.ResultSuccess, sink.records[0].Result)
+		assert.Equal(t, audit.ResultFailure, sink.records[1].Result)
+		assert.Equal(t, ErrorBindingExists.Error(), sink.records[1].Error)
+	}
+
+	// without a trail nothing is recorded
+	AnsibleBroker{}.auditRequest(bundle.JobMethodBind, user, audit.Record{}, errors.New("boom"))
+	records, err := AnsibleBroker{}.AuditRecords(audit.Filter{})
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}
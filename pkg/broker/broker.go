@@ -28,7 +28,10 @@ import (
 	"github.com/automationbroker/bundle-lib/bundle"
 	"github.com/automationbroker/bundle-lib/registries"
 	"github.com/automationbroker/config"
+	"github.com/openshift/ansible-service-broker/pkg/audit"
 	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"github.com/openshift/ansible-service-broker/pkg/encryption"
 	"github.com/openshift/ansible-service-broker/pkg/metrics"
 	"github.com/pborman/uuid"
 	log "github.com/sirupsen/logrus"
@@ -107,14 +110,26 @@ type DevBroker interface {
 	RemoveSpecs() error
 }
 
+// AdminBroker - Interface for the broker administration routes.
+type AdminBroker interface {
+	CancelJob(token string, userInfo UserInfo) error
+	DeadLetters() ([]*types.DeadLetter, error)
+	ReplayDeadLetter(id string) error
+	AuditRecords(filter audit.Filter) ([]audit.Record, error)
+}
+
 // AnsibleBroker - Broker using ansible and images to interact with oc/kubernetes/etcd
 type AnsibleBroker struct {
 	dao          dao.Dao
 	registry     []registries.Registry
 	engine       *WorkEngine
+	operations   *OperationQueue
 	brokerConfig Config
 	namespace    string
 	workFactory  WorkFactory
+	audit        *audit.Trail
+	// encrypts the secret parameters at rest, nil if not configured
+	cipher *encryption.Cipher
 }
 
 // NewAnsibleBroker - Creates a new ansible broker
@@ -144,6 +159,29 @@ func NewAnsibleBroker(dao dao.Dao,
 		namespace:   namespace,
 		workFactory: workFactory,
 	}
+	broker.operations = NewOperationQueue(broker.engine, dao)
+
+	auditConfig := brokerConfig.GetSubConfig("audit")
+	if auditConfig.GetBool("enabled") {
+		sink, err := audit.NewSink(auditConfig)
+		if err != nil {
+			return nil, err
+		}
+		broker.audit = audit.NewTrail(sink)
+		subscriber := NewAuditSubscriber(broker.audit)
+		for topic := range workTopicSet {
+			broker.engine.AttachSubscriber(subscriber, topic)
+		}
+	}
+
+	if keyDir := brokerConfig.GetString("encryption.key_dir"); keyDir != "" {
+		keyring, err := encryption.LoadKeyring(keyDir)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Encrypting secret parameters with key %s", keyring.Primary())
+		broker.cipher = encryption.NewCipher(keyring)
+	}
 	return broker, nil
 }
 
@@ -421,97 +459,172 @@ func (a AnsibleBroker) Recover() (string, error) {
 		if no, the job never started
 			we should restart the job
 		if yes,
-			did the job finish?
-				yes
-					* update status to finished
-					* extractCreds if available
-				no
-					* create a monitoring job to update status
+			the job is reattached to its pod, which updates the status
+			and extracts the credentials once the pod finishes
 	*/
 
 	// let's see if we need to recover any of these
 	for _, rs := range recoverStatuses {
-
-		// We have an in progress job
-		instanceID := rs.InstanceID.String()
-		instance, err := a.dao.GetServiceInstance(instanceID)
-		if err != nil {
+		if err := a.recoverJob(rs); err != nil {
 			return emptyToken, err
 		}
+	}
 
-		// Do we have a podname?
-		if rs.State.Podname == "" {
-			// NO, we do not have a podname
+	log.Info("Recovery complete")
+	return "recover called", nil
+}
 
-			log.Infof("No podname. Attempting to restart job: %s", instanceID)
-			log.Debugf("%v", instance)
+// unrecoverableJobError - the records a job needs to be recovered no longer
+// exist.
+type unrecoverableJobError struct {
+	reason string
+	// the service instance the job acts on was not completely written
+	incompleteInstance bool
+}
 
+func (e unrecoverableJobError) Error() string {
+	return e.reason
+}
+
+// recoverJob - starts the job taking over an in progress job, or marks the
+// job as failed if it can not be recovered.
+func (a AnsibleBroker) recoverJob(rs bundle.RecoverStatus) error {
+	job, topic, instanceID, err := a.recoveryJob(rs)
+	if e, ok := err.(unrecoverableJobError); ok {
+		if e.incompleteInstance {
 			// Handle bad write of service instance
-			if instance.Spec == nil || instance.Parameters == nil {
-				a.dao.SetState(instanceID, bundle.JobState{
-					Token:  rs.State.Token,
-					State:  bundle.StateFailed,
-					Method: rs.State.Method,
-				})
-				a.dao.DeleteServiceInstance(instance.ID.String())
-				log.Warningf("incomplete ServiceInstance [%s] record, marking job as failed",
-					instance.ID)
-
-				// skip to the next item
-				continue
-			}
+			a.dao.DeleteServiceInstance(rs.InstanceID.String())
+		}
+		return a.failRecoveredJob(rs.InstanceID.String(), rs.State, e.reason)
+	}
+	if err != nil {
+		return err
+	}
+	// Need to use the same token as before, since that's what the
+	// catalog will try to ping.
+	_, _, err = a.operations.StartAsync(instanceID, "", rs.State.Token, job, topic)
+	return err
+}
 
-			var job Work
-			var topic WorkTopic
-			if rs.State.Method == bundle.JobMethodProvision {
-				job = a.workFactory.NewProvisionJob(instance)
-				topic = ProvisionTopic
-			} else if rs.State.Method == bundle.JobMethodUpdate {
-				job = a.workFactory.NewUpdateJob(instance)
-				topic = UpdateTopic
-			} else if rs.State.Method == bundle.JobMethodDeprovision {
-				job = a.workFactory.NewDeprovisionJob(instance, false)
-				topic = DeprovisionTopic
-			} else {
-				log.Warningf(
-					"Attempted to recover job %s, but found an unrecognized "+
-						"MethodType: %s, skipping...",
-					rs.State.Token, rs.State.Method,
-				)
-			}
+// recoveryJob - creates the job taking over an in progress job. A job
+// without a pod is run again, a job with a pod is reattached to it. Returns
+// the job, its topic and the id of the service instance it acts on.
+func (a AnsibleBroker) recoveryJob(rs bundle.RecoverStatus) (Work, WorkTopic, string, error) {
+	method := rs.State.Method
+	topic, ok := methodTopics[method]
+	if !ok {
+		return nil, "", "", unrecoverableJobError{reason: fmt.Sprintf("unrecognized method %q", method)}
+	}
 
-			// Need to use the same token as before, since that's what the
-			// catalog will try to ping.
-			_, err := a.engine.StartNewAsyncJob(rs.State.Token, job, topic)
-			if err != nil {
-				return emptyToken, err
+	// The state of bind and unbind jobs is kept under the binding id
+	var bindInstance *bundle.BindInstance
+	instanceID := rs.InstanceID.String()
+	if method == bundle.JobMethodBind || method == bundle.JobMethodUnbind {
+		bi, err := a.dao.GetBindInstance(rs.InstanceID.String())
+		if err != nil {
+			if a.dao.IsNotFoundError(err) {
+				return nil, "", "", unrecoverableJobError{reason: "binding no longer exists"}
 			}
+			return nil, "", "", err
+		}
+		bindInstance = bi
+		instanceID = bi.ServiceID.String()
+	}
+	instance, err := a.dao.GetServiceInstance(instanceID)
+	if err != nil {
+		if a.dao.IsNotFoundError(err) {
+			return nil, "", "", unrecoverableJobError{reason: "service instance no longer exists"}
+		}
+		return nil, "", "", err
+	}
+	if instance.Spec == nil {
+		return nil, "", "", unrecoverableJobError{reason: "incomplete service instance record", incompleteInstance: bindInstance == nil}
+	}
 
-		} else {
-			// YES, we have a podname
-			log.Infof("We have a pod to recover: %s", rs.State.Podname)
-
-			// did the pod finish?
-			extErr := bundle.RecoverExtractCredentials(
-				rs.State.Podname,
-				instance.Context.Namespace,
-				instance.Spec.FQName,
-				instance.ID.String(),
-				rs.State.Method,
-				[]string{instance.Context.Namespace},
-				instance.Spec.Runtime,
-			)
-
-			// NO, pod failed.
-			if extErr != nil {
-				log.Errorf("broker::Recover error occurred. %s", extErr.Error())
-				return emptyToken, extErr
-			}
+	if rs.State.Podname != "" {
+		log.Infof("Reattaching %s job %s to pod %s", method, rs.State.Token, rs.State.Podname)
+		bindingID := ""
+		if bindInstance != nil {
+			bindingID = bindInstance.ID.String()
+		}
+		return a.workFactory.NewReattachJob(method, rs.State.Podname, bindingID, instance), topic, instanceID, nil
+	}
+
+	log.Infof("No podname. Attempting to restart %s job %s", method, rs.State.Token)
+	if bindInstance == nil && instance.Parameters == nil {
+		return nil, "", "", unrecoverableJobError{reason: "incomplete service instance record", incompleteInstance: true}
+	}
+	if instance, err = a.openInstance(instance); err != nil {
+		return nil, "", "", err
+	}
+	var job Work
+	switch method {
+	case bundle.JobMethodProvision:
+		job = a.workFactory.NewProvisionJob(instance)
+	case bundle.JobMethodUpdate:
+		job = a.workFactory.NewUpdateJob(instance, nil)
+	case bundle.JobMethodDeprovision:
+		job = a.workFactory.NewDeprovisionJob(instance, false)
+	default:
+		if job, err = a.rebuildBindingJob(method, bindInstance, instance); err != nil {
+			return nil, "", "", err
+		}
+	}
+	return job, topic, instanceID, nil
+}
+
+// rebuildBindingJob - creates the bind or unbind job of a binding from its
+// persisted parameters.
+func (a AnsibleBroker) rebuildBindingJob(
+	method bundle.JobMethod, bindInstance *bundle.BindInstance, instance *bundle.ServiceInstance,
+) (Work, error) {
+	bindingID := bindInstance.ID.String()
+	saved := bundle.Parameters{}
+	if bindInstance.Parameters != nil {
+		opened, err := a.cipher.Open(bindInstance.Parameters)
+		if err != nil {
+			return nil, err
 		}
+		saved = *opened
+	}
+	provExtCreds, err := bundle.GetExtractedCredentials(instance.ID.String())
+	if err != nil && err != bundle.ErrExtractedCredentialsNotFound {
+		return nil, err
 	}
 
-	log.Info("Recovery complete")
-	return "recover called", nil
+	if method == bundle.JobMethodBind {
+		params := bundle.Parameters{}
+		for key, value := range saved {
+			params[key] = value
+		}
+		if provExtCreds != nil {
+			params[bundle.ProvisionCredentialsKey] = provExtCreds.Credentials
+		}
+		return a.workFactory.NewBindJob(bindingID, &params, instance), nil
+	}
+
+	bindExtCreds, err := bundle.GetExtractedCredentials(bindingID)
+	if err != nil && err != bundle.ErrExtractedCredentialsNotFound {
+		return nil, err
+	}
+	planID, _ := saved[planParameterKey].(string)
+	user, _ := saved[lastRequestingUserKey].(string)
+	params := unbindParams(instance, bindingID, planID, user, provExtCreds, bindExtCreds)
+	return a.workFactory.NewUnbindJob(bindingID, &params, instance, false), nil
+}
+
+// failRecoveredJob - marks a job that can not be recovered as failed.
+func (a AnsibleBroker) failRecoveredJob(id string, state bundle.JobState, reason string) error {
+	log.Warningf("unable to recover %s job %s - %s, marking job as failed", state.Method, state.Token, reason)
+	_, err := a.dao.SetState(id, bundle.JobState{
+		Token:       state.Token,
+		State:       bundle.StateFailed,
+		Method:      state.Method,
+		Podname:     state.Podname,
+		Error:       reason,
+		Description: fmt.Sprintf("unable to recover the job after a broker restart: %s", reason),
+	})
+	return err
 }
 
 // Catalog - returns the catalog of services defined
@@ -561,6 +674,24 @@ func (a AnsibleBroker) Catalog() (*CatalogResponse, error) {
 
 // Provision  - will provision a service
 func (a AnsibleBroker) Provision(instanceUUID uuid.UUID, req *ProvisionRequest, async bool, userInfo UserInfo,
+) (*ProvisionResponse, error) {
+	resp, err := a.provision(instanceUUID, req, async, userInfo)
+	record := audit.Record{
+		Namespace:  req.Context.Namespace,
+		InstanceID: instanceUUID.String(),
+		ServiceID:  req.ServiceID,
+		Plan:       req.PlanID,
+		Parameters: audit.ParameterNames(req.Parameters),
+	}
+	if resp != nil {
+		record.JobToken = resp.Operation
+	}
+	a.auditRequest(bundle.JobMethodProvision, userInfo, record, err)
+	return resp, err
+}
+
+// provision - the provision request, recorded in the audit trail by Provision.
+func (a AnsibleBroker) provision(instanceUUID uuid.UUID, req *ProvisionRequest, async bool, userInfo UserInfo,
 ) (*ProvisionResponse, error) {
 	////////////////////////////////////////////////////////////
 	//type ProvisionRequest struct {
@@ -694,6 +825,9 @@ func (a AnsibleBroker) Provision(instanceUUID uuid.UUID, req *ProvisionRequest,
 	// This will use the package to make sure that if the type is changed
 	// away from []byte it can still be evaluated.
 	if si != nil && uuid.Equal(si.ID, serviceInstance.ID) {
+		if si, err = a.openInstance(si); err != nil {
+			return nil, err
+		}
 		if reflect.DeepEqual(si.Parameters, serviceInstance.Parameters) {
 			alreadyInProgress, jobToken, err := a.isJobInProgress(serviceInstance.ID.String(), bundle.JobMethodProvision)
 			if err != nil {
@@ -713,7 +847,17 @@ func (a AnsibleBroker) Provision(instanceUUID uuid.UUID, req *ProvisionRequest,
 	//
 	// Looks like this is a new provision, let's get started.
 	//
-	if err = a.dao.SetServiceInstance(instanceUUID.String(), serviceInstance); err != nil {
+	stored, err := a.sealInstance(serviceInstance)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = a.dao.SetServiceInstanceIf(instanceUUID.String(), stored, types.NoVersion); err != nil {
+		if types.IsConflictError(err) {
+			// another request created the instance since it was looked up,
+			// compare it with this one again
+			log.Infof("instance %s was provisioned concurrently", instanceUUID)
+			return a.provision(instanceUUID, req, async, userInfo)
+		}
 		return nil, err
 	}
 
@@ -723,14 +867,14 @@ func (a AnsibleBroker) Provision(instanceUUID uuid.UUID, req *ProvisionRequest,
 	if async {
 		log.Info("ASYNC provisioning in progress")
 		// asynchronously provision and return the token for the lastoperation
-		token, err = a.engine.StartNewAsyncJob(token, pjob, ProvisionTopic)
+		token, _, err = a.operations.StartAsync(instanceUUID.String(), "", token, pjob, ProvisionTopic)
 		if err != nil {
 			log.Errorf("Failed to start new job for async provision\n%s", err.Error())
 			return nil, err
 		}
 	} else {
 		log.Info("reverting to synchronous provisioning in progress")
-		if err := a.engine.StartNewSyncJob(token, pjob, ProvisionTopic); err != nil {
+		if _, _, err := a.operations.StartSync(instanceUUID.String(), "", token, pjob, ProvisionTopic); err != nil {
 			log.Errorf("Failed to start new job for sync provision\n%s", err.Error())
 			return nil, err
 		}
@@ -790,6 +934,23 @@ func (a *AnsibleBroker) getDashboardURL(si *bundle.ServiceInstance) string {
 // Deprovision - will deprovision a service.
 func (a AnsibleBroker) Deprovision(
 	instance bundle.ServiceInstance, planID string, skipApbExecution bool, async bool, userInfo UserInfo,
+) (*DeprovisionResponse, error) {
+	resp, err := a.deprovision(instance, planID, skipApbExecution, async, userInfo)
+	record := audit.Record{
+		Namespace:  instanceNamespace(&instance),
+		InstanceID: instance.ID.String(),
+		Plan:       planID,
+	}
+	if resp != nil {
+		record.JobToken = resp.Operation
+	}
+	a.auditRequest(bundle.JobMethodDeprovision, userInfo, record, err)
+	return resp, err
+}
+
+// deprovision - the deprovision request, recorded in the audit trail by Deprovision.
+func (a AnsibleBroker) deprovision(
+	instance bundle.ServiceInstance, planID string, skipApbExecution bool, async bool, userInfo UserInfo,
 ) (*DeprovisionResponse, error) {
 	////////////////////////////////////////////////////////////
 	// Deprovision flow
@@ -842,23 +1003,35 @@ func (a AnsibleBroker) Deprovision(
 		instance.Parameters.EnsureDefaults()
 	}
 
-	var token = a.engine.Token()
-	dpjob := a.workFactory.NewDeprovisionJob(&instance, skipApbExecution)
+	opened, err := a.openInstance(&instance)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		token  = a.engine.Token()
+		hash   = requestHash(bundle.JobMethodDeprovision, instance.ID.String(), planID)
+		merged bool
+	)
+	dpjob := a.workFactory.NewDeprovisionJob(opened, skipApbExecution)
 	metrics.ActionStarted("deprovision")
 	if async {
 		log.Info("ASYNC deprovision in progress")
 
-		token, err = a.engine.StartNewAsyncJob(token, dpjob, DeprovisionTopic)
+		token, merged, err = a.operations.StartAsync(instance.ID.String(), hash, token, dpjob, DeprovisionTopic)
 		if err != nil {
 			log.Errorf("Failed to start new job for async deprovision\n%s", err.Error())
 			return nil, err
 		}
+		if merged {
+			return &DeprovisionResponse{Operation: token}, ErrorDeprovisionInProgress
+		}
 		return &DeprovisionResponse{Operation: token}, nil
 	}
 
 	if !skipApbExecution {
 		log.Info("Synchronous deprovision in progress")
-		if err := a.engine.StartNewSyncJob(token, dpjob, DeprovisionTopic); err != nil {
+		if _, _, err := a.operations.StartSync(instance.ID.String(), hash, token, dpjob, DeprovisionTopic); err != nil {
 			return nil, err
 		}
 
@@ -940,6 +1113,25 @@ func (a AnsibleBroker) GetBind(instance bundle.ServiceInstance, bindingUUID uuid
 // whether the caller is willing to have the operation run asynchronously. The
 // returned bool will be true if the operation actually ran asynchronously.
 func (a AnsibleBroker) Bind(instance bundle.ServiceInstance, bindingUUID uuid.UUID, req *BindRequest, async bool, userInfo UserInfo,
+) (*BindResponse, bool, error) {
+	resp, ranAsync, err := a.bind(instance, bindingUUID, req, async, userInfo)
+	record := audit.Record{
+		Namespace:  instanceNamespace(&instance),
+		InstanceID: instance.ID.String(),
+		BindingID:  bindingUUID.String(),
+		ServiceID:  req.ServiceID,
+		Plan:       req.PlanID,
+		Parameters: audit.ParameterNames(req.Parameters),
+	}
+	if resp != nil {
+		record.JobToken = resp.Operation
+	}
+	a.auditRequest(bundle.JobMethodBind, userInfo, record, err)
+	return resp, ranAsync, err
+}
+
+// bind - the bind request, recorded in the audit trail by Bind.
+func (a AnsibleBroker) bind(instance bundle.ServiceInstance, bindingUUID uuid.UUID, req *BindRequest, async bool, userInfo UserInfo,
 ) (*BindResponse, bool, error) {
 	// binding_id is the id of the binding.
 	// the instanceUUID is the previously provisioned service id.
@@ -1011,6 +1203,9 @@ func (a AnsibleBroker) Bind(instance bundle.ServiceInstance, bindingUUID uuid.UU
 	}
 
 	if existingBI, err := a.dao.GetBindInstance(bindingUUID.String()); err == nil {
+		if existingBI.Parameters, err = a.cipher.Open(existingBI.Parameters); err != nil {
+			return nil, false, err
+		}
 		if existingBI.IsEqual(bindingInstance) {
 			bindExtCreds, err := bundle.GetExtractedCredentials(existingBI.ID.String())
 			// It's ok if there aren't any bind credentials yet.
@@ -1055,7 +1250,11 @@ func (a AnsibleBroker) Bind(instance bundle.ServiceInstance, bindingUUID uuid.UU
 	}
 
 	// No existing BindInstance was found above, so proceed with saving this one
-	if err := a.dao.SetBindInstance(bindingUUID.String(), bindingInstance); err != nil {
+	stored, err := a.sealBinding(bindingInstance, &instance)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := a.dao.SetBindInstance(bindingUUID.String(), stored); err != nil {
 		return nil, false, err
 	}
 
@@ -1074,6 +1273,7 @@ func (a AnsibleBroker) Bind(instance bundle.ServiceInstance, bindingUUID uuid.UU
 	var (
 		bindExtCreds *bundle.ExtractedCredentials
 		token        = a.engine.Token()
+		hash         = requestHash(bundle.JobMethodBind, bindingUUID.String(), req)
 		bindingJob   = a.workFactory.NewBindJob(bindingUUID.String(), &params, &instance)
 	)
 
@@ -1081,26 +1281,28 @@ func (a AnsibleBroker) Bind(instance bundle.ServiceInstance, bindingUUID uuid.UU
 		// asynchronous mode, requires that the launch apb config
 		// entry is on, and that async comes in from the catalog
 		log.Info("ASYNC binding in progress")
-		token, err = a.engine.StartNewAsyncJob("", bindingJob, BindingTopic)
+		token, _, err = a.operations.StartAsync(instance.ID.String(), hash, "", bindingJob, BindingTopic)
 		if err != nil {
 			log.Errorf("Failed to start new job for async binding\n%s", err.Error())
 			return nil, false, err
 		}
 
 		bindingInstance.CreateJobKey = fmt.Sprintf("/state/%s/job/%s", bindingUUID.String(), token)
-		if err := a.dao.SetBindInstance(bindingUUID.String(), bindingInstance); err != nil {
+		if stored, err = a.sealBinding(bindingInstance, &instance); err != nil {
+			return nil, false, err
+		}
+		if err := a.dao.SetBindInstance(bindingUUID.String(), stored); err != nil {
 			return nil, false, err
 		}
 		return &BindResponse{Operation: token}, true, nil
 	} else if a.brokerConfig.LaunchApbOnBind {
 		// we are synchronous mode
 		log.Info("Broker configured to run APB bind")
-		if err := a.engine.StartNewSyncJob(token, bindingJob, BindingTopic); err != nil {
+		if _, _, err := a.operations.StartSync(instance.ID.String(), hash, token, bindingJob, BindingTopic); err != nil {
 			return nil, false, err
 		}
 		//TODO are we only setting the bindingUUID if sync?
-		instance.AddBinding(bindingUUID)
-		if err := a.dao.SetServiceInstance(instance.ID.String(), &instance); err != nil {
+		if err := a.addBinding(instance.ID.String(), bindingUUID); err != nil {
 			return nil, false, err
 		}
 	} else {
@@ -1113,8 +1315,7 @@ func (a AnsibleBroker) Bind(instance bundle.ServiceInstance, bindingUUID uuid.UU
 			log.Errorf("Unable to create new binding extracted creds from provision creds - %v", err)
 			return nil, false, err
 		}
-		instance.AddBinding(bindingUUID)
-		if err := a.dao.SetServiceInstance(instance.ID.String(), &instance); err != nil {
+		if err := a.addBinding(instance.ID.String(), bindingUUID); err != nil {
 			return nil, false, err
 		}
 	}
@@ -1124,11 +1325,37 @@ func (a AnsibleBroker) Bind(instance bundle.ServiceInstance, bindingUUID uuid.UU
 	return resp, false, err
 }
 
+// addBinding - adds the binding to the latest version of the instance.
+func (a AnsibleBroker) addBinding(instanceID string, bindingUUID uuid.UUID) error {
+	return types.UpdateServiceInstance(a.dao, instanceID, func(si *bundle.ServiceInstance) error {
+		si.AddBinding(bindingUUID)
+		return nil
+	})
+}
+
 // Unbind - unbind a service's previous binding. Parameter "async" declares
 // whether the caller is willing to have the operation run asynchronously. The
 // returned bool will be true if the operation actually ran asynchronously.
 func (a AnsibleBroker) Unbind(
 	instance bundle.ServiceInstance, bindInstance bundle.BindInstance, planID string, skipApbExecution bool, async bool, userInfo UserInfo,
+) (*UnbindResponse, bool, error) {
+	resp, ranAsync, err := a.unbind(instance, bindInstance, planID, skipApbExecution, async, userInfo)
+	record := audit.Record{
+		Namespace:  instanceNamespace(&instance),
+		InstanceID: instance.ID.String(),
+		BindingID:  bindInstance.ID.String(),
+		Plan:       planID,
+	}
+	if resp != nil {
+		record.JobToken = resp.Operation
+	}
+	a.auditRequest(bundle.JobMethodUnbind, userInfo, record, err)
+	return resp, ranAsync, err
+}
+
+// unbind - the unbind request, recorded in the audit trail by Unbind.
+func (a AnsibleBroker) unbind(
+	instance bundle.ServiceInstance, bindInstance bundle.BindInstance, planID string, skipApbExecution bool, async bool, userInfo UserInfo,
 ) (*UnbindResponse, bool, error) {
 	if planID == "" {
 		errMsg :=
@@ -1173,45 +1400,35 @@ func (a AnsibleBroker) Unbind(
 		return nil, false, err
 	}
 
-	// build up unbind parameters
-	params := make(bundle.Parameters)
-	// Fixes BZ1578319 - put last requesting user at the top level
-	// they should be at the top level. We are still keeping the lower level
-	// values as well since others might already be using them.
-	params[lastRequestingUserKey] = getLastRequestingUser(userInfo)
-	params[planParameterKey] = planID
-	params[serviceInstIDKey] = serviceInstance.ID.String()
-	params[serviceBindingIDKey] = bindInstance.ID.String()
-
-	// TODO: feels like we should be passing in service instance id
-	// and binding uuid as well
-
-	if provExtCreds != nil {
-		params[bundle.ProvisionCredentialsKey] = provExtCreds.Credentials
-	}
-	if bindExtCreds != nil {
-		params[bundle.BindCredentialsKey] = bindExtCreds.Credentials
-	}
-	if serviceInstance.Parameters != nil {
-		params["provision_params"] = *serviceInstance.Parameters
+	opened, err := a.openInstance(&serviceInstance)
+	if err != nil {
+		return nil, false, err
 	}
+
+	params := unbindParams(opened, bindInstance.ID.String(), planID,
+		getLastRequestingUser(userInfo), provExtCreds, bindExtCreds)
 	metrics.ActionStarted("unbind")
 
 	var (
 		token     = a.engine.Token()
+		hash      = requestHash(bundle.JobMethodUnbind, bindInstance.ID.String(), planID)
+		merged    bool
 		jerr      error
-		unbindJob = a.workFactory.NewUnbindJob(bindInstance.ID.String(), &params, &serviceInstance, skipApbExecution)
+		unbindJob = a.workFactory.NewUnbindJob(bindInstance.ID.String(), &params, opened, skipApbExecution)
 	)
 	if async && a.brokerConfig.LaunchApbOnBind {
 		// asynchronous mode, required that the launch apb config
 		// entry is on, and that async comes in from the catalog
 		log.Info("ASYNC unbinding in progress")
 
-		token, jerr = a.engine.StartNewAsyncJob("", unbindJob, UnbindingTopic)
+		token, merged, jerr = a.operations.StartAsync(instance.ID.String(), hash, "", unbindJob, UnbindingTopic)
 		if jerr != nil {
 			log.Errorf("Failed to start new job for async unbind\n%s", jerr.Error())
 			return nil, false, jerr
 		}
+		if merged {
+			return &UnbindResponse{Operation: token}, false, ErrorUnbindingInProgress
+		}
 
 		return &UnbindResponse{Operation: token}, true, nil
 
@@ -1222,7 +1439,7 @@ func (a AnsibleBroker) Unbind(
 			err = nil
 		} else {
 			log.Debug("Launching apb for unbind in blocking mode")
-			if err := a.engine.StartNewSyncJob(token, unbindJob, UnbindingTopic); err != nil {
+			if _, _, err := a.operations.StartSync(instance.ID.String(), hash, token, unbindJob, UnbindingTopic); err != nil {
 				return nil, false, err
 			}
 		}
@@ -1240,8 +1457,56 @@ func (a AnsibleBroker) Unbind(
 	return &UnbindResponse{}, false, nil
 }
 
+// unbindParams - builds up the parameters of an unbind job.
+func unbindParams(
+	serviceInstance *bundle.ServiceInstance, bindingID string, planID string, requestingUser string,
+	provExtCreds *bundle.ExtractedCredentials, bindExtCreds *bundle.ExtractedCredentials,
+) bundle.Parameters {
+	params := make(bundle.Parameters)
+	// Fixes BZ1578319 - put last requesting user at the top level
+	// they should be at the top level. We are still keeping the lower level
+	// values as well since others might already be using them.
+	params[lastRequestingUserKey] = requestingUser
+	params[planParameterKey] = planID
+	params[serviceInstIDKey] = serviceInstance.ID.String()
+	params[serviceBindingIDKey] = bindingID
+
+	if provExtCreds != nil {
+		params[bundle.ProvisionCredentialsKey] = provExtCreds.Credentials
+	}
+	if bindExtCreds != nil {
+		params[bundle.BindCredentialsKey] = bindExtCreds.Credentials
+	}
+	if serviceInstance.Parameters != nil {
+		params["provision_params"] = *serviceInstance.Parameters
+	}
+	return params
+}
+
 // Update  - will update a service
 func (a AnsibleBroker) Update(instanceUUID uuid.UUID, req *UpdateRequest, async bool, userInfo UserInfo,
+) (*UpdateResponse, error) {
+	resp, err := a.update(instanceUUID, req, async, userInfo)
+	params := map[string]interface{}{}
+	for name, value := range req.Parameters {
+		params[name] = value
+	}
+	record := audit.Record{
+		Namespace:  req.Context.Namespace,
+		InstanceID: instanceUUID.String(),
+		ServiceID:  req.ServiceID,
+		Plan:       req.PlanID,
+		Parameters: audit.ParameterNames(params),
+	}
+	if resp != nil {
+		record.JobToken = resp.Operation
+	}
+	a.auditRequest(bundle.JobMethodUpdate, userInfo, record, err)
+	return resp, err
+}
+
+// update - the update request, recorded in the audit trail by Update.
+func (a AnsibleBroker) update(instanceUUID uuid.UUID, req *UpdateRequest, async bool, userInfo UserInfo,
 ) (*UpdateResponse, error) {
 	////////////////////////////////////////////////////////////
 	//type UpdateRequest struct {
@@ -1311,6 +1576,11 @@ func (a AnsibleBroker) Update(instanceUUID uuid.UUID, req *UpdateRequest, async
 		log.Debug("Error retrieving instance")
 		return nil, ErrorNotFound
 	}
+	// the update job is handed every parameter, and the unchanged secret
+	// values of the request are compared with the stored ones
+	if si, err = a.openInstance(si); err != nil {
+		return nil, err
+	}
 
 	// update the lastRequestingUserKey value in the si.Parameters
 	if *si.Parameters != nil {
@@ -1323,29 +1593,26 @@ func (a AnsibleBroker) Update(instanceUUID uuid.UUID, req *UpdateRequest, async
 		prevParams[k] = v
 	}
 
-	////////////////////////////////////////////////////////////
-	// TODO -- HACK!: Update will report a 202 if it finds any jobs
-	// in_progress for a particular instance, *even if the requests are different*.
-	// This means an update must be completed before a user is able to further
-	// request additional, possibly different updates. This should be considered
-	// a known issue with our update implementation.
-	//
-	// The right way to do this is probably to setup an update request queue.
-	// When a request comes in, hash it, check to see if there are any jobs in
-	// the queue or currently in progress that match the hash. If so, $DO_SENSIBLE_THING,
-	// else, add onto the back of the queue. Ensures update operations are not
-	// trying to execute concurrently.
-	////////////////////////////////////////////////////////////
-	alreadyInProgress, jobToken, err := a.isJobInProgress(si.ID.String(), bundle.JobMethodUpdate)
+	// Operations on an instance are queued and run one after the other. An
+	// update identical to one that is queued or running is merged into it and
+	// reports the token of that operation, a different update is queued.
+	hash := requestHash(bundle.JobMethodUpdate, instanceUUID.String(), req)
+	if jobToken, ok := a.operations.Duplicate(instanceUUID.String(), hash); ok {
+		log.Infof("Update requested for instance %s, but the same update is already queued or in progress", si.ID)
+		return &UpdateResponse{Operation: jobToken}, ErrorUpdateInProgress
+	}
+	// The request of an update in progress that the queue has no hash for,
+	// such as one recovered after a restart, is not known. Any update is
+	// merged into it.
+	inProgress, jobToken, err := a.isJobInProgress(si.ID.String(), bundle.JobMethodUpdate)
 	if err != nil {
 		return nil, fmt.Errorf(
 			"An error occurred while trying to determine if an update job is already in progress for instance: %s", si.ID)
 	}
-	if alreadyInProgress {
-		log.Infof("Update requested for instance %s, but job is already in progress", si.ID)
+	if inProgress && !a.operations.Hashed(instanceUUID.String(), jobToken) {
+		log.Infof("Update requested for instance %s, but a recovered update is in progress", si.ID)
 		return &UpdateResponse{Operation: jobToken}, ErrorUpdateInProgress
 	}
-	////////////////////////////////////////////////////////////
 
 	// Retrieve requested spec
 	spec, err := a.dao.GetSpec(si.Spec.ID)
@@ -1414,13 +1681,13 @@ func (a AnsibleBroker) Update(instanceUUID uuid.UUID, req *UpdateRequest, async
 	}
 
 	// Parameters look good, update the ServiceInstance values
+	changed := map[string]interface{}{}
+	if fromPlan.Name != toPlan.Name {
+		changed[planParameterKey] = toPlan.Name
+	}
 	for newParamKey, newParamVal := range req.Parameters {
 		(*si.Parameters)[newParamKey] = newParamVal
-	}
-
-	// We're ready to provision so save
-	if err = a.dao.SetServiceInstance(instanceUUID.String(), si); err != nil {
-		return nil, err
+		changed[newParamKey] = newParamVal
 	}
 
 	var token = a.engine.Token()
@@ -1430,19 +1697,27 @@ func (a AnsibleBroker) Update(instanceUUID uuid.UUID, req *UpdateRequest, async
 	log.Debugf("toPlanName: [%s]", toPlan.Name)
 	log.Debugf("PreviousValues: [ %+v ]", req.PreviousValues)
 	log.Debugf("ServiceInstance Parameters: [%v]", *si.Parameters)
-	ujob := a.workFactory.NewUpdateJob(si)
+	// The parameters are saved when the update starts, an update waiting in
+	// the queue of the instance may still be cancelled
+	ujob := a.workFactory.NewUpdateJob(si, func() error {
+		return a.applyUpdate(si, changed)
+	})
 	metrics.ActionStarted("update")
 	if async {
 		log.Info("ASYNC update in progress")
 		// asynchronously provision and return the token for the lastoperation
-		token, err = a.engine.StartNewAsyncJob(token, ujob, UpdateTopic)
+		var merged bool
+		token, merged, err = a.operations.StartAsync(instanceUUID.String(), hash, token, ujob, UpdateTopic)
 		if err != nil {
 			log.Errorf("Failed to start new job for async update\n%s", err.Error())
 			return nil, err
 		}
+		if merged {
+			return &UpdateResponse{Operation: token}, ErrorUpdateInProgress
+		}
 	} else {
 		log.Info("reverting to synchronous update in progress")
-		if err := a.engine.StartNewSyncJob(token, ujob, UpdateTopic); err != nil {
+		if _, _, err := a.operations.StartSync(instanceUUID.String(), hash, token, ujob, UpdateTopic); err != nil {
 			log.Errorf("Failed to start new job for sync update\n%s", err.Error())
 			return nil, err
 		}
@@ -1451,6 +1726,35 @@ func (a AnsibleBroker) Update(instanceUUID uuid.UUID, req *UpdateRequest, async
 	return &UpdateResponse{Operation: token}, nil
 }
 
+// applyUpdate - saves the parameters changed by an update to the latest
+// version of the instance, and hands the resulting parameters to the update
+// job through si. Updates that ran in the meantime keep their changes.
+func (a AnsibleBroker) applyUpdate(si *bundle.ServiceInstance, changed map[string]interface{}) error {
+	return types.UpdateServiceInstance(a.dao, si.ID.String(), func(latest *bundle.ServiceInstance) error {
+		opened, err := a.openInstance(latest)
+		if err != nil {
+			return err
+		}
+		params := bundle.Parameters{}
+		if opened.Parameters != nil {
+			for k, v := range *opened.Parameters {
+				params[k] = v
+			}
+		}
+		for k, v := range changed {
+			params[k] = v
+		}
+		opened.Parameters = &params
+		stored, err := a.sealInstance(opened)
+		if err != nil {
+			return err
+		}
+		latest.Parameters = stored.Parameters
+		si.Parameters = &params
+		return nil
+	})
+}
+
 func (a AnsibleBroker) isValidPlanTransition(fromPlan bundle.Plan, toPlanName string) bool {
 	// Make sure that we can find the plan we're updating from.
 	// This should probably never fail, but cover our tail.
@@ -1543,6 +1847,32 @@ func (a AnsibleBroker) LastOperation(instanceUUID uuid.UUID, req *LastOperationR
 	return &LastOperationResponse{State: state, Description: jobstate.Description}, err
 }
 
+// CancelJob - cancels a queued or running job by its token. The job is
+// marked as failed and the subscribers of its topic are notified.
+func (a AnsibleBroker) CancelJob(token string, userInfo UserInfo) error {
+	if a.operations.Cancel(token, userInfo.Username) {
+		return nil
+	}
+	return a.engine.CancelJob(token, userInfo.Username)
+}
+
+// DeadLetters - returns the job messages the work subscribers failed to
+// handle.
+func (a AnsibleBroker) DeadLetters() ([]*types.DeadLetter, error) {
+	if a.engine.DeadLetters() == nil {
+		return []*types.DeadLetter{}, nil
+	}
+	return a.engine.DeadLetters().List()
+}
+
+// ReplayDeadLetter - delivers a dead letter to its subscriber again.
+func (a AnsibleBroker) ReplayDeadLetter(id string) error {
+	if a.engine.DeadLetters() == nil {
+		return ErrorNotFound
+	}
+	return a.engine.DeadLetters().Replay(id)
+}
+
 // AddSpec - adding the spec to the catalog for local development
 func (a AnsibleBroker) AddSpec(spec bundle.Spec) (*CatalogResponse, error) {
 	log.Debug("broker::AddSpec")
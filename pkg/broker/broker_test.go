@@ -17,6 +17,7 @@
 package broker
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"testing"
@@ -26,10 +27,12 @@ import (
 	"errors"
 	"github.com/automationbroker/bundle-lib/bundle"
 	"github.com/automationbroker/bundle-lib/registries"
+	"github.com/automationbroker/bundle-lib/runtime"
 	"github.com/automationbroker/config"
 	"github.com/openshift/ansible-service-broker/pkg/dao/mocks"
 	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
 	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/mock"
 	"os"
 )
 
@@ -50,7 +53,7 @@ func TestAddIdForPlan(t *testing.T) {
 }
 
 func TestNewAnsibleBroker(t *testing.T) {
-	_, err := NewAnsibleBroker(&mocks.Dao{}, []registries.Registry{}, *NewWorkEngine(20, 2*time.Minute, &mocks.Dao{}), &config.Config{}, "new-space", NewWorkFactory())
+	_, err := NewAnsibleBroker(&mocks.Dao{}, []registries.Registry{}, *NewWorkEngine(20, 2*time.Minute, &mocks.Dao{}), &config.Config{}, "new-space", NewWorkFactory(RetryPolicies{}, bundle.ClusterConfig{}))
 	if err != nil {
 		t.Fail()
 	}
@@ -400,3 +403,267 @@ func TestMarkSpecsForDeletion(t *testing.T) {
 		}
 	}
 }
+
+// recoveryWorkFactory - records the jobs created to recover bindings.
+type recoveryWorkFactory struct {
+	WorkFactory
+	jobs   chan string
+	params chan bundle.Parameters
+}
+
+func newRecoveryWorkFactory() *recoveryWorkFactory {
+	return &recoveryWorkFactory{jobs: make(chan string, 1), params: make(chan bundle.Parameters, 1)}
+}
+
+func (f *recoveryWorkFactory) NewProvisionJob(si *bundle.ServiceInstance) Work {
+	f.jobs <- "provision"
+	return &recoveredWork{id: si.ID.String(), method: bundle.JobMethodProvision}
+}
+
+func (f *recoveryWorkFactory) NewBindJob(bindingID string, params *bundle.Parameters, si *bundle.ServiceInstance) Work {
+	f.jobs <- "bind"
+	f.params <- *params
+	return &recoveredWork{id: bindingID, method: bundle.JobMethodBind}
+}
+
+func (f *recoveryWorkFactory) NewUnbindJob(bindingID string, params *bundle.Parameters, si *bundle.ServiceInstance, skip bool) Work {
+	f.jobs <- "unbind"
+	f.params <- *params
+	return &recoveredWork{id: bindingID, method: bundle.JobMethodUnbind}
+}
+
+func (f *recoveryWorkFactory) NewReattachJob(method bundle.JobMethod, podName string, bindingID string, si *bundle.ServiceInstance) Work {
+	f.jobs <- fmt.Sprintf("reattach %s to %s", method, podName)
+	if bindingID == "" {
+		return &recoveredWork{id: si.ID.String(), method: method}
+	}
+	return &recoveredWork{id: bindingID, method: method}
+}
+
+// recoveredWork - work that succeeds straight away.
+type recoveredWork struct {
+	id     string
+	method bundle.JobMethod
+}
+
+func (w *recoveredWork) ID() string               { return w.id }
+func (w *recoveredWork) Method() bundle.JobMethod { return w.method }
+func (w *recoveredWork) Run(ctx context.Context, token string, msgBuffer chan<- JobMsg) {
+	msgBuffer <- JobMsg{
+		BindingUUID: w.id,
+		JobToken:    token,
+		State:       bundle.JobState{Token: token, State: bundle.StateSucceeded, Method: w.method},
+	}
+}
+
+func TestRecoverBindingJobs(t *testing.T) {
+	instanceID := uuid.NewRandom()
+	bindingID := uuid.NewRandom()
+	notFound := errors.New("not found")
+	instance := &bundle.ServiceInstance{
+		ID:         instanceID,
+		Spec:       &bundle.Spec{FQName: "dh-postgresql-apb"},
+		Context:    &bundle.Context{Namespace: "project"},
+		Parameters: &bundle.Parameters{planParameterKey: "dev"},
+	}
+	bindInstance := &bundle.BindInstance{
+		ID:        bindingID,
+		ServiceID: instanceID,
+		Parameters: &bundle.Parameters{
+			planParameterKey:      "dev",
+			lastRequestingUserKey: "developer",
+			"db_name":             "orders",
+		},
+	}
+	recoverStatus := func(method bundle.JobMethod, podName string) []bundle.RecoverStatus {
+		return []bundle.RecoverStatus{{
+			InstanceID: bindingID,
+			State:      bundle.JobState{Token: "token", State: bundle.StateInProgress, Method: method, Podname: podName},
+		}}
+	}
+
+	cases := []struct {
+		name            string
+		method          bundle.JobMethod
+		podName         string
+		missingBinding  bool
+		expectedJob     string
+		assertParams    func(t *testing.T, params bundle.Parameters)
+		expectedFailure bool
+	}{
+		{
+			name:        "bind without pod is started again",
+			method:      bundle.JobMethodBind,
+			expectedJob: "bind",
+			assertParams: func(t *testing.T, params bundle.Parameters) {
+				ft.AssertEqual(t, params["db_name"], "orders")
+				ft.AssertTrue(t, reflect.DeepEqual(params[bundle.ProvisionCredentialsKey], map[string]interface{}{"user": "admin"}))
+			},
+		},
+		{
+			name:        "unbind without pod is started again",
+			method:      bundle.JobMethodUnbind,
+			expectedJob: "unbind",
+			assertParams: func(t *testing.T, params bundle.Parameters) {
+				ft.AssertEqual(t, params[planParameterKey], "dev")
+				ft.AssertEqual(t, params[lastRequestingUserKey], "developer")
+				ft.AssertEqual(t, params[serviceInstIDKey], instanceID.String())
+				ft.AssertEqual(t, params[serviceBindingIDKey], bindingID.String())
+				ft.AssertTrue(t, reflect.DeepEqual(params[bundle.BindCredentialsKey], map[string]interface{}{"user": "admin"}))
+			},
+		},
+		{
+			name:        "bind with pod is reattached",
+			method:      bundle.JobMethodBind,
+			podName:     "bundle-1234",
+			expectedJob: "reattach bind to bundle-1234",
+		},
+		{
+			name:        "unbind with pod is reattached",
+			method:      bundle.JobMethodUnbind,
+			podName:     "bundle-1234",
+			expectedJob: "reattach unbind to bundle-1234",
+		},
+		{
+			name:            "job of a missing binding is failed",
+			method:          bundle.JobMethodBind,
+			missingBinding:  true,
+			expectedFailure: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := new(runtime.MockRuntime)
+			rt.On("GetExtractedCredential", mock.Anything, mock.Anything).Return(map[string]interface{}{"user": "admin"}, nil)
+			runtime.Provider = rt
+
+			d := new(mocks.Dao)
+			d.On("FindJobStateByState", bundle.StateInProgress).Return(recoverStatus(tc.method, tc.podName), nil)
+			if tc.missingBinding {
+				d.On("GetBindInstance", bindingID.String()).Return(nil, notFound)
+			} else {
+				d.On("GetBindInstance", bindingID.String()).Return(bindInstance, nil)
+			}
+			d.On("IsNotFoundError", notFound).Return(true)
+			d.On("GetServiceInstance", instanceID.String()).Return(instance, nil)
+			d.On("SetState", bindingID.String(), mock.Anything).Return("", nil)
+
+			factory := newRecoveryWorkFactory()
+			a, err := NewAnsibleBroker(d, []registries.Registry{}, *NewWorkEngine(20, 2*time.Minute, d), &config.Config{}, "new-space", factory)
+			ft.AssertNil(t, err)
+
+			_, err = a.Recover()
+			ft.AssertNil(t, err)
+
+			if tc.expectedFailure {
+				d.AssertCalled(t, "SetState", bindingID.String(), mock.MatchedBy(func(state bundle.JobState) bool {
+					return state.Token == "token" && state.State == bundle.StateFailed
+				}))
+				ft.AssertEqual(t, len(factory.jobs), 0)
+				return
+			}
+			select {
+			case job := <-factory.jobs:
+				ft.AssertEqual(t, job, tc.expectedJob)
+			case <-time.After(time.Second):
+				t.Fatal("no job was started")
+			}
+			if tc.assertParams != nil {
+				tc.assertParams(t, <-factory.params)
+			}
+			// the job is started again with the same token
+			d.AssertCalled(t, "SetState", bindingID.String(), bundle.JobState{
+				Token: "token", State: bundle.StateNotYetStarted, Method: tc.method})
+		})
+	}
+}
+
+func TestRecoverInstanceJobs(t *testing.T) {
+	instanceID := uuid.NewRandom()
+	notFound := errors.New("not found")
+	instance := &bundle.ServiceInstance{
+		ID:         instanceID,
+		Spec:       &bundle.Spec{FQName: "dh-postgresql-apb"},
+		Context:    &bundle.Context{Namespace: "project"},
+		Parameters: &bundle.Parameters{planParameterKey: "dev"},
+	}
+	incomplete := &bundle.ServiceInstance{
+		ID:      instanceID,
+		Spec:    instance.Spec,
+		Context: instance.Context,
+	}
+
+	cases := []struct {
+		name            string
+		podName         string
+		instance        *bundle.ServiceInstance
+		expectedJob     string
+		expectedDeleted bool
+	}{
+		{
+			name:        "provision without pod is started again",
+			instance:    instance,
+			expectedJob: "provision",
+		},
+		{
+			name:        "provision with pod is reattached",
+			podName:     "bundle-1234",
+			instance:    instance,
+			expectedJob: "reattach provision to bundle-1234",
+		},
+		{
+			name:            "job of an incomplete instance is failed",
+			instance:        incomplete,
+			expectedDeleted: true,
+		},
+		{
+			name: "job of a missing instance is failed",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := new(mocks.Dao)
+			d.On("FindJobStateByState", bundle.StateInProgress).Return([]bundle.RecoverStatus{{
+				InstanceID: instanceID,
+				State:      bundle.JobState{Token: "token", State: bundle.StateInProgress, Method: bundle.JobMethodProvision, Podname: tc.podName},
+			}}, nil)
+			if tc.instance != nil {
+				d.On("GetServiceInstance", instanceID.String()).Return(tc.instance, nil)
+			} else {
+				d.On("GetServiceInstance", instanceID.String()).Return(nil, notFound)
+			}
+			d.On("IsNotFoundError", notFound).Return(true)
+			d.On("SetState", instanceID.String(), mock.Anything).Return("", nil)
+			d.On("DeleteServiceInstance", instanceID.String()).Return(nil)
+
+			factory := newRecoveryWorkFactory()
+			a, err := NewAnsibleBroker(d, []registries.Registry{}, *NewWorkEngine(20, 2*time.Minute, d), &config.Config{}, "new-space", factory)
+			ft.AssertNil(t, err)
+
+			_, err = a.Recover()
+			ft.AssertNil(t, err)
+
+			if tc.expectedJob == "" {
+				d.AssertCalled(t, "SetState", instanceID.String(), mock.MatchedBy(func(state bundle.JobState) bool {
+					return state.Token == "token" && state.State == bundle.StateFailed
+				}))
+				ft.AssertEqual(t, len(factory.jobs), 0)
+				if tc.expectedDeleted {
+					d.AssertCalled(t, "DeleteServiceInstance", instanceID.String())
+				} else {
+					d.AssertNotCalled(t, "DeleteServiceInstance", instanceID.String())
+				}
+				return
+			}
+			select {
+			case job := <-factory.jobs:
+				ft.AssertEqual(t, job, tc.expectedJob)
+			case <-time.After(time.Second):
+				t.Fatal("no job was started")
+			}
+			// the job is started again with the same token
+			d.AssertCalled(t, "SetState", instanceID.String(), bundle.JobState{
+				Token: "token", State: bundle.StateNotYetStarted, Method: bundle.JobMethodProvision})
+		})
+	}
+}
@@ -0,0 +1,210 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/automationbroker/config"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDeadLetterInterval    = 30 * time.Second
+	defaultDeadLetterMaxAttempts = 10
+)
+
+// DeadLetterDAO - defines the interface the dead letter queue uses to store
+// the undelivered messages.
+type DeadLetterDAO interface {
+	SetDeadLetter(*types.DeadLetter) error
+	GetDeadLetter(id string) (*types.DeadLetter, error)
+	BatchGetDeadLetters() ([]*types.DeadLetter, error)
+	DeleteDeadLetter(id string) error
+	IsNotFoundError(err error) bool
+}
+
+// DeadLetterSettings - how undelivered job messages are retried.
+type DeadLetterSettings struct {
+	// how often the store is checked for letters due for a retry
+	Interval time.Duration
+	// the attempts and backoff of the retries, the error classes are ignored
+	Retry RetryPolicy
+}
+
+// NewDeadLetterSettings - reads the dead_letters sub config of the broker
+// section.
+func NewDeadLetterSettings(c *config.Config) DeadLetterSettings {
+	m := c.GetSubConfig("dead_letters").ToMap()
+	settings := DeadLetterSettings{
+		Interval: defaultDeadLetterInterval,
+		Retry:    parseRetryPolicy(RetryPolicy{MaxAttempts: defaultDeadLetterMaxAttempts}, m),
+	}
+	if v, ok := toDuration(m["retry_interval"]); ok && v > 0 {
+		settings.Interval = v
+	}
+	return settings
+}
+
+// DeadLetterQueue - keeps the job messages a subscriber failed to handle,
+// or did not handle in time, in the dao and delivers them again with a
+// backoff. Letters that ran out of attempts are kept until they are replayed
+// by an admin.
+type DeadLetterQueue struct {
+	engine   *WorkEngine
+	dao      DeadLetterDAO
+	settings DeadLetterSettings
+	// letters being replayed, a letter is only delivered once at a time
+	mutex     sync.Mutex
+	replaying map[string]bool
+}
+
+// NewDeadLetterQueue - creates the dead letter queue of the engine.
+func NewDeadLetterQueue(engine *WorkEngine, dao DeadLetterDAO, settings DeadLetterSettings) *DeadLetterQueue {
+	q := &DeadLetterQueue{
+		engine:    engine,
+		dao:       dao,
+		settings:  settings,
+		replaying: map[string]bool{},
+	}
+	engine.deadLetters = q
+	return q
+}
+
+// Add - stores a message that could not be delivered to a subscriber.
+func (q *DeadLetterQueue) Add(subscriberID string, topic WorkTopic, msg JobMsg, cause error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("unable to encode job message %v for subscriber %v, it is lost - %v", msg.JobToken, subscriberID, err)
+		return
+	}
+	now := time.Now()
+	letter := &types.DeadLetter{
+		ID:           uuid.New(),
+		SubscriberID: subscriberID,
+		Topic:        string(topic),
+		JobToken:     msg.JobToken,
+		Payload:      payload,
+		Error:        cause.Error(),
+		Attempts:     1,
+		CreatedAt:    now,
+		NextAttempt:  now.Add(q.settings.Retry.Backoff(1)),
+	}
+	if err := q.dao.SetDeadLetter(letter); err != nil {
+		log.Errorf("unable to save dead letter for job %v and subscriber %v, it is lost - %v", msg.JobToken, subscriberID, err)
+		return
+	}
+	log.Warningf("job message %v for subscriber %v saved as dead letter %v", msg.JobToken, subscriberID, letter.ID)
+}
+
+// List - returns the dead letters, oldest first.
+func (q *DeadLetterQueue) List() ([]*types.DeadLetter, error) {
+	letters, err := q.dao.BatchGetDeadLetters()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].CreatedAt.Before(letters[j].CreatedAt)
+	})
+	return letters, nil
+}
+
+// Replay - delivers a dead letter to its subscriber again. The letter is
+// deleted once delivered, otherwise its next retry is pushed back.
+func (q *DeadLetterQueue) Replay(id string) error {
+	q.mutex.Lock()
+	if q.replaying[id] {
+		q.mutex.Unlock()
+		return fmt.Errorf("dead letter %v is already being replayed", id)
+	}
+	q.replaying[id] = true
+	q.mutex.Unlock()
+	defer func() {
+		q.mutex.Lock()
+		delete(q.replaying, id)
+		q.mutex.Unlock()
+	}()
+
+	letter, err := q.dao.GetDeadLetter(id)
+	if err != nil {
+		if q.dao.IsNotFoundError(err) {
+			return ErrorNotFound
+		}
+		return err
+	}
+	if err := q.deliver(letter); err != nil {
+		letter.Attempts++
+		letter.Error = err.Error()
+		letter.NextAttempt = time.Now().Add(q.settings.Retry.Backoff(letter.Attempts))
+		if setErr := q.dao.SetDeadLetter(letter); setErr != nil {
+			log.Errorf("unable to update dead letter %v - %v", id, setErr)
+		}
+		return err
+	}
+	log.Infof("dead letter %v delivered to subscriber %v", id, letter.SubscriberID)
+	return q.dao.DeleteDeadLetter(id)
+}
+
+func (q *DeadLetterQueue) deliver(letter *types.DeadLetter) error {
+	msg := JobMsg{}
+	if err := json.Unmarshal(letter.Payload, &msg); err != nil {
+		return fmt.Errorf("unable to decode job message - %v", err)
+	}
+	for _, sub := range q.engine.GetSubscribers(WorkTopic(letter.Topic)) {
+		if sub.ID() == letter.SubscriberID {
+			return q.engine.deliver(sub, msg)
+		}
+	}
+	return fmt.Errorf("subscriber %v is not attached to %v", letter.SubscriberID, letter.Topic)
+}
+
+// RetryDue - replays the letters due for a retry that have attempts left.
+func (q *DeadLetterQueue) RetryDue(now time.Time) {
+	letters, err := q.dao.BatchGetDeadLetters()
+	if err != nil {
+		log.Errorf("unable to get dead letters - %v", err)
+		return
+	}
+	for _, letter := range letters {
+		if letter.Attempts >= q.settings.Retry.MaxAttempts || letter.NextAttempt.After(now) {
+			continue
+		}
+		if err := q.Replay(letter.ID); err != nil {
+			log.Warningf("retry %d of dead letter %v failed - %v", letter.Attempts+1, letter.ID, err)
+		}
+	}
+}
+
+// Run - retries the dead letters every interval until stop is closed.
+func (q *DeadLetterQueue) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(q.settings.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			q.RetryDue(now)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,207 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/automationbroker/config"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// deliverySubscriber - a subscriber failing to deliver messages with err,
+// or, when cancelled is set, waiting for its delivery to be cancelled.
+type deliverySubscriber struct {
+	err       error
+	delivered chan JobMsg
+	cancelled chan struct{}
+}
+
+func (ds *deliverySubscriber) ID() string {
+	return "delivery"
+}
+
+func (ds *deliverySubscriber) Notify(msg JobMsg) {
+	ds.Deliver(context.Background(), msg)
+}
+
+func (ds *deliverySubscriber) Deliver(ctx context.Context, msg JobMsg) error {
+	if ds.cancelled != nil {
+		<-ctx.Done()
+		close(ds.cancelled)
+		return ctx.Err()
+	}
+	if ds.err != nil {
+		return ds.err
+	}
+	ds.delivered <- msg
+	return nil
+}
+
+func newDeadLetter(t *testing.T, id string, attempts int, nextAttempt time.Time) *types.DeadLetter {
+	payload, err := json.Marshal(JobMsg{JobToken: "token", State: bundle.JobState{State: bundle.StateSucceeded}})
+	assert.NoError(t, err)
+	return &types.DeadLetter{
+		ID:           id,
+		SubscriberID: "delivery",
+		Topic:        string(ProvisionTopic),
+		JobToken:     "token",
+		Payload:      payload,
+		Attempts:     attempts,
+		NextAttempt:  nextAttempt,
+	}
+}
+
+func TestNewDeadLetterSettings(t *testing.T) {
+	settings := NewDeadLetterSettings(config.NewConfigFromMap(map[string]interface{}{
+		"dead_letters": map[string]interface{}{
+			"retry_interval":  "1m",
+			"max_attempts":    3,
+			"initial_backoff": "5s",
+		},
+	}))
+	assert.Equal(t, DeadLetterSettings{
+		Interval: time.Minute,
+		Retry:    RetryPolicy{MaxAttempts: 3, InitialBackoff: 5 * time.Second},
+	}, settings)
+
+	assert.Equal(t, DeadLetterSettings{
+		Interval: defaultDeadLetterInterval,
+		Retry:    RetryPolicy{MaxAttempts: defaultDeadLetterMaxAttempts},
+	}, NewDeadLetterSettings(&config.Config{}))
+}
+
+func TestEngineSavesUndeliveredMessages(t *testing.T) {
+	letterDao := &dao.MockDao{}
+	letterDao.On("SetState", "id", mock.Anything).Return("", nil)
+	saved := make(chan *types.DeadLetter, 1)
+	letterDao.On("SetDeadLetter", mock.Anything).Run(func(args mock.Arguments) {
+		saved <- args.Get(0).(*types.DeadLetter)
+	}).Return(nil)
+
+	engine := NewWorkEngine(10, 1, letterDao)
+	NewDeadLetterQueue(engine, letterDao, DeadLetterSettings{Interval: time.Minute, Retry: RetryPolicy{MaxAttempts: 3}})
+	engine.AttachSubscriber(&deliverySubscriber{err: errors.New("datastore unavailable")}, ProvisionTopic)
+
+	work := &mockWork{funcToCall: func(msg chan<- JobMsg) {
+		msg <- JobMsg{JobToken: "token", State: bundle.JobState{State: bundle.StateSucceeded}}
+	}}
+	_, err := engine.StartNewAsyncJob("token", work, ProvisionTopic)
+	assert.NoError(t, err)
+
+	select {
+	case letter := <-saved:
+		assert.Equal(t, "delivery", letter.SubscriberID)
+		assert.Equal(t, string(ProvisionTopic), letter.Topic)
+		assert.Equal(t, "token", letter.JobToken)
+		assert.Equal(t, "datastore unavailable", letter.Error)
+		assert.Equal(t, 1, letter.Attempts)
+		msg := JobMsg{}
+		assert.NoError(t, json.Unmarshal(letter.Payload, &msg))
+		assert.Equal(t, bundle.StateSucceeded, msg.State.State)
+	case <-time.After(time.Second):
+		t.Fatal("undelivered message was not saved")
+	}
+}
+
+func TestDeliveryCancelledOnTimeout(t *testing.T) {
+	engine := NewWorkEngine(10, 1, &dao.MockDao{})
+	sub := &deliverySubscriber{cancelled: make(chan struct{})}
+
+	err := engine.deliver(sub, JobMsg{JobToken: "token"})
+	assert.Error(t, err)
+	select {
+	case <-sub.cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the delivery was not cancelled after the subscriber timeout")
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	letterDao := &dao.MockDao{}
+	letterDao.On("GetDeadLetter", "letter").Return(newDeadLetter(t, "letter", 1, time.Now()), nil)
+	letterDao.On("DeleteDeadLetter", "letter").Return(nil)
+
+	engine := NewWorkEngine(10, 1, letterDao)
+	q := NewDeadLetterQueue(engine, letterDao, DeadLetterSettings{Retry: RetryPolicy{MaxAttempts: 3}})
+	sub := &deliverySubscriber{delivered: make(chan JobMsg, 1)}
+	engine.AttachSubscriber(sub, ProvisionTopic)
+
+	assert.NoError(t, q.Replay("letter"))
+	msg := <-sub.delivered
+	assert.Equal(t, "token", msg.JobToken)
+	letterDao.AssertCalled(t, "DeleteDeadLetter", "letter")
+}
+
+func TestDeadLetterReplayFailure(t *testing.T) {
+	letterDao := &dao.MockDao{}
+	letterDao.On("GetDeadLetter", "letter").Return(newDeadLetter(t, "letter", 1, time.Now()), nil)
+	letterDao.On("SetDeadLetter", mock.Anything).Return(nil)
+
+	engine := NewWorkEngine(10, 1, letterDao)
+	q := NewDeadLetterQueue(engine, letterDao, DeadLetterSettings{
+		Retry: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Minute},
+	})
+	engine.AttachSubscriber(&deliverySubscriber{err: errors.New("still down")}, ProvisionTopic)
+
+	before := time.Now()
+	assert.EqualError(t, q.Replay("letter"), "still down")
+	letter := letterDao.Calls[len(letterDao.Calls)-1].Arguments.Get(0).(*types.DeadLetter)
+	assert.Equal(t, 2, letter.Attempts)
+	assert.Equal(t, "still down", letter.Error)
+	assert.True(t, letter.NextAttempt.After(before.Add(time.Minute)))
+	letterDao.AssertNotCalled(t, "DeleteDeadLetter", mock.Anything)
+}
+
+func TestDeadLetterReplayNotFound(t *testing.T) {
+	letterDao := &dao.MockDao{}
+	notFound := errors.New("not found")
+	letterDao.On("GetDeadLetter", "unknown").Return(nil, notFound)
+	letterDao.On("IsNotFoundError", notFound).Return(true)
+
+	q := NewDeadLetterQueue(NewWorkEngine(10, 1, letterDao), letterDao, DeadLetterSettings{})
+	assert.Equal(t, ErrorNotFound, q.Replay("unknown"))
+}
+
+func TestDeadLetterRetryDue(t *testing.T) {
+	now := time.Now()
+	letterDao := &dao.MockDao{}
+	letterDao.On("BatchGetDeadLetters").Return([]*types.DeadLetter{
+		newDeadLetter(t, "due", 1, now.Add(-time.Second)),
+		newDeadLetter(t, "later", 1, now.Add(time.Hour)),
+		newDeadLetter(t, "exhausted", 3, now.Add(-time.Second)),
+	}, nil)
+	letterDao.On("GetDeadLetter", "due").Return(newDeadLetter(t, "due", 1, now.Add(-time.Second)), nil)
+	letterDao.On("DeleteDeadLetter", "due").Return(nil)
+
+	engine := NewWorkEngine(10, 1, letterDao)
+	q := NewDeadLetterQueue(engine, letterDao, DeadLetterSettings{Retry: RetryPolicy{MaxAttempts: 3}})
+	engine.AttachSubscriber(&deliverySubscriber{delivered: make(chan JobMsg, 3)}, ProvisionTopic)
+
+	q.RetryDue(now)
+	letterDao.AssertCalled(t, "DeleteDeadLetter", "due")
+	letterDao.AssertNotCalled(t, "GetDeadLetter", "later")
+	letterDao.AssertNotCalled(t, "GetDeadLetter", "exhausted")
+}
@@ -0,0 +1,69 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Red Hat trademarks are not licensed under Apache License, Version 2.
+// No permission is granted to use or replicate Red Hat trademarks that
+// are incorporated in this software or its documentation.
+//
+
+package broker
+
+import (
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/encryption"
+)
+
+// instanceSecrets - the names of the parameters of the instance encrypted at
+// rest.
+func instanceSecrets(si *bundle.ServiceInstance) map[string]bool {
+	return encryption.SecretParameters(si.Spec, instancePlan(si))
+}
+
+// sealInstance - returns a copy of the service instance to store, with its
+// secret parameters encrypted.
+func (a AnsibleBroker) sealInstance(si *bundle.ServiceInstance) (*bundle.ServiceInstance, error) {
+	params, err := a.cipher.Seal(si.Parameters, instanceSecrets(si))
+	if err != nil {
+		return nil, err
+	}
+	sealed := *si
+	sealed.Parameters = params
+	return &sealed, nil
+}
+
+// sealBinding - returns a copy of the binding of the service instance to
+// store, with its secret parameters encrypted.
+func (a AnsibleBroker) sealBinding(bi *bundle.BindInstance, si *bundle.ServiceInstance) (*bundle.BindInstance, error) {
+	params, err := a.cipher.Seal(bi.Parameters, instanceSecrets(si))
+	if err != nil {
+		return nil, err
+	}
+	sealed := *bi
+	sealed.Parameters = params
+	return &sealed, nil
+}
+
+// openInstance - returns a copy of the stored service instance with its
+// parameters decrypted. Only the instances handed to an executor, or
+// compared with a request, are opened.
+func (a AnsibleBroker) openInstance(si *bundle.ServiceInstance) (*bundle.ServiceInstance, error) {
+	params, err := a.cipher.Open(si.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	opened := *si
+	opened.Parameters = params
+	return &opened, nil
+}
@@ -0,0 +1,130 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// Red Hat trademarks are not licensed under Apache License, Version 2.
+// No permission is granted to use or replicate Red Hat trademarks that
+// are incorporated in this software or its documentation.
+//
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/automationbroker/bundle-lib/registries"
+	"github.com/automationbroker/bundle-lib/runtime"
+	"github.com/automationbroker/config"
+	"github.com/openshift/ansible-service-broker/pkg/dao/mocks"
+	"github.com/openshift/ansible-service-broker/pkg/encryption"
+	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestCipher(t *testing.T) *encryption.Cipher {
+	keyring, err := encryption.NewKeyring("key1", map[string][]byte{"key1": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryption.NewCipher(keyring)
+}
+
+var secretSpec = &bundle.Spec{
+	ID:     "spec-postgresql",
+	FQName: "dh-postgresql-apb",
+	Plans: []bundle.Plan{{
+		Name:           "dev",
+		Parameters:     []bundle.ParameterDescriptor{{Name: "db_password", DisplayType: "password"}},
+		BindParameters: []bundle.ParameterDescriptor{{Name: "bind_token", DisplayType: "password"}},
+	}},
+}
+
+func TestSealAndOpenInstance(t *testing.T) {
+	a := AnsibleBroker{cipher: newTestCipher(t)}
+	si := &bundle.ServiceInstance{
+		ID:         uuid.NewRandom(),
+		Spec:       secretSpec,
+		Parameters: &bundle.Parameters{planParameterKey: "dev", "db_password": "s3cr3t", "db_name": "orders"},
+	}
+
+	stored, err := a.sealInstance(si)
+	ft.AssertNil(t, err)
+	ft.AssertEqual(t, (*si.Parameters)["db_password"], "s3cr3t")
+	ft.AssertEqual(t, (*stored.Parameters)["db_name"], "orders")
+	ft.AssertTrue(t, encryption.IsEncrypted((*stored.Parameters)["db_password"]))
+	data, _ := json.Marshal(stored)
+	ft.AssertFalse(t, bytes.Contains(data, []byte("s3cr3t")))
+
+	opened, err := a.openInstance(stored)
+	ft.AssertNil(t, err)
+	ft.AssertTrue(t, reflect.DeepEqual(opened.Parameters, si.Parameters))
+
+	// without a key the parameters are stored as they are
+	stored, err = AnsibleBroker{}.sealInstance(si)
+	ft.AssertNil(t, err)
+	ft.AssertTrue(t, reflect.DeepEqual(stored.Parameters, si.Parameters))
+}
+
+func TestRecoverDecryptsBindingParameters(t *testing.T) {
+	c := newTestCipher(t)
+	instanceID := uuid.NewRandom()
+	bindingID := uuid.NewRandom()
+	instance := &bundle.ServiceInstance{
+		ID:         instanceID,
+		Spec:       secretSpec,
+		Context:    &bundle.Context{Namespace: "project"},
+		Parameters: &bundle.Parameters{planParameterKey: "dev"},
+	}
+	params, err := c.Seal(&bundle.Parameters{
+		planParameterKey: "dev",
+		"bind_token":     "s3cr3t",
+	}, encryption.SecretParameters(secretSpec, "dev"))
+	ft.AssertNil(t, err)
+	bindInstance := &bundle.BindInstance{ID: bindingID, ServiceID: instanceID, Parameters: params}
+
+	rt := new(runtime.MockRuntime)
+	rt.On("GetExtractedCredential", mock.Anything, mock.Anything).Return(nil, bundle.ErrExtractedCredentialsNotFound)
+	runtime.Provider = rt
+
+	d := new(mocks.Dao)
+	d.On("FindJobStateByState", bundle.StateInProgress).Return([]bundle.RecoverStatus{{
+		InstanceID: bindingID,
+		State:      bundle.JobState{Token: "token", State: bundle.StateInProgress, Method: bundle.JobMethodBind},
+	}}, nil)
+	d.On("GetBindInstance", bindingID.String()).Return(bindInstance, nil)
+	d.On("GetServiceInstance", instanceID.String()).Return(instance, nil)
+	d.On("SetState", bindingID.String(), mock.Anything).Return("", nil)
+
+	factory := newRecoveryWorkFactory()
+	a, err := NewAnsibleBroker(d, []registries.Registry{}, *NewWorkEngine(20, 2*time.Minute, d), &config.Config{}, "new-space", factory)
+	ft.AssertNil(t, err)
+	a.cipher = c
+
+	_, err = a.Recover()
+	ft.AssertNil(t, err)
+	select {
+	case job := <-factory.jobs:
+		ft.AssertEqual(t, job, "bind")
+	case <-time.After(time.Second):
+		t.Fatal("no job was started")
+	}
+	ft.AssertEqual(t, (<-factory.params)["bind_token"], "s3cr3t")
+	ft.AssertTrue(t, encryption.IsEncrypted((*bindInstance.Parameters)["bind_token"]), "the stored binding is left encrypted")
+}
@@ -0,0 +1,154 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// The reasons of the events recorded for the jobs.
+const (
+	EventReasonJobStarted    = "JobStarted"
+	EventReasonJobInProgress = "JobInProgress"
+	EventReasonJobSucceeded  = "JobSucceeded"
+	EventReasonJobFailed     = "JobFailed"
+
+	eventComponent = "ansible-service-broker"
+)
+
+// EventSubscriber - records a Kubernetes Event in the namespace of the
+// service instance for every transition of a job, so that `oc get events`
+// shows what the broker is doing.
+type EventSubscriber struct {
+	events corev1.EventsGetter
+	mutex  sync.Mutex
+	// the last description recorded for the running jobs, by token
+	running map[string]string
+}
+
+// NewEventSubscriber - creates the subscriber, events are created through
+// the given client.
+func NewEventSubscriber(events corev1.EventsGetter) *EventSubscriber {
+	return &EventSubscriber{
+		events:  events,
+		running: map[string]string{},
+	}
+}
+
+// ID - the id of the subscriber.
+func (es *EventSubscriber) ID() string {
+	return "events"
+}
+
+// Notify - records an event for the job transition of the message.
+func (es *EventSubscriber) Notify(msg JobMsg) {
+	reason, ok := es.transition(msg)
+	if !ok {
+		return
+	}
+	if msg.Namespace == "" {
+		log.Debugf("job %v has no namespace, not recording an event", msg.JobToken)
+		return
+	}
+	if _, err := es.events.Events(msg.Namespace).Create(jobEvent(msg, reason, time.Now())); err != nil {
+		log.Errorf("unable to record %v event for job %v in %v - %v", reason, msg.JobToken, msg.Namespace, err)
+	}
+}
+
+// JobEnded - forgets the job, which may have ended without a terminal
+// message.
+func (es *EventSubscriber) JobEnded(token string) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	delete(es.running, token)
+}
+
+// transition - the reason of the event for the message, false if the job
+// has not changed since the last event.
+func (es *EventSubscriber) transition(msg JobMsg) (string, bool) {
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+	last, running := es.running[msg.JobToken]
+	switch msg.State.State {
+	case bundle.StateSucceeded:
+		delete(es.running, msg.JobToken)
+		return EventReasonJobSucceeded, true
+	case bundle.StateFailed:
+		delete(es.running, msg.JobToken)
+		return EventReasonJobFailed, true
+	case bundle.StateInProgress:
+		es.running[msg.JobToken] = msg.State.Description
+		if !running {
+			return EventReasonJobStarted, true
+		}
+		return EventReasonJobInProgress, last != msg.State.Description
+	}
+	return "", false
+}
+
+// jobEvent - the event of a job transition, attached to the service
+// instance.
+func jobEvent(msg JobMsg, reason string, now time.Time) *v1.Event {
+	eventType := v1.EventTypeNormal
+	if reason == EventReasonJobFailed {
+		eventType = v1.EventTypeWarning
+	}
+	message := fmt.Sprintf("%s job %s of %s", msg.State.Method, msg.JobToken, msg.SpecFQName)
+	if msg.PlanName != "" {
+		message = fmt.Sprintf("%s, plan %s", message, msg.PlanName)
+	}
+	if msg.BindingUUID != "" {
+		message = fmt.Sprintf("%s, binding %s", message, msg.BindingUUID)
+	}
+	if msg.State.Description != "" {
+		message = fmt.Sprintf("%s: %s", message, msg.State.Description)
+	}
+	if msg.State.Error != "" {
+		message = fmt.Sprintf("%s (error: %s)", message, msg.State.Error)
+	}
+	t := metav1.NewTime(now)
+	return &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", msg.InstanceUUID, now.UnixNano()),
+			Namespace: msg.Namespace,
+			Labels: map[string]string{
+				"job-token": msg.JobToken,
+			},
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:       "BundleInstance",
+			APIVersion: "automationbroker.io/v1alpha1",
+			Name:       msg.InstanceUUID,
+			Namespace:  msg.Namespace,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: eventComponent},
+		FirstTimestamp: t,
+		LastTimestamp:  t,
+		Count:          1,
+	}
+}
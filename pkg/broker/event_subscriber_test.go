@@ -0,0 +1,179 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"k8s.io/api/core/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// fakeEvents - records the events created through it, the other methods of
+// the clients are not implemented.
+type fakeEvents struct {
+	corev1.EventInterface
+	err     error
+	created []*v1.Event
+}
+
+func (f *fakeEvents) Events(namespace string) corev1.EventInterface {
+	return f
+}
+
+func (f *fakeEvents) Create(event *v1.Event) (*v1.Event, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.created = append(f.created, event)
+	return event, nil
+}
+
+func eventMsg(state bundle.State, description string) JobMsg {
+	return JobMsg{
+		InstanceUUID: "instance",
+		JobToken:     "token",
+		Namespace:    "project",
+		SpecFQName:   "dh-postgresql-apb",
+		PlanName:     "dev",
+		State: bundle.JobState{
+			State:       state,
+			Method:      bundle.JobMethodProvision,
+			Description: description,
+		},
+	}
+}
+
+func TestEventSubscriberTransitions(t *testing.T) {
+	events := &fakeEvents{}
+	es := NewEventSubscriber(events)
+
+	es.Notify(eventMsg(bundle.StateInProgress, ""))
+	es.Notify(eventMsg(bundle.StateInProgress, "action started"))
+	es.Notify(eventMsg(bundle.StateInProgress, "action started"))
+	failed := eventMsg(bundle.StateFailed, "Error occurred during provision.")
+	failed.State.Error = "playbook failed"
+	es.Notify(failed)
+
+	reasons := []string{}
+	for _, e := range events.created {
+		reasons = append(reasons, e.Reason)
+		assert.Equal(t, "project", e.Namespace)
+		assert.Equal(t, "project", e.InvolvedObject.Namespace)
+		assert.Equal(t, "instance", e.InvolvedObject.Name)
+		assert.Equal(t, "token", e.Labels["job-token"])
+	}
+	assert.Equal(t, []string{EventReasonJobStarted, EventReasonJobInProgress, EventReasonJobFailed}, reasons)
+
+	last := events.created[2]
+	assert.Equal(t, v1.EventTypeWarning, last.Type)
+	assert.Equal(t,
+		"provision job token of dh-postgresql-apb, plan dev: Error occurred during provision. (error: playbook failed)",
+		last.Message)
+	assert.Equal(t, 0, len(es.running), "finished jobs are forgotten")
+}
+
+func TestEventSubscriberSucceeded(t *testing.T) {
+	events := &fakeEvents{}
+	es := NewEventSubscriber(events)
+
+	es.Notify(eventMsg(bundle.StateInProgress, ""))
+	es.Notify(eventMsg(bundle.StateSucceeded, "action finished"))
+
+	assert.Equal(t, 2, len(events.created))
+	assert.Equal(t, EventReasonJobSucceeded, events.created[1].Reason)
+	assert.Equal(t, v1.EventTypeNormal, events.created[1].Type)
+	assert.True(t, strings.HasPrefix(events.created[1].Name, "instance."))
+}
+
+func TestEventSubscriberSkipsJobsWithoutNamespace(t *testing.T) {
+	events := &fakeEvents{}
+	es := NewEventSubscriber(events)
+
+	msg := eventMsg(bundle.StateSucceeded, "")
+	msg.Namespace = ""
+	es.Notify(msg)
+	assert.Equal(t, 0, len(events.created))
+
+	// errors are logged, the job is not affected
+	events.err = errors.New("forbidden")
+	es.Notify(eventMsg(bundle.StateInProgress, ""))
+	assert.Equal(t, 0, len(events.created))
+}
+
+func TestEventSubscriberForgetsCancelledJobs(t *testing.T) {
+	events := &fakeEvents{}
+	es := NewEventSubscriber(events)
+
+	es.Notify(eventMsg(bundle.StateInProgress, "action started"))
+	// the failure of a cancelled job is reported without its namespace
+	cancelled := eventMsg(bundle.StateFailed, "cancelled by admin")
+	cancelled.Namespace = ""
+	es.Notify(cancelled)
+	assert.Equal(t, 1, len(events.created))
+	assert.Equal(t, 0, len(es.running), "cancelled jobs are forgotten")
+}
+
+func TestEventSubscriberForgetsEndedJobs(t *testing.T) {
+	engineDao := &dao.MockDao{}
+	engineDao.On("SetState", mock.Anything, mock.Anything).Return("", nil)
+	engine := NewWorkEngine(10, 1, engineDao)
+	es := NewEventSubscriber(&fakeEvents{})
+	engine.AttachSubscriber(es, ProvisionTopic)
+
+	// the job ends without a terminal message
+	work := &mockWork{funcToCall: func(msg chan<- JobMsg) {
+		msg <- eventMsg(bundle.StateInProgress, "action started")
+	}}
+	msgs, stop := engine.WatchJob("token")
+	defer stop()
+	_, err := engine.StartNewAsyncJob("token", work, ProvisionTopic)
+	assert.NoError(t, err)
+	// the message is published once the subscribers handled it
+	msg, _ := receiveMsg(t, msgs)
+	assert.Equal(t, bundle.StateInProgress, msg.State.State)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		es.mutex.Lock()
+		n := len(es.running)
+		es.mutex.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the job was not forgotten once it ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobEventForBinding(t *testing.T) {
+	msg := eventMsg(bundle.StateSucceeded, "")
+	msg.BindingUUID = "binding"
+	msg.State.Method = bundle.JobMethodBind
+	event := jobEvent(msg, EventReasonJobSucceeded, time.Unix(0, 0))
+	assert.Equal(t, "bind job token of dh-postgresql-apb, plan dev, binding binding", event.Message)
+	assert.Equal(t, "instance.0", event.Name)
+}
@@ -0,0 +1,149 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/automationbroker/bundle-lib/clients"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	// ErrorJobCancelled - the error recorded for a job cancelled by a user.
+	ErrorJobCancelled = errors.New("job cancelled")
+	// ErrorJobTimeout - the error recorded for a job that ran past its
+	// deadline.
+	ErrorJobTimeout = errors.New("job deadline exceeded")
+)
+
+// jobCancellation - records why the engine cancelled the context of a job.
+type jobCancellation struct {
+	mutex  sync.Mutex
+	reason string
+	err    error
+	cancel context.CancelFunc
+}
+
+type jobCancellationKey struct{}
+
+// newJobContext - creates the context a job runs with. The returned
+// jobCancellation is used by the engine to cancel the job with a reason.
+func newJobContext() (context.Context, *jobCancellation) {
+	c := &jobCancellation{}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	return context.WithValue(ctx, jobCancellationKey{}, c), c
+}
+
+func jobCancellationFrom(ctx context.Context) (*jobCancellation, bool) {
+	c, ok := ctx.Value(jobCancellationKey{}).(*jobCancellation)
+	return c, ok
+}
+
+// cancelWith - cancels the job, the first reason given is kept.
+func (c *jobCancellation) cancelWith(err error, reason string) {
+	c.mutex.Lock()
+	if c.reason == "" {
+		c.reason = reason
+		c.err = err
+	}
+	c.mutex.Unlock()
+	c.cancel()
+}
+
+// CancelReason - returns a human readable reason for a job's context being
+// done, to be used as the description of the failed JobState.
+func CancelReason(ctx context.Context) string {
+	if c, ok := jobCancellationFrom(ctx); ok {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.reason != "" {
+			return c.reason
+		}
+	}
+	if ctx.Err() == nil {
+		return ""
+	}
+	return fmt.Sprintf("job stopped: %v", ctx.Err())
+}
+
+// CancelError - returns the error to record in the failed JobState of a job
+// whose context is done.
+func CancelError(ctx context.Context) error {
+	if c, ok := jobCancellationFrom(ctx); ok {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.err != nil {
+			return c.err
+		}
+	}
+	return ctx.Err()
+}
+
+// cancelledBy - the reason recorded when a user cancels a job.
+func cancelledBy(user string) string {
+	if user == "" {
+		user = "unknown user"
+	}
+	return fmt.Sprintf("cancelled by %s", user)
+}
+
+// stopFn - stops the sandbox pod of a running job.
+type stopFn func(podName string) error
+
+// deleteBundlePod - deletes the bundle pod, which makes the executor give up
+// watching it and clean up the sandbox.
+func deleteBundlePod(podName string) error {
+	k8scli, err := clients.Kubernetes()
+	if err != nil {
+		return err
+	}
+	pods, err := findBundlePods(podName)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		log.Infof("deleting bundle pod %s/%s", pod.Namespace, pod.Name)
+		err := k8scli.Client.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findBundlePods - looks up a bundle pod by its bundle-pod-name label since
+// the sandbox namespace is not exposed by the executor.
+func findBundlePods(podName string) ([]v1.Pod, error) {
+	k8scli, err := clients.Kubernetes()
+	if err != nil {
+		return nil, err
+	}
+	selector := fmt.Sprintf("bundle-pod-name=%s", podName)
+	pods, err := k8scli.Client.CoreV1().Pods(metav1.NamespaceAll).List(
+		metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
@@ -0,0 +1,82 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/automationbroker/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// jobDeadlinesAlphaKey - the spec alpha key overriding the job deadlines.
+const jobDeadlinesAlphaKey = "job_deadlines"
+
+// JobDeadlines - how long a job of each JobMethod may run before the
+// WorkEngine stops it. Methods without a deadline run until they finish.
+type JobDeadlines map[bundle.JobMethod]time.Duration
+
+// deadlineWork - work overriding the deadline of its method.
+type deadlineWork interface {
+	Deadline() time.Duration
+}
+
+// NewJobDeadlines - reads the deadlines from the job_deadlines sub config of
+// the broker section, keyed by job method.
+func NewJobDeadlines(c *config.Config) JobDeadlines {
+	deadlines := JobDeadlines{}
+	for method, value := range c.GetSubConfig(jobDeadlinesAlphaKey).ToMap() {
+		d, ok := toDuration(value)
+		if !ok || d < 0 {
+			log.Warningf("ignoring job deadline %v for %v, expected a duration", value, method)
+			continue
+		}
+		deadlines[bundle.JobMethod(method)] = d
+	}
+	return deadlines
+}
+
+// specDeadline - the deadline of a job method set in the job_deadlines alpha
+// field of the spec, zero if there is none.
+func specDeadline(method bundle.JobMethod, spec *bundle.Spec) time.Duration {
+	if spec == nil {
+		return 0
+	}
+	override, ok := spec.Alpha[jobDeadlinesAlphaKey]
+	if !ok {
+		return 0
+	}
+	m, ok := toStringMap(override)
+	if !ok {
+		log.Warningf("ignoring %s alpha field of spec %v, expected a map", jobDeadlinesAlphaKey, spec.FQName)
+		return 0
+	}
+	d, ok := toDuration(m[string(method)])
+	if !ok || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// deadlineFor - the deadline of the work, zero if it may run forever.
+func (engine *WorkEngine) deadlineFor(work Work) time.Duration {
+	if dw, ok := work.(deadlineWork); ok && dw.Deadline() > 0 {
+		return dw.Deadline()
+	}
+	return engine.deadlines[work.Method()]
+}
@@ -0,0 +1,64 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/automationbroker/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewJobDeadlines(t *testing.T) {
+	c := config.NewConfigFromMap(map[string]interface{}{
+		"job_deadlines": map[string]interface{}{
+			"provision": "1h",
+			"bind":      300,
+			"update":    "soon",
+		},
+	})
+	deadlines := NewJobDeadlines(c)
+
+	assert.Equal(t, JobDeadlines{
+		bundle.JobMethodProvision: time.Hour,
+		bundle.JobMethodBind:      5 * time.Minute,
+	}, deadlines)
+	assert.Equal(t, 0, len(NewJobDeadlines(&config.Config{})))
+}
+
+func TestSpecDeadline(t *testing.T) {
+	spec := &bundle.Spec{Alpha: map[string]interface{}{
+		"job_deadlines": map[interface{}]interface{}{"provision": "30m", "bind": float64(60)},
+	}}
+	assert.Equal(t, 30*time.Minute, specDeadline(bundle.JobMethodProvision, spec))
+	assert.Equal(t, time.Minute, specDeadline(bundle.JobMethodBind, spec))
+	assert.Equal(t, time.Duration(0), specDeadline(bundle.JobMethodUpdate, spec))
+	assert.Equal(t, time.Duration(0), specDeadline(bundle.JobMethodProvision, &bundle.Spec{}))
+	assert.Equal(t, time.Duration(0), specDeadline(bundle.JobMethodProvision, nil))
+}
+
+func TestDeadlineFor(t *testing.T) {
+	engine := NewWorkEngine(10, 1, nil)
+	engine.SetJobDeadlines(JobDeadlines{bundle.JobMethodBind: time.Hour})
+
+	assert.Equal(t, time.Hour, engine.deadlineFor(&mockWork{}))
+	assert.Equal(t, time.Minute, engine.deadlineFor(&apbJob{method: bundle.JobMethodBind, deadline: time.Minute}))
+	assert.Equal(t, time.Hour, engine.deadlineFor(&apbJob{method: bundle.JobMethodBind}))
+	assert.Equal(t, time.Duration(0), engine.deadlineFor(&apbJob{method: bundle.JobMethodProvision}))
+}
@@ -0,0 +1,282 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/automationbroker/config"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"github.com/openshift/ansible-service-broker/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+)
+
+// defaultReconcileInterval - how often the jobs in progress are reconciled
+// when recovery is enabled and the broker does not configure it.
+const defaultReconcileInterval = 5 * time.Minute
+
+// reconcilePageSize - how many jobs in progress are read from the dao at once.
+const reconcilePageSize = 100
+
+// The actions of the reconciler, used as the label of its metric.
+const (
+	reconcileResumed    = "resumed"
+	reconcileReattached = "reattached"
+	reconcileFinalized  = "finalized"
+	reconcileFailed     = "failed"
+	reconcileStopped    = "stopped"
+)
+
+// ErrorBundlePodGone - the error recorded for a job whose bundle pod, or the
+// sandbox namespace of the pod, no longer exists.
+var ErrorBundlePodGone = errors.New("bundle pod no longer exists")
+
+// podPhaseFn - returns the phase of a bundle pod, and false if the pod no
+// longer exists.
+type podPhaseFn func(podName string) (v1.PodPhase, bool, error)
+
+// JobReconcileInterval - reads how often the jobs in progress are reconciled
+// from the reconcile_interval field of the broker section. Zero disables the
+// reconciler. Like the recovery, which it complements, the reconciler is
+// disabled unless recovery is enabled or reconcile_interval is set.
+func JobReconcileInterval(c *config.Config) time.Duration {
+	fallback := time.Duration(0)
+	if c.GetBool("recovery") {
+		fallback = defaultReconcileInterval
+	}
+	v, ok := c.ToMap()["reconcile_interval"]
+	if !ok {
+		return fallback
+	}
+	interval, ok := toDuration(v)
+	if !ok || interval < 0 {
+		log.Warningf("ignoring invalid reconcile_interval %v, using %v", v, fallback)
+		return fallback
+	}
+	return interval
+}
+
+// JobReconciler - periodically compares the jobs in progress in the dao with
+// the jobs of the engine and the bundle pods of the cluster. A job the engine
+// lost track of is resumed when its pod is running or was never created,
+// finalized when its pod has completed and failed when its pod is gone. A
+// running job whose pod is gone is stopped. Jobs are only acted on when they
+// are found in the same situation on two passes in a row, so that jobs
+// changing state while a pass runs are left alone.
+type JobReconciler struct {
+	broker   *AnsibleBroker
+	interval time.Duration
+	podPhase podPhaseFn
+	// the tokens of the jobs found orphaned or stuck on the previous pass
+	suspects map[string]bool
+}
+
+// NewJobReconciler - creates the reconciler of the jobs of the broker.
+func NewJobReconciler(broker *AnsibleBroker, interval time.Duration) *JobReconciler {
+	return &JobReconciler{
+		broker:   broker,
+		interval: interval,
+		podPhase: bundlePodPhase,
+		suspects: map[string]bool{},
+	}
+}
+
+// Run - reconciles the jobs in progress every interval until stopped.
+func (r *JobReconciler) Run(stop <-chan struct{}) {
+	log.Infof("reconciling jobs in progress every %v", r.interval)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.ReconcileOnce(); err != nil {
+				log.Errorf("unable to reconcile jobs in progress - %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ReconcileOnce - compares every job in progress with the engine and its
+// bundle pod.
+func (r *JobReconciler) ReconcileOnce() error {
+	statuses, err := types.AllJobStates(r.broker.dao,
+		types.JobStateFilter{State: bundle.StateInProgress}, reconcilePageSize)
+	if err != nil {
+		return err
+	}
+	suspects := map[string]bool{}
+	for _, rs := range statuses {
+		token := rs.State.Token
+		suspect, err := r.isSuspect(rs)
+		if err != nil {
+			log.Warningf("unable to reconcile %s job %s - %v", rs.State.Method, token, err)
+			continue
+		}
+		if !suspect {
+			continue
+		}
+		if !r.suspects[token] {
+			// the job may have moved on since its state was read
+			suspects[token] = true
+			continue
+		}
+		if err := r.reconcile(rs); err != nil {
+			log.Errorf("unable to reconcile %s job %s - %v", rs.State.Method, token, err)
+			suspects[token] = true
+		}
+	}
+	r.suspects = suspects
+	return nil
+}
+
+// isSuspect - true if the job is not known to the engine, or if it is running
+// but its bundle pod is gone.
+func (r *JobReconciler) isSuspect(rs bundle.RecoverStatus) (bool, error) {
+	if !r.broker.engine.IsJobActive(rs.State.Token) {
+		return true, nil
+	}
+	if rs.State.Podname == "" {
+		return false, nil
+	}
+	_, found, err := r.podPhase(rs.State.Podname)
+	return !found, err
+}
+
+func (r *JobReconciler) reconcile(rs bundle.RecoverStatus) error {
+	state := rs.State
+	if r.broker.engine.IsJobActive(state.Token) {
+		log.Warningf("bundle pod %s of running %s job %s is gone, stopping the job", state.Podname, state.Method, state.Token)
+		err := r.broker.engine.stopJob(state.Token, ErrorBundlePodGone,
+			fmt.Sprintf("bundle pod %s no longer exists", state.Podname))
+		if err == ErrorNotFound {
+			// finished in the meantime
+			return nil
+		}
+		if err == nil {
+			metrics.JobReconciled(reconcileStopped)
+		}
+		return err
+	}
+
+	action := reconcileResumed
+	if state.Podname != "" {
+		phase, found, err := r.podPhase(state.Podname)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !found:
+			return r.fail(rs, fmt.Sprintf("bundle pod %s no longer exists", state.Podname))
+		case phase == v1.PodSucceeded || phase == v1.PodFailed:
+			action = reconcileFinalized
+		case phase == v1.PodUnknown:
+			return fmt.Errorf("bundle pod %s is in an unknown state", state.Podname)
+		default:
+			action = reconcileReattached
+		}
+	}
+
+	job, topic, instanceID, err := r.broker.recoveryJob(rs)
+	if e, ok := err.(unrecoverableJobError); ok {
+		return r.fail(rs, e.reason)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("%s job %s was not running in the engine, %s it", state.Method, state.Token, action)
+	if _, _, err := r.broker.operations.StartAsync(instanceID, "", state.Token, job, topic); err != nil {
+		return err
+	}
+	metrics.JobReconciled(action)
+	return nil
+}
+
+// fail - reports the job as failed through the engine, so the subscribers of
+// its topic learn about it.
+func (r *JobReconciler) fail(rs bundle.RecoverStatus, reason string) error {
+	log.Warningf("unable to resume %s job %s - %s, marking job as failed", rs.State.Method, rs.State.Token, reason)
+	topic, ok := methodTopics[rs.State.Method]
+	if !ok {
+		_, err := r.broker.dao.SetState(rs.InstanceID.String(), failedJobState(rs.State, reason))
+		return err
+	}
+	job := &failedJob{id: rs.InstanceID.String(), state: failedJobState(rs.State, reason)}
+	if _, err := r.broker.engine.StartNewAsyncJob(rs.State.Token, job, topic); err != nil {
+		return err
+	}
+	metrics.JobReconciled(reconcileFailed)
+	return nil
+}
+
+func failedJobState(state bundle.JobState, reason string) bundle.JobState {
+	return bundle.JobState{
+		Token:       state.Token,
+		State:       bundle.StateFailed,
+		Method:      state.Method,
+		Podname:     state.Podname,
+		Error:       reason,
+		Description: fmt.Sprintf("unable to resume the job: %s", reason),
+	}
+}
+
+// failedJob - reports the failure of a job that can not be resumed. The id is
+// the binding id of bind and unbind jobs.
+type failedJob struct {
+	id    string
+	state bundle.JobState
+}
+
+func (j *failedJob) ID() string {
+	return j.id
+}
+
+func (j *failedJob) Method() bundle.JobMethod {
+	return j.state.Method
+}
+
+func (j *failedJob) Run(ctx context.Context, token string, msgBuffer chan<- JobMsg) {
+	msg := JobMsg{
+		JobToken: token,
+		PodName:  j.state.Podname,
+		State:    j.state,
+	}
+	if isBinding(msg) {
+		msg.BindingUUID = j.id
+	} else {
+		msg.InstanceUUID = j.id
+	}
+	msgBuffer <- msg
+}
+
+// bundlePodPhase - looks up the phase of a bundle pod.
+func bundlePodPhase(podName string) (v1.PodPhase, bool, error) {
+	pods, err := findBundlePods(podName)
+	if err != nil {
+		return "", false, err
+	}
+	if len(pods) == 0 {
+		return "", false, nil
+	}
+	return pods[0].Status.Phase, true, nil
+}
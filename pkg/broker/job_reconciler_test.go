@@ -0,0 +1,245 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/automationbroker/bundle-lib/registries"
+	"github.com/automationbroker/config"
+	"github.com/openshift/ansible-service-broker/pkg/dao/mocks"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/mock"
+	"k8s.io/api/core/v1"
+)
+
+// the jobs in progress the reconciler lists, all on the first page
+var (
+	inProgress = types.JobStateFilter{State: bundle.StateInProgress}
+	firstPage  = types.Page{Limit: reconcilePageSize}
+)
+
+func TestJobReconcileInterval(t *testing.T) {
+	ft.AssertEqual(t, JobReconcileInterval(&config.Config{}), time.Duration(0))
+	ft.AssertEqual(t, JobReconcileInterval(config.NewConfigFromMap(map[string]interface{}{
+		"recovery": true,
+	})), defaultReconcileInterval)
+	ft.AssertEqual(t, JobReconcileInterval(config.NewConfigFromMap(map[string]interface{}{
+		"recovery":           true,
+		"reconcile_interval": "often",
+	})), defaultReconcileInterval)
+	ft.AssertEqual(t, JobReconcileInterval(config.NewConfigFromMap(map[string]interface{}{
+		"reconcile_interval": "-1m",
+	})), time.Duration(0))
+	ft.AssertEqual(t, JobReconcileInterval(config.NewConfigFromMap(map[string]interface{}{
+		"reconcile_interval": "1m",
+	})), time.Minute)
+	ft.AssertEqual(t, JobReconcileInterval(config.NewConfigFromMap(map[string]interface{}{
+		"reconcile_interval": 0,
+	})), time.Duration(0))
+}
+
+func TestJobReconcilerOrphanedJobs(t *testing.T) {
+	instanceID := uuid.NewRandom()
+	instance := &bundle.ServiceInstance{
+		ID:         instanceID,
+		Spec:       &bundle.Spec{FQName: "dh-postgresql-apb"},
+		Context:    &bundle.Context{Namespace: "project"},
+		Parameters: &bundle.Parameters{planParameterKey: "dev"},
+	}
+
+	cases := []struct {
+		name          string
+		podName       string
+		phase         v1.PodPhase
+		podGone       bool
+		expectedJob   string
+		expectedError string
+	}{
+		{
+			name:        "job without pod is started again",
+			expectedJob: "provision",
+		},
+		{
+			name:        "job with running pod is reattached",
+			podName:     "bundle-1234",
+			phase:       v1.PodRunning,
+			expectedJob: "reattach provision to bundle-1234",
+		},
+		{
+			name:        "job with completed pod is finalized",
+			podName:     "bundle-1234",
+			phase:       v1.PodSucceeded,
+			expectedJob: "reattach provision to bundle-1234",
+		},
+		{
+			name:          "job with deleted pod is failed",
+			podName:       "bundle-1234",
+			podGone:       true,
+			expectedError: "bundle pod bundle-1234 no longer exists",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := new(mocks.Dao)
+			d.On("ListJobStates", inProgress, firstPage).Return(types.JobStatePage{JobStates: []bundle.RecoverStatus{{
+				InstanceID: instanceID,
+				State: bundle.JobState{
+					Token:   "token",
+					State:   bundle.StateInProgress,
+					Method:  bundle.JobMethodProvision,
+					Podname: tc.podName,
+				},
+			}}}, nil)
+			d.On("GetServiceInstance", instanceID.String()).Return(instance, nil)
+			d.On("SetState", instanceID.String(), mock.Anything).Return("", nil)
+
+			factory := newRecoveryWorkFactory()
+			a, err := NewAnsibleBroker(d, []registries.Registry{}, *NewWorkEngine(20, 2*time.Minute, d), &config.Config{}, "new-space", factory)
+			ft.AssertNil(t, err)
+			received := make(chan JobMsg, 1)
+			a.engine.AttachSubscriber(&mockSubscriber{
+				funcToCall: func(msg JobMsg) {
+					received <- msg
+				},
+			}, ProvisionTopic)
+
+			r := NewJobReconciler(a, time.Minute)
+			r.podPhase = func(podName string) (v1.PodPhase, bool, error) {
+				ft.AssertEqual(t, podName, tc.podName)
+				return tc.phase, !tc.podGone, nil
+			}
+
+			// the job is only acted on once it is found orphaned twice
+			ft.AssertNil(t, r.ReconcileOnce())
+			ft.AssertEqual(t, len(factory.jobs), 0)
+			ft.AssertEqual(t, len(received), 0)
+			ft.AssertNil(t, r.ReconcileOnce())
+
+			select {
+			case msg := <-received:
+				ft.AssertEqual(t, msg.JobToken, "token")
+				if tc.expectedError != "" {
+					ft.AssertEqual(t, msg.State.State, bundle.StateFailed)
+					ft.AssertEqual(t, msg.InstanceUUID, instanceID.String())
+					ft.AssertEqual(t, msg.State.Error, tc.expectedError)
+					ft.AssertEqual(t, len(factory.jobs), 0)
+					return
+				}
+				ft.AssertEqual(t, msg.State.State, bundle.StateSucceeded)
+			case <-time.After(time.Second):
+				t.Fatal("the job was not reconciled")
+			}
+			ft.AssertEqual(t, <-factory.jobs, tc.expectedJob)
+		})
+	}
+}
+
+func TestJobReconcilerStopsJobsWithoutPod(t *testing.T) {
+	instanceID := uuid.NewRandom()
+	d := new(mocks.Dao)
+	d.On("ListJobStates", inProgress, firstPage).Return(types.JobStatePage{JobStates: []bundle.RecoverStatus{{
+		InstanceID: instanceID,
+		State: bundle.JobState{
+			Token:   "token",
+			State:   bundle.StateInProgress,
+			Method:  bundle.JobMethodUpdate,
+			Podname: "bundle-1234",
+		},
+	}}}, nil)
+	d.On("SetState", mock.Anything, mock.Anything).Return("", nil)
+
+	a, err := NewAnsibleBroker(d, []registries.Registry{}, *NewWorkEngine(20, 2*time.Minute, d), &config.Config{}, "new-space", newRecoveryWorkFactory())
+	ft.AssertNil(t, err)
+	received := make(chan JobMsg, 1)
+	a.engine.AttachSubscriber(&mockSubscriber{
+		funcToCall: func(msg JobMsg) {
+			received <- msg
+		},
+	}, UpdateTopic)
+	work := newQueueWork(instanceID.String())
+	_, err = a.engine.StartNewAsyncJob("token", work, UpdateTopic)
+	ft.AssertNil(t, err)
+	waitForStart(t, work)
+
+	r := NewJobReconciler(a, time.Minute)
+	podFound := true
+	r.podPhase = func(podName string) (v1.PodPhase, bool, error) {
+		return v1.PodRunning, podFound, nil
+	}
+
+	// a running job with its pod is left alone
+	ft.AssertNil(t, r.ReconcileOnce())
+	ft.AssertNil(t, r.ReconcileOnce())
+	ft.AssertTrue(t, a.engine.IsJobActive("token"))
+
+	podFound = false
+	ft.AssertNil(t, r.ReconcileOnce())
+	ft.AssertTrue(t, a.engine.IsJobActive("token"))
+	ft.AssertNil(t, r.ReconcileOnce())
+	select {
+	case msg := <-received:
+		ft.AssertEqual(t, msg.State.State, bundle.StateFailed)
+	case <-time.After(time.Second):
+		t.Fatal("the job was not stopped")
+	}
+}
+
+func TestJobReconcilerLookupErrors(t *testing.T) {
+	instanceID := uuid.NewRandom()
+	d := new(mocks.Dao)
+	d.On("ListJobStates", inProgress, firstPage).Return(types.JobStatePage{JobStates: []bundle.RecoverStatus{{
+		InstanceID: instanceID,
+		State:      bundle.JobState{Token: "token", State: bundle.StateInProgress, Method: bundle.JobMethodProvision, Podname: "bundle-1234"},
+	}}}, nil)
+
+	factory := newRecoveryWorkFactory()
+	a, err := NewAnsibleBroker(d, []registries.Registry{}, *NewWorkEngine(20, 2*time.Minute, d), &config.Config{}, "new-space", factory)
+	ft.AssertNil(t, err)
+	r := NewJobReconciler(a, time.Minute)
+	r.podPhase = func(podName string) (v1.PodPhase, bool, error) {
+		return "", false, errors.New("forbidden")
+	}
+
+	// jobs are left alone when their pod can not be looked up
+	ft.AssertNil(t, r.ReconcileOnce())
+	ft.AssertNil(t, r.ReconcileOnce())
+	ft.AssertNil(t, r.ReconcileOnce())
+	ft.AssertEqual(t, len(factory.jobs), 0)
+	d.AssertNotCalled(t, "SetState", mock.Anything, mock.Anything)
+}
+
+func TestJobReconcilerReadsEveryPage(t *testing.T) {
+	d := new(mocks.Dao)
+	d.On("ListJobStates", inProgress, firstPage).Return(types.JobStatePage{Next: "next"}, nil)
+	d.On("ListJobStates", inProgress, types.Page{Cursor: "next", Limit: reconcilePageSize}).
+		Return(types.JobStatePage{}, nil).Once()
+	d.On("ListJobStates", inProgress, types.Page{Cursor: "next", Limit: reconcilePageSize}).
+		Return(types.JobStatePage{}, errors.New("unavailable"))
+
+	a, err := NewAnsibleBroker(d, []registries.Registry{}, *NewWorkEngine(20, 2*time.Minute, d), &config.Config{}, "new-space", newRecoveryWorkFactory())
+	ft.AssertNil(t, err)
+	r := NewJobReconciler(a, time.Minute)
+	ft.AssertNil(t, r.ReconcileOnce())
+	ft.AssertNotNil(t, r.ReconcileOnce())
+	d.AssertNumberOfCalls(t, "ListJobStates", 4)
+}
@@ -1,13 +1,19 @@
 package broker
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"github.com/automationbroker/bundle-lib/bundle"
 	"github.com/automationbroker/bundle-lib/runtime"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
 	log "github.com/sirupsen/logrus"
 )
 
+// errJobFinished - a message changes the state of a job that already finished.
+var errJobFinished = errors.New("job already finished")
+
 // JobStateSubscriber is responsible for handling and persisting JobState changes
 type JobStateSubscriber struct {
 	dao SubscriberDAO
@@ -31,6 +37,15 @@ func (jss *JobStateSubscriber) ID() string {
 
 // Notify external API to notify this subscriber of a change in the Job
 func (jss *JobStateSubscriber) Notify(msg JobMsg) {
+	if err := jss.Deliver(context.Background(), msg); err != nil {
+		log.Errorf("Error JobStateSubscriber failed to handle job %v : %v", msg.JobToken, err)
+	}
+}
+
+// Deliver persists the change in the Job, returning an error if it could not
+// be saved. Nothing is saved once ctx is done, the message is delivered again
+// from the dead letters.
+func (jss *JobStateSubscriber) Deliver(ctx context.Context, msg JobMsg) error {
 	log.Debugf("JobStateSubscriber Notify : msg state %v ", msg.State)
 	id := msg.InstanceUUID
 	if isBinding(msg) {
@@ -56,33 +71,45 @@ func (jss *JobStateSubscriber) Notify(msg JobMsg) {
 		}
 	}
 
-	if _, err := jss.dao.SetState(id, msg.State); err != nil {
-		log.Errorf("Error JobStateSubscriber failed to set state after action %v completed with state %s err: %v", msg.State.Method, msg.State.State, err)
-		return
+	// The job state is read before it is replaced so that a late message,
+	// e.g. a progress update delivered again, does not undo the end of a job.
+	err := types.UpdateState(jss.dao, id, msg.State.Token, func(state *bundle.JobState) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if isTerminalState(state.State) && state.State != msg.State.State {
+			return errJobFinished
+		}
+		*state = msg.State
+		return nil
+	})
+	if err == errJobFinished {
+		log.Warningf("ignoring %s state of job %v, it already finished", msg.State.State, msg.State.Token)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to set state after action %v completed with state %s err: %v", msg.State.Method, msg.State.State, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 	if msg.State.State == bundle.StateSucceeded {
 		if err := jss.handleSucceeded(msg); err != nil {
-			log.Errorf("Error after job succeeded : %v", err)
-			return
+			return fmt.Errorf("Error after job succeeded : %v", err)
 		}
 	}
 	//TODO: Need to get the service instance
 	//TODO: NOTE: THIS NEEDS TO BREAK OUT TO OWN SUBSCRIBER
 	// Update with dashboard URL.
 	if msg.DashboardURL != "" {
-		instance, err := jss.dao.GetServiceInstance(msg.InstanceUUID)
+		err := types.UpdateServiceInstance(jss.dao, msg.InstanceUUID, func(instance *bundle.ServiceInstance) error {
+			instance.DashboardURL = msg.DashboardURL
+			return nil
+		})
 		if err != nil {
-			log.Errorf("Error after job succeeded : %v", err)
-			return
-		}
-		instance.DashboardURL = msg.DashboardURL
-		err = jss.dao.SetServiceInstance(msg.InstanceUUID, instance)
-		if err != nil {
-			log.Errorf("Error after job succeeded : %v", err)
-			return
+			return fmt.Errorf("Error after job succeeded : %v", err)
 		}
 	}
-	return
+	return nil
 }
 
 // handle specific logic for the succeeded state
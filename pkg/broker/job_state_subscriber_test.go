@@ -8,6 +8,7 @@ import (
 	apb "github.com/automationbroker/bundle-lib/bundle"
 	"github.com/automationbroker/bundle-lib/runtime"
 	"github.com/openshift/ansible-service-broker/pkg/broker"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
 	"github.com/openshift/ansible-service-broker/pkg/mock"
 	"github.com/pborman/uuid"
 	tmock "github.com/stretchr/testify/mock"
@@ -85,7 +86,7 @@ func TestJobStateSubscriber(t *testing.T) {
 				dao.Object["GetServiceInstance"] = &apb.ServiceInstance{}
 				dao.Object["GetBindInstance"] = &apb.BindInstance{ID: uID}
 				expectedCalls := map[string]int{
-					"SetState": 1,
+					"SetStateIf": 1,
 				}
 				return dao, expectedCalls
 			},
@@ -118,7 +119,7 @@ func TestJobStateSubscriber(t *testing.T) {
 					return nil
 				}
 				expectedCalls := map[string]int{
-					"SetState":      1,
+					"SetStateIf":    1,
 					"DeleteBinding": 1,
 				}
 				return dao, expectedCalls
@@ -138,7 +139,7 @@ func TestJobStateSubscriber(t *testing.T) {
 			rt: *new(runtime.MockRuntime),
 			DAO: func() (*mock.SubscriberDAO, map[string]int) {
 				dao := mock.NewSubscriberDAO()
-				dao.AssertOn["SetState"] = func(args ...interface{}) error {
+				dao.AssertOn["SetStateIf"] = func(args ...interface{}) error {
 					state := args[1].(apb.JobState)
 					if state.Method != apb.JobMethodDeprovision {
 						return fmt.Errorf("expected to have a provision job state")
@@ -149,7 +150,7 @@ func TestJobStateSubscriber(t *testing.T) {
 					return nil
 				}
 				expectedCalls := map[string]int{
-					"SetState":              1,
+					"SetStateIf":            1,
 					"DeleteServiceInstance": 1,
 				}
 				return dao, expectedCalls
@@ -171,7 +172,7 @@ func TestJobStateSubscriber(t *testing.T) {
 				dao := mock.NewSubscriberDAO()
 				dao.Errs["DeleteServiceInstance"] = errors.New("failed")
 				calls := 0
-				dao.AssertOn["SetState"] = func(args ...interface{}) error {
+				assertState := func(args ...interface{}) error {
 					calls++
 					state := args[1].(apb.JobState)
 					if state.Method != apb.JobMethodDeprovision {
@@ -185,8 +186,11 @@ func TestJobStateSubscriber(t *testing.T) {
 
 					return nil
 				}
+				dao.AssertOn["SetStateIf"] = assertState
+				dao.AssertOn["SetState"] = assertState
 				expectedCalls := map[string]int{
-					"SetState":              2,
+					"SetStateIf":            1,
+					"SetState":              1,
 					"DeleteServiceInstance": 1,
 				}
 				return dao, expectedCalls
@@ -210,7 +214,7 @@ func TestJobStateSubscriber(t *testing.T) {
 				dao.Object["GetBindInstance"] = &apb.BindInstance{ID: uID}
 				dao.Errs["DeleteBinding"] = errors.New("failed")
 				calls := 0
-				dao.AssertOn["SetState"] = func(args ...interface{}) error {
+				assertState := func(args ...interface{}) error {
 					calls++
 					state := args[1].(apb.JobState)
 					if state.Method != apb.JobMethodUnbind {
@@ -224,8 +228,11 @@ func TestJobStateSubscriber(t *testing.T) {
 
 					return nil
 				}
+				dao.AssertOn["SetStateIf"] = assertState
+				dao.AssertOn["SetState"] = assertState
 				expectedCalls := map[string]int{
-					"SetState":      2,
+					"SetStateIf":    1,
+					"SetState":      1,
 					"DeleteBinding": 1,
 				}
 				return dao, expectedCalls
@@ -250,7 +257,7 @@ func TestJobStateSubscriber(t *testing.T) {
 				dao.Object["GetBindInstance"] = &apb.BindInstance{ID: uID}
 				dao.Errs["DeleteBinding"] = errors.New("failed")
 				calls := 0
-				dao.AssertOn["SetState"] = func(args ...interface{}) error {
+				dao.AssertOn["SetStateIf"] = func(args ...interface{}) error {
 					calls++
 					state := args[1].(apb.JobState)
 					if state.Method != apb.JobMethodBind {
@@ -265,7 +272,7 @@ func TestJobStateSubscriber(t *testing.T) {
 					return nil
 				}
 				expectedCalls := map[string]int{
-					"SetState": 1,
+					"SetStateIf": 1,
 				}
 				return dao, expectedCalls
 			},
@@ -285,11 +292,11 @@ func TestJobStateSubscriber(t *testing.T) {
 			rt: *new(runtime.MockRuntime),
 			DAO: func() (*mock.SubscriberDAO, map[string]int) {
 				dao := mock.NewSubscriberDAO()
-				dao.Object["GetServiceInstance"] = &apb.ServiceInstance{}
+				dao.Object["GetServiceInstanceVersion"] = &apb.ServiceInstance{}
 				dao.Object["GetBindInstance"] = &apb.BindInstance{ID: uID}
 				dao.Errs["DeleteBinding"] = errors.New("failed")
 				calls := 0
-				dao.AssertOn["SetState"] = func(args ...interface{}) error {
+				dao.AssertOn["SetStateIf"] = func(args ...interface{}) error {
 					calls++
 					state := args[1].(apb.JobState)
 					if state.Method != apb.JobMethodProvision {
@@ -304,9 +311,9 @@ func TestJobStateSubscriber(t *testing.T) {
 					return nil
 				}
 				expectedCalls := map[string]int{
-					"SetState":           1,
-					"GetServiceInstance": 1,
-					"SetServiceInstance": 1,
+					"SetStateIf":                1,
+					"GetServiceInstanceVersion": 1,
+					"SetServiceInstanceIf":      1,
 				}
 				return dao, expectedCalls
 			},
@@ -314,6 +321,47 @@ func TestJobStateSubscriber(t *testing.T) {
 				rt.On("DeleteExtractedCredential", tmock.Anything, tmock.Anything).Return(nil)
 			},
 		},
+		{
+			Name: "a late message does not change the state of a finished job",
+			JobMsg: []broker.JobMsg{{
+				State: apb.JobState{
+					State:  apb.StateInProgress,
+					Method: apb.JobMethodProvision,
+				},
+			}},
+			rt: *new(runtime.MockRuntime),
+			DAO: func() (*mock.SubscriberDAO, map[string]int) {
+				dao := mock.NewSubscriberDAO()
+				dao.Object["GetStateVersion"] = apb.JobState{
+					State:  apb.StateSucceeded,
+					Method: apb.JobMethodProvision,
+				}
+				expectedCalls := map[string]int{
+					"GetStateVersion": 1,
+					"SetStateIf":      0,
+				}
+				return dao, expectedCalls
+			},
+		},
+		{
+			Name: "conflicting job state writes are retried",
+			JobMsg: []broker.JobMsg{{
+				State: apb.JobState{
+					State:  apb.StateInProgress,
+					Method: apb.JobMethodProvision,
+				},
+			}},
+			rt: *new(runtime.MockRuntime),
+			DAO: func() (*mock.SubscriberDAO, map[string]int) {
+				dao := mock.NewSubscriberDAO()
+				dao.Errs["SetStateIf"] = types.ConflictError{Kind: "job state", ID: "id"}
+				expectedCalls := map[string]int{
+					"GetStateVersion": types.MaxConflictRetries,
+					"SetStateIf":      types.MaxConflictRetries,
+				}
+				return dao, expectedCalls
+			},
+		},
 	}
 
 	for _, tc := range cases {
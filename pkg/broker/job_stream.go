@@ -0,0 +1,240 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// watchBufferSize - the number of messages kept for a slow watcher of a
+// job, the oldest are dropped first.
+const watchBufferSize = 16
+
+var (
+	// jobStatePollInterval - how often the persisted state of a streamed job
+	// that is not active in this broker is read.
+	jobStatePollInterval = 5 * time.Second
+	// jobStatePollTimeout - how long a job that is not active in this broker
+	// is streamed before the stream is closed.
+	jobStatePollTimeout = 30 * time.Minute
+)
+
+// JobStreamer - a broker streaming the messages of its jobs.
+type JobStreamer interface {
+	StreamJob(id uuid.UUID, token string) (*JobStream, error)
+}
+
+// JobStream - the messages of a job. Latest is built from the persisted job
+// state, Msgs receives the messages the job sends from then on and is closed
+// once the job is done. Close must be called when the stream is no longer
+// read.
+type JobStream struct {
+	Latest JobMsg
+	Msgs   <-chan JobMsg
+	stop   func()
+}
+
+// Done - true if the latest state of the job is terminal, nothing more is
+// sent on Msgs.
+func (s *JobStream) Done() bool {
+	return isTerminalState(s.Latest.State.State)
+}
+
+// Close - stops watching the job.
+func (s *JobStream) Close() {
+	if s.stop != nil {
+		s.stop()
+	}
+}
+
+// StreamJob - streams the messages of the job of a service instance or
+// binding, starting with its latest persisted state. A job that is not active
+// in this broker, e.g. run by another broker or lost in a restart, sends
+// no messages, so its persisted state is polled instead.
+func (a AnsibleBroker) StreamJob(id uuid.UUID, token string) (*JobStream, error) {
+	// watch before reading the state so that no message is missed
+	msgs, stop := a.engine.WatchJob(token)
+	state, err := a.dao.GetState(id.String(), token)
+	if err != nil {
+		stop()
+		if a.dao.IsNotFoundError(err) {
+			return nil, ErrorNotFound
+		}
+		return nil, err
+	}
+	quit := make(chan struct{})
+	once := sync.Once{}
+	stream := &JobStream{
+		Latest: jobStateMsg(id, token, state),
+		Msgs:   msgs,
+		stop: func() {
+			once.Do(func() {
+				close(quit)
+				stop()
+			})
+		},
+	}
+	if stream.Done() {
+		stream.stop()
+	} else if !a.engine.IsJobActive(token) {
+		go a.pollJobState(id, state, stream, quit)
+	}
+	return stream, nil
+}
+
+// pollJobState - sends the changes of the persisted state of a job that is
+// not active in this broker to the stream, which is closed once the state is
+// terminal or after jobStatePollTimeout. Polling ends early if the job
+// becomes active, the engine then streams its messages.
+func (a AnsibleBroker) pollJobState(id uuid.UUID, last bundle.JobState, stream *JobStream, quit <-chan struct{}) {
+	ticker := time.NewTicker(jobStatePollInterval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(jobStatePollTimeout)
+	defer timeout.Stop()
+	token := stream.Latest.JobToken
+	for {
+		select {
+		case <-quit:
+			return
+		case <-timeout.C:
+			log.Infof("job %v is still %v after %v, closing its stream", token, last.State, jobStatePollTimeout)
+			stream.Close()
+			return
+		case <-ticker.C:
+		}
+		if a.engine.IsJobActive(token) {
+			return
+		}
+		state, err := a.dao.GetState(id.String(), token)
+		if err != nil {
+			log.Warningf("unable to read the state of streamed job %v - %v", token, err)
+			continue
+		}
+		if state.State == last.State && state.Description == last.Description {
+			continue
+		}
+		last = state
+		a.engine.publishTo(token, stream.Msgs, jobStateMsg(id, token, state))
+		if isTerminalState(state.State) {
+			stream.Close()
+			return
+		}
+	}
+}
+
+// jobStateMsg - the message of a persisted job state.
+func jobStateMsg(id uuid.UUID, token string, state bundle.JobState) JobMsg {
+	msg := JobMsg{
+		JobToken: token,
+		PodName:  state.Podname,
+		State:    state,
+		Error:    state.Error,
+	}
+	if state.Method == bundle.JobMethodBind || state.Method == bundle.JobMethodUnbind {
+		msg.BindingUUID = id.String()
+	} else {
+		msg.InstanceUUID = id.String()
+	}
+	return msg
+}
+
+// WatchJob - returns a channel receiving the messages of the job with the
+// token, which does not need to be running yet. The channel is closed once
+// the job is done or when the returned func is called.
+func (engine *WorkEngine) WatchJob(token string) (<-chan JobMsg, func()) {
+	ch := make(chan JobMsg, watchBufferSize)
+	engine.jobMutex.Lock()
+	engine.watchers[token] = append(engine.watchers[token], ch)
+	engine.jobMutex.Unlock()
+
+	stop := func() {
+		engine.jobMutex.Lock()
+		defer engine.jobMutex.Unlock()
+		watchers := engine.watchers[token]
+		for i, watcher := range watchers {
+			if watcher == ch {
+				close(ch)
+				watchers = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+		if len(watchers) == 0 {
+			delete(engine.watchers, token)
+		} else {
+			engine.watchers[token] = watchers
+		}
+	}
+	return ch, stop
+}
+
+// publish - sends the msg to the watchers of its job, without the
+// credentials.
+func (engine *WorkEngine) publish(token string, msg JobMsg) {
+	msg.ExtractedCredentials = bundle.ExtractedCredentials{}
+	engine.jobMutex.RLock()
+	defer engine.jobMutex.RUnlock()
+	for _, ch := range engine.watchers[token] {
+		sendToWatcher(token, ch, msg)
+	}
+}
+
+// publishTo - sends the msg to one watcher of the job, if it is still
+// watching.
+func (engine *WorkEngine) publishTo(token string, watcher <-chan JobMsg, msg JobMsg) {
+	msg.ExtractedCredentials = bundle.ExtractedCredentials{}
+	engine.jobMutex.RLock()
+	defer engine.jobMutex.RUnlock()
+	for _, ch := range engine.watchers[token] {
+		if ch == watcher {
+			sendToWatcher(token, ch, msg)
+		}
+	}
+}
+
+// sendToWatcher - a watcher that is behind loses its oldest message rather
+// than holding up the job.
+func sendToWatcher(token string, ch chan JobMsg, msg JobMsg) {
+	select {
+	case ch <- msg:
+		return
+	default:
+	}
+	log.Debugf("watcher of job %v is behind, dropping its oldest message", token)
+	select {
+	case <-ch:
+	default:
+	}
+	select {
+	case ch <- msg:
+	default:
+	}
+}
+
+// closeWatchers - closes the channels of the watchers of a job that is done.
+func (engine *WorkEngine) closeWatchers(token string) {
+	engine.jobMutex.Lock()
+	defer engine.jobMutex.Unlock()
+	for _, ch := range engine.watchers[token] {
+		close(ch)
+	}
+	delete(engine.watchers, token)
+}
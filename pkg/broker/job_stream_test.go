@@ -0,0 +1,171 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func receiveMsg(t *testing.T, msgs <-chan JobMsg) (JobMsg, bool) {
+	select {
+	case msg, ok := <-msgs:
+		return msg, ok
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+	return JobMsg{}, false
+}
+
+func TestWatchJob(t *testing.T) {
+	engineDao := &dao.MockDao{}
+	engineDao.On("SetState", mock.Anything, mock.Anything).Return("", nil)
+	engine := NewWorkEngine(10, 1, engineDao)
+
+	// the job does not need to be running to be watched
+	msgs, stop := engine.WatchJob("token")
+	defer stop()
+	other, stopOther := engine.WatchJob("other-token")
+
+	work := newQueueWork("instance")
+	_, err := engine.StartNewAsyncJob("token", work, UpdateTopic)
+	assert.NoError(t, err)
+	waitForStart(t, work)
+	close(work.release)
+
+	msg, ok := receiveMsg(t, msgs)
+	assert.True(t, ok)
+	assert.Equal(t, "token", msg.JobToken)
+	assert.Equal(t, bundle.StateSucceeded, msg.State.State)
+	_, ok = receiveMsg(t, msgs)
+	assert.False(t, ok, "the channel is closed once the job is done")
+
+	stopOther()
+	_, ok = receiveMsg(t, other)
+	assert.False(t, ok, "the channel is closed when the watch is stopped")
+}
+
+func TestPublishDropsOldestMessages(t *testing.T) {
+	engine := NewWorkEngine(10, 1, &dao.MockDao{})
+	msgs, stop := engine.WatchJob("token")
+	defer stop()
+
+	for i := 0; i < watchBufferSize+2; i++ {
+		engine.publish("token", JobMsg{
+			Msg:                  string(rune('a' + i)),
+			ExtractedCredentials: bundle.ExtractedCredentials{Credentials: map[string]interface{}{"password": "secret"}},
+		})
+	}
+	msg, _ := receiveMsg(t, msgs)
+	assert.Equal(t, "c", msg.Msg)
+	assert.Empty(t, msg.ExtractedCredentials.Credentials, "credentials are never streamed")
+	assert.Len(t, msgs, watchBufferSize-1)
+}
+
+func TestStreamJob(t *testing.T) {
+	instanceID := uuid.NewRandom()
+	bindingID := uuid.NewRandom()
+	notFound := errors.New("not found")
+	streamDao := &dao.MockDao{}
+	streamDao.On("GetState", instanceID.String(), "running").Return(
+		bundle.JobState{Token: "running", State: bundle.StateInProgress, Method: bundle.JobMethodProvision, Description: "action started"}, nil)
+	streamDao.On("GetState", bindingID.String(), "done").Return(
+		bundle.JobState{Token: "done", State: bundle.StateSucceeded, Method: bundle.JobMethodBind}, nil)
+	streamDao.On("GetState", instanceID.String(), "unknown").Return(bundle.JobState{}, notFound)
+	streamDao.On("IsNotFoundError", notFound).Return(true)
+	a := AnsibleBroker{dao: streamDao, engine: NewWorkEngine(10, 1, streamDao)}
+
+	// the job is running in this broker, its messages are streamed
+	a.engine.activeJobs["running"] = &jobCancellation{}
+	stream, err := a.StreamJob(instanceID, "running")
+	assert.NoError(t, err)
+	assert.False(t, stream.Done())
+	assert.Equal(t, instanceID.String(), stream.Latest.InstanceUUID)
+	assert.Equal(t, "action started", stream.Latest.State.Description)
+	a.engine.publish("running", JobMsg{JobToken: "running", State: bundle.JobState{State: bundle.StateSucceeded}})
+	msg, _ := receiveMsg(t, stream.Msgs)
+	assert.Equal(t, bundle.StateSucceeded, msg.State.State)
+	stream.Close()
+
+	stream, err = a.StreamJob(bindingID, "done")
+	assert.NoError(t, err)
+	assert.True(t, stream.Done())
+	assert.Equal(t, bindingID.String(), stream.Latest.BindingUUID)
+	_, ok := receiveMsg(t, stream.Msgs)
+	assert.False(t, ok, "nothing is streamed after a terminal state")
+	stream.Close()
+
+	_, err = a.StreamJob(instanceID, "unknown")
+	assert.Equal(t, ErrorNotFound, err)
+	assert.Empty(t, a.engine.watchers, "watches are stopped on error")
+}
+
+func TestStreamJobPollsInactiveJob(t *testing.T) {
+	defer func(interval, timeout time.Duration) {
+		jobStatePollInterval, jobStatePollTimeout = interval, timeout
+	}(jobStatePollInterval, jobStatePollTimeout)
+	jobStatePollInterval = 10 * time.Millisecond
+	jobStatePollTimeout = time.Minute
+
+	instanceID := uuid.NewRandom()
+	streamDao := &dao.MockDao{}
+	streamDao.On("GetState", instanceID.String(), "token").Return(
+		bundle.JobState{Token: "token", State: bundle.StateInProgress, Method: bundle.JobMethodProvision}, nil).Twice()
+	streamDao.On("GetState", instanceID.String(), "token").Return(
+		bundle.JobState{Token: "token", State: bundle.StateSucceeded, Method: bundle.JobMethodProvision}, nil)
+	a := AnsibleBroker{dao: streamDao, engine: NewWorkEngine(10, 1, streamDao)}
+
+	stream, err := a.StreamJob(instanceID, "token")
+	assert.NoError(t, err)
+	defer stream.Close()
+	assert.False(t, stream.Done())
+
+	msg, ok := receiveMsg(t, stream.Msgs)
+	assert.True(t, ok)
+	assert.Equal(t, bundle.StateSucceeded, msg.State.State)
+	assert.Equal(t, instanceID.String(), msg.InstanceUUID)
+	_, ok = receiveMsg(t, stream.Msgs)
+	assert.False(t, ok, "the stream is closed once the state is terminal")
+}
+
+func TestStreamJobPollTimeout(t *testing.T) {
+	defer func(interval, timeout time.Duration) {
+		jobStatePollInterval, jobStatePollTimeout = interval, timeout
+	}(jobStatePollInterval, jobStatePollTimeout)
+	jobStatePollInterval = 10 * time.Millisecond
+	jobStatePollTimeout = 50 * time.Millisecond
+
+	instanceID := uuid.NewRandom()
+	streamDao := &dao.MockDao{}
+	streamDao.On("GetState", instanceID.String(), "token").Return(
+		bundle.JobState{Token: "token", State: bundle.StateInProgress, Method: bundle.JobMethodProvision}, nil)
+	a := AnsibleBroker{dao: streamDao, engine: NewWorkEngine(10, 1, streamDao)}
+
+	stream, err := a.StreamJob(instanceID, "token")
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	_, ok := receiveMsg(t, stream.Msgs)
+	assert.False(t, ok, "the stream is closed after the timeout")
+}
@@ -21,7 +21,9 @@
 package broker
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/automationbroker/bundle-lib/bundle"
 	"github.com/automationbroker/bundle-lib/runtime"
@@ -35,12 +37,23 @@ type runFn func(bundle.Executor) <-chan bundle.StatusMessage
 type apbJob struct {
 	serviceInstanceID      string
 	specID                 string
+	specFQName             string
+	planName               string
+	namespace              string
 	bindingID              *string
 	method                 bundle.JobMethod
 	metricsJobStartHook    metricsHookFn
 	metricsJobFinishedHook metricsHookFn
 	executor               bundle.Executor
 	run                    runFn
+	stop                   stopFn
+	// creates the executor of each retried attempt, executors are single use
+	newExecutor func() bundle.Executor
+	retry       RetryPolicy
+	// overrides the deadline the engine enforces for the method
+	deadline time.Duration
+	// run when the job starts, before its first attempt, its error fails the job
+	start func() error
 
 	// NOTE: skipExecution is an artifact of an older time when we did not have
 	// spec level support for some async actions (like bind). In time, this should
@@ -59,19 +72,41 @@ func (j *apbJob) Method() bundle.JobMethod {
 	return j.method
 }
 
-func (j *apbJob) Run(token string, msgBuffer chan<- JobMsg) {
+// Deadline - the deadline set by the spec for the job, zero if there is none.
+func (j *apbJob) Deadline() time.Duration {
+	return j.deadline
+}
+
+// Namespace - the namespace of the service instance the job acts on.
+func (j *apbJob) Namespace() string {
+	return j.namespace
+}
+
+func (j *apbJob) Run(ctx context.Context, token string, msgBuffer chan<- JobMsg) {
 	var (
-		err     error
-		podName string
-		jobMsg  JobMsg
-		exec    = j.executor
-		errMsg  = fmt.Sprintf(
+		exec   = j.executor
+		errMsg = fmt.Sprintf(
 			"Error occurred during %s. Please contact administrator if the issue persists.", j.method)
 	)
 
 	j.metricsJobStartHook()
 	defer j.metricsJobFinishedHook()
 
+	if ctx.Err() != nil {
+		msgBuffer <- j.createCancelledJobMsg(ctx, "", token)
+		return
+	}
+
+	if j.start != nil {
+		if err := j.start(); err != nil {
+			log.Errorf("broker::%s unable to start job %s - %v", j.method, token, err)
+			jobMsg := j.createJobMsg("", token, bundle.StateFailed, errMsg)
+			jobMsg.State.Error = err.Error()
+			msgBuffer <- jobMsg
+			return
+		}
+	}
+
 	if j.skipExecution {
 		log.Debugf("skipExecution: True for %s, sending complete msg to channel", j.method)
 		msgBuffer <- j.createJobMsg(
@@ -79,26 +114,60 @@ func (j *apbJob) Run(token string, msgBuffer chan<- JobMsg) {
 		return
 	}
 
-	for status := range j.run(exec) {
-		podName = exec.PodName()
-		jobMsg = j.createJobMsg(podName, token, status.State, status.Description)
-		if status.State == bundle.StateInProgress {
-			// Only send intermediate messages since the final ones are processed
-			// and messaged separately (otherwise we'll double up).
+	for attempt := 1; ; attempt++ {
+		jobMsg, stopped := j.runAttempt(ctx, exec, token, attempt, msgBuffer)
+		if stopped {
+			return
+		}
+
+		err := exec.LastStatus().Error
+		if err == nil {
+			extCreds := exec.ExtractedCredentials()
+			if extCreds != nil {
+				jobMsg.ExtractedCredentials = *extCreds
+			}
+
+			// pull out dashboard url from exec.
+			if exec.DashboardURL() != "" {
+				jobMsg.DashboardURL = exec.DashboardURL()
+			}
+
+			jobMsg.State.State = bundle.StateSucceeded
+			jobMsg.State.Description = fmt.Sprintf("%s job completed", j.method)
 			msgBuffer <- jobMsg
+			return
 		}
-	}
 
-	err = exec.LastStatus().Error
+		log.Errorf("broker::%s error occurred on attempt %d. %s", j.method, attempt, err.Error())
+
+		if j.retry.Retries(attempt, err) && j.newExecutor != nil {
+			backoff := j.retry.Backoff(attempt)
+			log.Infof("broker::%s job %s will be retried in %v", j.method, token, backoff)
+			// record the failed attempt, the job stays in progress
+			jobMsg.State.State = bundle.StateInProgress
+			jobMsg.State.Error = err.Error()
+			jobMsg.State.Description = retryDescription(attempt+1, j.retry.MaxAttempts,
+				fmt.Sprintf("attempt %d failed, retrying in %v", attempt, backoff))
+			msgBuffer <- jobMsg
 
-	if err != nil {
-		log.Errorf("broker::%s error occurred. %s", j.method, err.Error())
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				msgBuffer <- j.createCancelledJobMsg(ctx, jobMsg.PodName, token)
+				return
+			}
+			exec = j.newExecutor()
+			continue
+		}
 
 		if err == runtime.ErrorPodPullErr {
 			errMsg = err.Error()
 		} else if runtime.IsErrorCustomMsg(err) {
 			errMsg = err.Error()
 		}
+		if attempt > 1 {
+			errMsg = fmt.Sprintf("%s (failed after %d attempts)", errMsg, attempt)
+		}
 
 		jobMsg.State.State = bundle.StateFailed
 		// send error message, can't have
@@ -109,20 +178,64 @@ func (j *apbJob) Run(token string, msgBuffer chan<- JobMsg) {
 		msgBuffer <- jobMsg
 		return
 	}
+}
 
-	extCreds := exec.ExtractedCredentials()
-	if extCreds != nil {
-		jobMsg.ExtractedCredentials = *extCreds
+// runAttempt - runs the executor once, forwarding its intermediate messages.
+// Returns the last message of the attempt, and true if the job was stopped
+// because ctx is done.
+func (j *apbJob) runAttempt(
+	ctx context.Context, exec bundle.Executor, token string, attempt int, msgBuffer chan<- JobMsg,
+) (JobMsg, bool) {
+	var jobMsg JobMsg
+	statusChan := j.run(exec)
+	for {
+		select {
+		case status, ok := <-statusChan:
+			if !ok {
+				return jobMsg, false
+			}
+			description := status.Description
+			if attempt > 1 {
+				description = retryDescription(attempt, j.retry.MaxAttempts, description)
+			}
+			jobMsg = j.createJobMsg(exec.PodName(), token, status.State, description)
+			if status.State == bundle.StateInProgress {
+				// Only send intermediate messages since the final ones are processed
+				// and messaged separately (otherwise we'll double up).
+				msgBuffer <- jobMsg
+			}
+		case <-ctx.Done():
+			log.Infof("broker::%s job %s stopped: %s", j.method, token, CancelReason(ctx))
+			go j.stopExecutor(exec, statusChan)
+			msgBuffer <- j.createCancelledJobMsg(ctx, exec.PodName(), token)
+			return jobMsg, true
+		}
 	}
+}
 
-	// pull out dashboard url from exec.
-	if exec.DashboardURL() != "" {
-		jobMsg.DashboardURL = exec.DashboardURL()
+// stopExecutor - stops the bundle pod once the executor has created it, and
+// drains the executor's status channel so it can finish cleaning up.
+func (j *apbJob) stopExecutor(exec bundle.Executor, statusChan <-chan bundle.StatusMessage) {
+	stopped := false
+	stopPod := func() {
+		if stopped || j.stop == nil || exec.PodName() == "" {
+			return
+		}
+		stopped = true
+		if err := j.stop(exec.PodName()); err != nil {
+			log.Errorf("broker::%s unable to stop pod %s - %v", j.method, exec.PodName(), err)
+		}
+	}
+	stopPod()
+	for range statusChan {
+		stopPod()
 	}
+}
 
-	jobMsg.State.State = bundle.StateSucceeded
-	jobMsg.State.Description = fmt.Sprintf("%s job completed", j.method)
-	msgBuffer <- jobMsg
+func (j *apbJob) createCancelledJobMsg(ctx context.Context, podName string, token string) JobMsg {
+	jobMsg := j.createJobMsg(podName, token, bundle.StateFailed, CancelReason(ctx))
+	jobMsg.State.Error = CancelError(ctx).Error()
+	return jobMsg
 }
 
 func (j *apbJob) createJobMsg(
@@ -134,6 +247,9 @@ func (j *apbJob) createJobMsg(
 		InstanceUUID: j.serviceInstanceID,
 		JobToken:     token,
 		SpecID:       j.specID,
+		Namespace:    j.namespace,
+		SpecFQName:   j.specFQName,
+		PlanName:     j.planName,
 		State: bundle.JobState{
 			State:       state,
 			Method:      j.method,
@@ -150,21 +266,34 @@ func (j *apbJob) createJobMsg(
 }
 
 type workFactory struct {
+	retryPolicies RetryPolicies
+	clusterConfig bundle.ClusterConfig
 }
 
 // NewWorkFactory will return a work factory capable of creating different kinds of work
-func NewWorkFactory() WorkFactory {
-	return &workFactory{}
+func NewWorkFactory(retryPolicies RetryPolicies, clusterConfig bundle.ClusterConfig) WorkFactory {
+	return &workFactory{retryPolicies: retryPolicies, clusterConfig: clusterConfig}
+}
+
+func newExecutor() bundle.Executor {
+	return bundle.NewExecutor(bundle.ExecutorConfig{})
 }
 
 // NewProvisionJob will setup a Work implementation that will perform the provision work
 func (wf *workFactory) NewProvisionJob(si *bundle.ServiceInstance) Work {
 	return &provisionJob{
 		apbJob: apbJob{
-			executor:               bundle.NewExecutor(bundle.ExecutorConfig{}),
+			executor:               newExecutor(),
+			newExecutor:            newExecutor,
+			stop:                   deleteBundlePod,
 			serviceInstanceID:      si.ID.String(),
 			specID:                 si.Spec.ID,
+			specFQName:             si.Spec.FQName,
+			planName:               instancePlan(si),
+			namespace:              instanceNamespace(si),
 			method:                 bundle.JobMethodProvision,
+			retry:                  wf.retryPolicies.ForSpec(bundle.JobMethodProvision, si.Spec),
+			deadline:               specDeadline(bundle.JobMethodProvision, si.Spec),
 			metricsJobStartHook:    metrics.ProvisionJobStarted,
 			metricsJobFinishedHook: metrics.ProvisionJobFinished,
 			skipExecution:          false,
@@ -180,10 +309,17 @@ func (wf *workFactory) NewProvisionJob(si *bundle.ServiceInstance) Work {
 func (wf *workFactory) NewDeprovisionJob(si *bundle.ServiceInstance, skipExecution bool) Work {
 	return &deprovisionJob{
 		apbJob: apbJob{
-			executor:               bundle.NewExecutor(bundle.ExecutorConfig{}),
+			executor:               newExecutor(),
+			newExecutor:            newExecutor,
+			stop:                   deleteBundlePod,
 			serviceInstanceID:      si.ID.String(),
 			specID:                 si.Spec.ID,
+			specFQName:             si.Spec.FQName,
+			planName:               instancePlan(si),
+			namespace:              instanceNamespace(si),
 			method:                 bundle.JobMethodDeprovision,
+			retry:                  wf.retryPolicies.ForSpec(bundle.JobMethodDeprovision, si.Spec),
+			deadline:               specDeadline(bundle.JobMethodDeprovision, si.Spec),
 			metricsJobStartHook:    metrics.DeprovisionJobStarted,
 			metricsJobFinishedHook: metrics.DeprovisionJobFinished,
 			skipExecution:          skipExecution,
@@ -199,11 +335,18 @@ func (wf *workFactory) NewDeprovisionJob(si *bundle.ServiceInstance, skipExecuti
 func (wf *workFactory) NewUnbindJob(bindingID string, params *bundle.Parameters, si *bundle.ServiceInstance, skipExecution bool) Work {
 	return &unbindJob{
 		apbJob: apbJob{
-			executor:               bundle.NewExecutor(bundle.ExecutorConfig{}),
+			executor:               newExecutor(),
+			newExecutor:            newExecutor,
+			stop:                   deleteBundlePod,
 			serviceInstanceID:      si.ID.String(),
 			specID:                 si.Spec.ID,
+			specFQName:             si.Spec.FQName,
+			planName:               instancePlan(si),
+			namespace:              instanceNamespace(si),
 			bindingID:              &bindingID,
 			method:                 bundle.JobMethodUnbind,
+			retry:                  wf.retryPolicies.ForSpec(bundle.JobMethodUnbind, si.Spec),
+			deadline:               specDeadline(bundle.JobMethodUnbind, si.Spec),
 			metricsJobStartHook:    metrics.UnbindJobStarted,
 			metricsJobFinishedHook: metrics.UnbindJobFinished,
 			skipExecution:          skipExecution,
@@ -218,11 +361,18 @@ func (wf *workFactory) NewUnbindJob(bindingID string, params *bundle.Parameters,
 func (wf *workFactory) NewBindJob(bindingID string, bindingParams *bundle.Parameters, si *bundle.ServiceInstance) Work {
 	return &bindJob{
 		apbJob: apbJob{
-			executor:               bundle.NewExecutor(bundle.ExecutorConfig{}),
+			executor:               newExecutor(),
+			newExecutor:            newExecutor,
+			stop:                   deleteBundlePod,
 			serviceInstanceID:      si.ID.String(),
 			specID:                 si.Spec.ID,
+			specFQName:             si.Spec.FQName,
+			planName:               instancePlan(si),
+			namespace:              instanceNamespace(si),
 			bindingID:              &bindingID,
 			method:                 bundle.JobMethodBind,
+			retry:                  wf.retryPolicies.ForSpec(bundle.JobMethodBind, si.Spec),
+			deadline:               specDeadline(bundle.JobMethodBind, si.Spec),
 			metricsJobStartHook:    metrics.BindJobStarted,
 			metricsJobFinishedHook: metrics.BindJobFinished,
 			skipExecution:          false,
@@ -233,17 +383,27 @@ func (wf *workFactory) NewBindJob(bindingID string, bindingParams *bundle.Parame
 	}
 }
 
-// NewUpdateJob will setup a Work implementation that will perform the update work
-func (wf *workFactory) NewUpdateJob(si *bundle.ServiceInstance) Work {
+// NewUpdateJob will setup a Work implementation that will perform the update work.
+// apply, if not nil, is run when the job starts to save the parameters of the
+// update to the instance.
+func (wf *workFactory) NewUpdateJob(si *bundle.ServiceInstance, apply func() error) Work {
 	return &updateJob{
 		apbJob: apbJob{
-			executor:               bundle.NewExecutor(bundle.ExecutorConfig{}),
+			executor:               newExecutor(),
+			newExecutor:            newExecutor,
+			stop:                   deleteBundlePod,
 			serviceInstanceID:      si.ID.String(),
 			specID:                 si.Spec.ID,
+			specFQName:             si.Spec.FQName,
+			planName:               instancePlan(si),
+			namespace:              instanceNamespace(si),
 			method:                 bundle.JobMethodUpdate,
+			retry:                  wf.retryPolicies.ForSpec(bundle.JobMethodUpdate, si.Spec),
+			deadline:               specDeadline(bundle.JobMethodUpdate, si.Spec),
 			metricsJobStartHook:    metrics.UpdateJobStarted,
 			metricsJobFinishedHook: metrics.UpdateJobFinished,
 			skipExecution:          false,
+			start:                  apply,
 			run: func(exec bundle.Executor) <-chan bundle.StatusMessage {
 				return exec.Update(si)
 			},
@@ -251,6 +411,83 @@ func (wf *workFactory) NewUpdateJob(si *bundle.ServiceInstance) Work {
 	}
 }
 
+// NewReattachJob will setup a Work implementation that follows the pod of a
+// job that was running when the broker lost track of it. The bindingID is
+// empty for the jobs of a service instance.
+func (wf *workFactory) NewReattachJob(method bundle.JobMethod, podName string, bindingID string, si *bundle.ServiceInstance) Work {
+	targets := []string{instanceNamespace(si)}
+	job := &reattachJob{
+		apbJob: apbJob{
+			stop:                   deleteBundlePod,
+			serviceInstanceID:      si.ID.String(),
+			specID:                 si.Spec.ID,
+			specFQName:             si.Spec.FQName,
+			planName:               instancePlan(si),
+			namespace:              instanceNamespace(si),
+			method:                 method,
+			deadline:               specDeadline(method, si.Spec),
+			metricsJobStartHook:    func() {},
+			metricsJobFinishedHook: func() {},
+		},
+		podName: podName,
+		watch:   watchBundlePod,
+	}
+	credentialsID := si.ID.String()
+	if bindingID != "" {
+		job.bindingID = &bindingID
+		credentialsID = bindingID
+	}
+	switch method {
+	case bundle.JobMethodProvision, bundle.JobMethodUpdate, bundle.JobMethodBind:
+		job.complete = func(podNamespace string) error {
+			// saves the credentials and destroys the sandbox
+			return bundle.RecoverExtractCredentials(
+				podName, podNamespace, si.Spec.FQName, credentialsID, method, targets, si.Spec.Runtime)
+		}
+	default:
+		job.complete = func(podNamespace string) error {
+			runtime.Provider.DestroySandbox(podName, podNamespace, targets, wf.clusterConfig.Namespace,
+				wf.clusterConfig.KeepNamespace, wf.clusterConfig.KeepNamespaceOnError)
+			if method == bundle.JobMethodUnbind {
+				// the credentials of a deprovisioned instance are deleted
+				// by the JobStateSubscriber
+				if err := bundle.DeleteExtractedCredentials(bindingID); err != nil {
+					log.Infof("unable to delete extracted credentials of binding %s - %v", bindingID, err)
+				}
+			}
+			return nil
+		}
+	}
+	switch method {
+	case bundle.JobMethodProvision:
+		job.metricsJobStartHook, job.metricsJobFinishedHook = metrics.ProvisionJobStarted, metrics.ProvisionJobFinished
+	case bundle.JobMethodDeprovision:
+		job.metricsJobStartHook, job.metricsJobFinishedHook = metrics.DeprovisionJobStarted, metrics.DeprovisionJobFinished
+	case bundle.JobMethodUpdate:
+		job.metricsJobStartHook, job.metricsJobFinishedHook = metrics.UpdateJobStarted, metrics.UpdateJobFinished
+	case bundle.JobMethodBind:
+		job.metricsJobStartHook, job.metricsJobFinishedHook = metrics.BindJobStarted, metrics.BindJobFinished
+	case bundle.JobMethodUnbind:
+		job.metricsJobStartHook, job.metricsJobFinishedHook = metrics.UnbindJobStarted, metrics.UnbindJobFinished
+	}
+	return job
+}
+
+func instanceNamespace(si *bundle.ServiceInstance) string {
+	if si.Context == nil {
+		return ""
+	}
+	return si.Context.Namespace
+}
+
+func instancePlan(si *bundle.ServiceInstance) string {
+	if si.Parameters == nil {
+		return ""
+	}
+	plan, _ := (*si.Parameters)[planParameterKey].(string)
+	return plan
+}
+
 type provisionJob struct {
 	apbJob
 	serviceInstance *bundle.ServiceInstance
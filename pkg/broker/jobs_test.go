@@ -1,6 +1,7 @@
 package broker
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -152,6 +153,26 @@ func TestApbJobRun(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "should fail without running the executor when the job fails to start",
+			testJob: &apbJob{
+				serviceInstanceID: serviceInstanceID,
+				specID:            specID,
+				method:            bundle.JobMethodUpdate,
+				executor:          &bundle.MockExecutor{},
+				start: func() error {
+					return fmt.Errorf("unable to save the parameters")
+				},
+			},
+			expectedMsgCount: 1,
+			validate: func(messages []JobMsg) error {
+				if messages[0].State.State != bundle.StateFailed ||
+					messages[0].State.Error != "unable to save the parameters" {
+					return fmt.Errorf("unexpected message contents %#v", messages[0].State)
+				}
+				return nil
+			},
+		},
 		{
 			name: "should send failed jobMsg when error reported on executor",
 			testJob: &apbJob{
@@ -478,7 +499,7 @@ func TestApbJobRun(t *testing.T) {
 
 			go func() {
 				fmt.Printf("Running test %s", tc.name)
-				tc.testJob.Run(token, msgBuffer)
+				tc.testJob.Run(context.Background(), token, msgBuffer)
 			}()
 
 			for {
@@ -498,6 +519,154 @@ func TestApbJobRun(t *testing.T) {
 	}
 }
 
+func TestApbJobCancel(t *testing.T) {
+	podName := "apb-8f9268c2-1aaa-48f1-918d-eae920986c9f"
+	stoppedPod := make(chan string, 1)
+	statusChan := make(chan bundle.StatusMessage)
+	exec := &bundle.MockExecutor{}
+	exec.On("PodName").Return(podName)
+
+	job := &apbJob{
+		serviceInstanceID:      "instance",
+		method:                 bundle.JobMethodProvision,
+		executor:               exec,
+		metricsJobStartHook:    func() {},
+		metricsJobFinishedHook: func() {},
+		run: func(exec bundle.Executor) <-chan bundle.StatusMessage {
+			return statusChan
+		},
+		stop: func(pod string) error {
+			stoppedPod <- pod
+			return nil
+		},
+	}
+
+	ctx, cancellation := newJobContext()
+	msgBuffer := make(chan JobMsg)
+	go job.Run(ctx, "token", msgBuffer)
+
+	statusChan <- bundle.StatusMessage{State: bundle.StateInProgress, Description: "action started"}
+	msg := <-msgBuffer
+	assert.Equal(t, bundle.StateInProgress, msg.State.State)
+
+	cancellation.cancelWith(ErrorJobCancelled, cancelledBy("admin"))
+	msg = <-msgBuffer
+	assert.Equal(t, bundle.StateFailed, msg.State.State)
+	assert.Equal(t, "cancelled by admin", msg.State.Description)
+	assert.Equal(t, "instance", msg.InstanceUUID)
+	assert.Equal(t, podName, msg.PodName)
+
+	select {
+	case pod := <-stoppedPod:
+		assert.Equal(t, podName, pod)
+	case <-time.After(time.Second):
+		t.Fatal("the bundle pod was not stopped")
+	}
+	// the executor must still be able to report until it is done
+	statusChan <- bundle.StatusMessage{State: bundle.StateFailed}
+	close(statusChan)
+}
+
+func TestApbJobRetry(t *testing.T) {
+	statusFor := func(final bundle.StatusMessage) runFn {
+		return func(exec bundle.Executor) <-chan bundle.StatusMessage {
+			statusChan := make(chan bundle.StatusMessage)
+			go func() {
+				statusChan <- bundle.StatusMessage{State: bundle.StateInProgress, Description: "action started"}
+				statusChan <- final
+				close(statusChan)
+			}()
+			return statusChan
+		}
+	}
+	failed := bundle.StatusMessage{State: bundle.StateFailed, Error: runtime.ErrorPodPullErr}
+	newMockExecutor := func(last bundle.StatusMessage) *bundle.MockExecutor {
+		e := &bundle.MockExecutor{}
+		e.On("PodName").Return("pod")
+		e.On("LastStatus").Return(last)
+		e.On("ExtractedCredentials").Return(nil)
+		e.On("DashboardURL").Return("")
+		return e
+	}
+
+	cases := []struct {
+		name      string
+		attempts  []bundle.StatusMessage
+		policy    RetryPolicy
+		validate  func(t *testing.T, messages []JobMsg)
+		lastState bundle.State
+	}{
+		{
+			name:      "succeeds on the second attempt",
+			attempts:  []bundle.StatusMessage{failed, {State: bundle.StateSucceeded}},
+			policy:    RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond},
+			lastState: bundle.StateSucceeded,
+			validate: func(t *testing.T, messages []JobMsg) {
+				assert.Equal(t, 4, len(messages))
+				assert.Equal(t, "action started", messages[0].State.Description)
+				assert.Equal(t, "retry 2/5: attempt 1 failed, retrying in 1ms", messages[1].State.Description)
+				assert.Equal(t, runtime.ErrorPodPullErr.Error(), messages[1].State.Error)
+				assert.Equal(t, bundle.StateInProgress, messages[1].State.State)
+				assert.Equal(t, "retry 2/5: action started", messages[2].State.Description)
+			},
+		},
+		{
+			name:      "fails once out of attempts",
+			attempts:  []bundle.StatusMessage{failed, failed},
+			policy:    RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+			lastState: bundle.StateFailed,
+			validate: func(t *testing.T, messages []JobMsg) {
+				assert.Equal(t, 4, len(messages))
+				assert.Equal(t, runtime.ErrorPodPullErr.Error()+" (failed after 2 attempts)", messages[3].State.Description)
+			},
+		},
+		{
+			name:      "does not retry errors that are not retryable",
+			attempts:  []bundle.StatusMessage{failed},
+			policy:    RetryPolicy{MaxAttempts: 5, RetryableErrors: []ErrorClass{ErrorClassEvicted}},
+			lastState: bundle.StateFailed,
+			validate: func(t *testing.T, messages []JobMsg) {
+				assert.Equal(t, 2, len(messages))
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			executors := []bundle.Executor{}
+			for _, attempt := range tc.attempts {
+				executors = append(executors, newMockExecutor(attempt))
+			}
+			attempt := 0
+			job := &apbJob{
+				serviceInstanceID:      "instance",
+				method:                 bundle.JobMethodProvision,
+				executor:               executors[0],
+				metricsJobStartHook:    func() {},
+				metricsJobFinishedHook: func() {},
+				retry:                  tc.policy,
+				newExecutor: func() bundle.Executor {
+					attempt++
+					return executors[attempt]
+				},
+				run: func(exec bundle.Executor) <-chan bundle.StatusMessage {
+					return statusFor(tc.attempts[attempt])(exec)
+				},
+			}
+
+			msgBuffer := make(chan JobMsg, 10)
+			job.Run(context.Background(), "token", msgBuffer)
+			close(msgBuffer)
+			messages := []JobMsg{}
+			for msg := range msgBuffer {
+				messages = append(messages, msg)
+			}
+			assert.Equal(t, tc.lastState, messages[len(messages)-1].State.State)
+			tc.validate(t, messages)
+		})
+	}
+}
+
 func TestWork(t *testing.T) {
 	cases := []struct {
 		Name     string
@@ -575,7 +744,7 @@ func TestNewUnbindJob(t *testing.T) {
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			wf := NewWorkFactory()
+			wf := NewWorkFactory(RetryPolicies{}, bundle.ClusterConfig{})
 			unbindjob := wf.NewUnbindJob(tc.bindingID, tc.params, tc.si, tc.skip)
 			tc.validate(t, unbindjob)
 		})
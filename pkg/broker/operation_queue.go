@@ -0,0 +1,360 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	log "github.com/sirupsen/logrus"
+)
+
+// operation - a job requested for a service instance.
+type operation struct {
+	token string
+	hash  string
+	work  Work
+	topic WorkTopic
+	// closed once the job of the operation has finished and its subscribers
+	// have handled its last message
+	done    chan struct{}
+	unwatch func()
+}
+
+// watch - closes done once the engine is done with the job of the
+// operation. The watchers of a job are sent its messages after the
+// subscribers of its topic, so the final state of the job is persisted by
+// then.
+func (op *operation) watch(engine *WorkEngine) {
+	msgs, stop := engine.WatchJob(op.token)
+	op.unwatch = stop
+	go func() {
+		for range msgs {
+		}
+		close(op.done)
+	}()
+}
+
+// instanceOperations - the running and pending operations of one instance.
+type instanceOperations struct {
+	running *operation
+	pending []*operation
+}
+
+// OperationQueue - serializes the operations requested for a service
+// instance. Only one job runs at a time for an instance, the others wait in
+// order with their own token in the not yet started state. Requests with the
+// same hash as a running or pending operation are merged into it. The queue
+// subscribes to every WorkTopic to learn when a job is done.
+type OperationQueue struct {
+	mutex     sync.Mutex
+	engine    *WorkEngine
+	dao       SubscriberDAO
+	instances map[string]*instanceOperations
+}
+
+// NewOperationQueue - creates the operation queue and subscribes it to all
+// the topics of the engine.
+func NewOperationQueue(engine *WorkEngine, dao SubscriberDAO) *OperationQueue {
+	q := &OperationQueue{
+		engine:    engine,
+		dao:       dao,
+		instances: map[string]*instanceOperations{},
+	}
+	for topic := range workTopicSet {
+		engine.AttachSubscriber(q, topic)
+	}
+	return q
+}
+
+// requestHash - hashes an operation request. Requests for the same method,
+// on the same id, with the same content have the same hash.
+func requestHash(method bundle.JobMethod, id string, request interface{}) string {
+	b, err := json.Marshal(struct {
+		Method  bundle.JobMethod `json:"method"`
+		ID      string           `json:"id"`
+		Request interface{}      `json:"request"`
+	}{method, id, request})
+	if err != nil {
+		// unhashable requests are never merged
+		log.Warningf("unable to hash %v request for %v - %v", method, id, err)
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Duplicate - returns the token of the running or pending operation of the
+// instance with the given hash.
+func (q *OperationQueue) Duplicate(instanceID string, hash string) (string, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.duplicate(instanceID, hash)
+}
+
+func (q *OperationQueue) duplicate(instanceID string, hash string) (string, bool) {
+	ops, ok := q.instances[instanceID]
+	if !ok || hash == "" {
+		return "", false
+	}
+	if ops.running != nil && ops.running.hash == hash {
+		return ops.running.token, true
+	}
+	for _, op := range ops.pending {
+		if op.hash == hash {
+			return op.token, true
+		}
+	}
+	return "", false
+}
+
+// Hashed - true if the operation of the instance with the token is queued or
+// running with the hash of its request. The request of a recovered operation
+// is not known.
+func (q *OperationQueue) Hashed(instanceID string, token string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if _, ok := q.instances[instanceID]; !ok {
+		return false
+	}
+	op := q.find(instanceID, token)
+	return op != nil && op.hash != ""
+}
+
+// StartAsync - starts the job if the instance has no running operation,
+// otherwise queues it. Returns the token of the operation, and true if the
+// request was merged into an existing operation.
+func (q *OperationQueue) StartAsync(
+	instanceID string, hash string, token string, work Work, topic WorkTopic,
+) (string, bool, error) {
+	op, merged, err := q.submit(instanceID, hash, token, work, topic)
+	return op.token, merged, err
+}
+
+// StartSync - same as StartAsync, but waits for the job to finish and its
+// final state to be persisted.
+func (q *OperationQueue) StartSync(
+	instanceID string, hash string, token string, work Work, topic WorkTopic,
+) (string, bool, error) {
+	op, merged, err := q.submit(instanceID, hash, token, work, topic)
+	if err != nil {
+		return op.token, merged, err
+	}
+	<-op.done
+	return op.token, merged, nil
+}
+
+func (q *OperationQueue) submit(
+	instanceID string, hash string, token string, work Work, topic WorkTopic,
+) (*operation, bool, error) {
+	if token == "" {
+		token = q.engine.Token()
+	}
+	q.mutex.Lock()
+	if existing, ok := q.duplicate(instanceID, hash); ok {
+		op := q.find(instanceID, existing)
+		q.mutex.Unlock()
+		log.Infof("%v request for instance %v merged into operation %v", work.Method(), instanceID, existing)
+		return op, true, nil
+	}
+	op := &operation{token: token, hash: hash, work: work, topic: topic, done: make(chan struct{})}
+	op.watch(q.engine)
+	ops, ok := q.instances[instanceID]
+	if !ok {
+		ops = &instanceOperations{}
+		q.instances[instanceID] = ops
+	}
+	if ops.running != nil {
+		ops.pending = append(ops.pending, op)
+		position := len(ops.pending)
+		q.mutex.Unlock()
+
+		log.Infof("%v operation %v queued for instance %v at position %d", work.Method(), token, instanceID, position)
+		if err := q.setQueuedState(op, position); err != nil {
+			q.remove(instanceID, op)
+			op.unwatch()
+			return op, false, err
+		}
+		return op, false, nil
+	}
+	ops.running = op
+	q.mutex.Unlock()
+
+	if err := q.start(instanceID, op); err != nil {
+		return op, false, err
+	}
+	return op, false, nil
+}
+
+// find - returns the running or pending operation with the token. Must be
+// called with the mutex held.
+func (q *OperationQueue) find(instanceID string, token string) *operation {
+	ops := q.instances[instanceID]
+	if ops.running != nil && ops.running.token == token {
+		return ops.running
+	}
+	for _, op := range ops.pending {
+		if op.token == token {
+			return op
+		}
+	}
+	return nil
+}
+
+// start - starts the job of the running operation of an instance. On error
+// the operation is finished and the next one is started.
+func (q *OperationQueue) start(instanceID string, op *operation) error {
+	_, err := q.engine.StartNewAsyncJob(op.token, op.work, op.topic)
+	if err != nil {
+		log.Errorf("unable to start %v operation %v for instance %v - %v", op.work.Method(), op.token, instanceID, err)
+		op.unwatch()
+		q.finish(instanceID, op.token)
+	}
+	return err
+}
+
+// Cancel - removes a pending operation from the queue. Its work is never run,
+// a job reporting it as cancelled is run in its place so that the
+// subscribers learn of its failure. Returns false if no operation is pending
+// with the token.
+func (q *OperationQueue) Cancel(token string, user string) bool {
+	q.mutex.Lock()
+	var cancelled *operation
+	moved := []*operation{}
+	for _, ops := range q.instances {
+		for i, op := range ops.pending {
+			if op.token == token {
+				cancelled = op
+				ops.pending = append(ops.pending[:i], ops.pending[i+1:]...)
+				moved = append(moved, ops.pending[i:]...)
+				break
+			}
+		}
+	}
+	q.mutex.Unlock()
+	if cancelled == nil {
+		return false
+	}
+	q.updatePositions(moved)
+	job := &failedJob{id: cancelled.work.ID(), state: bundle.JobState{
+		Token:       cancelled.token,
+		State:       bundle.StateFailed,
+		Method:      cancelled.work.Method(),
+		Error:       ErrorJobCancelled.Error(),
+		Description: cancelledBy(user),
+	}}
+	if _, err := q.engine.StartNewAsyncJob(cancelled.token, job, cancelled.topic); err != nil {
+		log.Errorf("unable to report cancelled operation %v - %v", token, err)
+		cancelled.unwatch()
+	}
+	return true
+}
+
+// Notify - starts the next operation of an instance once the job of the
+// running operation has finished.
+func (q *OperationQueue) Notify(msg JobMsg) {
+	if msg.State.State != bundle.StateSucceeded && msg.State.State != bundle.StateFailed {
+		return
+	}
+	q.finish(msg.InstanceUUID, msg.JobToken)
+}
+
+// ID - the id of the subscriber.
+func (q *OperationQueue) ID() string {
+	return "operationqueue"
+}
+
+func (q *OperationQueue) finish(instanceID string, token string) {
+	q.mutex.Lock()
+	ops, ok := q.instances[instanceID]
+	if !ok || ops.running == nil || ops.running.token != token {
+		q.mutex.Unlock()
+		return
+	}
+	if len(ops.pending) == 0 {
+		delete(q.instances, instanceID)
+		q.mutex.Unlock()
+		return
+	}
+	next := ops.pending[0]
+	ops.pending = ops.pending[1:]
+	ops.running = next
+	moved := append([]*operation{}, ops.pending...)
+	q.mutex.Unlock()
+
+	log.Infof("starting queued %v operation %v for instance %v", next.work.Method(), next.token, instanceID)
+	q.start(instanceID, next)
+	q.updatePositions(moved)
+}
+
+// updatePositions - reports the new position of pending operations that moved
+// up in the queue of their instance.
+func (q *OperationQueue) updatePositions(moved []*operation) {
+	for _, op := range moved {
+		q.mutex.Lock()
+		position := 0
+		for instanceID, ops := range q.instances {
+			for i, pending := range ops.pending {
+				if pending == op {
+					position = i + 1
+					log.Debugf("operation %v for instance %v now at position %d", op.token, instanceID, position)
+				}
+			}
+		}
+		q.mutex.Unlock()
+		if position == 0 {
+			// started or cancelled in the meantime
+			continue
+		}
+		if err := q.setQueuedState(op, position); err != nil {
+			log.Errorf("unable to update queued operation %v - %v", op.token, err)
+		}
+	}
+}
+
+func (q *OperationQueue) remove(instanceID string, op *operation) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	ops, ok := q.instances[instanceID]
+	if !ok {
+		return
+	}
+	for i, pending := range ops.pending {
+		if pending == op {
+			ops.pending = append(ops.pending[:i], ops.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *OperationQueue) setQueuedState(op *operation, position int) error {
+	_, err := q.dao.SetState(op.work.ID(), bundle.JobState{
+		Token:       op.token,
+		State:       bundle.StateNotYetStarted,
+		Method:      op.work.Method(),
+		Description: operationQueuedDescription(position),
+	})
+	return err
+}
+
+func operationQueuedDescription(position int) string {
+	return fmt.Sprintf("waiting for %d earlier operation(s) on the instance to finish", position)
+}
@@ -0,0 +1,249 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
+	"github.com/stretchr/testify/mock"
+)
+
+// queueWork - work that runs until released, then reports success for the
+// instance.
+type queueWork struct {
+	instanceID string
+	started    chan string
+	release    chan struct{}
+}
+
+func newQueueWork(instanceID string) *queueWork {
+	return &queueWork{
+		instanceID: instanceID,
+		started:    make(chan string, 1),
+		release:    make(chan struct{}),
+	}
+}
+
+func (qw *queueWork) ID() string {
+	return qw.instanceID
+}
+
+func (qw *queueWork) Method() bundle.JobMethod {
+	return bundle.JobMethodUpdate
+}
+
+func (qw *queueWork) Run(ctx context.Context, token string, msgBuffer chan<- JobMsg) {
+	qw.started <- token
+	state := bundle.StateSucceeded
+	select {
+	case <-qw.release:
+	case <-ctx.Done():
+		state = bundle.StateFailed
+	}
+	msgBuffer <- JobMsg{
+		InstanceUUID: qw.instanceID,
+		JobToken:     token,
+		State:        bundle.JobState{Token: token, State: state, Method: bundle.JobMethodUpdate},
+	}
+}
+
+func waitForStart(t *testing.T, w *queueWork) string {
+	select {
+	case token := <-w.started:
+		return token
+	case <-time.After(time.Second):
+		t.Fatal("work was not started")
+	}
+	return ""
+}
+
+func assertNotStarted(t *testing.T, w *queueWork) {
+	select {
+	case <-w.started:
+		t.Fatal("work should not have been started")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func newTestOperationQueue() (*OperationQueue, *dao.MockDao) {
+	queueDao := &dao.MockDao{}
+	queueDao.On("SetState", mock.Anything, mock.Anything).Return("", nil)
+	engine := NewWorkEngine(10, 1, queueDao)
+	return NewOperationQueue(engine, queueDao), queueDao
+}
+
+func TestRequestHash(t *testing.T) {
+	req := &UpdateRequest{PlanID: "plan", Parameters: map[string]string{"a": "1", "b": "2"}}
+	same := &UpdateRequest{PlanID: "plan", Parameters: map[string]string{"b": "2", "a": "1"}}
+	other := &UpdateRequest{PlanID: "plan", Parameters: map[string]string{"a": "2"}}
+
+	ft.AssertEqual(t, requestHash(bundle.JobMethodUpdate, "id", req), requestHash(bundle.JobMethodUpdate, "id", same))
+	ft.AssertNotEqual(t, requestHash(bundle.JobMethodUpdate, "id", req), requestHash(bundle.JobMethodUpdate, "id", other))
+	ft.AssertNotEqual(t, requestHash(bundle.JobMethodUpdate, "id", req), requestHash(bundle.JobMethodUpdate, "other", req))
+	ft.AssertNotEqual(t, requestHash(bundle.JobMethodUpdate, "id", req), requestHash(bundle.JobMethodBind, "id", req))
+}
+
+func TestOperationQueueSerializesInstanceOperations(t *testing.T) {
+	q, queueDao := newTestOperationQueue()
+	first := newQueueWork("instance")
+	second := newQueueWork("instance")
+	other := newQueueWork("other-instance")
+
+	token, merged, err := q.StartAsync("instance", "first", "first-token", first, UpdateTopic)
+	ft.AssertNil(t, err)
+	ft.AssertFalse(t, merged)
+	ft.AssertEqual(t, token, "first-token")
+	waitForStart(t, first)
+
+	token, merged, err = q.StartAsync("instance", "second", "second-token", second, UpdateTopic)
+	ft.AssertNil(t, err)
+	ft.AssertFalse(t, merged)
+	ft.AssertEqual(t, token, "second-token")
+	assertNotStarted(t, second)
+	queueDao.AssertCalled(t, "SetState", "instance", bundle.JobState{
+		Token:       "second-token",
+		State:       bundle.StateNotYetStarted,
+		Method:      bundle.JobMethodUpdate,
+		Description: "waiting for 1 earlier operation(s) on the instance to finish",
+	})
+
+	// other instances are not held back
+	_, _, err = q.StartAsync("other-instance", "other", "other-token", other, UpdateTopic)
+	ft.AssertNil(t, err)
+	waitForStart(t, other)
+	close(other.release)
+
+	close(first.release)
+	ft.AssertEqual(t, waitForStart(t, second), "second-token")
+	close(second.release)
+}
+
+func TestOperationQueueMergesDuplicates(t *testing.T) {
+	q, _ := newTestOperationQueue()
+	first := newQueueWork("instance")
+	pending := newQueueWork("instance")
+
+	_, _, err := q.StartAsync("instance", "running-hash", "first-token", first, UpdateTopic)
+	ft.AssertNil(t, err)
+	waitForStart(t, first)
+	_, _, err = q.StartAsync("instance", "pending-hash", "pending-token", pending, UpdateTopic)
+	ft.AssertNil(t, err)
+
+	token, ok := q.Duplicate("instance", "running-hash")
+	ft.AssertTrue(t, ok)
+	ft.AssertEqual(t, token, "first-token")
+
+	token, merged, err := q.StartAsync("instance", "pending-hash", "new-token", newQueueWork("instance"), UpdateTopic)
+	ft.AssertNil(t, err)
+	ft.AssertTrue(t, merged)
+	ft.AssertEqual(t, token, "pending-token")
+
+	_, ok = q.Duplicate("instance", "unknown-hash")
+	ft.AssertFalse(t, ok)
+	_, ok = q.Duplicate("other-instance", "running-hash")
+	ft.AssertFalse(t, ok)
+
+	close(first.release)
+	waitForStart(t, pending)
+	close(pending.release)
+}
+
+func TestOperationQueueCancelPending(t *testing.T) {
+	q, _ := newTestOperationQueue()
+	received := make(chan JobMsg, 5)
+	q.engine.AttachSubscriber(&mockSubscriber{
+		funcToCall: func(msg JobMsg) {
+			received <- msg
+		},
+	}, UpdateTopic)
+
+	first := newQueueWork("instance")
+	pending := newQueueWork("instance")
+	_, _, err := q.StartAsync("instance", "first", "first-token", first, UpdateTopic)
+	ft.AssertNil(t, err)
+	waitForStart(t, first)
+	_, _, err = q.StartAsync("instance", "pending", "pending-token", pending, UpdateTopic)
+	ft.AssertNil(t, err)
+
+	ft.AssertFalse(t, q.Cancel("first-token", "admin"), "running operations are cancelled by the engine")
+	ft.AssertTrue(t, q.Cancel("pending-token", "admin"))
+
+	select {
+	case msg := <-received:
+		ft.AssertEqual(t, msg.JobToken, "pending-token")
+		ft.AssertEqual(t, msg.InstanceUUID, "instance")
+		ft.AssertEqual(t, msg.State.State, bundle.StateFailed)
+		ft.AssertEqual(t, msg.State.Description, "cancelled by admin")
+	case <-time.After(time.Second):
+		t.Fatal("subscribers were not notified of the cancelled operation")
+	}
+	_, ok := q.Duplicate("instance", "pending")
+	ft.AssertFalse(t, ok)
+	close(first.release)
+	// the work of the cancelled operation is never run
+	assertNotStarted(t, pending)
+}
+
+func TestOperationQueueStartSyncWaitsForSubscribers(t *testing.T) {
+	q, _ := newTestOperationQueue()
+	persisted := make(chan struct{})
+	q.engine.AttachSubscriber(&mockSubscriber{
+		funcToCall: func(msg JobMsg) {
+			if msg.State.State == bundle.StateSucceeded {
+				time.Sleep(100 * time.Millisecond)
+				close(persisted)
+			}
+		},
+	}, UpdateTopic)
+
+	work := newQueueWork("instance")
+	close(work.release)
+	_, _, err := q.StartSync("instance", "hash", "token", work, UpdateTopic)
+	ft.AssertNil(t, err)
+	select {
+	case <-persisted:
+	default:
+		t.Fatal("StartSync returned before the subscribers handled the final state")
+	}
+}
+
+func TestOperationQueueHashed(t *testing.T) {
+	q, _ := newTestOperationQueue()
+	recovered := newQueueWork("instance")
+	hashed := newQueueWork("instance")
+
+	// recovered operations are queued without the hash of their request
+	_, _, err := q.StartAsync("instance", "", "recovered-token", recovered, UpdateTopic)
+	ft.AssertNil(t, err)
+	waitForStart(t, recovered)
+	_, _, err = q.StartAsync("instance", "hash", "hashed-token", hashed, UpdateTopic)
+	ft.AssertNil(t, err)
+
+	ft.AssertFalse(t, q.Hashed("instance", "recovered-token"))
+	ft.AssertTrue(t, q.Hashed("instance", "hashed-token"))
+	ft.AssertFalse(t, q.Hashed("instance", "unknown-token"))
+	ft.AssertFalse(t, q.Hashed("other-instance", "hashed-token"))
+
+	close(recovered.release)
+	waitForStart(t, hashed)
+	close(hashed.release)
+}
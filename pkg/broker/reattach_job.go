@@ -0,0 +1,116 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/automationbroker/bundle-lib/runtime"
+	log "github.com/sirupsen/logrus"
+)
+
+// watchPodFn - watches a bundle pod until it completes, reporting the
+// descriptions it sets. Returns the namespace of the pod.
+type watchPodFn func(podName string, update func(description string)) (string, error)
+
+// completeFn - finishes a job once its bundle pod has succeeded.
+type completeFn func(podNamespace string) error
+
+// reattachJob - follows the bundle pod of a job that was running when the
+// broker stopped, instead of running the bundle again.
+type reattachJob struct {
+	apbJob
+	podName  string
+	watch    watchPodFn
+	complete completeFn
+}
+
+func (j *reattachJob) Run(ctx context.Context, token string, msgBuffer chan<- JobMsg) {
+	j.metricsJobStartHook()
+	defer j.metricsJobFinishedHook()
+
+	if ctx.Err() != nil {
+		msgBuffer <- j.createCancelledJobMsg(ctx, j.podName, token)
+		return
+	}
+	msgBuffer <- j.createJobMsg(j.podName, token, bundle.StateInProgress,
+		fmt.Sprintf("reattached to pod %s after a broker restart", j.podName))
+
+	updates := make(chan string)
+	done := make(chan error, 1)
+	// stops the watch from sending updates once the job has returned
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		podNamespace, err := j.watch(j.podName, func(description string) {
+			select {
+			case updates <- description:
+			case <-stopped:
+			}
+		})
+		if err == nil {
+			err = j.complete(podNamespace)
+		}
+		done <- err
+	}()
+
+	for {
+		select {
+		case description := <-updates:
+			msgBuffer <- j.createJobMsg(j.podName, token, bundle.StateInProgress, description)
+		case err := <-done:
+			if err != nil {
+				log.Errorf("broker::%s reattached job %s failed - %v", j.method, token, err)
+				jobMsg := j.createJobMsg(j.podName, token, bundle.StateFailed, fmt.Sprintf(
+					"Error occurred during %s. Please contact administrator if the issue persists.", j.method))
+				jobMsg.State.Error = err.Error()
+				msgBuffer <- jobMsg
+				return
+			}
+			msgBuffer <- j.createJobMsg(j.podName, token, bundle.StateSucceeded,
+				fmt.Sprintf("%s job completed", j.method))
+			return
+		case <-ctx.Done():
+			log.Infof("broker::%s reattached job %s stopped: %s", j.method, token, CancelReason(ctx))
+			if err := j.stop(j.podName); err != nil {
+				log.Errorf("broker::%s unable to stop pod %s - %v", j.method, j.podName, err)
+			}
+			msgBuffer <- j.createCancelledJobMsg(ctx, j.podName, token)
+			return
+		}
+	}
+}
+
+// watchBundlePod - watches the bundle pod until it completes.
+func watchBundlePod(podName string, update func(description string)) (string, error) {
+	pods, err := findBundlePods(podName)
+	if err != nil {
+		return "", err
+	}
+	if len(pods) == 0 {
+		return "", fmt.Errorf("bundle pod %s no longer exists", podName)
+	}
+	namespace := pods[0].Namespace
+	err = runtime.Provider.WatchRunningBundle(podName, namespace, func(lastOperation string, _ string) {
+		if lastOperation != "" {
+			update(lastOperation)
+		}
+	})
+	return namespace, err
+}
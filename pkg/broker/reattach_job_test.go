@@ -0,0 +1,131 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReattachJob(watch watchPodFn, complete completeFn, stop stopFn) *reattachJob {
+	bindingID := "binding"
+	return &reattachJob{
+		apbJob: apbJob{
+			serviceInstanceID:      "instance",
+			bindingID:              &bindingID,
+			method:                 bundle.JobMethodBind,
+			stop:                   stop,
+			metricsJobStartHook:    func() {},
+			metricsJobFinishedHook: func() {},
+		},
+		podName:  "bundle-1234",
+		watch:    watch,
+		complete: complete,
+	}
+}
+
+func runReattachJob(job *reattachJob) []JobMsg {
+	ctx, _ := newJobContext()
+	msgs := make(chan JobMsg, 10)
+	job.Run(ctx, "token", msgs)
+	close(msgs)
+	result := []JobMsg{}
+	for msg := range msgs {
+		result = append(result, msg)
+	}
+	return result
+}
+
+func TestReattachJobSucceeds(t *testing.T) {
+	completedIn := ""
+	job := newTestReattachJob(
+		func(podName string, update func(string)) (string, error) {
+			update("creating database")
+			return "sandbox-ns", nil
+		},
+		func(podNamespace string) error {
+			completedIn = podNamespace
+			return nil
+		}, nil)
+
+	msgs := runReattachJob(job)
+	if assert.Len(t, msgs, 3) {
+		assert.Equal(t, bundle.StateInProgress, msgs[0].State.State)
+		assert.Equal(t, "reattached to pod bundle-1234 after a broker restart", msgs[0].State.Description)
+		assert.Equal(t, "creating database", msgs[1].State.Description)
+		assert.Equal(t, bundle.StateSucceeded, msgs[2].State.State)
+		assert.Equal(t, "binding", msgs[2].BindingUUID)
+		assert.Equal(t, "bundle-1234", msgs[2].PodName)
+	}
+	assert.Equal(t, "sandbox-ns", completedIn)
+}
+
+func TestReattachJobFails(t *testing.T) {
+	completed := false
+	job := newTestReattachJob(
+		func(podName string, update func(string)) (string, error) {
+			return "", errors.New("bundle pod bundle-1234 no longer exists")
+		},
+		func(podNamespace string) error {
+			completed = true
+			return nil
+		}, nil)
+
+	msgs := runReattachJob(job)
+	last := msgs[len(msgs)-1]
+	assert.Equal(t, bundle.StateFailed, last.State.State)
+	assert.Equal(t, "bundle pod bundle-1234 no longer exists", last.State.Error)
+	assert.False(t, completed)
+}
+
+func TestReattachJobCancelled(t *testing.T) {
+	stopped := make(chan string, 1)
+	release := make(chan struct{})
+	defer close(release)
+	job := newTestReattachJob(
+		func(podName string, update func(string)) (string, error) {
+			<-release
+			update("too late")
+			return "sandbox-ns", nil
+		},
+		func(string) error { return nil },
+		func(podName string) error {
+			stopped <- podName
+			return nil
+		})
+
+	ctx, cancellation := newJobContext()
+	msgs := make(chan JobMsg, 10)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancellation.cancelWith(ErrorJobCancelled, cancelledBy("admin"))
+	}()
+	job.Run(ctx, "token", msgs)
+	close(msgs)
+
+	var last JobMsg
+	for msg := range msgs {
+		last = msg
+	}
+	assert.Equal(t, bundle.StateFailed, last.State.State)
+	assert.Equal(t, "cancelled by admin", last.State.Description)
+	assert.Equal(t, "bundle-1234", <-stopped)
+}
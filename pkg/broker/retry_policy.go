@@ -0,0 +1,222 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/automationbroker/bundle-lib/runtime"
+	"github.com/automationbroker/config"
+	log "github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// ErrorClass - a class of job errors that a RetryPolicy can retry.
+type ErrorClass string
+
+const (
+	// ErrorClassImagePull - the bundle image could not be pulled.
+	ErrorClassImagePull ErrorClass = "image_pull"
+	// ErrorClassConflict - an API request conflicted with another update.
+	ErrorClassConflict ErrorClass = "conflict"
+	// ErrorClassEvicted - the bundle pod was evicted from its node.
+	ErrorClassEvicted ErrorClass = "evicted"
+	// ErrorClassOther - any other error, never retried.
+	ErrorClassOther ErrorClass = "other"
+)
+
+// retryPolicyAlphaKey - the spec alpha key overriding the retry policy.
+const retryPolicyAlphaKey = "retry_policy"
+
+const (
+	defaultInitialBackoff = 10 * time.Second
+	defaultMaxBackoff     = 5 * time.Minute
+)
+
+// RetryPolicy - how many times and how often a failed job is attempted
+// again. A MaxAttempts of 1 or less means the job is never retried.
+type RetryPolicy struct {
+	MaxAttempts     int
+	InitialBackoff  time.Duration
+	MaxBackoff      time.Duration
+	RetryableErrors []ErrorClass
+}
+
+// RetryPolicies - the retry policy of each JobMethod.
+type RetryPolicies map[bundle.JobMethod]RetryPolicy
+
+// NewRetryPolicies - reads the retry policies from the retry_policies sub
+// config of the broker section, keyed by job method.
+func NewRetryPolicies(c *config.Config) RetryPolicies {
+	policies := RetryPolicies{}
+	for method, value := range c.GetSubConfig("retry_policies").ToMap() {
+		m, ok := toStringMap(value)
+		if !ok {
+			log.Warningf("ignoring retry policy for %v, expected a map", method)
+			continue
+		}
+		policies[bundle.JobMethod(method)] = parseRetryPolicy(RetryPolicy{}, m)
+	}
+	return policies
+}
+
+// ForSpec - returns the retry policy of a job method, overridden by the
+// retry_policy alpha field of the spec.
+func (p RetryPolicies) ForSpec(method bundle.JobMethod, spec *bundle.Spec) RetryPolicy {
+	policy := p[method]
+	if spec == nil {
+		return policy
+	}
+	if override, ok := spec.Alpha[retryPolicyAlphaKey]; ok {
+		m, ok := toStringMap(override)
+		if !ok {
+			log.Warningf("ignoring %s alpha field of spec %v, expected a map", retryPolicyAlphaKey, spec.FQName)
+			return policy
+		}
+		policy = parseRetryPolicy(policy, m)
+	}
+	return policy
+}
+
+// parseRetryPolicy - overrides the fields of the policy set in the map.
+func parseRetryPolicy(policy RetryPolicy, m map[string]interface{}) RetryPolicy {
+	if v, ok := toInt(m["max_attempts"]); ok {
+		policy.MaxAttempts = v
+	}
+	if v, ok := toDuration(m["initial_backoff"]); ok {
+		policy.InitialBackoff = v
+	}
+	if v, ok := toDuration(m["max_backoff"]); ok {
+		policy.MaxBackoff = v
+	}
+	if v, ok := m["retryable_errors"].([]interface{}); ok {
+		policy.RetryableErrors = []ErrorClass{}
+		for _, class := range v {
+			policy.RetryableErrors = append(policy.RetryableErrors, ErrorClass(fmt.Sprintf("%v", class)))
+		}
+	}
+	return policy
+}
+
+// Retries - true if a job failing with err on the given attempt is attempted
+// again.
+func (p RetryPolicy) Retries(attempt int, err error) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	class := classifyError(err)
+	retryable := p.RetryableErrors
+	if retryable == nil {
+		retryable = []ErrorClass{ErrorClassImagePull, ErrorClassConflict, ErrorClassEvicted}
+	}
+	for _, c := range retryable {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff - how long to wait after the given failed attempt. Doubles with
+// every attempt, up to MaxBackoff.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff, max := p.InitialBackoff, p.MaxBackoff
+	if backoff <= 0 {
+		backoff = defaultInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	for i := 1; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// classifyError - returns the class of a job error.
+func classifyError(err error) ErrorClass {
+	switch {
+	case err == nil:
+		return ErrorClassOther
+	case err == runtime.ErrorPodPullErr:
+		return ErrorClassImagePull
+	case apierrors.IsConflict(err),
+		strings.Contains(err.Error(), "the object has been modified"):
+		return ErrorClassConflict
+	case strings.Contains(strings.ToLower(err.Error()), "evicted"):
+		return ErrorClassEvicted
+	}
+	return ErrorClassOther
+}
+
+// retryDescription - the job state description of a retried attempt.
+func retryDescription(attempt int, maxAttempts int, description string) string {
+	retry := fmt.Sprintf("retry %d/%d", attempt, maxAttempts)
+	if description == "" {
+		return retry
+	}
+	return fmt.Sprintf("%s: %s", retry, description)
+}
+
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for key, value := range m {
+			converted[fmt.Sprintf("%v", key)] = value
+		}
+		return converted, true
+	}
+	return nil, false
+}
+
+func toInt(v interface{}) (int, bool) {
+	switch i := v.(type) {
+	case int:
+		return i, true
+	case int64:
+		return int(i), true
+	case float64:
+		return int(i), true
+	}
+	return 0, false
+}
+
+func toDuration(v interface{}) (time.Duration, bool) {
+	switch d := v.(type) {
+	case string:
+		duration, err := time.ParseDuration(d)
+		if err != nil {
+			log.Warningf("ignoring invalid duration %q - %v", d, err)
+			return 0, false
+		}
+		return duration, true
+	case int, int64, float64:
+		// plain numbers are seconds
+		seconds, _ := toInt(d)
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
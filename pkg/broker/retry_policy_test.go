@@ -0,0 +1,142 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/automationbroker/bundle-lib/runtime"
+	"github.com/automationbroker/config"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestNewRetryPolicies(t *testing.T) {
+	c := config.NewConfigFromMap(map[string]interface{}{
+		"retry_policies": map[string]interface{}{
+			"provision": map[string]interface{}{
+				"max_attempts":     5,
+				"initial_backoff":  "30s",
+				"max_backoff":      "10m",
+				"retryable_errors": []interface{}{"image_pull"},
+			},
+			"bind": map[string]interface{}{
+				"max_attempts": 2,
+			},
+		},
+	})
+	policies := NewRetryPolicies(c)
+
+	assert.Equal(t, RetryPolicy{
+		MaxAttempts:     5,
+		InitialBackoff:  30 * time.Second,
+		MaxBackoff:      10 * time.Minute,
+		RetryableErrors: []ErrorClass{ErrorClassImagePull},
+	}, policies[bundle.JobMethodProvision])
+	assert.Equal(t, RetryPolicy{MaxAttempts: 2}, policies[bundle.JobMethodBind])
+	assert.Equal(t, RetryPolicy{}, policies[bundle.JobMethodUpdate])
+	assert.Equal(t, 0, len(NewRetryPolicies(&config.Config{})))
+}
+
+func TestRetryPolicyForSpec(t *testing.T) {
+	policies := RetryPolicies{
+		bundle.JobMethodProvision: {MaxAttempts: 3, InitialBackoff: time.Second},
+	}
+
+	cases := []struct {
+		name     string
+		spec     *bundle.Spec
+		expected RetryPolicy
+	}{
+		{
+			name:     "no spec",
+			expected: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second},
+		},
+		{
+			name:     "spec without override",
+			spec:     &bundle.Spec{},
+			expected: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second},
+		},
+		{
+			name: "override stored as json",
+			spec: &bundle.Spec{Alpha: map[string]interface{}{
+				"retry_policy": map[string]interface{}{"max_attempts": float64(5), "max_backoff": float64(60)},
+			}},
+			expected: RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: time.Minute},
+		},
+		{
+			name: "override read from yaml",
+			spec: &bundle.Spec{Alpha: map[string]interface{}{
+				"retry_policy": map[interface{}]interface{}{"retryable_errors": []interface{}{"conflict"}},
+			}},
+			expected: RetryPolicy{
+				MaxAttempts:     3,
+				InitialBackoff:  time.Second,
+				RetryableErrors: []ErrorClass{ErrorClassConflict},
+			},
+		},
+		{
+			name: "invalid override is ignored",
+			spec: &bundle.Spec{Alpha: map[string]interface{}{
+				"retry_policy": "always",
+			}},
+			expected: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, policies.ForSpec(bundle.JobMethodProvision, tc.spec))
+		})
+	}
+}
+
+func TestRetryPolicyRetries(t *testing.T) {
+	conflict := apierrors.NewConflict(schema.GroupResource{Resource: "pods"}, "pod", errors.New("changed"))
+	evicted := errors.New("The node was low on resource: memory. Pod was Evicted")
+
+	policy := RetryPolicy{MaxAttempts: 3}
+	assert.True(t, policy.Retries(1, runtime.ErrorPodPullErr))
+	assert.True(t, policy.Retries(2, conflict))
+	assert.True(t, policy.Retries(1, evicted))
+	assert.False(t, policy.Retries(3, runtime.ErrorPodPullErr), "max attempts reached")
+	assert.False(t, policy.Retries(1, errors.New("playbook failed")))
+
+	imagePullOnly := RetryPolicy{MaxAttempts: 3, RetryableErrors: []ErrorClass{ErrorClassImagePull}}
+	assert.True(t, imagePullOnly.Retries(1, runtime.ErrorPodPullErr))
+	assert.False(t, imagePullOnly.Retries(1, conflict))
+
+	assert.False(t, RetryPolicy{}.Retries(1, runtime.ErrorPodPullErr), "no retries by default")
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, policy.Backoff(1))
+	assert.Equal(t, 2*time.Second, policy.Backoff(2))
+	assert.Equal(t, 4*time.Second, policy.Backoff(3))
+	assert.Equal(t, 5*time.Second, policy.Backoff(4))
+	assert.Equal(t, 5*time.Second, policy.Backoff(10))
+	assert.Equal(t, defaultInitialBackoff, RetryPolicy{}.Backoff(1))
+}
+
+func TestRetryDescription(t *testing.T) {
+	assert.Equal(t, "retry 2/5", retryDescription(2, 5, ""))
+	assert.Equal(t, "retry 2/5: action started", retryDescription(2, 5, "action started"))
+}
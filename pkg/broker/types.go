@@ -17,11 +17,13 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 
 	"github.com/automationbroker/bundle-lib/bundle"
 	schema "github.com/lestrrat/go-jsschema"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
 	"github.com/pborman/uuid"
 	log "github.com/sirupsen/logrus"
 	authv1 "k8s.io/api/authentication/v1"
@@ -60,6 +62,15 @@ var workTopicSet = map[WorkTopic]bool{
 	UnbindingTopic:   true,
 }
 
+// methodTopics - the topic the jobs of each method report to.
+var methodTopics = map[bundle.JobMethod]WorkTopic{
+	bundle.JobMethodProvision:   ProvisionTopic,
+	bundle.JobMethodDeprovision: DeprovisionTopic,
+	bundle.JobMethodUpdate:      UpdateTopic,
+	bundle.JobMethodBind:        BindingTopic,
+	bundle.JobMethodUnbind:      UnbindingTopic,
+}
+
 // IsValidWorkTopic - Check if WorkTopic is part of acceptable set
 func IsValidWorkTopic(topic WorkTopic) bool {
 	_, ok := workTopicSet[topic]
@@ -77,8 +88,8 @@ type Service struct {
 	Bindable             bool                   `json:"bindable"`
 	Metadata             map[string]interface{} `json:"metadata,omitempty"`
 	DashboardClient      *DashboardClient       `json:"dashboard_client,omitempty"`
-	InstancesRetrievable bool                   `json:"instances_retrievable"`
-	BindingsRetrievable  bool                   `json:"bindings_retrievable"`
+	InstancesRetrievable bool                   `json:"instances_retrievable,omitempty"`
+	BindingsRetrievable  bool                   `json:"bindings_retrievable,omitempty"`
 	PlanUpdatable        bool                   `json:"plan_updateable,omitempty"`
 	Plans                []Plan                 `json:"plans"`
 }
@@ -100,7 +111,7 @@ type Plan struct {
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
 	Free        bool                   `json:"free,omitempty"`
 	Bindable    bool                   `json:"bindable,omitempty"`
-	Schemas     Schema                 `json:"schemas,omitempty"`
+	Schemas     *Schema                `json:"schemas,omitempty"`
 	UpdatesTo   []string               `json:"updates_to,omitempty"`
 }
 
@@ -296,6 +307,9 @@ type JobMsg struct {
 	DashboardURL         string                      `json:"dashboard_url"`
 	BindingUUID          string                      `json:"binding_uuid"`
 	Error                string                      `json:"error"`
+	Namespace            string                      `json:"namespace"`
+	SpecFQName           string                      `json:"spec_fqname"`
+	PlanName             string                      `json:"plan_name"`
 }
 
 // Render - Display the job message.
@@ -312,6 +326,8 @@ type SubscriberDAO interface {
 	GetBindInstance(id string) (*bundle.BindInstance, error)
 	DeleteBinding(bundle.BindInstance, bundle.ServiceInstance) error
 	SetServiceInstance(id string, serviceInstance *bundle.ServiceInstance) error
+	types.VersionedServiceInstances
+	types.VersionedJobStates
 }
 
 // WorkSubscriber - Defines how a Subscriber can be notified of changes
@@ -320,11 +336,30 @@ type WorkSubscriber interface {
 	Notify(msg JobMsg)
 }
 
+// DeliverySubscriber - a WorkSubscriber reporting whether it handled a
+// message. Messages it fails to handle are saved as dead letters and
+// delivered again later. ctx is cancelled once the subscriber timeout
+// passes, the message is then delivered again and the subscriber must stop
+// handling it.
+type DeliverySubscriber interface {
+	WorkSubscriber
+	Deliver(ctx context.Context, msg JobMsg) error
+}
+
+// JobEndSubscriber - a WorkSubscriber told when a job of its topics ends,
+// whether or not the job sent a terminal message, e.g. when it timed out or
+// was cancelled.
+type JobEndSubscriber interface {
+	WorkSubscriber
+	JobEnded(token string)
+}
+
 // WorkFactory is a factory for creating Work items
 type WorkFactory interface {
 	NewProvisionJob(si *bundle.ServiceInstance) Work
 	NewDeprovisionJob(si *bundle.ServiceInstance, skipExecution bool) Work
 	NewUnbindJob(bindingID string, params *bundle.Parameters, si *bundle.ServiceInstance, skipExecution bool) Work
 	NewBindJob(bindingID string, bindingParams *bundle.Parameters, si *bundle.ServiceInstance) Work
-	NewUpdateJob(si *bundle.ServiceInstance) Work
+	NewUpdateJob(si *bundle.ServiceInstance, apply func() error) Work
+	NewReattachJob(method bundle.JobMethod, podName string, bindingID string, si *bundle.ServiceInstance) Work
 }
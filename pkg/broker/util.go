@@ -74,7 +74,7 @@ func toBrokerPlans(apbPlans []bundle.Plan) ([]Plan, error) {
 			Free:        plan.Free,
 			Bindable:    plan.Bindable,
 			UpdatesTo:   plan.UpdatesTo,
-			Schemas:     schemas,
+			Schemas:     &schemas,
 		}
 		i++
 	}
@@ -0,0 +1,215 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/automationbroker/config"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// WebhookSignatureHeader - the header holding the HMAC-SHA256 signature
+	// of the request body, computed with the secret of the webhook.
+	WebhookSignatureHeader = "X-Broker-Signature"
+
+	webhookEventSource       = "/ansible-service-broker"
+	webhookEventTypePrefix   = "io.automationbroker.job."
+	webhookContentType       = "application/cloudevents+json"
+	defaultWebhookTimeout    = 2 * time.Second
+	defaultWebhookAttempts   = 3
+	defaultWebhookBackoff    = 100 * time.Millisecond
+	defaultWebhookMaxBackoff = time.Second
+)
+
+// WebhookConfig - an endpoint job messages are published to.
+type WebhookConfig struct {
+	Name   string
+	URL    string
+	Secret string
+	// the topics published to the webhook, all of them when empty
+	Topics []WorkTopic
+	// bounds the whole delivery of a message, retries included
+	Timeout time.Duration
+	Retry   RetryPolicy
+}
+
+// NewWebhookConfig - reads a webhook from an entry of the webhooks config.
+func NewWebhookConfig(c *config.Config) (WebhookConfig, error) {
+	wc := WebhookConfig{
+		Name:    c.GetString("name"),
+		URL:     c.GetString("url"),
+		Secret:  c.GetString("secret"),
+		Timeout: defaultWebhookTimeout,
+		Retry: parseRetryPolicy(RetryPolicy{
+			MaxAttempts:    defaultWebhookAttempts,
+			InitialBackoff: defaultWebhookBackoff,
+			MaxBackoff:     defaultWebhookMaxBackoff,
+		}, c.ToMap()),
+	}
+	u, err := url.Parse(wc.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return wc, fmt.Errorf("invalid url %q for webhook %q", wc.URL, wc.Name)
+	}
+	if wc.Name == "" {
+		wc.Name = u.Host
+	}
+	for _, t := range c.GetSliceOfStrings("topics") {
+		topic, ok := methodTopics[bundle.JobMethod(t)]
+		if !ok {
+			return wc, fmt.Errorf("invalid topic %q for webhook %q", t, wc.Name)
+		}
+		wc.Topics = append(wc.Topics, topic)
+	}
+	if len(wc.Topics) == 0 {
+		wc.Topics = []WorkTopic{ProvisionTopic, DeprovisionTopic, UpdateTopic, BindingTopic, UnbindingTopic}
+	}
+	if timeout, ok := toDuration(c.ToMap()["timeout"]); ok && timeout > 0 {
+		wc.Timeout = timeout
+	}
+	return wc, nil
+}
+
+// cloudEvent - the CloudEvents 1.0 structured mode envelope of a job message.
+type cloudEvent struct {
+	SpecVersion     string `json:"specversion"`
+	Type            string `json:"type"`
+	Source          string `json:"source"`
+	ID              string `json:"id"`
+	Time            string `json:"time"`
+	Subject         string `json:"subject,omitempty"`
+	DataContentType string `json:"datacontenttype"`
+	Data            JobMsg `json:"data"`
+}
+
+// WebhookSubscriber - publishes the job messages of its topics to a webhook.
+// Each request is signed with the secret of the webhook and retried on
+// network errors and 5xx or 429 responses.
+type WebhookSubscriber struct {
+	config WebhookConfig
+	client *http.Client
+}
+
+// NewWebhookSubscriber - creates a subscriber for the webhook.
+func NewWebhookSubscriber(wc WebhookConfig) *WebhookSubscriber {
+	return &WebhookSubscriber{config: wc, client: &http.Client{}}
+}
+
+// ID - the id of the subscriber, unique per webhook.
+func (ws *WebhookSubscriber) ID() string {
+	return fmt.Sprintf("webhook:%s", ws.config.Name)
+}
+
+// Topics - the topics the subscriber is attached to.
+func (ws *WebhookSubscriber) Topics() []WorkTopic {
+	return ws.config.Topics
+}
+
+// Notify - publishes the message to the webhook.
+func (ws *WebhookSubscriber) Notify(msg JobMsg) {
+	if err := ws.Deliver(context.Background(), msg); err != nil {
+		log.Errorf("unable to publish job %v to %v - %v", msg.JobToken, ws.ID(), err)
+	}
+}
+
+// Deliver - publishes the message to the webhook, retrying until the
+// attempts of the webhook are exhausted, its timeout passes or ctx is done.
+func (ws *WebhookSubscriber) Deliver(ctx context.Context, msg JobMsg) error {
+	body, err := ws.envelope(msg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, ws.config.Timeout)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		retryable, err := ws.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= ws.config.Retry.MaxAttempts {
+			return err
+		}
+		log.Debugf("attempt %d to publish job %v to %v failed - %v", attempt, msg.JobToken, ws.ID(), err)
+		select {
+		case <-time.After(ws.config.Retry.Backoff(attempt)):
+		case <-ctx.Done():
+			return fmt.Errorf("%v, giving up after %d attempt(s): %v", err, attempt, ctx.Err())
+		}
+	}
+}
+
+// envelope - the signed body of the request. Extracted credentials are
+// never published.
+func (ws *WebhookSubscriber) envelope(msg JobMsg) ([]byte, error) {
+	msg.ExtractedCredentials = bundle.ExtractedCredentials{}
+	return json.Marshal(cloudEvent{
+		SpecVersion:     "1.0",
+		Type:            webhookEventTypePrefix + string(msg.State.Method),
+		Source:          webhookEventSource,
+		ID:              uuid.New(),
+		Time:            time.Now().UTC().Format(time.RFC3339),
+		Subject:         msg.JobToken,
+		DataContentType: "application/json",
+		Data:            msg,
+	})
+}
+
+// post - sends the body once, returning whether a failure is worth a retry.
+func (ws *WebhookSubscriber) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, ws.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", webhookContentType)
+	if ws.config.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhookBody(ws.config.Secret, body))
+	}
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook responded %v", resp.Status)
+	}
+	return false, fmt.Errorf("webhook rejected the event: %v", resp.Status)
+}
+
+// SignWebhookBody - the signature of a webhook request body, sent in the
+// WebhookSignatureHeader as sha256=<hex encoded HMAC>.
+func SignWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,164 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/automationbroker/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func testWebhookConfig(url string) WebhookConfig {
+	return WebhookConfig{
+		Name:    "test",
+		URL:     url,
+		Secret:  "s3cr3t",
+		Topics:  []WorkTopic{ProvisionTopic},
+		Timeout: time.Second,
+		Retry:   RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	}
+}
+
+func TestNewWebhookConfig(t *testing.T) {
+	wc, err := NewWebhookConfig(config.NewConfigFromMap(map[string]interface{}{
+		"url":          "https://chat.example.com/hooks/asb",
+		"secret":       "s3cr3t",
+		"topics":       []interface{}{"provision", "deprovision"},
+		"timeout":      "1s",
+		"max_attempts": 5,
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, "chat.example.com", wc.Name)
+	assert.Equal(t, []WorkTopic{ProvisionTopic, DeprovisionTopic}, wc.Topics)
+	assert.Equal(t, time.Second, wc.Timeout)
+	assert.Equal(t, 5, wc.Retry.MaxAttempts)
+	assert.Equal(t, defaultWebhookBackoff, wc.Retry.InitialBackoff)
+
+	wc, err = NewWebhookConfig(config.NewConfigFromMap(map[string]interface{}{
+		"name": "cmdb",
+		"url":  "http://cmdb.example.com",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, "cmdb", wc.Name)
+	assert.Equal(t, 5, len(wc.Topics))
+	assert.Equal(t, defaultWebhookTimeout, wc.Timeout)
+
+	_, err = NewWebhookConfig(config.NewConfigFromMap(map[string]interface{}{"url": "cmdb.example.com"}))
+	assert.Error(t, err)
+	_, err = NewWebhookConfig(config.NewConfigFromMap(map[string]interface{}{
+		"url":    "http://cmdb.example.com",
+		"topics": []interface{}{"provision_topic"},
+	}))
+	assert.Error(t, err)
+}
+
+func TestWebhookSubscriberDeliver(t *testing.T) {
+	received := make(chan cloudEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, webhookContentType, r.Header.Get("Content-Type"))
+		assert.Equal(t, SignWebhookBody("s3cr3t", body), r.Header.Get(WebhookSignatureHeader))
+		event := cloudEvent{}
+		assert.NoError(t, json.Unmarshal(body, &event))
+		received <- event
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	ws := NewWebhookSubscriber(testWebhookConfig(server.URL))
+	assert.Equal(t, "webhook:test", ws.ID())
+	err := ws.Deliver(context.Background(), JobMsg{
+		InstanceUUID:         "instance",
+		JobToken:             "token",
+		State:                bundle.JobState{State: bundle.StateSucceeded, Method: bundle.JobMethodProvision},
+		ExtractedCredentials: bundle.ExtractedCredentials{Credentials: map[string]interface{}{"password": "hunter2"}},
+	})
+	assert.NoError(t, err)
+
+	event := <-received
+	assert.Equal(t, "1.0", event.SpecVersion)
+	assert.Equal(t, "io.automationbroker.job.provision", event.Type)
+	assert.Equal(t, "token", event.Subject)
+	assert.Equal(t, "instance", event.Data.InstanceUUID)
+	assert.Equal(t, bundle.StateSucceeded, event.Data.State.State)
+	assert.Equal(t, 0, len(event.Data.ExtractedCredentials.Credentials), "credentials must not be published")
+}
+
+func TestWebhookSubscriberRetries(t *testing.T) {
+	cases := []struct {
+		name      string
+		statuses  []int
+		attempts  int32
+		delivered bool
+	}{
+		{name: "server error is retried", statuses: []int{500, 503, 200}, attempts: 3, delivered: true},
+		{name: "too many requests is retried", statuses: []int{429, 200}, attempts: 2, delivered: true},
+		{name: "gives up after max attempts", statuses: []int{500, 500, 500, 200}, attempts: 3},
+		{name: "rejected event is not retried", statuses: []int{400, 200}, attempts: 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&attempts, 1)
+				w.WriteHeader(tc.statuses[n-1])
+			}))
+			defer server.Close()
+
+			err := NewWebhookSubscriber(testWebhookConfig(server.URL)).Deliver(context.Background(), JobMsg{JobToken: "token"})
+			assert.Equal(t, tc.delivered, err == nil)
+			assert.Equal(t, tc.attempts, atomic.LoadInt32(&attempts))
+		})
+	}
+}
+
+func TestWebhookSubscriberTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	wc := testWebhookConfig(server.URL)
+	wc.Timeout = 50 * time.Millisecond
+	wc.Retry = RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Second}
+	start := time.Now()
+	assert.Error(t, NewWebhookSubscriber(wc).Deliver(context.Background(), JobMsg{JobToken: "token"}))
+	assert.True(t, time.Since(start) < time.Second, "delivery should stop at the timeout")
+}
+
+func TestWebhookSubscriberCancelled(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, NewWebhookSubscriber(testWebhookConfig(server.URL)).Deliver(ctx, JobMsg{JobToken: "token"}))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&attempts), "nothing is published once the delivery is cancelled")
+}
@@ -19,41 +19,102 @@ package broker
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/automationbroker/bundle-lib/bundle"
 	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
 	"github.com/pborman/uuid"
 	log "github.com/sirupsen/logrus"
 	"sync"
 	"time"
 )
 
-// Work - is the interface that wraps the basic run method.
+// Work - is the interface that wraps the basic run method. Run must return
+// once ctx is done, after sending a failed JobMsg whose description and error
+// are given by CancelReason(ctx) and CancelError(ctx). The engine sends that
+// message itself if the work does not.
 type Work interface {
 	ID() string
 	Method() bundle.JobMethod
-	Run(token string, msgBuffer chan<- JobMsg)
+	Run(ctx context.Context, token string, msgBuffer chan<- JobMsg)
 }
 
 // WorkEngine - a new engine for doing work.
 type WorkEngine struct {
 	subscribers   map[WorkTopic][]WorkSubscriber
 	jobChannels   map[string]chan JobMsg
+	activeJobs    map[string]*jobCancellation
+	jobMutex      *sync.RWMutex
 	jobBufferSize int
 	// the number of seconds given to each subscriber to complete its task
 	subscriberTimeout time.Duration
 	dao               dao.Dao
+	// when set, jobs over the concurrency limits wait in the pool's queue
+	pool *workerPool
+	// jobs running past the deadline of their method are stopped
+	deadlines JobDeadlines
+	// when set, messages the subscribers fail to handle are kept for a retry
+	deadLetters *DeadLetterQueue
+	// the channels streaming the messages of a job, keyed by token
+	watchers map[string][]chan JobMsg
 }
 
 // NewWorkEngine - creates a new work engine
 func NewWorkEngine(bufferSize int, subscriberTimeout time.Duration, dao dao.Dao) *WorkEngine {
 	return &WorkEngine{
 		jobChannels:       make(map[string]chan JobMsg),
+		activeJobs:        make(map[string]*jobCancellation),
+		watchers:          make(map[string][]chan JobMsg),
+		jobMutex:          &sync.RWMutex{},
 		subscribers:       map[WorkTopic][]WorkSubscriber{},
 		jobBufferSize:     bufferSize,
 		subscriberTimeout: subscriberTimeout,
 		dao:               dao}
 }
 
+// SetConcurrencyLimits - puts the engine in worker-pool mode. Jobs that would
+// go over the limits are queued in the not yet started state until a running
+// job finishes. Unlimited limits turn worker-pool mode off.
+func (engine *WorkEngine) SetConcurrencyLimits(limits ConcurrencyLimits) {
+	if limits.IsUnlimited() {
+		engine.pool = nil
+		return
+	}
+	log.Infof("WorkEngine running in worker-pool mode, limits: %+v", limits)
+	engine.pool = newWorkerPool(limits, engine.updateQueuePosition)
+}
+
+// SetJobDeadlines - sets how long the jobs of each method may run.
+func (engine *WorkEngine) SetJobDeadlines(deadlines JobDeadlines) {
+	if len(deadlines) > 0 {
+		log.Infof("WorkEngine enforcing job deadlines: %v", deadlines)
+	}
+	engine.deadlines = deadlines
+}
+
+// errJobStarted - the job is no longer waiting in the queue.
+var errJobStarted = errors.New("job already started")
+
+// updateQueuePosition - reports the position of a queued job through its
+// job state description, which is returned by last_operation. The position is
+// only written while the job has not started, so that a job that was started
+// or stopped in the meantime keeps its state.
+func (engine *WorkEngine) updateQueuePosition(job *queuedJob) {
+	err := types.UpdateState(engine.dao, job.work.ID(), job.token, func(state *bundle.JobState) error {
+		if state.State != bundle.StateNotYetStarted {
+			return errJobStarted
+		}
+		state.Method = job.work.Method()
+		state.Description = queuedDescription(job.position)
+		return nil
+	})
+	if err == errJobStarted {
+		log.Debugf("not updating the queue position of job %v, it already started", job.token)
+	} else if err != nil {
+		log.Errorf("unable to update queue position of job %v - %v", job.token, err)
+	}
+}
+
 // StartNewAsyncJob - Starts a job in an new goroutine, reporting to a specific topic.
 // returns token, or generated token if an empty token is passed in.
 func (engine *WorkEngine) StartNewAsyncJob(
@@ -69,22 +130,12 @@ func (engine *WorkEngine) StartNewAsyncJob(
 	if err := engine.setupJob(token, work); err != nil {
 		return token, err
 	}
-	go engine.runJob(token, work, topic)
+	ctx := engine.trackJob(token)
+	go engine.runPooledJob(ctx, token, work, topic)
 
 	return token, nil
 }
 
-func waitForNotify(ctx context.Context, sub WorkSubscriber, msg JobMsg, signal chan<- struct{}) {
-	sub.Notify(msg)
-	// avoid sending on a closed channel if the context is done
-	select {
-	case <-ctx.Done():
-		return
-	default:
-		signal <- struct{}{}
-	}
-}
-
 func (engine *WorkEngine) setupJob(token string, work Work) error {
 	if _, err := engine.dao.SetState(work.ID(), bundle.JobState{Token: token, State: bundle.StateNotYetStarted, Method: work.Method()}); err != nil {
 		return err
@@ -92,54 +143,210 @@ func (engine *WorkEngine) setupJob(token string, work Work) error {
 	return nil
 }
 
-func (engine *WorkEngine) runJob(token string, work Work, topic WorkTopic) {
+// trackJob - creates the context of a job and keeps it so the job can be
+// cancelled until it finishes.
+func (engine *WorkEngine) trackJob(token string) context.Context {
+	ctx, cancellation := newJobContext()
+	engine.jobMutex.Lock()
+	engine.activeJobs[token] = cancellation
+	engine.jobMutex.Unlock()
+	return ctx
+}
+
+// runPooledJob - waits for a slot in the worker pool, if there is one, before
+// running the job. A job cancelled while queued is still run, with a done
+// context, so that it reports its failure to the subscribers.
+func (engine *WorkEngine) runPooledJob(ctx context.Context, token string, work Work, topic WorkTopic) {
+	defer func() {
+		engine.jobMutex.Lock()
+		if cancellation, ok := engine.activeJobs[token]; ok {
+			// release the context resources
+			cancellation.cancel()
+			delete(engine.activeJobs, token)
+		}
+		engine.jobMutex.Unlock()
+	}()
+	pool := engine.pool
+	if pool != nil && pool.acquire(ctx, token, work, topic) {
+		defer pool.release(work, topic)
+	}
+	engine.runJob(ctx, token, work, topic)
+}
+
+func (engine *WorkEngine) runJob(ctx context.Context, token string, work Work, topic WorkTopic) {
 	// create a channel specifically for use with this job
 	jobChannel := make(chan JobMsg, engine.jobBufferSize)
+	engine.jobMutex.Lock()
 	engine.jobChannels[token] = jobChannel
+	engine.jobMutex.Unlock()
 	// ensure we always clean up
 	defer func() {
 		log.Debugf("closing channel for job %v", token)
 		close(jobChannel)
+		engine.jobMutex.Lock()
 		delete(engine.jobChannels, token)
+		engine.jobMutex.Unlock()
 	}()
 
+	// whether the job was stopped by the time its Run returned, the context
+	// of a finished job is cancelled as it is cleaned up
+	stopped := make(chan bool, 1)
 	go func() {
+		var (
+			lastMsg  JobMsg
+			terminal bool
+		)
 		// listen for a new message for the job keyed to this token and hand off to the subscribers async.
 		// Wait for them all to be done before accepting the next message
 		for msg := range jobChannel {
-			wg := &sync.WaitGroup{}
-			// hand off the msg to all subscribers async
-			for _, sub := range engine.subscribers[topic] {
-				wg.Add(1)
-				go func(msg JobMsg, sub WorkSubscriber) {
-					// ensure things don't get locked up.
-					// Each subscriber has up to the configured amount of time to complete its action
-					ctx, cancel := context.WithTimeout(context.Background(), engine.subscriberTimeout*time.Second)
-					// used to tell us when the subscribers notify method is completed
-					notifySignal := make(chan struct{})
-					// If our subscriber times out or returns normally we will always clean up
-					defer func() {
-						wg.Done()
-						close(notifySignal)
-						cancel()
-					}()
-					// notify the subscriber
-					go waitForNotify(ctx, sub, msg, notifySignal)
-					// act on whichever happens first the subscriber's notify method completing or the timeout
-					select {
-					case <-notifySignal:
-						return
-					case <-ctx.Done():
-						log.Errorf("Subscriber %s timeout %v ", sub.ID(), ctx.Err())
-						return
-					}
-				}(msg, sub)
+			lastMsg = msg
+			terminal = isTerminalState(msg.State.State)
+			engine.notifySubscribers(topic, msg)
+			engine.publish(token, msg)
+		}
+		// a job stopped by the engine that did not report its failure is
+		// reported as failed on its behalf
+		if <-stopped && !terminal {
+			log.Warningf("job %v did not report being stopped, marking it as failed", token)
+			msg := stoppedJobMsg(ctx, token, work, lastMsg)
+			engine.notifySubscribers(topic, msg)
+			engine.publish(token, msg)
+		}
+		engine.closeWatchers(token)
+		engine.notifyJobEnded(topic, token)
+	}()
+	if d := engine.deadlineFor(work); d > 0 {
+		if cancellation, ok := jobCancellationFrom(ctx); ok {
+			timer := time.AfterFunc(d, func() {
+				log.Warningf("job %v ran past its deadline of %v, stopping it", token, d)
+				cancellation.cancelWith(ErrorJobTimeout,
+					fmt.Sprintf("%s job timed out after %v", work.Method(), d))
+			})
+			defer timer.Stop()
+		}
+	}
+	work.Run(ctx, token, jobChannel)
+	stopped <- ctx.Err() != nil
+}
+
+// notifySubscribers - hands off the msg to all the subscribers of the topic
+// and waits for them to be done. Messages a subscriber fails to handle are
+// saved as dead letters.
+func (engine *WorkEngine) notifySubscribers(topic WorkTopic, msg JobMsg) {
+	wg := &sync.WaitGroup{}
+	// hand off the msg to all subscribers async
+	for _, sub := range engine.subscribers[topic] {
+		wg.Add(1)
+		go func(msg JobMsg, sub WorkSubscriber) {
+			defer wg.Done()
+			if err := engine.deliver(sub, msg); err != nil {
+				log.Errorf("Subscriber %s failed to handle job %v - %v", sub.ID(), msg.JobToken, err)
+				if engine.deadLetters != nil {
+					engine.deadLetters.Add(sub.ID(), topic, msg, err)
+				}
 			}
-			// ensure we wait until all subs are done before taking on the next message
-			wg.Wait()
+		}(msg, sub)
+	}
+	// ensure we wait until all subs are done before taking on the next message
+	wg.Wait()
+}
+
+// notifyJobEnded - tells the subscribers of the topic that track jobs that
+// the job ended.
+func (engine *WorkEngine) notifyJobEnded(topic WorkTopic, token string) {
+	for _, sub := range engine.subscribers[topic] {
+		if js, ok := sub.(JobEndSubscriber); ok {
+			js.JobEnded(token)
 		}
+	}
+}
+
+// deliver - notifies the subscriber of the msg. Each subscriber has up to the
+// configured amount of time to complete its action, ensuring things don't get
+// locked up. The context of a DeliverySubscriber is cancelled on timeout.
+func (engine *WorkEngine) deliver(sub WorkSubscriber, msg JobMsg) error {
+	ctx, cancel := context.WithTimeout(context.Background(), engine.subscriberTimeout*time.Second)
+	defer cancel()
+	// buffered so that a subscriber completing after the timeout does not block
+	result := make(chan error, 1)
+	go func() {
+		if ds, ok := sub.(DeliverySubscriber); ok {
+			result <- ds.Deliver(ctx, msg)
+			return
+		}
+		sub.Notify(msg)
+		result <- nil
 	}()
-	work.Run(token, jobChannel)
+	// act on whichever happens first the subscriber completing or the timeout
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("subscriber timeout %v", ctx.Err())
+	}
+}
+
+func isTerminalState(state bundle.State) bool {
+	return state == bundle.StateSucceeded || state == bundle.StateFailed
+}
+
+// stoppedJobMsg - the failed JobMsg of a job stopped by the engine, based on
+// the last message the job sent if there is one.
+func stoppedJobMsg(ctx context.Context, token string, work Work, lastMsg JobMsg) JobMsg {
+	msg := lastMsg
+	msg.JobToken = token
+	if msg.InstanceUUID == "" && msg.BindingUUID == "" {
+		if work.Method() == bundle.JobMethodBind || work.Method() == bundle.JobMethodUnbind {
+			msg.BindingUUID = work.ID()
+		} else {
+			msg.InstanceUUID = work.ID()
+		}
+	}
+	msg.State = bundle.JobState{
+		Token:       token,
+		State:       bundle.StateFailed,
+		Podname:     msg.PodName,
+		Method:      work.Method(),
+		Error:       CancelError(ctx).Error(),
+		Description: CancelReason(ctx),
+	}
+	return msg
+}
+
+// CancelJob - cancels a queued or running job. The job reports itself as
+// failed, with a "cancelled by <user>" description, to the subscribers of its
+// topic.
+func (engine *WorkEngine) CancelJob(token string, user string) error {
+	engine.jobMutex.RLock()
+	cancellation, ok := engine.activeJobs[token]
+	engine.jobMutex.RUnlock()
+	if !ok {
+		return ErrorNotFound
+	}
+	log.Infof("cancelling job %v at the request of %v", token, user)
+	cancellation.cancelWith(ErrorJobCancelled, cancelledBy(user))
+	return nil
+}
+
+// IsJobActive - true if the job is queued or running in the engine.
+func (engine *WorkEngine) IsJobActive(token string) bool {
+	engine.jobMutex.RLock()
+	defer engine.jobMutex.RUnlock()
+	_, ok := engine.activeJobs[token]
+	return ok
+}
+
+// stopJob - stops a queued or running job, which reports itself as failed
+// with the given reason.
+func (engine *WorkEngine) stopJob(token string, err error, reason string) error {
+	engine.jobMutex.RLock()
+	cancellation, ok := engine.activeJobs[token]
+	engine.jobMutex.RUnlock()
+	if !ok {
+		return ErrorNotFound
+	}
+	cancellation.cancelWith(err, reason)
+	return nil
 }
 
 // StartNewSyncJob - Starts a job and waits for it to finish, reporting to a specific topic.
@@ -156,7 +363,8 @@ func (engine *WorkEngine) StartNewSyncJob(
 	if err := engine.setupJob(token, work); err != nil {
 		return err
 	}
-	engine.runJob(token, work, topic)
+	ctx := engine.trackJob(token)
+	engine.runPooledJob(ctx, token, work, topic)
 	return nil
 }
 
@@ -181,7 +389,27 @@ func (engine *WorkEngine) AttachSubscriber(
 
 // GetActiveJobChannels - Get list of active jobs
 func (engine *WorkEngine) GetActiveJobChannels() map[string]chan JobMsg {
-	return engine.jobChannels
+	engine.jobMutex.RLock()
+	defer engine.jobMutex.RUnlock()
+	channels := make(map[string]chan JobMsg, len(engine.jobChannels))
+	for token, channel := range engine.jobChannels {
+		channels[token] = channel
+	}
+	return channels
+}
+
+// GetQueuedJobCount - Get the number of jobs waiting for a worker
+func (engine *WorkEngine) GetQueuedJobCount() int {
+	if engine.pool == nil {
+		return 0
+	}
+	return engine.pool.queued()
+}
+
+// DeadLetters - returns the dead letter queue of the engine, nil if there is
+// none.
+func (engine *WorkEngine) DeadLetters() *DeadLetterQueue {
+	return engine.deadLetters
 }
 
 // GetSubscribers - Get list of subscribers to a topic
@@ -17,12 +17,15 @@
 package broker
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/automationbroker/bundle-lib/bundle"
 	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"github.com/stretchr/testify/mock"
 
 	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
 )
@@ -58,7 +61,7 @@ type mockWorker struct {
 	wg     *sync.WaitGroup
 }
 
-func (mw *mockWorker) Run(token string, buffer chan<- JobMsg) {
+func (mw *mockWorker) Run(ctx context.Context, token string, buffer chan<- JobMsg) {
 	mw.called = true
 	buffer <- JobMsg{Msg: "hello"}
 	mw.wg.Done()
@@ -89,10 +92,15 @@ func TestInvalidWorkTopic(t *testing.T) {
 }
 
 type mockWork struct {
-	funcToCall func(msg chan<- JobMsg)
+	funcToCall    func(msg chan<- JobMsg)
+	funcToCallCtx func(ctx context.Context, msg chan<- JobMsg)
 }
 
-func (mw *mockWork) Run(token string, msgBuffer chan<- JobMsg) {
+func (mw *mockWork) Run(ctx context.Context, token string, msgBuffer chan<- JobMsg) {
+	if mw.funcToCallCtx != nil {
+		mw.funcToCallCtx(ctx, msgBuffer)
+		return
+	}
 	mw.funcToCall(msgBuffer)
 }
 
@@ -204,3 +212,179 @@ func TestStartNewJob(t *testing.T) {
 		})
 	}
 }
+
+func TestStartNewJobWithConcurrencyLimits(t *testing.T) {
+	poolDao := &dao.MockDao{}
+	poolDao.On("SetState", "id", mock.Anything).Return("", nil)
+	poolDao.On("GetStateVersion", "id", "second").Return(
+		bundle.JobState{Token: "second", State: bundle.StateNotYetStarted, Method: bundle.JobMethodBind}, types.Version("1"), nil)
+	poolDao.On("IsNotFoundError", nil).Return(false)
+	poolDao.On("SetStateIf", "id", mock.Anything, types.Version("1")).Return("", types.Version("2"), nil)
+
+	engine := NewWorkEngine(10, 1, poolDao)
+	engine.SetConcurrencyLimits(ConcurrencyLimits{MaxJobs: 1})
+
+	firstRan := make(chan struct{})
+	release := make(chan struct{})
+	first := &mockWork{
+		funcToCall: func(msg chan<- JobMsg) {
+			close(firstRan)
+			<-release
+		},
+	}
+	secondRan := make(chan struct{})
+	second := &mockWork{
+		funcToCall: func(msg chan<- JobMsg) {
+			close(secondRan)
+		},
+	}
+
+	_, err := engine.StartNewAsyncJob("first", first, ProvisionTopic)
+	ft.AssertNil(t, err)
+	<-firstRan
+	_, err = engine.StartNewAsyncJob("second", second, ProvisionTopic)
+	ft.AssertNil(t, err)
+
+	select {
+	case <-secondRan:
+		t.Fatal("second job should wait for the first one to finish")
+	case <-time.After(100 * time.Millisecond):
+	}
+	ft.AssertEqual(t, engine.GetQueuedJobCount(), 1)
+	poolDao.AssertCalled(t, "SetStateIf", "id", bundle.JobState{
+		Token:       "second",
+		State:       bundle.StateNotYetStarted,
+		Method:      bundle.JobMethodBind,
+		Description: "waiting for an available worker, position 1 in queue",
+	}, types.Version("1"))
+
+	close(release)
+	select {
+	case <-secondRan:
+	case <-time.After(time.Second):
+		t.Fatal("second job was not started after the first one finished")
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	cancelDao := &dao.MockDao{}
+	cancelDao.On("SetState", "id", mock.Anything).Return("", nil)
+	engine := NewWorkEngine(10, 1, cancelDao)
+
+	ft.AssertEqual(t, engine.CancelJob("unknown", "admin"), ErrorNotFound)
+
+	received := make(chan JobMsg, 1)
+	engine.AttachSubscriber(&mockSubscriber{
+		funcToCall: func(msg JobMsg) {
+			received <- msg
+		},
+	}, ProvisionTopic)
+
+	running := make(chan struct{})
+	work := &mockWork{}
+	work.funcToCallCtx = func(ctx context.Context, msg chan<- JobMsg) {
+		close(running)
+		<-ctx.Done()
+		msg <- JobMsg{State: bundle.JobState{
+			State:       bundle.StateFailed,
+			Description: CancelReason(ctx),
+		}}
+	}
+	_, err := engine.StartNewAsyncJob("token", work, ProvisionTopic)
+	ft.AssertNil(t, err)
+	<-running
+
+	ft.AssertNil(t, engine.CancelJob("token", "admin"))
+	select {
+	case msg := <-received:
+		ft.AssertEqual(t, msg.State.State, bundle.StateFailed)
+		ft.AssertEqual(t, msg.State.Description, "cancelled by admin")
+	case <-time.After(time.Second):
+		t.Fatal("subscriber was not notified of the cancelled job")
+	}
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	cancelDao := &dao.MockDao{}
+	cancelDao.On("SetState", "id", mock.Anything).Return("", nil)
+	cancelDao.On("GetStateVersion", "id", "second").Return(
+		bundle.JobState{Token: "second", State: bundle.StateNotYetStarted}, types.Version("1"), nil)
+	cancelDao.On("IsNotFoundError", nil).Return(false)
+	cancelDao.On("SetStateIf", "id", mock.Anything, mock.Anything).Return("", types.Version("2"), nil)
+	engine := NewWorkEngine(10, 1, cancelDao)
+	engine.SetConcurrencyLimits(ConcurrencyLimits{MaxJobs: 1})
+
+	running := make(chan struct{})
+	release := make(chan struct{})
+	first := &mockWork{funcToCall: func(msg chan<- JobMsg) {
+		close(running)
+		<-release
+	}}
+	defer close(release)
+	_, err := engine.StartNewAsyncJob("first", first, ProvisionTopic)
+	ft.AssertNil(t, err)
+	<-running
+
+	description := make(chan string, 1)
+	second := &mockWork{}
+	second.funcToCallCtx = func(ctx context.Context, msg chan<- JobMsg) {
+		description <- CancelReason(ctx)
+	}
+	_, err = engine.StartNewAsyncJob("second", second, ProvisionTopic)
+	ft.AssertNil(t, err)
+
+	ft.AssertNil(t, engine.CancelJob("second", ""))
+	select {
+	case d := <-description:
+		ft.AssertEqual(t, d, "cancelled by unknown user")
+	case <-time.After(time.Second):
+		t.Fatal("queued job was not run after being cancelled")
+	}
+	ft.AssertEqual(t, engine.GetQueuedJobCount(), 0)
+}
+
+func TestJobDeadline(t *testing.T) {
+	deadlineDao := &dao.MockDao{}
+	deadlineDao.On("SetState", "id", mock.Anything).Return("", nil)
+	engine := NewWorkEngine(10, 1, deadlineDao)
+	engine.SetJobDeadlines(JobDeadlines{bundle.JobMethodBind: 50 * time.Millisecond})
+
+	received := make(chan JobMsg, 2)
+	engine.AttachSubscriber(&mockSubscriber{
+		funcToCall: func(msg JobMsg) {
+			received <- msg
+		},
+	}, BindingTopic)
+
+	// the work returns once stopped without reporting its failure, the
+	// engine reports it instead
+	work := &mockWork{}
+	work.funcToCallCtx = func(ctx context.Context, msg chan<- JobMsg) {
+		<-ctx.Done()
+	}
+	_, err := engine.StartNewAsyncJob("token", work, BindingTopic)
+	ft.AssertNil(t, err)
+
+	select {
+	case msg := <-received:
+		ft.AssertEqual(t, msg.JobToken, "token")
+		ft.AssertEqual(t, msg.BindingUUID, "id")
+		ft.AssertEqual(t, msg.State.State, bundle.StateFailed)
+		ft.AssertEqual(t, msg.State.Error, ErrorJobTimeout.Error())
+		ft.AssertEqual(t, msg.State.Description, "bind job timed out after 50ms")
+	case <-time.After(time.Second):
+		t.Fatal("subscriber was not notified of the timed out job")
+	}
+}
+
+func TestUpdateQueuePositionOfStartedJob(t *testing.T) {
+	queueDao := &dao.MockDao{}
+	queueDao.On("GetStateVersion", "id", "token").Return(
+		bundle.JobState{Token: "token", State: bundle.StateInProgress, Method: bundle.JobMethodBind}, types.Version("2"), nil)
+	queueDao.On("IsNotFoundError", nil).Return(false)
+	engine := NewWorkEngine(10, 1, queueDao)
+
+	engine.updateQueuePosition(&queuedJob{token: "token", work: &mockWork{}, position: 1})
+	queueDao.AssertNotCalled(t, "SetStateIf", mock.Anything, mock.Anything, mock.Anything)
+	queueDao.AssertNotCalled(t, "SetState", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,242 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/automationbroker/config"
+	"github.com/openshift/ansible-service-broker/pkg/metrics"
+)
+
+// ConcurrencyLimits - limits the number of jobs the WorkEngine will run at
+// the same time. A limit of 0 means unlimited.
+type ConcurrencyLimits struct {
+	// MaxJobs - the maximum number of jobs running across the whole broker.
+	MaxJobs int
+	// MaxJobsPerTopic - the maximum number of jobs running for a WorkTopic.
+	MaxJobsPerTopic map[WorkTopic]int
+	// MaxJobsPerNamespace - the maximum number of jobs running for the
+	// instances of a single namespace.
+	MaxJobsPerNamespace int
+}
+
+// NewConcurrencyLimits - reads the concurrency limits from the broker config
+// section.
+func NewConcurrencyLimits(c *config.Config) ConcurrencyLimits {
+	limits := ConcurrencyLimits{
+		MaxJobs:             c.GetInt("max_concurrent_jobs"),
+		MaxJobsPerNamespace: c.GetInt("max_concurrent_jobs_per_namespace"),
+		MaxJobsPerTopic:     map[WorkTopic]int{},
+	}
+	perTopic := c.GetSubConfig("max_concurrent_jobs_per_topic")
+	for topic := range workTopicSet {
+		if max := perTopic.GetInt(string(topic)); max > 0 {
+			limits.MaxJobsPerTopic[topic] = max
+		}
+	}
+	return limits
+}
+
+// IsUnlimited - true if none of the limits are set.
+func (l ConcurrencyLimits) IsUnlimited() bool {
+	return l.MaxJobs <= 0 && l.MaxJobsPerNamespace <= 0 && len(l.MaxJobsPerTopic) == 0
+}
+
+// namespacedWork - implemented by Work that knows which namespace it is
+// acting on. Work that does not implement it is only subject to the global
+// and per topic limits.
+type namespacedWork interface {
+	Namespace() string
+}
+
+func workNamespace(work Work) string {
+	if nw, ok := work.(namespacedWork); ok {
+		return nw.Namespace()
+	}
+	return ""
+}
+
+type queuedJob struct {
+	token     string
+	work      Work
+	topic     WorkTopic
+	namespace string
+	position  int
+	// closed when the job is allowed to run
+	ready chan struct{}
+}
+
+// positionFn - called with every queued job whose position in the queue has
+// changed.
+type positionFn func(job *queuedJob)
+
+// workerPool - keeps track of the running jobs and holds back the jobs that
+// would go over the concurrency limits until a slot frees up.
+type workerPool struct {
+	mutex               sync.Mutex
+	limits              ConcurrencyLimits
+	running             int
+	runningPerTopic     map[WorkTopic]int
+	runningPerNamespace map[string]int
+	queue               []*queuedJob
+	positionChanged     positionFn
+}
+
+func newWorkerPool(limits ConcurrencyLimits, positionChanged positionFn) *workerPool {
+	return &workerPool{
+		limits:              limits,
+		runningPerTopic:     map[WorkTopic]int{},
+		runningPerNamespace: map[string]int{},
+		positionChanged:     positionChanged,
+	}
+}
+
+// acquire - blocks until the job is allowed to run. Returns false, without
+// holding a slot, if ctx is done before the job leaves the queue.
+func (p *workerPool) acquire(ctx context.Context, token string, work Work, topic WorkTopic) bool {
+	job := &queuedJob{
+		token:     token,
+		work:      work,
+		topic:     topic,
+		namespace: workNamespace(work),
+		ready:     make(chan struct{}),
+	}
+	p.mutex.Lock()
+	p.queue = append(p.queue, job)
+	moved := p.dispatch()
+	p.mutex.Unlock()
+
+	p.notify(moved)
+	select {
+	case <-job.ready:
+		return true
+	case <-ctx.Done():
+	}
+
+	p.mutex.Lock()
+	removed := p.remove(job)
+	if !removed {
+		// dispatched while the context was being cancelled, the slot is ours
+		p.mutex.Unlock()
+		return true
+	}
+	moved = p.dispatch()
+	p.mutex.Unlock()
+
+	p.notify(moved)
+	return false
+}
+
+// remove - takes a job out of the queue. Returns false if the job was not
+// queued. Must be called with the mutex held.
+func (p *workerPool) remove(job *queuedJob) bool {
+	for i, queued := range p.queue {
+		if queued == job {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// release - frees the slot held by a job and starts the queued jobs that
+// now fit within the limits.
+func (p *workerPool) release(work Work, topic WorkTopic) {
+	namespace := workNamespace(work)
+	p.mutex.Lock()
+	p.running--
+	p.runningPerTopic[topic]--
+	if namespace != "" {
+		p.runningPerNamespace[namespace]--
+		if p.runningPerNamespace[namespace] <= 0 {
+			delete(p.runningPerNamespace, namespace)
+		}
+	}
+	moved := p.dispatch()
+	p.mutex.Unlock()
+
+	p.notify(moved)
+}
+
+// queued - returns the number of jobs waiting for a slot.
+func (p *workerPool) queued() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.queue)
+}
+
+// dispatch - starts, in order, every queued job that fits within the limits.
+// A job held back by its topic or namespace does not hold back the jobs
+// behind it. Returns the jobs whose queue position changed. Must be called
+// with the mutex held.
+func (p *workerPool) dispatch() []queuedJob {
+	remaining := []*queuedJob{}
+	for _, job := range p.queue {
+		if !p.fits(job) {
+			remaining = append(remaining, job)
+			continue
+		}
+		p.running++
+		p.runningPerTopic[job.topic]++
+		if job.namespace != "" {
+			p.runningPerNamespace[job.namespace]++
+		}
+		close(job.ready)
+	}
+	p.queue = remaining
+	metrics.JobsQueued(len(p.queue))
+
+	moved := []queuedJob{}
+	for i, job := range p.queue {
+		if job.position != i+1 {
+			job.position = i + 1
+			moved = append(moved, *job)
+		}
+	}
+	return moved
+}
+
+func (p *workerPool) fits(job *queuedJob) bool {
+	if p.limits.MaxJobs > 0 && p.running >= p.limits.MaxJobs {
+		return false
+	}
+	if max, ok := p.limits.MaxJobsPerTopic[job.topic]; ok && max > 0 &&
+		p.runningPerTopic[job.topic] >= max {
+		return false
+	}
+	if p.limits.MaxJobsPerNamespace > 0 && job.namespace != "" &&
+		p.runningPerNamespace[job.namespace] >= p.limits.MaxJobsPerNamespace {
+		return false
+	}
+	return true
+}
+
+func (p *workerPool) notify(moved []queuedJob) {
+	if p.positionChanged == nil {
+		return
+	}
+	for i := range moved {
+		p.positionChanged(&moved[i])
+	}
+}
+
+func queuedDescription(position int) string {
+	return fmt.Sprintf("waiting for an available worker, position %d in queue", position)
+}
@@ -0,0 +1,194 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package broker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/config"
+	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
+)
+
+type namespacedMockWork struct {
+	mockWork
+	namespace string
+}
+
+func (nw *namespacedMockWork) Namespace() string {
+	return nw.namespace
+}
+
+func TestNewConcurrencyLimits(t *testing.T) {
+	c := config.NewConfigFromMap(map[string]interface{}{
+		"max_concurrent_jobs":               10,
+		"max_concurrent_jobs_per_namespace": 2,
+		"max_concurrent_jobs_per_topic": map[string]interface{}{
+			"provision_topic": 5,
+			"not_a_topic":     3,
+		},
+	})
+	limits := NewConcurrencyLimits(c)
+	ft.AssertEqual(t, limits.MaxJobs, 10)
+	ft.AssertEqual(t, limits.MaxJobsPerNamespace, 2)
+	ft.AssertEqual(t, len(limits.MaxJobsPerTopic), 1)
+	ft.AssertEqual(t, limits.MaxJobsPerTopic[ProvisionTopic], 5)
+	ft.AssertFalse(t, limits.IsUnlimited())
+
+	ft.AssertTrue(t, NewConcurrencyLimits(&config.Config{}).IsUnlimited())
+}
+
+func TestWorkerPoolLimits(t *testing.T) {
+	cases := []struct {
+		name     string
+		limits   ConcurrencyLimits
+		first    Work
+		firstTop WorkTopic
+		second   Work
+		secTop   WorkTopic
+		blocked  bool
+	}{
+		{
+			name:     "global limit holds back any job",
+			limits:   ConcurrencyLimits{MaxJobs: 1},
+			first:    &namespacedMockWork{namespace: "a"},
+			firstTop: ProvisionTopic,
+			second:   &namespacedMockWork{namespace: "b"},
+			secTop:   BindingTopic,
+			blocked:  true,
+		},
+		{
+			name:     "topic limit only holds back jobs of the same topic",
+			limits:   ConcurrencyLimits{MaxJobsPerTopic: map[WorkTopic]int{ProvisionTopic: 1}},
+			first:    &namespacedMockWork{namespace: "a"},
+			firstTop: ProvisionTopic,
+			second:   &namespacedMockWork{namespace: "a"},
+			secTop:   BindingTopic,
+			blocked:  false,
+		},
+		{
+			name:     "topic limit holds back jobs of the same topic",
+			limits:   ConcurrencyLimits{MaxJobsPerTopic: map[WorkTopic]int{ProvisionTopic: 1}},
+			first:    &namespacedMockWork{namespace: "a"},
+			firstTop: ProvisionTopic,
+			second:   &namespacedMockWork{namespace: "b"},
+			secTop:   ProvisionTopic,
+			blocked:  true,
+		},
+		{
+			name:     "namespace limit holds back jobs of the same namespace",
+			limits:   ConcurrencyLimits{MaxJobsPerNamespace: 1},
+			first:    &namespacedMockWork{namespace: "a"},
+			firstTop: ProvisionTopic,
+			second:   &namespacedMockWork{namespace: "a"},
+			secTop:   BindingTopic,
+			blocked:  true,
+		},
+		{
+			name:     "namespace limit does not hold back other namespaces",
+			limits:   ConcurrencyLimits{MaxJobsPerNamespace: 1},
+			first:    &namespacedMockWork{namespace: "a"},
+			firstTop: ProvisionTopic,
+			second:   &namespacedMockWork{namespace: "b"},
+			secTop:   ProvisionTopic,
+			blocked:  false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			positions := []int{}
+			mutex := sync.Mutex{}
+			pool := newWorkerPool(tc.limits, func(job *queuedJob) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				positions = append(positions, job.position)
+			})
+			pool.acquire(context.Background(), "first", tc.first, tc.firstTop)
+
+			started := make(chan struct{})
+			go func() {
+				pool.acquire(context.Background(), "second", tc.second, tc.secTop)
+				close(started)
+			}()
+
+			select {
+			case <-started:
+				if tc.blocked {
+					t.Fatal("second job should have been queued")
+				}
+				return
+			case <-time.After(100 * time.Millisecond):
+				if !tc.blocked {
+					t.Fatal("second job should not have been queued")
+				}
+			}
+
+			ft.AssertEqual(t, pool.queued(), 1)
+			mutex.Lock()
+			ft.AssertEqual(t, len(positions), 1)
+			ft.AssertEqual(t, positions[0], 1)
+			mutex.Unlock()
+
+			pool.release(tc.first, tc.firstTop)
+			select {
+			case <-started:
+			case <-time.After(time.Second):
+				t.Fatal("second job was not started after the first one finished")
+			}
+			ft.AssertEqual(t, pool.queued(), 0)
+		})
+	}
+}
+
+func TestWorkerPoolDoesNotBlockOnHeadOfQueue(t *testing.T) {
+	pool := newWorkerPool(ConcurrencyLimits{MaxJobsPerNamespace: 1}, nil)
+	running := &namespacedMockWork{namespace: "a"}
+	pool.acquire(context.Background(), "running", running, ProvisionTopic)
+
+	blocked := make(chan struct{})
+	go func() {
+		pool.acquire(context.Background(), "blocked", &namespacedMockWork{namespace: "a"}, ProvisionTopic)
+		close(blocked)
+	}()
+	// give the blocked job time to get to the front of the queue
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		pool.acquire(context.Background(), "other", &namespacedMockWork{namespace: "b"}, ProvisionTopic)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("job in another namespace should not wait behind the queued job")
+	}
+
+	pool.release(running, ProvisionTopic)
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("queued job was not started")
+	}
+}
+
+func TestQueuedDescription(t *testing.T) {
+	ft.AssertEqual(t, queuedDescription(3), "waiting for an available worker, position 3 in queue")
+}
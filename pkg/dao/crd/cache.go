@@ -0,0 +1,580 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	automationbrokerv1 "github.com/automationbroker/broker-client-go/client/clientset/versioned/typed/automationbroker/v1alpha1"
+	v1 "github.com/automationbroker/broker-client-go/pkg/apis/automationbroker/v1alpha1"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"github.com/openshift/ansible-service-broker/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// stalenessInterval - how often the staleness of the cache is reported.
+const stalenessInterval = 10 * time.Second
+
+// Cache - a read cache of the bundles, bundle instances and bundle bindings
+// of the broker namespace, kept up to date by shared informers. The writes of
+// the dao still go to the API server, and the cache tracks them: an object
+// written by the dao is read from the API server until the cache has
+// observed the write, so the dao always reads its own writes.
+type Cache struct {
+	bundles   *cachedResource
+	instances *cachedResource
+	bindings  *cachedResource
+}
+
+// NewCache - Create the cache of the resources of a namespace, listed and
+// watched with the client. It is empty until it is run.
+func NewCache(client automationbrokerv1.AutomationbrokerV1alpha1Interface, namespace string) *Cache {
+	return &Cache{
+		bundles: newCachedResource("bundles", namespace, &v1.Bundle{}, &cache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				return client.Bundles(namespace).List(opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				return client.Bundles(namespace).Watch(opts)
+			},
+		}),
+		instances: newCachedResource("bundleinstances", namespace, &v1.BundleInstance{}, &cache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				return client.BundleInstances(namespace).List(opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				return client.BundleInstances(namespace).Watch(opts)
+			},
+		}),
+		bindings: newCachedResource("bundlebindings", namespace, &v1.BundleBinding{}, &cache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				return client.BundleBindings(namespace).List(opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				return client.BundleBindings(namespace).Watch(opts)
+			},
+		}),
+	}
+}
+
+func (c *Cache) resources() []*cachedResource {
+	return []*cachedResource{c.bundles, c.instances, c.bindings}
+}
+
+// Run - runs the informers until stopped. The reads go to the API server
+// until the cache has synced.
+func (c *Cache) Run(stop <-chan struct{}) {
+	for _, r := range c.resources() {
+		go r.informer.Run(stop)
+	}
+	go func() {
+		ticker := time.NewTicker(stalenessInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, r := range c.resources() {
+					r.reportStaleness()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// HasSynced - whether every informer has listed its resource.
+func (c *Cache) HasSynced() bool {
+	for _, r := range c.resources() {
+		if !r.informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// pendingWrite - a write of the dao the cache has not observed yet.
+type pendingWrite struct {
+	// the resource version written, 0 if unknown
+	version uint64
+	deleted bool
+	at      time.Time
+}
+
+// cachedResource - the informer of a resource and the writes of the dao it
+// has not observed yet, by name.
+type cachedResource struct {
+	resource  string
+	namespace string
+	informer  cache.SharedIndexInformer
+	mutex     sync.Mutex
+	pending   map[string]pendingWrite
+}
+
+func newCachedResource(resource string, namespace string, obj runtime.Object, lw cache.ListerWatcher) *cachedResource {
+	r := &cachedResource{
+		resource:  resource,
+		namespace: namespace,
+		// the cache is read by key, it is never resynced
+		informer: cache.NewSharedIndexInformer(lw, obj, 0, cache.Indexers{}),
+		pending:  map[string]pendingWrite{},
+	}
+	r.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { r.observe(obj, false) },
+		UpdateFunc: func(old, obj interface{}) { r.observe(obj, false) },
+		DeleteFunc: func(obj interface{}) { r.observe(obj, true) },
+	})
+	return r
+}
+
+// resourceVersion - the resource version of an object as a number, 0 if it
+// is not one.
+func resourceVersion(obj metav1.Object) uint64 {
+	version, err := strconv.ParseUint(obj.GetResourceVersion(), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// wrote - tracks an object written by the dao.
+func (r *cachedResource) wrote(obj metav1.Object) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.pending[obj.GetName()] = pendingWrite{version: resourceVersion(obj), at: time.Now()}
+}
+
+// conflicted - tracks an object the dao found written in the meantime,
+// maybe read from the cache before it observed that write. The object is read
+// from the API server until the cache observes the version or a newer one.
+func (r *cachedResource) conflicted(name string, version uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if p, ok := r.pending[name]; ok && (p.deleted || p.version >= version) {
+		return
+	}
+	r.pending[name] = pendingWrite{version: version, at: time.Now()}
+}
+
+// deleted - tracks an object deleted by the dao. There is nothing to observe
+// if the cache neither has the object nor is about to.
+func (r *cachedResource) deleted(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, cached, _ := r.informer.GetStore().GetByKey(r.key(name))
+	if _, pending := r.pending[name]; !cached && !pending {
+		return
+	}
+	r.pending[name] = pendingWrite{deleted: true, at: time.Now()}
+}
+
+// observe - the event handler of the informer, drops the pending write of
+// the object it observes.
+func (r *cachedResource) observe(obj interface{}, deleted bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		log.Warningf("unable to observe a %s event - %v", r.resource, err)
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p, ok := r.pending[accessor.GetName()]
+	if !ok {
+		return
+	}
+	// an object deleted by anyone is no longer cached, whatever was written
+	if !deleted && (p.deleted || resourceVersion(accessor) < p.version) {
+		return
+	}
+	metrics.DaoCacheWriteObserved(r.resource, time.Since(p.at))
+	delete(r.pending, accessor.GetName())
+}
+
+func (r *cachedResource) key(name string) string {
+	return r.namespace + "/" + name
+}
+
+// get - the cached object of a name, false if it must be read from the API
+// server: the cache has not synced, has not observed a write of the object
+// or does not have it.
+func (r *cachedResource) get(name string) (interface{}, bool) {
+	if !r.informer.HasSynced() {
+		return nil, false
+	}
+	r.mutex.Lock()
+	_, pending := r.pending[name]
+	r.mutex.Unlock()
+	if pending {
+		return nil, false
+	}
+	obj, ok, err := r.informer.GetStore().GetByKey(r.key(name))
+	if err != nil || !ok {
+		return nil, false
+	}
+	return obj, true
+}
+
+// list - the cached objects and the names of the objects written by the dao
+// the cache has not observed yet, which must be read from the API server.
+// False if the cache has not synced.
+func (r *cachedResource) list() ([]interface{}, []string, bool) {
+	if !r.informer.HasSynced() {
+		return nil, nil, false
+	}
+	r.mutex.Lock()
+	pending := map[string]pendingWrite{}
+	for name, p := range r.pending {
+		pending[name] = p
+	}
+	r.mutex.Unlock()
+	objs := []interface{}{}
+	for _, obj := range r.informer.GetStore().List() {
+		if accessor, err := meta.Accessor(obj); err == nil {
+			if _, ok := pending[accessor.GetName()]; ok {
+				continue
+			}
+		}
+		objs = append(objs, obj)
+	}
+	names := []string{}
+	for name, p := range pending {
+		if !p.deleted {
+			names = append(names, name)
+		}
+	}
+	return objs, names, true
+}
+
+// reportStaleness - reports the writes of the dao the cache has not
+// observed yet.
+func (r *cachedResource) reportStaleness() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	oldest := time.Duration(0)
+	for _, p := range r.pending {
+		if age := time.Since(p.at); age > oldest {
+			oldest = age
+		}
+	}
+	metrics.DaoCacheStaleness(r.resource, len(r.pending), oldest)
+}
+
+// conflicted - tracks a binding or an instance the dao found at a newer
+// version on the API server than the version it read.
+func (d *Dao) conflicted(obj metav1.Object) {
+	if d.cache == nil {
+		return
+	}
+	switch obj.(type) {
+	case *v1.BundleInstance:
+		d.cache.instances.conflicted(obj.GetName(), resourceVersion(obj))
+	case *v1.BundleBinding:
+		d.cache.bindings.conflicted(obj.GetName(), resourceVersion(obj))
+	}
+}
+
+// EnableCache - serves the reads of the dao from a cache run until stopped.
+// The writes go to the API server as before.
+func (d *Dao) EnableCache(stop <-chan struct{}) {
+	c := NewCache(d.client, d.namespace)
+	d.client = trackedClient{AutomationbrokerV1alpha1Interface: d.client, cache: c}
+	d.cache = c
+	c.Run(stop)
+}
+
+// getBundle - the bundle of a name, from the cache if possible.
+func (d *Dao) getBundle(name string) (*v1.Bundle, error) {
+	if d.cache != nil {
+		if obj, ok := d.cache.bundles.get(name); ok {
+			metrics.DaoCacheRead(d.cache.bundles.resource, "cache")
+			return obj.(*v1.Bundle).DeepCopy(), nil
+		}
+		metrics.DaoCacheRead(d.cache.bundles.resource, "api")
+	}
+	return d.client.Bundles(d.namespace).Get(name, metav1.GetOptions{})
+}
+
+// listBundles - every bundle, from the cache if possible.
+func (d *Dao) listBundles() ([]v1.Bundle, error) {
+	if d.cache != nil {
+		if objs, names, ok := d.cache.bundles.list(); ok {
+			metrics.DaoCacheRead(d.cache.bundles.resource, "cache")
+			items := []v1.Bundle{}
+			for _, obj := range objs {
+				items = append(items, *obj.(*v1.Bundle).DeepCopy())
+			}
+			for _, name := range names {
+				b, err := d.client.Bundles(d.namespace).Get(name, metav1.GetOptions{})
+				if apierrors.IsNotFound(err) {
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				items = append(items, *b)
+			}
+			return items, nil
+		}
+		metrics.DaoCacheRead(d.cache.bundles.resource, "api")
+	}
+	l, err := d.client.Bundles(d.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+// getBundleInstance - the bundle instance of a name, from the cache if
+// possible.
+func (d *Dao) getBundleInstance(name string) (*v1.BundleInstance, error) {
+	if d.cache != nil {
+		if obj, ok := d.cache.instances.get(name); ok {
+			metrics.DaoCacheRead(d.cache.instances.resource, "cache")
+			return obj.(*v1.BundleInstance).DeepCopy(), nil
+		}
+		metrics.DaoCacheRead(d.cache.instances.resource, "api")
+	}
+	return d.client.BundleInstances(d.namespace).Get(name, metav1.GetOptions{})
+}
+
+// listBundleInstances - the bundle instances matching the label selector,
+// from the cache if possible.
+func (d *Dao) listBundleInstances(selector string) ([]v1.BundleInstance, error) {
+	if d.cache != nil {
+		s, err := labels.Parse(selector)
+		if err != nil {
+			return nil, err
+		}
+		if objs, names, ok := d.cache.instances.list(); ok {
+			metrics.DaoCacheRead(d.cache.instances.resource, "cache")
+			items := []v1.BundleInstance{}
+			for _, obj := range objs {
+				if bi := obj.(*v1.BundleInstance); s.Matches(labels.Set(bi.Labels)) {
+					items = append(items, *bi.DeepCopy())
+				}
+			}
+			for _, name := range names {
+				bi, err := d.client.BundleInstances(d.namespace).Get(name, metav1.GetOptions{})
+				if apierrors.IsNotFound(err) {
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				if s.Matches(labels.Set(bi.Labels)) {
+					items = append(items, *bi)
+				}
+			}
+			return items, nil
+		}
+		metrics.DaoCacheRead(d.cache.instances.resource, "api")
+	}
+	l, err := d.client.BundleInstances(d.namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+// getBundleBinding - the bundle binding of a name, from the cache if
+// possible.
+func (d *Dao) getBundleBinding(name string) (*v1.BundleBinding, error) {
+	if d.cache != nil {
+		if obj, ok := d.cache.bindings.get(name); ok {
+			metrics.DaoCacheRead(d.cache.bindings.resource, "cache")
+			return obj.(*v1.BundleBinding).DeepCopy(), nil
+		}
+		metrics.DaoCacheRead(d.cache.bindings.resource, "api")
+	}
+	return d.client.BundleBindings(d.namespace).Get(name, metav1.GetOptions{})
+}
+
+// listBundleBindings - every bundle binding, from the cache if possible.
+func (d *Dao) listBundleBindings() ([]v1.BundleBinding, error) {
+	if d.cache != nil {
+		if objs, names, ok := d.cache.bindings.list(); ok {
+			metrics.DaoCacheRead(d.cache.bindings.resource, "cache")
+			items := []v1.BundleBinding{}
+			for _, obj := range objs {
+				items = append(items, *obj.(*v1.BundleBinding).DeepCopy())
+			}
+			for _, name := range names {
+				bb, err := d.client.BundleBindings(d.namespace).Get(name, metav1.GetOptions{})
+				if apierrors.IsNotFound(err) {
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				items = append(items, *bb)
+			}
+			return items, nil
+		}
+		metrics.DaoCacheRead(d.cache.bindings.resource, "api")
+	}
+	l, err := d.client.BundleBindings(d.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+// cachedJobs - the jobs of the binding or the instance of an id and its
+// resource version, if the cache has it.
+func (d *Dao) cachedJobs(id string) (map[string]v1.Job, types.Version, bool) {
+	if d.cache == nil {
+		return nil, types.NoVersion, false
+	}
+	if obj, ok := d.cache.bindings.get(id); ok {
+		metrics.DaoCacheRead(d.cache.bindings.resource, "cache")
+		bb := obj.(*v1.BundleBinding).DeepCopy()
+		return bb.Status.Jobs, types.Version(bb.ResourceVersion), true
+	}
+	if obj, ok := d.cache.instances.get(id); ok {
+		metrics.DaoCacheRead(d.cache.instances.resource, "cache")
+		bi := obj.(*v1.BundleInstance).DeepCopy()
+		return bi.Status.Jobs, types.Version(bi.ResourceVersion), true
+	}
+	return nil, types.NoVersion, false
+}
+
+// trackedClient - the client of the dao with a cache, tracks the writes
+// until the cache observes them.
+type trackedClient struct {
+	automationbrokerv1.AutomationbrokerV1alpha1Interface
+	cache *Cache
+}
+
+func (c trackedClient) Bundles(namespace string) automationbrokerv1.BundleInterface {
+	return trackedBundles{BundleInterface: c.AutomationbrokerV1alpha1Interface.Bundles(namespace), tracked: c.cache.bundles}
+}
+
+func (c trackedClient) BundleInstances(namespace string) automationbrokerv1.BundleInstanceInterface {
+	return trackedBundleInstances{
+		BundleInstanceInterface: c.AutomationbrokerV1alpha1Interface.BundleInstances(namespace),
+		tracked:                 c.cache.instances,
+	}
+}
+
+func (c trackedClient) BundleBindings(namespace string) automationbrokerv1.BundleBindingInterface {
+	return trackedBundleBindings{
+		BundleBindingInterface: c.AutomationbrokerV1alpha1Interface.BundleBindings(namespace),
+		tracked:                c.cache.bindings,
+	}
+}
+
+type trackedBundles struct {
+	automationbrokerv1.BundleInterface
+	tracked *cachedResource
+}
+
+func (t trackedBundles) Create(b *v1.Bundle) (*v1.Bundle, error) {
+	b, err := t.BundleInterface.Create(b)
+	if err == nil {
+		t.tracked.wrote(b)
+	}
+	return b, err
+}
+
+func (t trackedBundles) Update(b *v1.Bundle) (*v1.Bundle, error) {
+	updated, err := t.BundleInterface.Update(b)
+	if err == nil {
+		t.tracked.wrote(updated)
+	} else if apierrors.IsConflict(err) {
+		t.tracked.conflicted(b.Name, resourceVersion(b)+1)
+	}
+	return updated, err
+}
+
+func (t trackedBundles) Delete(name string, options *metav1.DeleteOptions) error {
+	err := t.BundleInterface.Delete(name, options)
+	if err == nil {
+		t.tracked.deleted(name)
+	}
+	return err
+}
+
+type trackedBundleInstances struct {
+	automationbrokerv1.BundleInstanceInterface
+	tracked *cachedResource
+}
+
+func (t trackedBundleInstances) Create(bi *v1.BundleInstance) (*v1.BundleInstance, error) {
+	bi, err := t.BundleInstanceInterface.Create(bi)
+	if err == nil {
+		t.tracked.wrote(bi)
+	}
+	return bi, err
+}
+
+func (t trackedBundleInstances) Update(bi *v1.BundleInstance) (*v1.BundleInstance, error) {
+	updated, err := t.BundleInstanceInterface.Update(bi)
+	if err == nil {
+		t.tracked.wrote(updated)
+	} else if apierrors.IsConflict(err) {
+		t.tracked.conflicted(bi.Name, resourceVersion(bi)+1)
+	}
+	return updated, err
+}
+
+func (t trackedBundleInstances) Delete(name string, options *metav1.DeleteOptions) error {
+	err := t.BundleInstanceInterface.Delete(name, options)
+	if err == nil {
+		t.tracked.deleted(name)
+	}
+	return err
+}
+
+type trackedBundleBindings struct {
+	automationbrokerv1.BundleBindingInterface
+	tracked *cachedResource
+}
+
+func (t trackedBundleBindings) Create(bb *v1.BundleBinding) (*v1.BundleBinding, error) {
+	bb, err := t.BundleBindingInterface.Create(bb)
+	if err == nil {
+		t.tracked.wrote(bb)
+	}
+	return bb, err
+}
+
+func (t trackedBundleBindings) Update(bb *v1.BundleBinding) (*v1.BundleBinding, error) {
+	updated, err := t.BundleBindingInterface.Update(bb)
+	if err == nil {
+		t.tracked.wrote(updated)
+	} else if apierrors.IsConflict(err) {
+		t.tracked.conflicted(bb.Name, resourceVersion(bb)+1)
+	}
+	return updated, err
+}
+
+func (t trackedBundleBindings) Delete(name string, options *metav1.DeleteOptions) error {
+	err := t.BundleBindingInterface.Delete(name, options)
+	if err == nil {
+		t.tracked.deleted(name)
+	}
+	return err
+}
@@ -19,6 +19,7 @@ package dao
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 
 	automationbrokerv1 "github.com/automationbroker/broker-client-go/client/clientset/versioned/typed/automationbroker/v1alpha1"
@@ -26,10 +27,12 @@ import (
 	"github.com/automationbroker/bundle-lib/bundle"
 	"github.com/automationbroker/bundle-lib/clients"
 	"github.com/automationbroker/bundle-lib/crd"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
 	"github.com/pborman/uuid"
 	log "github.com/sirupsen/logrus"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
 type arrayErrors []error
@@ -46,19 +49,23 @@ const (
 
 // Dao - object to interface with the data store.
 type Dao struct {
-	client       automationbrokerv1.AutomationbrokerV1alpha1Interface
-	namespace    string
-	bundleLock   sync.Mutex
-	bindingLock  sync.Mutex
-	instanceLock sync.Mutex
+	client     automationbrokerv1.AutomationbrokerV1alpha1Interface
+	namespace  string
+	bundleLock sync.Mutex
+	// guards the config map holding the dead letters
+	deadLetterLock sync.Mutex
+	// the jobs kept in the status of instances and bindings
+	retention JobRetention
+	// the config maps of the dead letters, from the kubernetes client if nil
+	configMapClient corev1.ConfigMapsGetter
+	// the cache the reads are served from, none if nil
+	cache *Cache
 }
 
 // NewDao - Create a new Dao object
 func NewDao(namespace string) (*Dao, error) {
 	dao := Dao{namespace: namespace,
-		bundleLock:   sync.Mutex{},
-		bindingLock:  sync.Mutex{},
-		instanceLock: sync.Mutex{},
+		bundleLock: sync.Mutex{},
 	}
 
 	crdClient, err := clients.CRDClient()
@@ -69,15 +76,25 @@ func NewDao(namespace string) (*Dao, error) {
 	return &dao, nil
 }
 
+// NewDaoWithClients - Create a new Dao object using the clients given, e.g.
+// fake ones in tests.
+func NewDaoWithClients(
+	namespace string,
+	client automationbrokerv1.AutomationbrokerV1alpha1Interface,
+	configMaps corev1.ConfigMapsGetter,
+) *Dao {
+	return &Dao{namespace: namespace, client: client, configMapClient: configMaps}
+}
+
 // GetSpec - Retrieve the spec from the k8s API.
 func (d *Dao) GetSpec(id string) (*bundle.Spec, error) {
 	log.Debugf("get spec: %v", id)
-	s, err := d.client.Bundles(d.namespace).Get(id, metav1.GetOptions{})
+	s, err := d.getBundle(id)
 	if err != nil {
 		log.Errorf("unable to get bundle from k8s api - %v", err)
 		return nil, err
 	}
-	return crd.ConvertBundleToSpec(s.Spec, s.GetName())
+	return convertBundle(*s)
 }
 
 // SetSpec - set spec for an id in the kvp API.
@@ -93,6 +110,7 @@ func (d *Dao) SetSpec(id string, spec *bundle.Spec) error {
 	if s, err := d.client.Bundles(d.namespace).Get(id, metav1.GetOptions{}); err == nil {
 		log.Infof("update spec: %v|%v to crd", id, spec.FQName)
 		s.Spec = bundleSpec
+		s.Annotations = withSchemaVersion(s.Annotations, types.SpecRecord)
 		if _, err = d.client.Bundles(d.namespace).Update(s); err != nil {
 			log.Errorf("error updating spec '%v', %v", id, err)
 			return err
@@ -104,8 +122,9 @@ func (d *Dao) SetSpec(id string, spec *bundle.Spec) error {
 	log.Infof("add spec: %v|%v", id, spec.FQName)
 	b := v1.Bundle{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      id,
-			Namespace: d.namespace,
+			Name:        id,
+			Namespace:   d.namespace,
+			Annotations: withSchemaVersion(nil, types.SpecRecord),
 		},
 		Spec: bundleSpec,
 	}
@@ -138,7 +157,7 @@ func (d *Dao) BatchSetSpecs(specs bundle.SpecManifest) error {
 // BatchGetSpecs - Retrieve all the specs for dir.
 func (d *Dao) BatchGetSpecs(dir string) ([]*bundle.Spec, error) {
 	log.Debugf("Dao::BatchGetSpecs")
-	l, err := d.client.Bundles(d.namespace).List(metav1.ListOptions{})
+	l, err := d.listBundles()
 	if err != nil {
 		log.Errorf("unable to get batch specs - %v", err)
 		return nil, err
@@ -146,8 +165,8 @@ func (d *Dao) BatchGetSpecs(dir string) ([]*bundle.Spec, error) {
 	specs := []*bundle.Spec{}
 	// capture all the errors and still try to save the correct bundles
 	errs := arrayErrors{}
-	for _, b := range l.Items {
-		spec, err := crd.ConvertBundleToSpec(b.Spec, b.GetName())
+	for _, b := range l {
+		spec, err := convertBundle(b)
 		if err != nil {
 			errs = append(errs, err)
 			continue
@@ -163,19 +182,19 @@ func (d *Dao) BatchGetSpecs(dir string) ([]*bundle.Spec, error) {
 // BatchGetBundleInstances - get list of bundleinstances
 func (d *Dao) BatchGetBundleInstances() ([]*bundle.ServiceInstance, error) {
 	log.Debugf("Dao::BatchGetBundleInstances")
-	bl, err := d.client.BundleInstances(d.namespace).List(metav1.ListOptions{})
+	bl, err := d.listBundleInstances("")
 	if err != nil {
 		log.Errorf("unable to get batch bundleinstances - %v", err)
 		return nil, err
 	}
-	bundleInstances := make([]*bundle.ServiceInstance, len(bl.Items))
-	for index, bundleInstance := range bl.Items {
+	bundleInstances := make([]*bundle.ServiceInstance, len(bl))
+	for index, bundleInstance := range bl {
 
 		spec, err := d.GetSpec(bundleInstance.Spec.Bundle.Name)
 		if err != nil {
 			return nil, err
 		}
-		s, err := crd.ConvertServiceInstanceToAPB(bundleInstance, spec, bundleInstance.GetName())
+		s, err := convertBundleInstance(bundleInstance, spec)
 		if err != nil {
 			log.Errorf("unable to convert service instance to bundle instance - %v", err)
 			return nil, err
@@ -199,60 +218,123 @@ func (d *Dao) BatchDeleteSpecs(specs []*bundle.Spec) error {
 
 // GetServiceInstance - Retrieve specific service instance from the kvp API.
 func (d *Dao) GetServiceInstance(id string) (*bundle.ServiceInstance, error) {
+	si, _, err := d.GetServiceInstanceVersion(id)
+	return si, err
+}
+
+// GetServiceInstanceVersion - Retrieve specific service instance from the k8s
+// API along with its resource version.
+func (d *Dao) GetServiceInstanceVersion(id string) (*bundle.ServiceInstance, types.Version, error) {
 	log.Debugf("get service instance: %v", id)
-	servInstance, err := d.client.BundleInstances(d.namespace).Get(id, metav1.GetOptions{})
+	servInstance, err := d.getBundleInstance(id)
 	if err != nil {
-		return nil, err
+		return nil, types.NoVersion, err
 	}
 	spec, err := d.GetSpec(servInstance.Spec.Bundle.Name)
 	if err != nil {
-		return nil, err
+		return nil, types.NoVersion, err
 	}
-	return crd.ConvertServiceInstanceToAPB(*servInstance, spec, servInstance.GetName())
+	si, err := convertBundleInstance(*servInstance, spec)
+	if err != nil {
+		return nil, types.NoVersion, err
+	}
+	return si, types.Version(servInstance.ResourceVersion), nil
 }
 
 // SetServiceInstance - Set service instance for an id in the kvp API.
 func (d *Dao) SetServiceInstance(id string, serviceInstance *bundle.ServiceInstance) error {
-	defer d.instanceLock.Unlock()
-	d.instanceLock.Lock()
 	log.Debugf("set service instance: %v", id)
+	return types.RetryOnConflict(func() error {
+		si, err := d.client.BundleInstances(d.namespace).Get(id, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			si = nil
+		} else if err != nil {
+			log.Errorf("unable to get service instance - %v", err)
+			return err
+		}
+		_, err = d.writeServiceInstance(id, serviceInstance, si)
+		return err
+	})
+}
+
+// SetServiceInstanceIf - Set service instance for an id in the k8s API if it
+// is still at the resource version.
+func (d *Dao) SetServiceInstanceIf(
+	id string, serviceInstance *bundle.ServiceInstance, version types.Version,
+) (types.Version, error) {
+	log.Debugf("set service instance: %v at version %v", id, version)
+	var current *v1.BundleInstance
+	if version != types.NoVersion {
+		si, err := d.client.BundleInstances(d.namespace).Get(id, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return types.NoVersion, serviceInstanceConflict(id)
+		} else if err != nil {
+			return types.NoVersion, err
+		}
+		if si.ResourceVersion != string(version) {
+			d.conflicted(si)
+			return types.NoVersion, serviceInstanceConflict(id)
+		}
+		current = si
+	}
+	return d.writeServiceInstance(id, serviceInstance, current)
+}
+
+// writeServiceInstance - updates the current bundle instance with the service
+// instance, or creates it if there is no current one. The resource version of
+// the current one guards the update.
+func (d *Dao) writeServiceInstance(
+	id string, serviceInstance *bundle.ServiceInstance, current *v1.BundleInstance,
+) (types.Version, error) {
 	spec, err := crd.ConvertServiceInstanceToCRD(serviceInstance)
 	if err != nil {
-		return err
+		return types.NoVersion, err
 	}
-	if si, err := d.client.BundleInstances(d.namespace).Get(id, metav1.GetOptions{}); err == nil {
+	if current != nil {
 		log.Debugf("updating service instance: %v", id)
-		si.Spec = spec.Spec
-		si.Status.Bindings = intersectionOfBindings(serviceInstance.BindingIDs, si.Status.Bindings)
-		_, err := d.client.BundleInstances(d.namespace).Update(si)
-		if err != nil {
-			log.Errorf("unable to get service instance - %v", err)
-			return err
+		current.Spec = spec.Spec
+		current.Labels = serviceInstanceLabels(current.Labels, serviceInstance)
+		current.Annotations = withSchemaVersion(current.Annotations, types.ServiceInstanceRecord)
+		current.Status.Bindings = intersectionOfBindings(serviceInstance.BindingIDs, current.Status.Bindings)
+		si, err := d.client.BundleInstances(d.namespace).Update(current)
+		if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			return types.NoVersion, serviceInstanceConflict(id)
+		} else if err != nil {
+			log.Errorf("unable to update service instance - %v", err)
+			return types.NoVersion, err
 		}
-		return nil
+		return types.Version(si.ResourceVersion), nil
 	}
 	s := v1.BundleInstance{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      id,
-			Namespace: d.namespace,
+			Name:        id,
+			Namespace:   d.namespace,
+			Labels:      serviceInstanceLabels(nil, serviceInstance),
+			Annotations: withSchemaVersion(nil, types.ServiceInstanceRecord),
 		},
 		Spec:   spec.Spec,
 		Status: spec.Status,
 	}
 
-	_, err = d.client.BundleInstances(d.namespace).Create(&s)
-	if err != nil {
+	si, err := d.client.BundleInstances(d.namespace).Create(&s)
+	if apierrors.IsAlreadyExists(err) {
+		return types.NoVersion, serviceInstanceConflict(id)
+	} else if err != nil {
 		log.Errorf("unable to save service instance - %v", err)
-		return err
+		return types.NoVersion, err
 	}
-	return nil
+	return types.Version(si.ResourceVersion), nil
+}
+
+func serviceInstanceConflict(id string) error {
+	return types.ConflictError{Kind: "service instance", ID: id}
 }
 
 func intersectionOfBindings(bindings map[string]bool, bind []v1.LocalObjectReference) []v1.LocalObjectReference {
 	newBindings := []v1.LocalObjectReference{}
 	alreadyChecked := map[string]bool{}
 	// If one was deleted then we are not adding a binding and do not need to update them.
-	// Because of the sync we can reason that nothing else is updating this
+	// The resource version of the instance guards against concurrent updates
 	deleted := false
 	log.Debugf("\n\nbindings: %#v\nbind: %#v", bindings, bind)
 	for _, b := range bind {
@@ -287,17 +369,15 @@ func (d *Dao) DeleteServiceInstance(id string) error {
 // GetBindInstance - Retrieve a specific bind instance from the kvp API
 func (d *Dao) GetBindInstance(id string) (*bundle.BindInstance, error) {
 	log.Debugf("get binding instance: %v", id)
-	bi, err := d.client.BundleBindings(d.namespace).Get(id, metav1.GetOptions{})
+	bi, err := d.getBundleBinding(id)
 	if err != nil {
 		return nil, err
 	}
-	return crd.ConvertServiceBindingToAPB(*bi, bi.GetName())
+	return convertBundleBinding(*bi)
 }
 
 // SetBindInstance - Set the bind instance for id in the kvp API.
 func (d *Dao) SetBindInstance(id string, bindInstance *bundle.BindInstance) error {
-	defer d.instanceLock.Unlock()
-	d.instanceLock.Lock()
 	log.Debugf("set binding instance: %v", id)
 	b, err := crd.ConvertServiceBindingToCRD(bindInstance)
 	if err != nil {
@@ -305,8 +385,9 @@ func (d *Dao) SetBindInstance(id string, bindInstance *bundle.BindInstance) erro
 	}
 	bi := v1.BundleBinding{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      id,
-			Namespace: d.namespace,
+			Name:        id,
+			Namespace:   d.namespace,
+			Annotations: withCreateJobKey(withSchemaVersion(nil, types.BindInstanceRecord), bindInstance),
 		},
 		Spec:   b.Spec,
 		Status: b.Status,
@@ -317,6 +398,8 @@ func (d *Dao) SetBindInstance(id string, bindInstance *bundle.BindInstance) erro
 		// another goroutine. Let's try to update the existing one instead.
 		if binding, err := d.client.BundleBindings(d.namespace).Get(id, metav1.GetOptions{}); err == nil {
 			binding.Spec = b.Spec
+			binding.Annotations = withCreateJobKey(
+				withSchemaVersion(binding.Annotations, types.BindInstanceRecord), bindInstance)
 			_, err := d.client.BundleBindings(d.namespace).Update(binding)
 
 			if err != nil && apierrors.IsConflict(err) {
@@ -344,19 +427,51 @@ func (d *Dao) DeleteBindInstance(id string) error {
 
 // SetState - Set the Job State in the kvp API for id.
 func (d *Dao) SetState(instanceID string, state bundle.JobState) (string, error) {
+	key := state.Token
+	err := types.RetryOnConflict(func() error {
+		var err error
+		key, _, err = d.setState(instanceID, state, nil)
+		return err
+	})
+	return key, err
+}
+
+// SetStateIf - Set the Job State for id if the binding or instance holding the
+// job is still at the resource version, or, for NoVersion, does not hold the
+// job yet.
+func (d *Dao) SetStateIf(instanceID string, state bundle.JobState, version types.Version) (string, types.Version, error) {
+	return d.setState(instanceID, state, func(jobs map[string]v1.Job, resourceVersion string) bool {
+		if version == types.NoVersion {
+			_, exists := jobs[state.Token]
+			return !exists
+		}
+		return resourceVersion == string(version)
+	})
+}
+
+// setState - saves the job state in the status of the binding or instance,
+// depending on the method of the job. If a precondition is given and it does
+// not hold for the jobs and the resource version of the binding or instance,
+// a conflict is returned.
+func (d *Dao) setState(
+	instanceID string, state bundle.JobState, precondition func(map[string]v1.Job, string) bool,
+) (string, types.Version, error) {
 	log.Debugf("set job state for instance: %v token: %v", instanceID, state.Token)
+	conflict := types.ConflictError{Kind: "job state", ID: stateKey(instanceID, state.Token)}
 	n := metav1.Now()
 	switch state.Method {
 	case bundle.JobMethodBind, bundle.JobMethodUnbind:
-		defer d.bindingLock.Unlock()
-		d.bindingLock.Lock()
 		// get the binding based on instance ID //update the job based on the token.
 		bi, err := d.client.BundleBindings(d.namespace).Get(instanceID, metav1.GetOptions{})
 		if err != nil {
 			log.Errorf("Could not find binding %v associated with job state %v - %v",
 				instanceID, state.Token, err)
 
-			return state.Token, err
+			return state.Token, types.NoVersion, err
+		}
+		if precondition != nil && !precondition(bi.Status.Jobs, bi.ResourceVersion) {
+			d.conflicted(bi)
+			return state.Token, types.NoVersion, conflict
 		}
 		if bi.Status.Jobs == nil {
 			bi.Status.Jobs = map[string]v1.Job{}
@@ -369,33 +484,38 @@ func (d *Dao) SetState(instanceID string, state bundle.JobState) (string, error)
 			State:            crd.ConvertStateToCRD(state.State),
 			Error:            state.Error,
 		}
+		d.retention.prune(bi.Status.Jobs, bindingCreateJob(bi), n.Time)
 		bi.Status.LastDescription = state.Description
 		bi.Status.State = crd.ConvertStateToCRD(state.State)
-		_, err = d.client.BundleBindings(d.namespace).Update(bi)
+		bi, err = d.client.BundleBindings(d.namespace).Update(bi)
 		if err != nil {
 			if apierrors.IsConflict(err) {
 				// detect if the error was a conflict or not. Conflicts occur
 				// when two things attempt to update the same resource
 				// simultaneously
-				log.Warningf("detected a conflicting update of job state %v on binding %v",
+				log.Debugf("detected a conflicting update of job state %v on binding %v",
 					state.Token, instanceID)
+				return state.Token, types.NoVersion, conflict
 			}
 
 			log.Errorf("Unable to update the job state %v on the binding %v. Reason: %v - %v",
 				state.Token, instanceID, apierrors.ReasonForError(err), err)
 
-			return state.Token, err
+			return state.Token, types.NoVersion, err
 		}
+		return stateKey(instanceID, state.Token), types.Version(bi.ResourceVersion), nil
 	case bundle.JobMethodUpdate, bundle.JobMethodDeprovision, bundle.JobMethodProvision:
-		defer d.bindingLock.Unlock()
-		d.bindingLock.Lock()
 		// get the binding based on instance id //update the job based on the token
 		si, err := d.client.BundleInstances(d.namespace).Get(instanceID, metav1.GetOptions{})
 		if err != nil {
 			log.Errorf("Could not find instance %v associated with job state %v - %v",
 				instanceID, state.Token, err)
 
-			return state.Token, err
+			return state.Token, types.NoVersion, err
+		}
+		if precondition != nil && !precondition(si.Status.Jobs, si.ResourceVersion) {
+			d.conflicted(si)
+			return state.Token, types.NoVersion, conflict
 		}
 		if si.Status.Jobs == nil {
 			si.Status.Jobs = map[string]v1.Job{}
@@ -408,70 +528,79 @@ func (d *Dao) SetState(instanceID string, state bundle.JobState) (string, error)
 			State:            crd.ConvertStateToCRD(state.State),
 			Error:            state.Error,
 		}
+		d.retention.prune(si.Status.Jobs, keepInstanceJob, n.Time)
 		si.Status.LastDescription = state.Description
 		si.Status.State = crd.ConvertStateToCRD(state.State)
-		_, err = d.client.BundleInstances(d.namespace).Update(si)
+		si, err = d.client.BundleInstances(d.namespace).Update(si)
 		if err != nil {
+			if apierrors.IsConflict(err) {
+				log.Debugf("detected a conflicting update of job state %v on instance %v",
+					state.Token, instanceID)
+				return state.Token, types.NoVersion, conflict
+			}
 			log.Errorf("Unable to update the job state %v on the instance %v: %v",
 				state.Token, instanceID, err)
 
-			return state.Token, err
+			return state.Token, types.NoVersion, err
 		}
+		return stateKey(instanceID, state.Token), types.Version(si.ResourceVersion), nil
 	}
 
 	// looks like we're good
-	return state.Token, nil
+	return stateKey(instanceID, state.Token), types.NoVersion, nil
 }
 
 // GetState - Retrieve a job state from the kvp API for an ID and Token.
 func (d *Dao) GetState(id string, token string) (bundle.JobState, error) {
+	state, _, err := d.GetStateVersion(id, token)
+	return state, err
+}
+
+// GetStateVersion - Retrieve a job state from the k8s API for an ID and Token
+// along with the resource version of the binding or instance holding it.
+func (d *Dao) GetStateVersion(id string, token string) (bundle.JobState, types.Version, error) {
 	// get the binding based on instance ID //update the job based on the token.
-	var job v1.Job
+	jobs, version, cached := d.cachedJobs(id)
+	if cached {
+		job, ok := jobs[token]
+		if !ok {
+			return bundle.JobState{}, types.NoVersion, jobStateNotFound(id, token)
+		}
+		return convertJob(token, job), version, nil
+	}
 	bi, err := d.client.BundleBindings(d.namespace).Get(id, metav1.GetOptions{})
 	if err != nil && !d.IsNotFoundError(err) {
 		log.Debugf("Could not find binding %v associated with job state %v - %v", id, token, err)
-		return bundle.JobState{}, fmt.Errorf("Could not find binding %v associated with job state %v",
+		return bundle.JobState{}, types.NoVersion, fmt.Errorf("Could not find binding %v associated with job state %v",
 			id, token)
 	} else if d.IsNotFoundError(err) {
 		si, err := d.client.BundleInstances(d.namespace).Get(id, metav1.GetOptions{})
-		if err != nil || si.Status.Jobs == nil {
+		if err != nil {
 			log.Debugf("Could not find instance %v associated with job state %v - %v",
 				id, token, err)
 
-			return bundle.JobState{}, err
-		}
-		j, ok := si.Status.Jobs[token]
-		if !ok {
-			log.Debugf("Unable to get the job state: %v - %v", token, err)
-			return bundle.JobState{}, fmt.Errorf("unable to find job state %v", token)
+			return bundle.JobState{}, types.NoVersion, err
 		}
-		job = j
+		jobs, version = si.Status.Jobs, types.Version(si.ResourceVersion)
 	} else {
-		if bi.Status.Jobs == nil {
-			log.Debugf("binding %v has no associated job states: %v - %v", id, token, err)
-			return bundle.JobState{}, err
-		}
-		j, ok := bi.Status.Jobs[token]
-		if !ok {
-			log.Debugf("binding %v does not have job state: %v - %v", id, token, err)
-			return bundle.JobState{}, fmt.Errorf("unable to find job state %v", token)
-		}
-
-		job = j
+		jobs, version = bi.Status.Jobs, types.Version(bi.ResourceVersion)
 	}
-	return bundle.JobState{
-		Description: job.Description,
-		Method:      crd.ConvertJobMethodToAPB(job.Method),
-		Podname:     job.Podname,
-		Token:       token,
-		State:       crd.ConvertStateToAPB(job.State),
-		Error:       job.Error,
-	}, nil
+	job, ok := jobs[token]
+	if !ok {
+		log.Debugf("%v does not have job state: %v", id, token)
+		return bundle.JobState{}, types.NoVersion, jobStateNotFound(id, token)
+	}
+	return convertJob(token, job), version, nil
 }
 
-// GetStateByKey - Retrieve a job state from the kvp API for a job key
+// GetStateByKey - Retrieve a job state from the k8s API for a job key, as
+// returned by SetState. A key that is the name of a binding is the bind job
+// of the binding.
 func (d *Dao) GetStateByKey(key string) (bundle.JobState, error) {
-	bi, err := d.client.BundleBindings(d.namespace).Get(key, metav1.GetOptions{})
+	if id, token, ok := parseStateKey(key); ok {
+		return d.GetState(id, token)
+	}
+	bi, err := d.getBundleBinding(key)
 	if err != nil {
 		if !d.IsNotFoundError(err) {
 			log.Errorf("Unable to get the job state: %v - %v", key, err)
@@ -481,27 +610,66 @@ func (d *Dao) GetStateByKey(key string) (bundle.JobState, error) {
 	for token, j := range bi.Status.Jobs {
 		// Assuming a single bind job happens per binding instance.
 		if j.Method == v1.JobMethodBind {
-			return bundle.JobState{
-				Description: j.Description,
-				Method:      crd.ConvertJobMethodToAPB(j.Method),
-				Podname:     j.Podname,
-				Token:       token,
-				State:       crd.ConvertStateToAPB(j.State),
-				Error:       j.Error,
-			}, nil
-		}
-	}
-	return bundle.JobState{}, &apierrors.StatusError{ErrStatus: metav1.Status{
-		Status: metav1.StatusFailure,
-		Code:   http.StatusNotFound,
-		Reason: metav1.StatusReasonNotFound,
+			return convertJob(token, j), nil
+		}
+	}
+	return bundle.JobState{}, jobStateNotFound(key, "bind")
+}
+
+// convertJob - the job state of a job kept in a status.
+func convertJob(token string, job v1.Job) bundle.JobState {
+	return bundle.JobState{
+		Description: job.Description,
+		Method:      crd.ConvertJobMethodToAPB(job.Method),
+		Podname:     job.Podname,
+		Token:       token,
+		State:       crd.ConvertStateToAPB(job.State),
+		Error:       job.Error,
+	}
+}
+
+// createJobKeyAnnotation - the annotation of a bundle binding keeping the
+// CreateJobKey of the binding, which the spec of a bundle binding has no field
+// for.
+const createJobKeyAnnotation = "automationbroker.io/create-job-key"
+
+func withCreateJobKey(annotations map[string]string, bi *bundle.BindInstance) map[string]string {
+	annotations[createJobKeyAnnotation] = bi.CreateJobKey
+	return annotations
+}
+
+// stateKey - the key of a job state, in the format of the etcd dao which the
+// broker uses for the CreateJobKey of a binding.
+func stateKey(id string, token string) string {
+	return fmt.Sprintf("/state/%s/job/%s", id, token)
+}
+
+func parseStateKey(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, "/state/") {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(key, "/state/"), "/job/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// jobStateNotFound - the not found error of a missing job state, they are
+// kept in the status of the instances and bindings.
+func jobStateNotFound(id string, token string) error {
+	return &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusNotFound,
+		Reason:  metav1.StatusReasonNotFound,
+		Message: fmt.Sprintf("job state %v of %v not found", token, id),
 	}}
 }
 
 // FindJobStateByState - Retrieve all the jobs that match the specified state
 func (d *Dao) FindJobStateByState(state bundle.State) ([]bundle.RecoverStatus, error) {
 
-	sis, err := d.client.BundleInstances(d.namespace).List(metav1.ListOptions{})
+	sis, err := d.listBundleInstances("")
 	if err != nil {
 		if !d.IsNotFoundError(err) {
 			log.Errorf("unable to get instance jobs for the state: %v - %v", state, err)
@@ -509,7 +677,7 @@ func (d *Dao) FindJobStateByState(state bundle.State) ([]bundle.RecoverStatus, e
 		return nil, err
 	}
 
-	bis, err := d.client.BundleBindings(d.namespace).List(metav1.ListOptions{})
+	bis, err := d.listBundleBindings()
 	if err != nil {
 		if !d.IsNotFoundError(err) {
 			log.Errorf("unable to get binding jobs for the state: %v - %v", state, err)
@@ -520,7 +688,7 @@ func (d *Dao) FindJobStateByState(state bundle.State) ([]bundle.RecoverStatus, e
 	// build the status information for recovery purposes
 	rss := []bundle.RecoverStatus{}
 
-	for _, si := range sis.Items {
+	for _, si := range sis {
 		for token, j := range si.Status.Jobs {
 			if state == crd.ConvertStateToAPB(j.State) {
 				rss = append(rss,
@@ -536,7 +704,7 @@ func (d *Dao) FindJobStateByState(state bundle.State) ([]bundle.RecoverStatus, e
 		}
 	}
 
-	for _, bi := range bis.Items {
+	for _, bi := range bis {
 		for token, j := range bi.Status.Jobs {
 			if state == crd.ConvertStateToAPB(j.State) {
 				rss = append(rss,
@@ -559,13 +727,23 @@ func (d *Dao) FindJobStateByState(state bundle.State) ([]bundle.RecoverStatus, e
 func (d *Dao) GetSvcInstJobsByState(ID string, state bundle.State) ([]bundle.JobState, error) {
 	// get the binding based on instance ID //update the job based on the token.
 	jobs := []bundle.JobState{}
+	if cached, _, ok := d.cachedJobs(ID); ok {
+		for token, job := range cached {
+			if job.State == crd.ConvertStateToCRD(state) {
+				jobs = append(jobs, convertJob(token, job))
+			}
+		}
+		return jobs, nil
+	}
 	bi, err := d.client.BundleBindings(d.namespace).Get(ID, metav1.GetOptions{})
 	if err != nil && !d.IsNotFoundError(err) {
 		log.Errorf("Unable to get the job state: %v - %v", ID, err)
 		return []bundle.JobState{}, fmt.Errorf("unable to find job state %v", ID)
 	} else if d.IsNotFoundError(err) {
 		si, err := d.client.BundleInstances(d.namespace).Get(ID, metav1.GetOptions{})
-		if err != nil {
+		if d.IsNotFoundError(err) {
+			return jobs, nil
+		} else if err != nil {
 			log.Errorf("Unable to get the job state: %v - %v", ID, err)
 			return []bundle.JobState{}, err
 		}
@@ -603,11 +781,14 @@ func (d *Dao) IsNotFoundError(err error) bool {
 	return apierrors.IsNotFound(err)
 }
 
-// DeleteBinding - Delete the binding instance and remove the association with the service instance.
+// DeleteBinding - Delete the binding instance and remove the association with
+// the latest version of the service instance.
 func (d *Dao) DeleteBinding(bindingInstance bundle.BindInstance, serviceInstance bundle.ServiceInstance) error {
 	if err := d.DeleteBindInstance(bindingInstance.ID.String()); err != nil {
 		return err
 	}
-	serviceInstance.RemoveBinding(bindingInstance.ID)
-	return d.SetServiceInstance(serviceInstance.ID.String(), &serviceInstance)
+	return types.UpdateServiceInstance(d, serviceInstance.ID.String(), func(si *bundle.ServiceInstance) error {
+		si.RemoveBinding(bindingInstance.ID)
+		return nil
+	})
 }
@@ -0,0 +1,842 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao_test
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	automationbrokerv1 "github.com/automationbroker/broker-client-go/client/clientset/versioned/typed/automationbroker/v1alpha1"
+	v1 "github.com/automationbroker/broker-client-go/pkg/apis/automationbroker/v1alpha1"
+	"github.com/automationbroker/bundle-lib/bundle"
+	bundlecrd "github.com/automationbroker/bundle-lib/crd"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	crd "github.com/openshift/ansible-service-broker/pkg/dao/crd"
+	"github.com/openshift/ansible-service-broker/pkg/dao/daotest"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"github.com/pborman/uuid"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// fakeStore - the objects of one resource, with the resource version checks
+// of the k8s API.
+type fakeStore struct {
+	mutex    sync.Mutex
+	resource schema.GroupResource
+	objects  map[string]runtime.Object
+	version  int
+	// the reads served, to tell those served by a cache
+	gets, lists int
+	// the watches and the events sent to them
+	watching int
+	events   *watch.Broadcaster
+	// run once at the start of the next update, to write concurrently to it
+	interleave func(s *fakeStore)
+}
+
+func newFakeStore(group string, resource string) *fakeStore {
+	return &fakeStore{
+		resource: schema.GroupResource{Group: group, Resource: resource},
+		objects:  map[string]runtime.Object{},
+		events:   watch.NewBroadcaster(100, watch.WaitIfChannelFull),
+	}
+}
+
+func (s *fakeStore) get(name string) (runtime.Object, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.gets++
+	obj, ok := s.objects[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(s.resource, name)
+	}
+	return obj.DeepCopyObject(), nil
+}
+
+// list - the objects whose labels match the label selector of the options.
+func (s *fakeStore) list(opts metav1.ListOptions) ([]runtime.Object, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lists++
+	names := []string{}
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	objs := []runtime.Object{}
+	for _, name := range names {
+		if selector.Matches(labels.Set(s.objects[name].(metav1.Object).GetLabels())) {
+			objs = append(objs, s.objects[name].DeepCopyObject())
+		}
+	}
+	return objs, nil
+}
+
+func (s *fakeStore) create(obj runtime.Object) (runtime.Object, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name := obj.(metav1.Object).GetName()
+	if _, ok := s.objects[name]; ok {
+		return nil, apierrors.NewAlreadyExists(s.resource, name)
+	}
+	obj = obj.DeepCopyObject()
+	obj.(metav1.Object).SetCreationTimestamp(metav1.Now())
+	return s.store(name, obj, watch.Added), nil
+}
+
+func (s *fakeStore) update(obj runtime.Object) (runtime.Object, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if interleave := s.interleave; interleave != nil {
+		s.interleave = nil
+		interleave(s)
+	}
+	meta := obj.(metav1.Object)
+	existing, ok := s.objects[meta.GetName()]
+	if !ok {
+		return nil, apierrors.NewNotFound(s.resource, meta.GetName())
+	}
+	if rv := meta.GetResourceVersion(); rv != "" && rv != existing.(metav1.Object).GetResourceVersion() {
+		return nil, apierrors.NewConflict(s.resource, meta.GetName(), nil)
+	}
+	obj = obj.DeepCopyObject()
+	obj.(metav1.Object).SetCreationTimestamp(existing.(metav1.Object).GetCreationTimestamp())
+	return s.store(meta.GetName(), obj, watch.Modified), nil
+}
+
+// store - saves a copy of the object with a new resource version.
+func (s *fakeStore) store(name string, obj runtime.Object, event watch.EventType) runtime.Object {
+	s.version++
+	stored := obj.DeepCopyObject()
+	stored.(metav1.Object).SetResourceVersion(strconv.Itoa(s.version))
+	s.objects[name] = stored
+	s.events.Action(event, stored.DeepCopyObject())
+	return stored.DeepCopyObject()
+}
+
+// lag - updates an object without sending its event, as if the watches lag
+// behind the API server.
+func (s *fakeStore) lag(name string, update func(obj runtime.Object)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.version++
+	obj := s.objects[name].DeepCopyObject()
+	update(obj)
+	obj.(metav1.Object).SetResourceVersion(strconv.Itoa(s.version))
+	s.objects[name] = obj
+}
+
+func (s *fakeStore) delete(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	obj, ok := s.objects[name]
+	if !ok {
+		return apierrors.NewNotFound(s.resource, name)
+	}
+	delete(s.objects, name)
+	s.events.Action(watch.Deleted, obj)
+	return nil
+}
+
+// watch - the events of the objects stored from now on.
+func (s *fakeStore) watch() watch.Interface {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.watching++
+	return s.events.Watch()
+}
+
+// reads - the reads served so far.
+func (s *fakeStore) reads() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.gets + s.lists
+}
+
+// watched - whether the store is watched.
+func (s *fakeStore) watched() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.watching > 0
+}
+
+// fakeClient - the automation broker custom resources of one namespace.
+type fakeClient struct {
+	automationbrokerv1.AutomationbrokerV1alpha1Interface
+	bundles   *fakeStore
+	instances *fakeStore
+	bindings  *fakeStore
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		bundles:   newFakeStore(v1.SchemeGroupVersion.Group, "bundles"),
+		instances: newFakeStore(v1.SchemeGroupVersion.Group, "bundleinstances"),
+		bindings:  newFakeStore(v1.SchemeGroupVersion.Group, "bundlebindings"),
+	}
+}
+
+func (c *fakeClient) Bundles(namespace string) automationbrokerv1.BundleInterface {
+	return fakeBundles{store: c.bundles}
+}
+
+func (c *fakeClient) BundleInstances(namespace string) automationbrokerv1.BundleInstanceInterface {
+	return fakeBundleInstances{store: c.instances}
+}
+
+func (c *fakeClient) BundleBindings(namespace string) automationbrokerv1.BundleBindingInterface {
+	return fakeBundleBindings{store: c.bindings}
+}
+
+type fakeBundles struct {
+	automationbrokerv1.BundleInterface
+	store *fakeStore
+}
+
+func (f fakeBundles) Create(b *v1.Bundle) (*v1.Bundle, error) {
+	obj, err := f.store.create(b)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.Bundle), nil
+}
+
+func (f fakeBundles) Update(b *v1.Bundle) (*v1.Bundle, error) {
+	obj, err := f.store.update(b)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.Bundle), nil
+}
+
+func (f fakeBundles) Delete(name string, options *metav1.DeleteOptions) error {
+	return f.store.delete(name)
+}
+
+func (f fakeBundles) Get(name string, options metav1.GetOptions) (*v1.Bundle, error) {
+	obj, err := f.store.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.Bundle), nil
+}
+
+func (f fakeBundles) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return f.store.watch(), nil
+}
+
+func (f fakeBundles) List(opts metav1.ListOptions) (*v1.BundleList, error) {
+	objs, err := f.store.list(opts)
+	if err != nil {
+		return nil, err
+	}
+	l := &v1.BundleList{}
+	for _, obj := range objs {
+		l.Items = append(l.Items, *obj.(*v1.Bundle))
+	}
+	return l, nil
+}
+
+type fakeBundleInstances struct {
+	automationbrokerv1.BundleInstanceInterface
+	store *fakeStore
+}
+
+func (f fakeBundleInstances) Create(bi *v1.BundleInstance) (*v1.BundleInstance, error) {
+	obj, err := f.store.create(bi)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.BundleInstance), nil
+}
+
+func (f fakeBundleInstances) Update(bi *v1.BundleInstance) (*v1.BundleInstance, error) {
+	obj, err := f.store.update(bi)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.BundleInstance), nil
+}
+
+func (f fakeBundleInstances) Delete(name string, options *metav1.DeleteOptions) error {
+	return f.store.delete(name)
+}
+
+func (f fakeBundleInstances) Get(name string, options metav1.GetOptions) (*v1.BundleInstance, error) {
+	obj, err := f.store.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.BundleInstance), nil
+}
+
+func (f fakeBundleInstances) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return f.store.watch(), nil
+}
+
+func (f fakeBundleInstances) List(opts metav1.ListOptions) (*v1.BundleInstanceList, error) {
+	objs, err := f.store.list(opts)
+	if err != nil {
+		return nil, err
+	}
+	l := &v1.BundleInstanceList{}
+	for _, obj := range objs {
+		l.Items = append(l.Items, *obj.(*v1.BundleInstance))
+	}
+	return l, nil
+}
+
+type fakeBundleBindings struct {
+	automationbrokerv1.BundleBindingInterface
+	store *fakeStore
+}
+
+func (f fakeBundleBindings) Create(bb *v1.BundleBinding) (*v1.BundleBinding, error) {
+	obj, err := f.store.create(bb)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.BundleBinding), nil
+}
+
+func (f fakeBundleBindings) Update(bb *v1.BundleBinding) (*v1.BundleBinding, error) {
+	obj, err := f.store.update(bb)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.BundleBinding), nil
+}
+
+func (f fakeBundleBindings) Delete(name string, options *metav1.DeleteOptions) error {
+	return f.store.delete(name)
+}
+
+func (f fakeBundleBindings) Get(name string, options metav1.GetOptions) (*v1.BundleBinding, error) {
+	obj, err := f.store.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*v1.BundleBinding), nil
+}
+
+func (f fakeBundleBindings) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return f.store.watch(), nil
+}
+
+func (f fakeBundleBindings) List(opts metav1.ListOptions) (*v1.BundleBindingList, error) {
+	objs, err := f.store.list(opts)
+	if err != nil {
+		return nil, err
+	}
+	l := &v1.BundleBindingList{}
+	for _, obj := range objs {
+		l.Items = append(l.Items, *obj.(*v1.BundleBinding))
+	}
+	return l, nil
+}
+
+// fakeConfigMaps - the config maps of one namespace.
+type fakeConfigMaps struct {
+	typedcorev1.ConfigMapInterface
+	store *fakeStore
+}
+
+func (f fakeConfigMaps) ConfigMaps(namespace string) typedcorev1.ConfigMapInterface {
+	return f
+}
+
+func (f fakeConfigMaps) Create(cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	obj, err := f.store.create(cm)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*corev1.ConfigMap), nil
+}
+
+func (f fakeConfigMaps) Update(cm *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	obj, err := f.store.update(cm)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*corev1.ConfigMap), nil
+}
+
+func (f fakeConfigMaps) Get(name string, options metav1.GetOptions) (*corev1.ConfigMap, error) {
+	obj, err := f.store.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*corev1.ConfigMap), nil
+}
+
+func TestConformance(t *testing.T) {
+	daotest.RunConformance(t, func(t *testing.T) dao.Dao {
+		configMaps := fakeConfigMaps{store: newFakeStore("", "configmaps")}
+		return crd.NewDaoWithClients("broker", newFakeClient(), configMaps)
+	})
+}
+
+func TestConformanceWithCache(t *testing.T) {
+	daotest.RunConformance(t, func(t *testing.T) dao.Dao {
+		return newCachedDao(t, newFakeClient())
+	})
+}
+
+// newCachedDao - a dao reading from a cache run until the test ends, which
+// watches the resources of the client.
+func newCachedDao(t *testing.T, client *fakeClient) *crd.Dao {
+	d := crd.NewDaoWithClients("broker", client, fakeConfigMaps{store: newFakeStore("", "configmaps")})
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	d.EnableCache(stop)
+	eventually(t, "the resources are watched", func() bool {
+		return client.bundles.watched() && client.instances.watched() && client.bindings.watched()
+	})
+	return d
+}
+
+// eventually - fails the test if the condition is not met within a few
+// seconds.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+	}
+}
+
+func TestCacheServesReads(t *testing.T) {
+	client := newFakeClient()
+	d := newCachedDao(t, client)
+	spec := &bundle.Spec{
+		ID: "spec-1", FQName: "dh-postgresql-apb", Image: "postgresql-apb", Runtime: 2,
+		Plans: []bundle.Plan{{Name: "dev"}},
+	}
+	if err := d.SetSpec("spec-1", spec); err != nil {
+		t.Fatal(err)
+	}
+
+	// the spec is read from the API server until the cache observes the write
+	eventually(t, "the spec is read from the cache", func() bool {
+		reads := client.bundles.reads()
+		s, err := d.GetSpec("spec-1")
+		return err == nil && s.FQName == "dh-postgresql-apb" && client.bundles.reads() == reads
+	})
+	reads := client.bundles.reads()
+	if specs, err := d.BatchGetSpecs(""); err != nil || len(specs) != 1 {
+		t.Fatalf("listed %d specs - %v", len(specs), err)
+	}
+	if client.bundles.reads() != reads {
+		t.Fatal("the specs were listed from the API server")
+	}
+
+	// a write of another broker is read once the cache observes it
+	b, err := client.Bundles("broker").Get("spec-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Spec.Description = "updated elsewhere"
+	if _, err := client.Bundles("broker").Update(b); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the update is read from the cache", func() bool {
+		s, err := d.GetSpec("spec-1")
+		return err == nil && s.Description == "updated elsewhere"
+	})
+
+	// the dao reads its own writes, whether the cache observed them or not
+	spec.Description = "updated by the dao"
+	if err := d.SetSpec("spec-1", spec); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := d.GetSpec("spec-1"); err != nil || s.Description != "updated by the dao" {
+		t.Fatalf("read a stale spec %#v - %v", s, err)
+	}
+	if err := d.DeleteSpec("spec-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetSpec("spec-1"); !apierrors.IsNotFound(err) {
+		t.Fatalf("read a deleted spec - %v", err)
+	}
+	if specs, err := d.BatchGetSpecs(""); err != nil || len(specs) != 0 {
+		t.Fatalf("listed %d deleted specs - %v", len(specs), err)
+	}
+}
+
+func TestCacheConflictReadsAPIServer(t *testing.T) {
+	client := newFakeClient()
+	d := newCachedDao(t, client)
+	spec := &bundle.Spec{
+		ID: "spec-1", FQName: "dh-postgresql-apb", Image: "postgresql-apb", Runtime: 2,
+		Plans: []bundle.Plan{{Name: "dev"}},
+	}
+	if err := d.SetSpec("spec-1", spec); err != nil {
+		t.Fatal(err)
+	}
+	si := &bundle.ServiceInstance{
+		ID:         uuid.NewRandom(),
+		Spec:       spec,
+		Context:    &bundle.Context{Platform: "kubernetes", Namespace: "test-project"},
+		Parameters: &bundle.Parameters{"replicas": "1"},
+		BindingIDs: map[string]bool{},
+	}
+	id := si.ID.String()
+	if err := d.SetServiceInstance(id, si); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the instance is read from the cache", func() bool {
+		reads := client.instances.reads()
+		_, err := d.GetServiceInstance(id)
+		return err == nil && client.instances.reads() == reads
+	})
+
+	// another broker updates the instance, the cache does not observe it
+	client.instances.lag(id, func(obj runtime.Object) {
+		obj.(metav1.Object).SetAnnotations(map[string]string{"updated": "elsewhere"})
+	})
+	err := types.UpdateServiceInstance(d, id, func(si *bundle.ServiceInstance) error {
+		(*si.Parameters)["replicas"] = "2"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("the update of a stale cached instance failed - %v", err)
+	}
+	bi, err := client.BundleInstances("broker").Get(id, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bi.Annotations["updated"] != "elsewhere" {
+		t.Fatalf("the update overwrote the annotations %v", bi.Annotations)
+	}
+	if s, err := d.GetServiceInstance(id); err != nil || (*s.Parameters)["replicas"] != "2" {
+		t.Fatalf("read a stale instance %#v - %v", s, err)
+	}
+
+	// the job states read from the cache are just as stale
+	eventually(t, "the update is read from the cache", func() bool {
+		reads := client.instances.reads()
+		_, _, err := d.GetStateVersion(id, "p1")
+		return d.IsNotFoundError(err) && client.instances.reads() == reads
+	})
+	client.instances.lag(id, func(obj runtime.Object) {
+		obj.(*v1.BundleInstance).Status.Jobs = map[string]v1.Job{"p1": {Method: v1.JobMethodProvision, State: v1.StateInProgress}}
+	})
+	var updated bundle.State
+	err = types.UpdateState(d, id, "p1", func(state *bundle.JobState) error {
+		updated = state.State
+		state.Method, state.State = bundle.JobMethodProvision, bundle.StateSucceeded
+		return nil
+	})
+	if err != nil || updated != bundle.StateInProgress {
+		t.Fatalf("updated the job state %q - %v", updated, err)
+	}
+	if state, err := d.GetState(id, "p1"); err != nil || state.State != bundle.StateSucceeded {
+		t.Fatalf("read a stale job state %#v - %v", state, err)
+	}
+}
+
+func TestRewriteOutdatedRecords(t *testing.T) {
+	// the bundles not annotated with a schema version are outdated
+	defer types.RegisterTestUpgrade(types.SpecRecord, func(map[string]interface{}) error { return nil })()
+	client := newFakeClient()
+	spec, err := bundlecrd.ConvertSpecToBundle(&bundle.Spec{
+		ID: "spec-1", FQName: "dh-postgresql-apb", Image: "postgresql-apb", Runtime: 2, Bindable: true,
+		Plans: []bundle.Plan{{Name: "dev"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Bundles("broker").Create(&v1.Bundle{
+		ObjectMeta: metav1.ObjectMeta{Name: "spec-1", Namespace: "broker"},
+		Spec:       spec,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	d := crd.NewDaoWithClients("broker", client, fakeConfigMaps{store: newFakeStore("", "configmaps")})
+
+	s, err := d.GetSpec("spec-1")
+	if err != nil {
+		t.Fatalf("unable to read the outdated bundle - %v", err)
+	}
+	if s.FQName != "dh-postgresql-apb" || len(s.Plans) != 1 {
+		t.Fatalf("unexpected spec %#v", s)
+	}
+
+	n, err := d.RewriteOutdatedRecords()
+	if err != nil || n != 1 {
+		t.Fatalf("rewrote %d records - %v", n, err)
+	}
+	b, err := client.Bundles("broker").Get("spec-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := b.Annotations["automationbroker.io/schema-version"]; version != "2" {
+		t.Fatalf("the bundle was rewritten with schema version %q", version)
+	}
+	if n, err := d.RewriteOutdatedRecords(); err != nil || n != 0 {
+		t.Fatalf("rewrote %d current records - %v", n, err)
+	}
+}
+
+// retainedJob - a job of a status, last modified age ago.
+func retainedJob(method v1.JobMethod, state v1.State, age time.Duration) v1.Job {
+	modified := metav1.NewTime(time.Now().Add(-age))
+	return v1.Job{Method: method, State: state, LastModifiedTime: &modified}
+}
+
+// newBindingWithJobs - a binding with the jobs in its status, created by
+// the bind job with the create token if it is not empty.
+func newBindingWithJobs(t *testing.T, client *fakeClient, d *crd.Dao, createToken string, jobs map[string]v1.Job) string {
+	id := uuid.New()
+	bi := &bundle.BindInstance{ID: uuid.Parse(id), ServiceID: uuid.NewRandom()}
+	if createToken != "" {
+		bi.CreateJobKey = fmt.Sprintf("/state/%s/job/%s", id, createToken)
+	}
+	if err := d.SetBindInstance(id, bi); err != nil {
+		t.Fatal(err)
+	}
+	bb, err := client.BundleBindings("broker").Get(id, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bb.Status.Jobs = jobs
+	if _, err := client.BundleBindings("broker").Update(bb); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func bindingJobTokens(t *testing.T, client *fakeClient, id string) []string {
+	bb, err := client.BundleBindings("broker").Get(id, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := []string{}
+	for token := range bb.Status.Jobs {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+func TestCompactJobs(t *testing.T) {
+	cases := []struct {
+		name        string
+		retention   crd.JobRetention
+		createToken string
+		// the binding was written before its CreateJobKey was annotated
+		legacy bool
+		jobs   map[string]v1.Job
+		kept   []string
+	}{
+		{
+			name: "every job kept by default",
+			jobs: map[string]v1.Job{
+				"u1": retainedJob(v1.JobMethodUnbind, v1.StateSucceeded, time.Hour),
+				"u2": retainedJob(v1.JobMethodUnbind, v1.StateFailed, 1000*time.Hour),
+			},
+			kept: []string{"u1", "u2"},
+		},
+		{
+			name:      "latest jobs of each method kept",
+			retention: crd.JobRetention{MaxJobsPerMethod: 2},
+			jobs: map[string]v1.Job{
+				"b1": retainedJob(v1.JobMethodBind, v1.StateFailed, 5*time.Hour),
+				"u1": retainedJob(v1.JobMethodUnbind, v1.StateSucceeded, time.Hour),
+				"u2": retainedJob(v1.JobMethodUnbind, v1.StateFailed, 2*time.Hour),
+				"u3": retainedJob(v1.JobMethodUnbind, v1.StateSucceeded, 3*time.Hour),
+			},
+			kept: []string{"b1", "u1", "u2"},
+		},
+		{
+			name:      "old jobs dropped",
+			retention: crd.JobRetention{MaxAge: 24 * time.Hour},
+			jobs: map[string]v1.Job{
+				"u1": retainedJob(v1.JobMethodUnbind, v1.StateSucceeded, time.Hour),
+				"u2": retainedJob(v1.JobMethodUnbind, v1.StateFailed, 48*time.Hour),
+			},
+			kept: []string{"u1"},
+		},
+		{
+			name:      "unfinished jobs kept",
+			retention: crd.JobRetention{MaxJobsPerMethod: 1, MaxAge: time.Hour},
+			jobs: map[string]v1.Job{
+				"u1": retainedJob(v1.JobMethodUnbind, v1.StateSucceeded, time.Minute),
+				"u2": retainedJob(v1.JobMethodUnbind, v1.StateInProgress, 5*time.Hour),
+				"u3": retainedJob(v1.JobMethodUnbind, v1.StateNotYetStarted, 6*time.Hour),
+				"u4": retainedJob(v1.JobMethodUnbind, v1.StateFailed, 7*time.Hour),
+			},
+			kept: []string{"u1", "u2", "u3"},
+		},
+		{
+			name:        "create job of the binding kept",
+			retention:   crd.JobRetention{MaxJobsPerMethod: 1},
+			createToken: "b1",
+			jobs: map[string]v1.Job{
+				"b1": retainedJob(v1.JobMethodBind, v1.StateSucceeded, 10*time.Hour),
+				"b2": retainedJob(v1.JobMethodBind, v1.StateFailed, time.Hour),
+				"b3": retainedJob(v1.JobMethodBind, v1.StateFailed, 2*time.Hour),
+			},
+			kept: []string{"b1", "b2"},
+		},
+		{
+			name:      "bind jobs of a binding without create job dropped",
+			retention: crd.JobRetention{MaxJobsPerMethod: 1},
+			jobs: map[string]v1.Job{
+				"b1": retainedJob(v1.JobMethodBind, v1.StateSucceeded, 10*time.Hour),
+				"b2": retainedJob(v1.JobMethodBind, v1.StateFailed, time.Hour),
+			},
+			kept: []string{"b2"},
+		},
+		{
+			name:      "bind jobs of a legacy binding kept",
+			retention: crd.JobRetention{MaxAge: time.Hour},
+			legacy:    true,
+			jobs: map[string]v1.Job{
+				"b1": retainedJob(v1.JobMethodBind, v1.StateSucceeded, 10*time.Hour),
+				"b2": retainedJob(v1.JobMethodBind, v1.StateFailed, 5*time.Hour),
+				"u1": retainedJob(v1.JobMethodUnbind, v1.StateFailed, 5*time.Hour),
+			},
+			kept: []string{"b1", "b2"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeClient()
+			d := crd.NewDaoWithClients("broker", client, fakeConfigMaps{store: newFakeStore("", "configmaps")})
+			d.SetJobRetention(tc.retention)
+			id := newBindingWithJobs(t, client, d, tc.createToken, tc.jobs)
+			if tc.legacy {
+				bb, err := client.BundleBindings("broker").Get(id, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				delete(bb.Annotations, "automationbroker.io/create-job-key")
+				if _, err := client.BundleBindings("broker").Update(bb); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := d.CompactJobs(); err != nil {
+				t.Fatal(err)
+			}
+			if kept := bindingJobTokens(t, client, id); fmt.Sprint(kept) != fmt.Sprint(tc.kept) {
+				t.Fatalf("kept the jobs %v, expected %v", kept, tc.kept)
+			}
+		})
+	}
+}
+
+func TestCompactJobsConflict(t *testing.T) {
+	client := newFakeClient()
+	d := crd.NewDaoWithClients("broker", client, fakeConfigMaps{store: newFakeStore("", "configmaps")})
+	d.SetJobRetention(crd.JobRetention{MaxJobsPerMethod: 1})
+	id := newBindingWithJobs(t, client, d, "", map[string]v1.Job{
+		"u1": retainedJob(v1.JobMethodUnbind, v1.StateSucceeded, time.Hour),
+		"u2": retainedJob(v1.JobMethodUnbind, v1.StateSucceeded, 2*time.Hour),
+	})
+
+	// a job state is written while the jobs are compacted
+	client.bindings.interleave = func(s *fakeStore) {
+		bb := s.objects[id].DeepCopyObject().(*v1.BundleBinding)
+		bb.Status.Jobs["b1"] = retainedJob(v1.JobMethodBind, v1.StateInProgress, 0)
+		s.store(id, bb, watch.Modified)
+	}
+	if err := d.CompactJobs(); err != nil {
+		t.Fatalf("a conflict failed the compaction - %v", err)
+	}
+	if kept := bindingJobTokens(t, client, id); fmt.Sprint(kept) != "[b1 u1 u2]" {
+		t.Fatalf("the conflicting compaction kept the jobs %v", kept)
+	}
+
+	// compacted on the next pass
+	if err := d.CompactJobs(); err != nil {
+		t.Fatal(err)
+	}
+	if kept := bindingJobTokens(t, client, id); fmt.Sprint(kept) != "[b1 u1]" {
+		t.Fatalf("kept the jobs %v", kept)
+	}
+}
+
+func TestAllJobStatesListsOnce(t *testing.T) {
+	client := newFakeClient()
+	d := crd.NewDaoWithClients("broker", client, fakeConfigMaps{store: newFakeStore("", "configmaps")})
+	for i := 0; i < 3; i++ {
+		newBindingWithJobs(t, client, d, "", map[string]v1.Job{
+			"b1": retainedJob(v1.JobMethodBind, v1.StateSucceeded, time.Hour),
+			"u1": retainedJob(v1.JobMethodUnbind, v1.StateFailed, 0),
+		})
+	}
+	instanceLists, bindingLists := client.instances.lists, client.bindings.lists
+	statuses, err := types.AllJobStates(d, types.JobStateFilter{}, 1)
+	if err != nil || len(statuses) != 6 {
+		t.Fatalf("listed %d job states - %v", len(statuses), err)
+	}
+	if client.instances.lists != instanceLists+1 || client.bindings.lists != bindingLists+1 {
+		t.Fatalf("listed the instances %d and the bindings %d times",
+			client.instances.lists-instanceLists, client.bindings.lists-bindingLists)
+	}
+	page, err := d.ListJobStates(types.JobStateFilter{}, types.Page{Limit: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range page.JobStates {
+		if s.InstanceID.String() != statuses[i].InstanceID.String() || s.State.Token != statuses[i].State.Token {
+			t.Fatalf("listed the job states in another order than the pages %v", statuses)
+		}
+	}
+}
+
+func TestSetStateAppliesJobRetention(t *testing.T) {
+	client := newFakeClient()
+	d := crd.NewDaoWithClients("broker", client, fakeConfigMaps{store: newFakeStore("", "configmaps")})
+	d.SetJobRetention(crd.JobRetention{MaxJobsPerMethod: 1})
+	id := newBindingWithJobs(t, client, d, "b1", map[string]v1.Job{
+		"b1": retainedJob(v1.JobMethodBind, v1.StateSucceeded, 10*time.Hour),
+		"u1": retainedJob(v1.JobMethodUnbind, v1.StateFailed, time.Hour),
+	})
+	if bi, err := d.GetBindInstance(id); err != nil || bi.CreateJobKey != fmt.Sprintf("/state/%s/job/b1", id) {
+		t.Fatalf("read the create job key of %#v - %v", bi, err)
+	}
+	for _, token := range []string{"u2", "b2"} {
+		method := bundle.JobMethodUnbind
+		if token == "b2" {
+			method = bundle.JobMethodBind
+		}
+		if _, err := d.SetState(id, bundle.JobState{Token: token, Method: method, State: bundle.StateSucceeded}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if kept := bindingJobTokens(t, client, id); fmt.Sprint(kept) != "[b1 b2 u2]" {
+		t.Fatalf("kept the jobs %v", kept)
+	}
+}
@@ -0,0 +1,159 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao
+
+import (
+	"net/http"
+
+	"github.com/automationbroker/bundle-lib/clients"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// deadLetterConfigMap - there is no custom resource for dead letters, they
+// are kept in a config map of the broker namespace keyed by their id.
+const deadLetterConfigMap = "broker-dead-letters"
+
+func (d *Dao) configMaps() (corev1.ConfigMapInterface, error) {
+	if d.configMapClient != nil {
+		return d.configMapClient.ConfigMaps(d.namespace), nil
+	}
+	k8scli, err := clients.Kubernetes()
+	if err != nil {
+		return nil, err
+	}
+	return k8scli.Client.CoreV1().ConfigMaps(d.namespace), nil
+}
+
+// getDeadLetterConfigMap - gets the config map of the dead letters, creating
+// it if it does not exist yet.
+func (d *Dao) getDeadLetterConfigMap(configMaps corev1.ConfigMapInterface) (*v1.ConfigMap, error) {
+	cm, err := configMaps.Get(deadLetterConfigMap, metav1.GetOptions{})
+	if err == nil {
+		return cm, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	return configMaps.Create(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      deadLetterConfigMap,
+			Namespace: d.namespace,
+		},
+		Data: map[string]string{},
+	})
+}
+
+// SetDeadLetter - Create or update a dead letter in the k8s API.
+func (d *Dao) SetDeadLetter(letter *types.DeadLetter) error {
+	defer d.deadLetterLock.Unlock()
+	d.deadLetterLock.Lock()
+	configMaps, err := d.configMaps()
+	if err != nil {
+		return err
+	}
+	cm, err := d.getDeadLetterConfigMap(configMaps)
+	if err != nil {
+		log.Errorf("unable to get the dead letters config map - %v", err)
+		return err
+	}
+	data, err := types.EncodeRecord(types.DeadLetterRecord, letter)
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[letter.ID] = data
+	if _, err := configMaps.Update(cm); err != nil {
+		log.Errorf("unable to save dead letter %v - %v", letter.ID, err)
+		return err
+	}
+	return nil
+}
+
+// GetDeadLetter - Retrieve a dead letter from the k8s API.
+func (d *Dao) GetDeadLetter(id string) (*types.DeadLetter, error) {
+	letters, err := d.deadLetters()
+	if err != nil {
+		return nil, err
+	}
+	for _, letter := range letters {
+		if letter.ID == id {
+			return letter, nil
+		}
+	}
+	return nil, &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status: metav1.StatusFailure,
+		Code:   http.StatusNotFound,
+		Reason: metav1.StatusReasonNotFound,
+	}}
+}
+
+// BatchGetDeadLetters - Retrieve all the dead letters from the k8s API.
+func (d *Dao) BatchGetDeadLetters() ([]*types.DeadLetter, error) {
+	return d.deadLetters()
+}
+
+func (d *Dao) deadLetters() ([]*types.DeadLetter, error) {
+	configMaps, err := d.configMaps()
+	if err != nil {
+		return nil, err
+	}
+	cm, err := configMaps.Get(deadLetterConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return []*types.DeadLetter{}, nil
+	} else if err != nil {
+		log.Errorf("unable to get the dead letters config map - %v", err)
+		return nil, err
+	}
+	letters := []*types.DeadLetter{}
+	for id, data := range cm.Data {
+		letter := &types.DeadLetter{}
+		if _, err := types.DecodeRecord(types.DeadLetterRecord, data, letter); err != nil {
+			log.Errorf("unable to read dead letter %v - %v", id, err)
+			continue
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// DeleteDeadLetter - Delete the dead letter for an id in the k8s API.
+func (d *Dao) DeleteDeadLetter(id string) error {
+	defer d.deadLetterLock.Unlock()
+	d.deadLetterLock.Lock()
+	log.Debugf("Dao::DeleteDeadLetter -> [ %s ]", id)
+	configMaps, err := d.configMaps()
+	if err != nil {
+		return err
+	}
+	cm, err := configMaps.Get(deadLetterConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if _, ok := cm.Data[id]; !ok {
+		return nil
+	}
+	delete(cm.Data, id)
+	_, err = configMaps.Update(cm)
+	return err
+}
@@ -0,0 +1,225 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao
+
+import (
+	"sort"
+	"strings"
+
+	v1 "github.com/automationbroker/broker-client-go/pkg/apis/automationbroker/v1alpha1"
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// the labels of the bundle instances ListServiceInstances selects on. A
+	// label is left out if its value is not a valid label value, the filter
+	// is then applied once the instances are listed. Bundle instances saved
+	// by older brokers have no namespace label.
+	instanceNamespaceLabel string = "contextNamespace"
+	instanceSpecLabel      string = "specId"
+	instancePlanLabel      string = "plan"
+)
+
+// serviceInstanceLabels - the labels of the bundle instance of the service
+// instance, keeping the other labels it has.
+func serviceInstanceLabels(labels map[string]string, si *bundle.ServiceInstance) map[string]string {
+	updated := map[string]string{}
+	for k, v := range labels {
+		updated[k] = v
+	}
+	namespace, specID := "", ""
+	if si.Context != nil {
+		namespace = si.Context.Namespace
+	}
+	if si.Spec != nil {
+		specID = si.Spec.ID
+	}
+	for label, value := range map[string]string{
+		instanceNamespaceLabel: namespace,
+		instanceSpecLabel:      specID,
+		instancePlanLabel:      types.Plan(si),
+	} {
+		if len(validation.IsValidLabelValue(value)) == 0 {
+			updated[label] = value
+		} else {
+			delete(updated, label)
+		}
+	}
+	return updated
+}
+
+// serviceInstanceSelector - the label selector of the bundle instances
+// matching the filter, empty if the filter selects on no label.
+func serviceInstanceSelector(filter types.ServiceInstanceFilter) string {
+	selectors := []string{}
+	for _, label := range []struct{ key, value string }{
+		{instanceNamespaceLabel, filter.Namespace},
+		{instanceSpecLabel, filter.SpecID},
+		{instancePlanLabel, filter.Plan},
+	} {
+		if label.value != "" && len(validation.IsValidLabelValue(label.value)) == 0 {
+			selectors = append(selectors, label.key+"="+label.value)
+		}
+	}
+	return strings.Join(selectors, ",")
+}
+
+// ListServiceInstances - Retrieve a page of the service instances matching
+// the filter, ordered by id. The bundle instances are selected by their
+// labels, along with those not labelled yet.
+func (d *Dao) ListServiceInstances(
+	filter types.ServiceInstanceFilter, page types.Page,
+) (types.ServiceInstancePage, error) {
+	result := types.ServiceInstancePage{ServiceInstances: []*bundle.ServiceInstance{}}
+	selectors := []string{""}
+	if selector := serviceInstanceSelector(filter); selector != "" {
+		selectors = []string{selector, "!" + instanceNamespaceLabel}
+	}
+	items := []v1.BundleInstance{}
+	for _, selector := range selectors {
+		l, err := d.listBundleInstances(selector)
+		if err != nil {
+			log.Errorf("unable to list the bundle instances - %v", err)
+			return result, err
+		}
+		items = append(items, l...)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].GetName() < items[j].GetName() })
+
+	specs := map[string]*bundle.Spec{}
+	pager := types.NewPager(page)
+	for _, item := range items {
+		if pager.Full() {
+			break
+		}
+		spec, ok := specs[item.Spec.Bundle.Name]
+		if !ok {
+			var err error
+			if spec, err = d.GetSpec(item.Spec.Bundle.Name); err != nil {
+				return types.ServiceInstancePage{}, err
+			}
+			specs[item.Spec.Bundle.Name] = spec
+		}
+		si, err := convertBundleInstance(item, spec)
+		if err != nil {
+			log.Errorf("unable to convert service instance to bundle instance - %v", err)
+			return types.ServiceInstancePage{}, err
+		}
+		if filter.Match(si, item.CreationTimestamp.Time) && pager.Take(item.GetName()) {
+			result.ServiceInstances = append(result.ServiceInstances, si)
+		}
+	}
+	result.Next = pager.Next
+	return result, nil
+}
+
+// listedJobState - a job state and its cursor.
+type listedJobState struct {
+	cursor string
+	status bundle.RecoverStatus
+}
+
+// ListJobStates - Retrieve a page of the job states matching the filter,
+// ordered by instance or binding id and token. Every page reads the job
+// states of all the instances and bindings, see AllJobStates.
+func (d *Dao) ListJobStates(filter types.JobStateFilter, page types.Page) (types.JobStatePage, error) {
+	result := types.JobStatePage{JobStates: []bundle.RecoverStatus{}}
+	statuses, err := d.jobStates(filter)
+	if err != nil {
+		return result, err
+	}
+	pager := types.NewPager(page)
+	for _, l := range statuses {
+		if pager.Full() {
+			break
+		}
+		if pager.Take(l.cursor) {
+			result.JobStates = append(result.JobStates, l.status)
+		}
+	}
+	result.Next = pager.Next
+	return result, nil
+}
+
+// AllJobStates - Retrieve every job state matching the filter, reading the
+// instances and bindings once.
+func (d *Dao) AllJobStates(filter types.JobStateFilter) ([]bundle.RecoverStatus, error) {
+	statuses, err := d.jobStates(filter)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]bundle.RecoverStatus, 0, len(statuses))
+	for _, l := range statuses {
+		result = append(result, l.status)
+	}
+	return result, nil
+}
+
+// jobStates - the job states matching the filter, ordered by their cursor.
+// The jobs are kept in the status of the instances and bindings, only the one
+// of the filter is read if it has one.
+func (d *Dao) jobStates(filter types.JobStateFilter) ([]listedJobState, error) {
+	owners := map[string]map[string]v1.Job{}
+	if filter.ID != "" {
+		if jobs, _, ok := d.cachedJobs(filter.ID); ok {
+			owners[filter.ID] = jobs
+		} else if bi, err := d.client.BundleBindings(d.namespace).Get(filter.ID, metav1.GetOptions{}); err == nil {
+			owners[bi.GetName()] = bi.Status.Jobs
+		} else if !d.IsNotFoundError(err) {
+			return nil, err
+		} else if si, err := d.client.BundleInstances(d.namespace).Get(filter.ID, metav1.GetOptions{}); err == nil {
+			owners[si.GetName()] = si.Status.Jobs
+		} else if !d.IsNotFoundError(err) {
+			return nil, err
+		}
+	} else {
+		sis, err := d.listBundleInstances("")
+		if err != nil {
+			return nil, err
+		}
+		for _, si := range sis {
+			owners[si.GetName()] = si.Status.Jobs
+		}
+		bis, err := d.listBundleBindings()
+		if err != nil {
+			return nil, err
+		}
+		for _, bi := range bis {
+			owners[bi.GetName()] = bi.Status.Jobs
+		}
+	}
+
+	statuses := []listedJobState{}
+	for id, jobs := range owners {
+		for token, job := range jobs {
+			js := convertJob(token, job)
+			if filter.Match(id, js) {
+				statuses = append(statuses, listedJobState{
+					cursor: types.JobStateCursor(id, token),
+					status: bundle.RecoverStatus{InstanceID: uuid.Parse(id), State: js},
+				})
+			}
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].cursor < statuses[j].cursor })
+	return statuses, nil
+}
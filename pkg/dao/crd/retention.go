@@ -0,0 +1,208 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao
+
+import (
+	"sort"
+	"time"
+
+	v1 "github.com/automationbroker/broker-client-go/pkg/apis/automationbroker/v1alpha1"
+	"github.com/automationbroker/config"
+	log "github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultCompactionInterval - how often the jobs are compacted once a
+// retention is configured.
+const defaultCompactionInterval = time.Hour
+
+// JobRetention - which of the jobs of the status of a bundle instance or
+// binding are kept. Jobs that are not finished yet, and the bind job that
+// created a binding, are always kept. The zero value keeps every job.
+type JobRetention struct {
+	// MaxJobsPerMethod - how many of the latest jobs of each method are kept,
+	// zero keeps them all.
+	MaxJobsPerMethod int
+	// MaxAge - jobs last modified longer ago are dropped, zero keeps them
+	// regardless of their age.
+	MaxAge time.Duration
+	// CompactionInterval - how often the jobs of every instance and binding
+	// are compacted, zero disables the compaction.
+	CompactionInterval time.Duration
+}
+
+// NewJobRetention - reads the job retention from the job_retention sub config
+// of the dao section. Every job is kept unless max_jobs_per_method or max_age
+// is set.
+func NewJobRetention(c *config.Config) JobRetention {
+	r := JobRetention{
+		MaxJobsPerMethod:   c.GetInt("max_jobs_per_method"),
+		CompactionInterval: defaultCompactionInterval,
+	}
+	for key, d := range map[string]*time.Duration{
+		"max_age":             &r.MaxAge,
+		"compaction_interval": &r.CompactionInterval,
+	} {
+		v := c.GetString(key)
+		if v == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(v)
+		if err != nil {
+			log.Warningf("ignoring invalid job_retention.%s %q - %v", key, v, err)
+			continue
+		}
+		*d = duration
+	}
+	return r
+}
+
+func (r JobRetention) enabled() bool {
+	return r.MaxJobsPerMethod > 0 || r.MaxAge > 0
+}
+
+// prune - removes the jobs past the retention from the map, except the
+// protected ones. Returns the number of jobs removed.
+func (r JobRetention) prune(jobs map[string]v1.Job, protected func(string, v1.Job) bool, now time.Time) int {
+	if !r.enabled() {
+		return 0
+	}
+	byMethod := map[v1.JobMethod][]string{}
+	for token, job := range jobs {
+		byMethod[job.Method] = append(byMethod[job.Method], token)
+	}
+	removed := 0
+	for _, tokens := range byMethod {
+		// latest first
+		sort.Slice(tokens, func(i, j int) bool {
+			return lastModified(jobs[tokens[i]]).After(lastModified(jobs[tokens[j]]))
+		})
+		for i, token := range tokens {
+			job := jobs[token]
+			if isUnfinished(job) || protected(token, job) {
+				continue
+			}
+			tooMany := r.MaxJobsPerMethod > 0 && i >= r.MaxJobsPerMethod
+			tooOld := r.MaxAge > 0 && now.Sub(lastModified(job)) > r.MaxAge
+			if tooMany || tooOld {
+				delete(jobs, token)
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+func lastModified(job v1.Job) time.Time {
+	if job.LastModifiedTime == nil {
+		return time.Time{}
+	}
+	return job.LastModifiedTime.Time
+}
+
+func isUnfinished(job v1.Job) bool {
+	return job.State == v1.StateInProgress || job.State == v1.StateNotYetStarted
+}
+
+// bindingCreateJob - tells the job the CreateJobKey of the binding refers
+// to. The bindings written before the key was annotated have every bind job
+// taken for it, the one they were created by cannot be told apart.
+func bindingCreateJob(bb *v1.BundleBinding) func(string, v1.Job) bool {
+	key, ok := bb.Annotations[createJobKeyAnnotation]
+	if !ok {
+		return func(_ string, job v1.Job) bool {
+			return job.Method == v1.JobMethodBind
+		}
+	}
+	_, createToken, _ := parseStateKey(key)
+	return func(token string, _ v1.Job) bool {
+		return createToken != "" && token == createToken
+	}
+}
+
+func keepInstanceJob(string, v1.Job) bool {
+	return false
+}
+
+// SetJobRetention - sets which jobs are kept when a job state is written and
+// when the jobs are compacted. By default every job is kept.
+func (d *Dao) SetJobRetention(retention JobRetention) {
+	d.retention = retention
+}
+
+// CompactionInterval - how often the jobs are compacted, zero if the
+// retention keeps every job.
+func (d *Dao) CompactionInterval() time.Duration {
+	if !d.retention.enabled() {
+		return 0
+	}
+	return d.retention.CompactionInterval
+}
+
+// CompactJobs - drops the jobs past the retention from the status of every
+// bundle instance and binding.
+func (d *Dao) CompactJobs() error {
+	if !d.retention.enabled() {
+		return nil
+	}
+	now := time.Now()
+
+	sis, err := d.client.BundleInstances(d.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range sis.Items {
+		si := &sis.Items[i]
+		removed := d.retention.prune(si.Status.Jobs, keepInstanceJob, now)
+		if removed == 0 {
+			continue
+		}
+		if _, err := d.client.BundleInstances(d.namespace).Update(si); err != nil {
+			logCompactionError("instance", si.GetName(), err)
+			continue
+		}
+		log.Infof("compacted %d job(s) of instance %s", removed, si.GetName())
+	}
+
+	bis, err := d.client.BundleBindings(d.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range bis.Items {
+		bi := &bis.Items[i]
+		removed := d.retention.prune(bi.Status.Jobs, bindingCreateJob(bi), now)
+		if removed == 0 {
+			continue
+		}
+		if _, err := d.client.BundleBindings(d.namespace).Update(bi); err != nil {
+			logCompactionError("binding", bi.GetName(), err)
+			continue
+		}
+		log.Infof("compacted %d job(s) of binding %s", removed, bi.GetName())
+	}
+	return nil
+}
+
+func logCompactionError(kind string, name string, err error) {
+	if apierrors.IsConflict(err) {
+		// compacted again on the next pass
+		log.Debugf("%s %s changed while its jobs were compacted", kind, name)
+		return
+	}
+	log.Errorf("unable to compact the jobs of %s %s - %v", kind, name, err)
+}
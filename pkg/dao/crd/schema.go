@@ -0,0 +1,272 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao
+
+import (
+	"fmt"
+	"strconv"
+
+	v1 "github.com/automationbroker/broker-client-go/pkg/apis/automationbroker/v1alpha1"
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/automationbroker/bundle-lib/crd"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	log "github.com/sirupsen/logrus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// schemaVersionAnnotation - the annotation of the bundles, bundle instances
+// and bundle bindings holding the schema version of the record they were
+// converted from. The job states in their status are typed by the custom
+// resource definition and have no version of their own.
+const schemaVersionAnnotation = "automationbroker.io/schema-version"
+
+// withSchemaVersion - the annotations with the current schema version of the
+// kind of record.
+func withSchemaVersion(annotations map[string]string, kind types.RecordKind) map[string]string {
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[schemaVersionAnnotation] = strconv.Itoa(types.SchemaVersion(kind))
+	return annotations
+}
+
+// storedSchemaVersion - the schema version of the record a resource was
+// converted from, 1 if it is not annotated.
+func storedSchemaVersion(meta metav1.ObjectMeta) (int, error) {
+	value, ok := meta.Annotations[schemaVersionAnnotation]
+	if !ok {
+		return 1, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s annotation %q of %s - %v", schemaVersionAnnotation, value, meta.Name, err)
+	}
+	if version < 1 {
+		return 1, nil
+	}
+	return version, nil
+}
+
+// outdated - whether the resource was converted from a record with an older
+// schema version.
+func outdated(meta metav1.ObjectMeta, kind types.RecordKind) bool {
+	version, err := storedSchemaVersion(meta)
+	return err == nil && version < types.SchemaVersion(kind)
+}
+
+// upgradeRecord - upgrades the record converted from a resource to the
+// current schema version of its kind.
+func upgradeRecord(meta metav1.ObjectMeta, kind types.RecordKind, record interface{}) error {
+	version, err := storedSchemaVersion(meta)
+	if err != nil {
+		return err
+	}
+	return types.UpgradeRecord(kind, version, record)
+}
+
+// convertBundle - the spec of a bundle, at the current schema version.
+func convertBundle(b v1.Bundle) (*bundle.Spec, error) {
+	spec, err := crd.ConvertBundleToSpec(b.Spec, b.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if err := upgradeRecord(b.ObjectMeta, types.SpecRecord, spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// convertBundleInstance - the service instance of a bundle instance, at the
+// current schema version.
+func convertBundleInstance(bi v1.BundleInstance, spec *bundle.Spec) (*bundle.ServiceInstance, error) {
+	si, err := crd.ConvertServiceInstanceToAPB(bi, spec, bi.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if err := upgradeRecord(bi.ObjectMeta, types.ServiceInstanceRecord, si); err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+// convertBundleBinding - the bind instance of a bundle binding, at the
+// current schema version.
+func convertBundleBinding(bb v1.BundleBinding) (*bundle.BindInstance, error) {
+	bi, err := crd.ConvertServiceBindingToAPB(bb, bb.GetName())
+	if err != nil {
+		return nil, err
+	}
+	bi.CreateJobKey = bb.Annotations[createJobKeyAnnotation]
+	if err := upgradeRecord(bb.ObjectMeta, types.BindInstanceRecord, bi); err != nil {
+		return nil, err
+	}
+	return bi, nil
+}
+
+// RewriteOutdatedRecords - rewrites the resources converted from records
+// with an older schema version, and the dead letters stored with one, with
+// the current version. The resource version guards against concurrent
+// writes, a resource written in the meantime is skipped.
+func (d *Dao) RewriteOutdatedRecords() (int, error) {
+	rewritten := 0
+	for _, rewrite := range []func() (int, error){
+		d.rewriteBundles, d.rewriteBundleInstances, d.rewriteBundleBindings, d.rewriteDeadLetters,
+	} {
+		n, err := rewrite()
+		rewritten += n
+		if err != nil {
+			return rewritten, err
+		}
+	}
+	return rewritten, nil
+}
+
+func (d *Dao) rewriteBundles() (int, error) {
+	l, err := d.client.Bundles(d.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for i := range l.Items {
+		b := &l.Items[i]
+		if !outdated(b.ObjectMeta, types.SpecRecord) {
+			continue
+		}
+		spec, err := convertBundle(*b)
+		if err != nil {
+			log.Warningf("unable to rewrite bundle %s - %v", b.GetName(), err)
+			continue
+		}
+		if b.Spec, err = crd.ConvertSpecToBundle(spec); err != nil {
+			log.Warningf("unable to rewrite bundle %s - %v", b.GetName(), err)
+			continue
+		}
+		b.Annotations = withSchemaVersion(b.Annotations, types.SpecRecord)
+		_, err = d.client.Bundles(d.namespace).Update(b)
+		if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+func (d *Dao) rewriteBundleInstances() (int, error) {
+	l, err := d.client.BundleInstances(d.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for i := range l.Items {
+		bi := &l.Items[i]
+		if !outdated(bi.ObjectMeta, types.ServiceInstanceRecord) {
+			continue
+		}
+		spec, err := d.GetSpec(bi.Spec.Bundle.Name)
+		if err != nil {
+			log.Warningf("unable to rewrite bundle instance %s - %v", bi.GetName(), err)
+			continue
+		}
+		si, err := convertBundleInstance(*bi, spec)
+		if err != nil {
+			log.Warningf("unable to rewrite bundle instance %s - %v", bi.GetName(), err)
+			continue
+		}
+		_, err = d.writeServiceInstance(bi.GetName(), si, bi)
+		if types.IsConflictError(err) {
+			continue
+		} else if err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+func (d *Dao) rewriteBundleBindings() (int, error) {
+	l, err := d.client.BundleBindings(d.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for i := range l.Items {
+		bb := &l.Items[i]
+		if !outdated(bb.ObjectMeta, types.BindInstanceRecord) {
+			continue
+		}
+		bi, err := convertBundleBinding(*bb)
+		if err != nil {
+			log.Warningf("unable to rewrite bundle binding %s - %v", bb.GetName(), err)
+			continue
+		}
+		b, err := crd.ConvertServiceBindingToCRD(bi)
+		if err != nil {
+			log.Warningf("unable to rewrite bundle binding %s - %v", bb.GetName(), err)
+			continue
+		}
+		bb.Spec = b.Spec
+		bb.Annotations = withSchemaVersion(bb.Annotations, types.BindInstanceRecord)
+		_, err = d.client.BundleBindings(d.namespace).Update(bb)
+		if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+func (d *Dao) rewriteDeadLetters() (int, error) {
+	defer d.deadLetterLock.Unlock()
+	d.deadLetterLock.Lock()
+	configMaps, err := d.configMaps()
+	if err != nil {
+		return 0, err
+	}
+	cm, err := configMaps.Get(deadLetterConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	rewritten := 0
+	for id, data := range cm.Data {
+		payload, ok, err := types.RewriteRecord(types.DeadLetterRecord, data)
+		if err != nil {
+			log.Warningf("unable to rewrite dead letter %s - %v", id, err)
+			continue
+		}
+		if ok {
+			cm.Data[id] = payload
+			rewritten++
+		}
+	}
+	if rewritten == 0 {
+		return 0, nil
+	}
+	_, err = configMaps.Update(cm)
+	if apierrors.IsConflict(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return rewritten, nil
+}
@@ -17,21 +17,58 @@
 package dao
 
 import (
+	"time"
+
 	"github.com/automationbroker/bundle-lib/bundle"
 	"github.com/automationbroker/config"
 	crd "github.com/openshift/ansible-service-broker/pkg/dao/crd"
 	etcd "github.com/openshift/ansible-service-broker/pkg/dao/etcd"
+	memory "github.com/openshift/ansible-service-broker/pkg/dao/memory"
+	sqldao "github.com/openshift/ansible-service-broker/pkg/dao/sql"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 // NewDao - Create a new Dao object
 func NewDao(c *config.Config) (Dao, error) {
 	if c.GetString("dao.type") == "crd" {
-		return crd.NewDao(c.GetString("openshift.namespace"))
+		d, err := crd.NewDao(c.GetString("openshift.namespace"))
+		if err != nil {
+			return nil, err
+		}
+		d.SetJobRetention(crd.NewJobRetention(c.GetSubConfig("dao.job_retention")))
+		if c.GetBool("dao.read_cache") {
+			// the dao is used until the broker stops
+			d.EnableCache(wait.NeverStop)
+		}
+		return d, nil
+	}
+	if c.GetString("dao.type") == "memory" {
+		return memory.NewDao(c.GetString("dao.snapshot_file"))
+	}
+	if c.GetString("dao.type") == "sql" {
+		return sqldao.NewDao(c.GetString("dao.sql_driver"), c.GetString("dao.sql_dsn"))
 	}
 	return etcd.NewDao()
 
 }
 
+// JobCompactor - a Dao dropping the job states past their retention.
+type JobCompactor interface {
+	// CompactJobs - drops the job states past their retention.
+	CompactJobs() error
+	// CompactionInterval - how often CompactJobs should run, zero if never.
+	CompactionInterval() time.Duration
+}
+
+// RecordRewriter - a Dao rewriting the records stored with an older schema
+// version, which are otherwise upgraded every time they are read.
+type RecordRewriter interface {
+	// RewriteOutdatedRecords - rewrites the records stored with an older
+	// schema version with the current one. Returns how many were rewritten.
+	RewriteOutdatedRecords() (int, error)
+}
+
 //go:generate mockery -name=Dao -case=underscore -inpkg -note=Generated
 
 // Dao - object to interface with the data store.
@@ -61,15 +98,28 @@ type Dao interface {
 	// FindJobStateByState - Retrieve all the jobs that match the specified state
 	FindJobStateByState(bundle.State) ([]bundle.RecoverStatus, error)
 
-	// GetSvcInstJobsByState - Lookup all jobs of a given state for a specific instance
+	// GetSvcInstJobsByState - Lookup all jobs of a given state for a specific
+	// instance, none for an instance without job states.
 	GetSvcInstJobsByState(string, bundle.State) ([]bundle.JobState, error)
 
+	// ListServiceInstances - Retrieve a page of the service instances matching
+	// the filter, ordered by id.
+	ListServiceInstances(types.ServiceInstanceFilter, types.Page) (types.ServiceInstancePage, error)
+
 	// GetServiceInstance - Retrieve specific service instance from the kvp API.
 	GetServiceInstance(string) (*bundle.ServiceInstance, error)
 
 	// SetServiceInstance - Set service instance for an id in the kvp API.
 	SetServiceInstance(string, *bundle.ServiceInstance) error
 
+	// GetServiceInstanceVersion - Retrieve a service instance along with its version.
+	GetServiceInstanceVersion(string) (*bundle.ServiceInstance, types.Version, error)
+
+	// SetServiceInstanceIf - Set the service instance for an id if its version
+	// is still the given one, types.NoVersion if it must not exist yet.
+	// Returns the new version, or a types.ConflictError.
+	SetServiceInstanceIf(string, *bundle.ServiceInstance, types.Version) (types.Version, error)
+
 	// DeleteServiceInstance - Delete the service instance for an service instance id.
 	DeleteServiceInstance(string) error
 
@@ -82,7 +132,8 @@ type Dao interface {
 	// DeleteBindInstance - Delete the binding instance for an id in the kvp API.
 	DeleteBindInstance(string) error
 
-	// DeleteBinding - Delete the binding instance and remove the association with the service instance.
+	// DeleteBinding - Delete the binding instance and remove the association
+	// with the latest version of the service instance.
 	DeleteBinding(bundle.BindInstance, bundle.ServiceInstance) error
 
 	// SetState - Set the Job State in the kvp API for id.
@@ -94,6 +145,30 @@ type Dao interface {
 	// GetStateByKey - Retrieve a job state from the kvp API for a job key
 	GetStateByKey(key string) (bundle.JobState, error)
 
+	// GetStateVersion - Retrieve a job state for an ID and Token along with its version.
+	GetStateVersion(string, string) (bundle.JobState, types.Version, error)
+
+	// SetStateIf - Set the Job State for id if its version is still the given
+	// one, types.NoVersion if it must not exist yet. Returns the key of the job
+	// state and its new version, or a types.ConflictError.
+	SetStateIf(string, bundle.JobState, types.Version) (string, types.Version, error)
+
+	// ListJobStates - Retrieve a page of the job states matching the filter,
+	// ordered by instance or binding id and token.
+	ListJobStates(types.JobStateFilter, types.Page) (types.JobStatePage, error)
+
+	// SetDeadLetter - Create or update a dead letter.
+	SetDeadLetter(*types.DeadLetter) error
+
+	// GetDeadLetter - Retrieve a dead letter by id.
+	GetDeadLetter(string) (*types.DeadLetter, error)
+
+	// BatchGetDeadLetters - Retrieve all the dead letters.
+	BatchGetDeadLetters() ([]*types.DeadLetter, error)
+
+	// DeleteDeadLetter - Delete the dead letter for an id.
+	DeleteDeadLetter(string) error
+
 	// IsNotFoundError - Will determine if the error is a not found error from the DAO implementation.
 	IsNotFoundError(err error) bool
 }
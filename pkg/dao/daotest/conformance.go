@@ -0,0 +1,943 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package daotest - a conformance suite for the implementations of dao.Dao.
+// Every backend runs it from its tests, so that they all behave the same way
+// for the broker:
+//
+//	func TestConformance(t *testing.T) {
+//		daotest.RunConformance(t, func(t *testing.T) dao.Dao {
+//			return newTestDao(t)
+//		})
+//	}
+package daotest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// specDir - the dir the broker gets the specs of.
+const specDir = "/spec"
+
+// Factory - returns a new and empty Dao, called once for every test of the
+// suite. The Dao should be cleaned up with t.
+type Factory func(t *testing.T) dao.Dao
+
+// conformanceTests - the contract of a Dao. The job states of an instance or
+// a binding are only written once it exists, like the broker does.
+var conformanceTests = []struct {
+	name string
+	run  func(t *testing.T, d dao.Dao)
+}{
+	{name: "not found errors", run: testNotFoundErrors},
+	{name: "specs", run: testSpecs},
+	{name: "batch specs", run: testBatchSpecs},
+	{name: "service instances", run: testServiceInstances},
+	{name: "conditional service instances", run: testConditionalServiceInstances},
+	{name: "concurrent service instance updates", run: testConcurrentUpdateServiceInstance},
+	{name: "bind instances", run: testBindInstances},
+	{name: "delete binding", run: testDeleteBinding},
+	{name: "instance job states", run: testInstanceJobStates},
+	{name: "binding job states", run: testBindingJobStates},
+	{name: "conditional job states", run: testConditionalJobStates},
+	{name: "find job states by state", run: testFindJobStateByState},
+	{name: "instance jobs by state", run: testGetSvcInstJobsByState},
+	{name: "concurrent job states", run: testConcurrentSetState},
+	{name: "dead letters", run: testDeadLetters},
+	{name: "list service instances", run: testListServiceInstances},
+	{name: "list job states", run: testListJobStates},
+}
+
+// RunConformance - runs the conformance suite against the Dao returned by
+// newDao, each test as a sub test with its own Dao.
+func RunConformance(t *testing.T, newDao Factory) {
+	for _, tc := range conformanceTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.run(t, newDao(t))
+		})
+	}
+}
+
+func testNotFoundErrors(t *testing.T, d dao.Dao) {
+	assert.False(t, d.IsNotFoundError(nil))
+	assert.False(t, d.IsNotFoundError(errors.New("not found")))
+
+	_, err := d.GetSpec("missing")
+	assertNotFound(t, d, err, "GetSpec")
+	_, err = d.GetServiceInstance(uuid.New())
+	assertNotFound(t, d, err, "GetServiceInstance")
+	_, err = d.GetBindInstance(uuid.New())
+	assertNotFound(t, d, err, "GetBindInstance")
+	_, err = d.GetState(uuid.New(), uuid.New())
+	assertNotFound(t, d, err, "GetState")
+	_, _, err = d.GetServiceInstanceVersion(uuid.New())
+	assertNotFound(t, d, err, "GetServiceInstanceVersion")
+	_, err = d.GetDeadLetter(uuid.New())
+	assertNotFound(t, d, err, "GetDeadLetter")
+}
+
+func testSpecs(t *testing.T, d dao.Dao) {
+	spec := newSpec("spec-1")
+	if !assert.NoError(t, d.SetSpec(spec.ID, spec)) {
+		return
+	}
+	got, err := d.GetSpec(spec.ID)
+	if assert.NoError(t, err) {
+		assertSpec(t, spec, got)
+	}
+
+	spec.Description = "updated"
+	assert.NoError(t, d.SetSpec(spec.ID, spec))
+	got, err = d.GetSpec(spec.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "updated", got.Description)
+	}
+
+	assert.NoError(t, d.DeleteSpec(spec.ID))
+	_, err = d.GetSpec(spec.ID)
+	assertNotFound(t, d, err, "GetSpec after DeleteSpec")
+	assertDeleted(t, d, d.DeleteSpec(spec.ID), "DeleteSpec of a missing spec")
+}
+
+func testBatchSpecs(t *testing.T, d dao.Dao) {
+	specs, err := d.BatchGetSpecs(specDir)
+	assert.NoError(t, err, "BatchGetSpecs without specs")
+	assert.Empty(t, specs)
+
+	manifest := bundle.SpecManifest{}
+	for _, id := range []string{"spec-1", "spec-2", "spec-3"} {
+		manifest[id] = newSpec(id)
+	}
+	if !assert.NoError(t, d.BatchSetSpecs(manifest)) {
+		return
+	}
+	specs, err = d.BatchGetSpecs(specDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"spec-1", "spec-2", "spec-3"}, specIDs(specs))
+
+	assert.NoError(t, d.BatchDeleteSpecs([]*bundle.Spec{manifest["spec-1"], manifest["spec-3"]}))
+	specs, err = d.BatchGetSpecs(specDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"spec-2"}, specIDs(specs))
+}
+
+func testServiceInstances(t *testing.T, d dao.Dao) {
+	instances, err := d.BatchGetBundleInstances()
+	assert.NoError(t, err, "BatchGetBundleInstances without instances")
+	assert.Empty(t, instances)
+
+	si := newServiceInstance(t, d)
+	if si == nil {
+		return
+	}
+	got, err := d.GetServiceInstance(si.ID.String())
+	if assert.NoError(t, err) {
+		assertServiceInstance(t, si, got)
+	}
+
+	si.DashboardURL = "https://dashboard.example.com/updated"
+	(*si.Parameters)["replicas"] = "3"
+	assert.NoError(t, d.SetServiceInstance(si.ID.String(), si))
+	got, err = d.GetServiceInstance(si.ID.String())
+	if assert.NoError(t, err) {
+		assertServiceInstance(t, si, got)
+	}
+
+	instances, err = d.BatchGetBundleInstances()
+	if assert.NoError(t, err) && assert.Len(t, instances, 1) {
+		assertServiceInstance(t, si, instances[0])
+	}
+
+	assert.NoError(t, d.DeleteServiceInstance(si.ID.String()))
+	_, err = d.GetServiceInstance(si.ID.String())
+	assertNotFound(t, d, err, "GetServiceInstance after DeleteServiceInstance")
+	assertDeleted(t, d, d.DeleteServiceInstance(si.ID.String()), "DeleteServiceInstance of a missing instance")
+}
+
+func testConditionalServiceInstances(t *testing.T, d dao.Dao) {
+	si := newServiceInstance(t, d)
+	if si == nil {
+		return
+	}
+	id := si.ID.String()
+	_, err := d.SetServiceInstanceIf(id, si, types.NoVersion)
+	assertConflict(t, err, "SetServiceInstanceIf without a version of an existing instance")
+
+	got, version, err := d.GetServiceInstanceVersion(id)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertServiceInstance(t, si, got)
+	assert.NotEqual(t, types.NoVersion, version)
+
+	got.DashboardURL = "https://updated.example.com"
+	updated, err := d.SetServiceInstanceIf(id, got, version)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, version, updated, "a write changes the version")
+	_, err = d.SetServiceInstanceIf(id, si, version)
+	assertConflict(t, err, "SetServiceInstanceIf with a stale version")
+
+	got, current, err := d.GetServiceInstanceVersion(id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, updated, current)
+		assert.Equal(t, "https://updated.example.com", got.DashboardURL)
+	}
+	assert.NoError(t, d.SetServiceInstance(id, si))
+	_, err = d.SetServiceInstanceIf(id, si, updated)
+	assertConflict(t, err, "SetServiceInstanceIf after an unconditional write")
+
+	created := &bundle.ServiceInstance{
+		ID:         uuid.NewRandom(),
+		Spec:       si.Spec,
+		Context:    si.Context,
+		Parameters: &bundle.Parameters{},
+		BindingIDs: map[string]bool{},
+	}
+	version, err = d.SetServiceInstanceIf(created.ID.String(), created, types.NoVersion)
+	if assert.NoError(t, err, "SetServiceInstanceIf without a version of a new instance") {
+		_, current, err := d.GetServiceInstanceVersion(created.ID.String())
+		assert.NoError(t, err)
+		assert.Equal(t, version, current)
+	}
+}
+
+func testConcurrentUpdateServiceInstance(t *testing.T, d dao.Dao) {
+	si := newServiceInstance(t, d)
+	if si == nil {
+		return
+	}
+	id := si.ID.String()
+	bindings := make([]uuid.UUID, 8)
+	for i := range bindings {
+		bindings[i] = uuid.NewRandom()
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, len(bindings))
+	for _, binding := range bindings {
+		wg.Add(1)
+		go func(binding uuid.UUID) {
+			defer wg.Done()
+			err := types.UpdateServiceInstance(d, id, func(si *bundle.ServiceInstance) error {
+				si.AddBinding(binding)
+				return nil
+			})
+			if err != nil {
+				errs <- err
+			}
+		}(binding)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err, "concurrent UpdateServiceInstance")
+	}
+
+	got, err := d.GetServiceInstance(id)
+	if assert.NoError(t, err) {
+		for _, binding := range bindings {
+			assert.True(t, got.BindingIDs[binding.String()], "binding %v was lost", binding)
+		}
+	}
+}
+
+func testBindInstances(t *testing.T, d dao.Dao) {
+	si := newServiceInstance(t, d)
+	if si == nil {
+		return
+	}
+	bi := newBindInstance(t, d, si)
+	if bi == nil {
+		return
+	}
+	got, err := d.GetBindInstance(bi.ID.String())
+	if assert.NoError(t, err) {
+		assertBindInstance(t, bi, got)
+	}
+
+	(*bi.Parameters)["user"] = "other"
+	assert.NoError(t, d.SetBindInstance(bi.ID.String(), bi))
+	got, err = d.GetBindInstance(bi.ID.String())
+	if assert.NoError(t, err) {
+		assertBindInstance(t, bi, got)
+	}
+
+	assert.NoError(t, d.DeleteBindInstance(bi.ID.String()))
+	_, err = d.GetBindInstance(bi.ID.String())
+	assertNotFound(t, d, err, "GetBindInstance after DeleteBindInstance")
+	assertDeleted(t, d, d.DeleteBindInstance(bi.ID.String()), "DeleteBindInstance of a missing binding")
+}
+
+func testDeleteBinding(t *testing.T, d dao.Dao) {
+	si := newServiceInstance(t, d)
+	if si == nil {
+		return
+	}
+	deleted := newBindInstance(t, d, si)
+	if deleted == nil {
+		return
+	}
+	// the instance given is older than the stored one
+	stale := *si
+	stale.BindingIDs = map[string]bool{deleted.ID.String(): true}
+	kept := newBindInstance(t, d, si)
+	if kept == nil {
+		return
+	}
+
+	if !assert.NoError(t, d.DeleteBinding(*deleted, stale)) {
+		return
+	}
+	_, err := d.GetBindInstance(deleted.ID.String())
+	assertNotFound(t, d, err, "GetBindInstance of the deleted binding")
+	_, err = d.GetBindInstance(kept.ID.String())
+	assert.NoError(t, err, "the other binding is kept")
+
+	got, err := d.GetServiceInstance(si.ID.String())
+	if assert.NoError(t, err) {
+		assert.False(t, got.BindingIDs[deleted.ID.String()], "the deleted binding is removed from the instance")
+		assert.True(t, got.BindingIDs[kept.ID.String()], "the other binding is still on the instance")
+	}
+}
+
+func testInstanceJobStates(t *testing.T, d dao.Dao) {
+	si := newServiceInstance(t, d)
+	if si == nil {
+		return
+	}
+	id := si.ID.String()
+	state := bundle.JobState{
+		Token:       uuid.New(),
+		State:       bundle.StateInProgress,
+		Method:      bundle.JobMethodProvision,
+		Podname:     "bundle-1234",
+		Description: "provisioning",
+	}
+	key, err := d.SetState(id, state)
+	if !assert.NoError(t, err) {
+		return
+	}
+	got, err := d.GetState(id, state.Token)
+	if assert.NoError(t, err) {
+		assertJobState(t, state, got)
+	}
+	got, err = d.GetStateByKey(key)
+	if assert.NoError(t, err, "GetStateByKey of the key returned by SetState") {
+		assertJobState(t, state, got)
+	}
+
+	state.State = bundle.StateFailed
+	state.Error = "playbook failed"
+	state.Description = "provision failed"
+	_, err = d.SetState(id, state)
+	assert.NoError(t, err)
+	got, err = d.GetState(id, state.Token)
+	if assert.NoError(t, err) {
+		assertJobState(t, state, got)
+	}
+
+	_, err = d.GetState(id, uuid.New())
+	assertNotFound(t, d, err, "GetState of a missing token")
+}
+
+func testBindingJobStates(t *testing.T, d dao.Dao) {
+	si := newServiceInstance(t, d)
+	if si == nil {
+		return
+	}
+	bi := newBindInstance(t, d, si)
+	if bi == nil {
+		return
+	}
+	id := bi.ID.String()
+	state := bundle.JobState{
+		Token:  uuid.New(),
+		State:  bundle.StateSucceeded,
+		Method: bundle.JobMethodBind,
+	}
+	key, err := d.SetState(id, state)
+	if !assert.NoError(t, err) {
+		return
+	}
+	got, err := d.GetState(id, state.Token)
+	if assert.NoError(t, err) {
+		assertJobState(t, state, got)
+	}
+	got, err = d.GetStateByKey(key)
+	if assert.NoError(t, err, "GetStateByKey of the key returned by SetState") {
+		assertJobState(t, state, got)
+	}
+	// the broker builds the CreateJobKey of a binding itself
+	got, err = d.GetStateByKey(fmt.Sprintf("/state/%s/job/%s", id, state.Token))
+	if assert.NoError(t, err, "GetStateByKey of the CreateJobKey of the binding") {
+		assertJobState(t, state, got)
+	}
+}
+
+func testConditionalJobStates(t *testing.T, d dao.Dao) {
+	si := newServiceInstance(t, d)
+	if si == nil {
+		return
+	}
+	id := si.ID.String()
+	state := bundle.JobState{
+		Token:  uuid.New(),
+		State:  bundle.StateInProgress,
+		Method: bundle.JobMethodProvision,
+	}
+	_, _, err := d.GetStateVersion(id, state.Token)
+	assertNotFound(t, d, err, "GetStateVersion of a missing token")
+
+	key, version, err := d.SetStateIf(id, state, types.NoVersion)
+	if !assert.NoError(t, err, "SetStateIf without a version of a new job state") {
+		return
+	}
+	got, err := d.GetStateByKey(key)
+	if assert.NoError(t, err, "GetStateByKey of the key returned by SetStateIf") {
+		assertJobState(t, state, got)
+	}
+	_, _, err = d.SetStateIf(id, state, types.NoVersion)
+	assertConflict(t, err, "SetStateIf without a version of an existing job state")
+
+	got, current, err := d.GetStateVersion(id, state.Token)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertJobState(t, state, got)
+	assert.Equal(t, version, current)
+
+	state.State = bundle.StateSucceeded
+	_, updated, err := d.SetStateIf(id, state, version)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, version, updated, "a write changes the version")
+	_, _, err = d.SetStateIf(id, state, version)
+	assertConflict(t, err, "SetStateIf with a stale version")
+
+	got, err = d.GetState(id, state.Token)
+	if assert.NoError(t, err) {
+		assertJobState(t, state, got)
+	}
+}
+
+func testFindJobStateByState(t *testing.T, d dao.Dao) {
+	statuses, err := d.FindJobStateByState(bundle.StateInProgress)
+	assert.NoError(t, err, "FindJobStateByState without job states")
+	assert.Empty(t, statuses)
+
+	si := newServiceInstance(t, d)
+	if si == nil {
+		return
+	}
+	bi := newBindInstance(t, d, si)
+	if bi == nil {
+		return
+	}
+	running := bundle.JobState{Token: uuid.New(), State: bundle.StateInProgress, Method: bundle.JobMethodUpdate}
+	binding := bundle.JobState{Token: uuid.New(), State: bundle.StateInProgress, Method: bundle.JobMethodBind}
+	for _, job := range []struct {
+		id    string
+		state bundle.JobState
+	}{
+		{si.ID.String(), bundle.JobState{Token: uuid.New(), State: bundle.StateSucceeded, Method: bundle.JobMethodProvision}},
+		{si.ID.String(), running},
+		{bi.ID.String(), binding},
+	} {
+		if _, err := d.SetState(job.id, job.state); !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	statuses, err = d.FindJobStateByState(bundle.StateInProgress)
+	if !assert.NoError(t, err) {
+		return
+	}
+	found := map[string]string{}
+	for _, status := range statuses {
+		assert.Equal(t, bundle.StateInProgress, status.State.State)
+		found[status.InstanceID.String()] = status.State.Token
+	}
+	assert.Equal(t, map[string]string{
+		si.ID.String(): running.Token,
+		bi.ID.String(): binding.Token,
+	}, found)
+}
+
+func testGetSvcInstJobsByState(t *testing.T, d dao.Dao) {
+	si := newServiceInstance(t, d)
+	if si == nil {
+		return
+	}
+	id := si.ID.String()
+	provision := bundle.JobState{Token: uuid.New(), State: bundle.StateSucceeded, Method: bundle.JobMethodProvision}
+	update := bundle.JobState{Token: uuid.New(), State: bundle.StateInProgress, Method: bundle.JobMethodUpdate}
+	for _, state := range []bundle.JobState{provision, update} {
+		if _, err := d.SetState(id, state); !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	jobs, err := d.GetSvcInstJobsByState(id, bundle.StateInProgress)
+	if assert.NoError(t, err) && assert.Len(t, jobs, 1) {
+		assertJobState(t, update, jobs[0])
+	}
+	jobs, err = d.GetSvcInstJobsByState(id, bundle.StateFailed)
+	assert.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	// an id without job states has no jobs
+	jobs, err = d.GetSvcInstJobsByState(uuid.New(), bundle.StateInProgress)
+	assert.NoError(t, err, "GetSvcInstJobsByState of an unknown id")
+	assert.Empty(t, jobs)
+}
+
+// testConcurrentSetState - concurrent writes of the job states of an
+// instance must not overwrite each other.
+func testConcurrentSetState(t *testing.T, d dao.Dao) {
+	si := newServiceInstance(t, d)
+	if si == nil {
+		return
+	}
+	id := si.ID.String()
+	methods := []bundle.JobMethod{bundle.JobMethodProvision, bundle.JobMethodUpdate}
+	states := make([]bundle.JobState, 8)
+	for i := range states {
+		states[i] = bundle.JobState{
+			Token:  uuid.New(),
+			State:  bundle.StateInProgress,
+			Method: methods[i%len(methods)],
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, len(states))
+	for _, state := range states {
+		wg.Add(1)
+		go func(state bundle.JobState) {
+			defer wg.Done()
+			if _, err := d.SetState(id, state); err != nil {
+				errs <- err
+			}
+		}(state)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err, "concurrent SetState")
+	}
+
+	for _, state := range states {
+		got, err := d.GetState(id, state.Token)
+		if assert.NoError(t, err, "job state %v was lost", state.Token) {
+			assertJobState(t, state, got)
+		}
+	}
+	jobs, err := d.GetSvcInstJobsByState(id, bundle.StateInProgress)
+	assert.NoError(t, err)
+	assert.Len(t, jobs, len(states))
+}
+
+func testDeadLetters(t *testing.T, d dao.Dao) {
+	letters, err := d.BatchGetDeadLetters()
+	assert.NoError(t, err, "BatchGetDeadLetters without dead letters")
+	assert.Empty(t, letters)
+
+	letter := &types.DeadLetter{
+		ID:           uuid.New(),
+		SubscriberID: "provision-subscriber",
+		Topic:        "provision",
+		JobToken:     uuid.New(),
+		Payload:      []byte(`{"state":"succeeded"}`),
+		Error:        "conflict",
+		Attempts:     1,
+		CreatedAt:    time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC),
+		NextAttempt:  time.Date(2018, 7, 1, 12, 1, 0, 0, time.UTC),
+	}
+	if !assert.NoError(t, d.SetDeadLetter(letter)) {
+		return
+	}
+	got, err := d.GetDeadLetter(letter.ID)
+	if assert.NoError(t, err) {
+		assertDeadLetter(t, letter, got)
+	}
+
+	letter.Attempts = 2
+	assert.NoError(t, d.SetDeadLetter(letter))
+	letters, err = d.BatchGetDeadLetters()
+	if assert.NoError(t, err) && assert.Len(t, letters, 1) {
+		assertDeadLetter(t, letter, letters[0])
+	}
+
+	assert.NoError(t, d.DeleteDeadLetter(letter.ID))
+	_, err = d.GetDeadLetter(letter.ID)
+	assertNotFound(t, d, err, "GetDeadLetter after DeleteDeadLetter")
+	assertDeleted(t, d, d.DeleteDeadLetter(letter.ID), "DeleteDeadLetter of a missing dead letter")
+}
+
+func testListServiceInstances(t *testing.T, d dao.Dao) {
+	page, err := d.ListServiceInstances(types.ServiceInstanceFilter{}, types.Page{})
+	if assert.NoError(t, err, "ListServiceInstances without instances") {
+		assert.Empty(t, page.ServiceInstances)
+		assert.Empty(t, page.Next)
+	}
+
+	before := time.Now().Add(-time.Minute)
+	mysql, postgres := newSpec(uuid.New()), newSpec(uuid.New())
+	for _, spec := range []*bundle.Spec{mysql, postgres} {
+		if !assert.NoError(t, d.SetSpec(spec.ID, spec)) {
+			return
+		}
+	}
+	ids := map[string][]string{}
+	for _, instance := range []struct {
+		name      string
+		spec      *bundle.Spec
+		namespace string
+		plan      string
+	}{
+		{"a-mysql-dev", mysql, "project-a", "dev"},
+		{"a-mysql-prod", mysql, "project-a", "prod"},
+		{"a-postgres-dev", postgres, "project-a", "dev"},
+		{"b-mysql-dev", mysql, "project-b", "dev"},
+		{"b-postgres-prod", postgres, "project-b", "prod"},
+	} {
+		si := &bundle.ServiceInstance{
+			ID:         uuid.NewRandom(),
+			Spec:       instance.spec,
+			Context:    &bundle.Context{Platform: "kubernetes", Namespace: instance.namespace},
+			Parameters: &bundle.Parameters{types.PlanParameterKey: instance.plan},
+			BindingIDs: map[string]bool{},
+		}
+		if !assert.NoError(t, d.SetServiceInstance(si.ID.String(), si)) {
+			return
+		}
+		ids[""] = append(ids[""], si.ID.String())
+		for _, key := range []string{instance.namespace, instance.spec.ID, instance.plan, instance.namespace + "/" + instance.plan} {
+			ids[key] = append(ids[key], si.ID.String())
+		}
+	}
+	for key := range ids {
+		sort.Strings(ids[key])
+	}
+
+	for _, tc := range []struct {
+		name     string
+		filter   types.ServiceInstanceFilter
+		expected []string
+	}{
+		{"no filter", types.ServiceInstanceFilter{}, ids[""]},
+		{"namespace", types.ServiceInstanceFilter{Namespace: "project-a"}, ids["project-a"]},
+		{"spec", types.ServiceInstanceFilter{SpecID: postgres.ID}, ids[postgres.ID]},
+		{"plan", types.ServiceInstanceFilter{Plan: "prod"}, ids["prod"]},
+		{"namespace and plan", types.ServiceInstanceFilter{Namespace: "project-b", Plan: "prod"}, ids["project-b/prod"]},
+		{"unknown namespace", types.ServiceInstanceFilter{Namespace: "project-c"}, nil},
+		{"created after", types.ServiceInstanceFilter{CreatedAfter: before}, ids[""]},
+		{"created before", types.ServiceInstanceFilter{CreatedBefore: before}, nil},
+		{"created in the future", types.ServiceInstanceFilter{CreatedAfter: time.Now().Add(time.Hour)}, nil},
+	} {
+		page, err := d.ListServiceInstances(tc.filter, types.Page{})
+		if assert.NoError(t, err, "ListServiceInstances by %s", tc.name) {
+			assert.Equal(t, tc.expected, serviceInstanceIDs(page.ServiceInstances), "ListServiceInstances by %s", tc.name)
+			assert.Empty(t, page.Next, "ListServiceInstances by %s", tc.name)
+		}
+	}
+
+	listed, cursor := []string{}, ""
+	for pages := 1; ; pages++ {
+		page, err := d.ListServiceInstances(types.ServiceInstanceFilter{}, types.Page{Cursor: cursor, Limit: 2})
+		if !assert.NoError(t, err, "ListServiceInstances page %d", pages) || !assert.True(t, pages <= 3) {
+			return
+		}
+		assert.True(t, len(page.ServiceInstances) <= 2)
+		listed = append(listed, serviceInstanceIDs(page.ServiceInstances)...)
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	assert.Equal(t, ids[""], listed, "the pages list every instance once")
+
+	if !assert.NoError(t, d.DeleteServiceInstance(ids["project-a"][0])) {
+		return
+	}
+	page, err = d.ListServiceInstances(types.ServiceInstanceFilter{Namespace: "project-a"}, types.Page{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, ids["project-a"][1:], serviceInstanceIDs(page.ServiceInstances), "a deleted instance is not listed")
+	}
+}
+
+func testListJobStates(t *testing.T, d dao.Dao) {
+	page, err := d.ListJobStates(types.JobStateFilter{}, types.Page{})
+	if assert.NoError(t, err, "ListJobStates without job states") {
+		assert.Empty(t, page.JobStates)
+		assert.Empty(t, page.Next)
+	}
+
+	si := newServiceInstance(t, d)
+	if si == nil {
+		return
+	}
+	bi := newBindInstance(t, d, si)
+	if bi == nil {
+		return
+	}
+	provision := bundle.JobState{Token: uuid.New(), State: bundle.StateSucceeded, Method: bundle.JobMethodProvision}
+	update := bundle.JobState{Token: uuid.New(), State: bundle.StateInProgress, Method: bundle.JobMethodUpdate}
+	bind := bundle.JobState{Token: uuid.New(), State: bundle.StateInProgress, Method: bundle.JobMethodBind}
+	all, states := map[string]string{}, map[string]bundle.JobState{}
+	for _, job := range []struct {
+		id    string
+		state bundle.JobState
+	}{
+		{si.ID.String(), provision},
+		{si.ID.String(), update},
+		{bi.ID.String(), bind},
+	} {
+		if _, err := d.SetState(job.id, job.state); !assert.NoError(t, err) {
+			return
+		}
+		all[job.state.Token] = job.id
+		states[job.state.Token] = job.state
+	}
+
+	for _, tc := range []struct {
+		name     string
+		filter   types.JobStateFilter
+		expected []bundle.JobState
+	}{
+		{"no filter", types.JobStateFilter{}, []bundle.JobState{provision, update, bind}},
+		{"instance", types.JobStateFilter{ID: si.ID.String()}, []bundle.JobState{provision, update}},
+		{"state", types.JobStateFilter{State: bundle.StateInProgress}, []bundle.JobState{update, bind}},
+		{"method", types.JobStateFilter{Method: bundle.JobMethodBind}, []bundle.JobState{bind}},
+		{"binding and state", types.JobStateFilter{ID: bi.ID.String(), State: bundle.StateSucceeded}, nil},
+		{"unknown instance", types.JobStateFilter{ID: uuid.New()}, nil},
+	} {
+		page, err := d.ListJobStates(tc.filter, types.Page{})
+		if !assert.NoError(t, err, "ListJobStates by %s", tc.name) {
+			continue
+		}
+		expected := map[string]string{}
+		for _, js := range tc.expected {
+			expected[js.Token] = all[js.Token]
+		}
+		listed := map[string]string{}
+		for _, status := range page.JobStates {
+			listed[status.State.Token] = status.InstanceID.String()
+		}
+		assert.Equal(t, expected, listed, "ListJobStates by %s", tc.name)
+		assert.Empty(t, page.Next, "ListJobStates by %s", tc.name)
+	}
+
+	listed, cursor := []string{}, ""
+	for pages := 1; ; pages++ {
+		page, err := d.ListJobStates(types.JobStateFilter{}, types.Page{Cursor: cursor, Limit: 1})
+		if !assert.NoError(t, err, "ListJobStates page %d", pages) || !assert.True(t, pages <= 3) {
+			return
+		}
+		if assert.Len(t, page.JobStates, 1) {
+			status := page.JobStates[0]
+			assertJobState(t, states[status.State.Token], status.State)
+			listed = append(listed, types.JobStateCursor(status.InstanceID.String(), status.State.Token))
+		}
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	assert.Len(t, listed, 3)
+	assert.True(t, sort.StringsAreSorted(listed), "job states are listed in the order of their cursor")
+}
+
+func newSpec(id string) *bundle.Spec {
+	return &bundle.Spec{
+		ID:          id,
+		Runtime:     2,
+		Version:     "1.0",
+		FQName:      "dh-" + id,
+		Image:       "docker.io/example/" + id + ":latest",
+		Tags:        []string{"database"},
+		Bindable:    true,
+		Description: "a test spec",
+		Async:       "optional",
+		Metadata:    map[string]interface{}{"displayName": id},
+		Alpha:       map[string]interface{}{},
+		Plans: []bundle.Plan{{
+			ID:          id + "-default",
+			Name:        "default",
+			Description: "the default plan",
+			Metadata:    map[string]interface{}{},
+			Free:        true,
+			Bindable:    true,
+		}},
+	}
+}
+
+// newServiceInstance - saves a new instance, and its spec.
+func newServiceInstance(t *testing.T, d dao.Dao) *bundle.ServiceInstance {
+	spec := newSpec(uuid.New())
+	if !assert.NoError(t, d.SetSpec(spec.ID, spec)) {
+		return nil
+	}
+	si := &bundle.ServiceInstance{
+		ID:           uuid.NewRandom(),
+		Spec:         spec,
+		Context:      &bundle.Context{Platform: "kubernetes", Namespace: "test-project"},
+		Parameters:   &bundle.Parameters{"replicas": "1"},
+		BindingIDs:   map[string]bool{},
+		DashboardURL: "https://dashboard.example.com",
+	}
+	if !assert.NoError(t, d.SetServiceInstance(si.ID.String(), si)) {
+		return nil
+	}
+	return si
+}
+
+// newBindInstance - saves a new binding of the instance, and adds it to the
+// instance.
+func newBindInstance(t *testing.T, d dao.Dao, si *bundle.ServiceInstance) *bundle.BindInstance {
+	bi := &bundle.BindInstance{
+		ID:         uuid.NewRandom(),
+		ServiceID:  si.ID,
+		Parameters: &bundle.Parameters{"user": "admin"},
+	}
+	if !assert.NoError(t, d.SetBindInstance(bi.ID.String(), bi)) {
+		return nil
+	}
+	si.AddBinding(bi.ID)
+	if !assert.NoError(t, d.SetServiceInstance(si.ID.String(), si)) {
+		return nil
+	}
+	return bi
+}
+
+func assertNotFound(t *testing.T, d dao.Dao, err error, operation string) {
+	if assert.Error(t, err, "%s should fail", operation) {
+		assert.True(t, d.IsNotFoundError(err), "%s should fail with a not found error, got %v", operation, err)
+	}
+}
+
+// assertDeleted - deleting something missing is not an error, or is a not
+// found error.
+func assertConflict(t *testing.T, err error, operation string) {
+	assert.Error(t, err, operation)
+	assert.True(t, types.IsConflictError(err), "%s: expected a conflict error, got %v", operation, err)
+}
+
+func assertDeleted(t *testing.T, d dao.Dao, err error, operation string) {
+	if err != nil {
+		assert.True(t, d.IsNotFoundError(err), "%s should succeed or fail with a not found error, got %v", operation, err)
+	}
+}
+
+func assertSpec(t *testing.T, expected *bundle.Spec, actual *bundle.Spec) {
+	assert.Equal(t, expected.ID, actual.ID)
+	assert.Equal(t, expected.FQName, actual.FQName)
+	assert.Equal(t, expected.Image, actual.Image)
+	assert.Equal(t, expected.Runtime, actual.Runtime)
+	assert.Equal(t, expected.Version, actual.Version)
+	assert.Equal(t, expected.Bindable, actual.Bindable)
+	assert.Equal(t, expected.Description, actual.Description)
+	assert.Equal(t, expected.Tags, actual.Tags)
+	assert.Equal(t, expected.Metadata, actual.Metadata)
+	if assert.Len(t, actual.Plans, len(expected.Plans)) {
+		for i, plan := range expected.Plans {
+			assert.Equal(t, plan.ID, actual.Plans[i].ID)
+			assert.Equal(t, plan.Name, actual.Plans[i].Name)
+		}
+	}
+}
+
+func assertServiceInstance(t *testing.T, expected *bundle.ServiceInstance, actual *bundle.ServiceInstance) {
+	assert.Equal(t, expected.ID.String(), actual.ID.String())
+	if assert.NotNil(t, actual.Spec) {
+		assert.Equal(t, expected.Spec.ID, actual.Spec.ID)
+	}
+	assert.Equal(t, expected.Context, actual.Context)
+	assert.Equal(t, expected.Parameters, actual.Parameters)
+	assert.Equal(t, expected.DashboardURL, actual.DashboardURL)
+	assert.Equal(t, boundIDs(expected.BindingIDs), boundIDs(actual.BindingIDs))
+}
+
+func assertBindInstance(t *testing.T, expected *bundle.BindInstance, actual *bundle.BindInstance) {
+	assert.Equal(t, expected.ID.String(), actual.ID.String())
+	assert.Equal(t, expected.ServiceID.String(), actual.ServiceID.String())
+	assert.Equal(t, expected.Parameters, actual.Parameters)
+}
+
+func assertJobState(t *testing.T, expected bundle.JobState, actual bundle.JobState) {
+	assert.Equal(t, expected.Token, actual.Token)
+	assert.Equal(t, expected.State, actual.State)
+	assert.Equal(t, expected.Method, actual.Method)
+	assert.Equal(t, expected.Podname, actual.Podname)
+	assert.Equal(t, expected.Description, actual.Description)
+	assert.Equal(t, expected.Error, actual.Error)
+}
+
+func assertDeadLetter(t *testing.T, expected *types.DeadLetter, actual *types.DeadLetter) {
+	assert.Equal(t, expected.ID, actual.ID)
+	assert.Equal(t, expected.SubscriberID, actual.SubscriberID)
+	assert.Equal(t, expected.Topic, actual.Topic)
+	assert.Equal(t, expected.JobToken, actual.JobToken)
+	assert.JSONEq(t, string(expected.Payload), string(actual.Payload))
+	assert.Equal(t, expected.Error, actual.Error)
+	assert.Equal(t, expected.Attempts, actual.Attempts)
+	assert.True(t, expected.CreatedAt.Equal(actual.CreatedAt))
+	assert.True(t, expected.NextAttempt.Equal(actual.NextAttempt))
+}
+
+func specIDs(specs []*bundle.Spec) []string {
+	ids := []string{}
+	for _, spec := range specs {
+		ids = append(ids, spec.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// boundIDs - the bindings of an instance, a binding set to false is removed.
+func serviceInstanceIDs(instances []*bundle.ServiceInstance) []string {
+	var ids []string
+	for _, si := range instances {
+		ids = append(ids, si.ID.String())
+	}
+	return ids
+}
+
+func boundIDs(bindings map[string]bool) []string {
+	ids := []string{}
+	for id, bound := range bindings {
+		if bound {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -19,13 +19,15 @@ package dao
 import (
 	"context"
 	"fmt"
+	"path"
+	"strconv"
 	"strings"
-
-	"encoding/json"
+	"time"
 
 	"github.com/automationbroker/bundle-lib/bundle"
 	"github.com/automationbroker/bundle-lib/clients"
 	"github.com/coreos/etcd/client"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
 	"github.com/pborman/uuid"
 	log "github.com/sirupsen/logrus"
 )
@@ -49,6 +51,12 @@ func NewDao() (*Dao, error) {
 	return &dao, nil
 }
 
+// NewDaoWithKeysAPI - Create a new Dao object using the kvp API given, e.g.
+// a fake one in tests.
+func NewDaoWithKeysAPI(kapi client.KeysAPI) *Dao {
+	return &Dao{kapi: kapi}
+}
+
 // SetRaw - Allows the setting of the value json string to the key in the kvp API.
 func (d *Dao) SetRaw(key string, val string) error {
 	_, err := d.kapi.Set(context.Background(), key, val /*opts*/, nil)
@@ -143,7 +151,7 @@ func (d *Dao) BatchGetSpecs(dir string) ([]*bundle.Spec, error) {
 	specs := make([]*bundle.Spec, len(*payloads))
 	for i, payload := range *payloads {
 		spec := &bundle.Spec{}
-		bundle.LoadJSON(payload, spec)
+		types.DecodeRecord(types.SpecRecord, payload, spec)
 		specs[i] = spec
 		log.Debugf("Batch idx [ %d ] -> [ %s ]", i, spec.ID)
 	}
@@ -162,7 +170,7 @@ func (d *Dao) BatchGetBundleInstances() ([]*bundle.ServiceInstance, error) {
 	if siJSONStrs != nil {
 		for _, str := range *siJSONStrs {
 			si := bundle.ServiceInstance{}
-			err := json.Unmarshal([]byte(str), &si)
+			_, err := types.DecodeRecord(types.ServiceInstanceRecord, str, &si)
 			if err != nil {
 				log.Errorf("Unable to convert the service instances json unmarshal error - %v", err)
 				return nil, err
@@ -192,7 +200,10 @@ func (d *Dao) FindJobStateByState(state bundle.State) ([]bundle.RecoverStatus, e
 	var err error
 
 	opts := &client.GetOptions{Recursive: true}
-	if res, err = d.kapi.Get(context.Background(), "/state/", opts); err != nil {
+	if res, err = d.kapi.Get(context.Background(), "/state/", opts); client.IsKeyNotFound(err) {
+		// no job state was ever saved
+		return []bundle.RecoverStatus{}, nil
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -216,7 +227,7 @@ func (d *Dao) FindJobStateByState(state bundle.State) ([]bundle.RecoverStatus, e
 		}
 
 		for _, n := range nodes.Node.Nodes {
-			bundle.LoadJSON(n.Value, &jobstate)
+			types.DecodeKeyRecord(n.Key, n.Value, &jobstate)
 			if jobstate.State == state {
 				log.Debug(fmt.Sprintf(
 					"Found! jobstate [%v] matched given state: [%v].", jobstate, state))
@@ -267,7 +278,9 @@ func (d *Dao) getJobsForSvcInst(instanceID string) ([]bundle.JobState, error) {
 
 	lookupKey := fmt.Sprintf("/state/%s/job", instanceID)
 	opts := &client.GetOptions{Recursive: true}
-	if res, err = d.kapi.Get(context.Background(), lookupKey, opts); err != nil {
+	if res, err = d.kapi.Get(context.Background(), lookupKey, opts); client.IsKeyNotFound(err) {
+		return []bundle.JobState{}, nil
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -283,7 +296,7 @@ func (d *Dao) getJobsForSvcInst(instanceID string) ([]bundle.JobState, error) {
 	retJobs := []bundle.JobState{}
 	for _, node := range jobNodes {
 		js := bundle.JobState{}
-		err := bundle.LoadJSON(node.Value, &js)
+		err := types.DecodeKeyRecord(node.Key, node.Value, &js)
 		if err != nil {
 			return nil, fmt.Errorf("An error occurred trying to parse job state of [ %s ]\n%s", node.Key, err.Error())
 		}
@@ -303,7 +316,74 @@ func (d *Dao) GetServiceInstance(id string) (*bundle.ServiceInstance, error) {
 
 // SetServiceInstance - Set service instance for an id in the kvp API.
 func (d *Dao) SetServiceInstance(id string, serviceInstance *bundle.ServiceInstance) error {
-	return d.setObject(serviceInstanceKey(id), serviceInstance)
+	if err := d.setObject(serviceInstanceKey(id), serviceInstance); err != nil {
+		return err
+	}
+	d.setCreated(serviceInstanceKey(id))
+	return nil
+}
+
+// GetServiceInstanceVersion - Retrieve specific service instance from the kvp
+// API along with its modified index.
+func (d *Dao) GetServiceInstanceVersion(id string) (*bundle.ServiceInstance, types.Version, error) {
+	si := &bundle.ServiceInstance{}
+	version, err := d.getObjectVersion(serviceInstanceKey(id), si)
+	if err != nil {
+		return nil, types.NoVersion, err
+	}
+	return si, version, nil
+}
+
+// SetServiceInstanceIf - Set service instance for an id in the kvp API if it
+// is still at the modified index.
+func (d *Dao) SetServiceInstanceIf(
+	id string, serviceInstance *bundle.ServiceInstance, version types.Version,
+) (types.Version, error) {
+	newVersion, err := d.setObjectIf(serviceInstanceKey(id), serviceInstance, version,
+		types.ConflictError{Kind: "service instance", ID: id})
+	if err == nil && version == types.NoVersion {
+		d.setCreated(serviceInstanceKey(id))
+	}
+	return newVersion, err
+}
+
+// ListServiceInstances - Retrieve a page of the service instances matching
+// the filter, ordered by id, with a prefix scan of the service instances.
+func (d *Dao) ListServiceInstances(
+	filter types.ServiceInstanceFilter, page types.Page,
+) (types.ServiceInstancePage, error) {
+	result := types.ServiceInstancePage{ServiceInstances: []*bundle.ServiceInstance{}}
+	nodes, err := d.scan("/service_instance")
+	if err != nil {
+		return result, err
+	}
+	created := map[string]time.Time{}
+	if !filter.CreatedAfter.IsZero() || !filter.CreatedBefore.IsZero() {
+		createdNodes, err := d.scan(createdKey("/service_instance"))
+		if err != nil {
+			return result, err
+		}
+		for _, node := range createdNodes {
+			t, _ := time.Parse(time.RFC3339Nano, node.Value)
+			created[path.Base(node.Key)] = t
+		}
+	}
+	pager := types.NewPager(page)
+	for _, node := range nodes {
+		if pager.Full() {
+			break
+		}
+		id := path.Base(node.Key)
+		si := &bundle.ServiceInstance{}
+		if err := types.DecodeKeyRecord(node.Key, node.Value, si); err != nil {
+			return types.ServiceInstancePage{}, err
+		}
+		if filter.Match(si, created[id]) && pager.Take(id) {
+			result.ServiceInstances = append(result.ServiceInstances, si)
+		}
+	}
+	result.Next = pager.Next
+	return result, nil
 }
 
 func removeFalseBindings(bindings map[string]bool) map[string]bool {
@@ -320,7 +400,13 @@ func removeFalseBindings(bindings map[string]bool) map[string]bool {
 func (d *Dao) DeleteServiceInstance(id string) error {
 	log.Debug(fmt.Sprintf("Dao::DeleteServiceInstance -> [ %s ]", id))
 	_, err := d.kapi.Delete(context.Background(), serviceInstanceKey(id), nil)
-	return err
+	if err != nil {
+		return err
+	}
+	if _, err := d.kapi.Delete(context.Background(), createdKey(serviceInstanceKey(id)), nil); err != nil && !client.IsKeyNotFound(err) {
+		log.Warningf("unable to delete the creation time of service instance %s - %v", id, err)
+	}
+	return nil
 }
 
 // GetBindInstance - Retrieve a specific bind instance from the kvp API
@@ -344,16 +430,16 @@ func (d *Dao) DeleteBindInstance(id string) error {
 	return err
 }
 
-// DeleteBinding - Delete the binding instance and remove the association with the service instance.
+// DeleteBinding - Delete the binding instance and remove the association with
+// the latest version of the service instance.
 func (d *Dao) DeleteBinding(bindingInstance bundle.BindInstance, serviceInstance bundle.ServiceInstance) error {
 	if err := d.DeleteBindInstance(bindingInstance.ID.String()); err != nil {
 		return err
 	}
-	serviceInstance.RemoveBinding(bindingInstance.ID)
-	if err := d.SetServiceInstance(serviceInstance.ID.String(), &serviceInstance); err != nil {
-		return err
-	}
-	return nil
+	return types.UpdateServiceInstance(d, serviceInstance.ID.String(), func(si *bundle.ServiceInstance) error {
+		si.RemoveBinding(bindingInstance.ID)
+		return nil
+	})
 }
 
 // SetState - Set the Job State in the kvp API for id.
@@ -376,28 +462,235 @@ func (d *Dao) GetStateByKey(key string) (bundle.JobState, error) {
 	return state, nil
 }
 
+// GetStateVersion - Retrieve a job state from the kvp API for an ID and Token
+// along with its modified index.
+func (d *Dao) GetStateVersion(id string, token string) (bundle.JobState, types.Version, error) {
+	state := bundle.JobState{}
+	version, err := d.getObjectVersion(stateKey(id, token), &state)
+	if err != nil {
+		return bundle.JobState{State: bundle.StateFailed}, types.NoVersion, err
+	}
+	return state, version, nil
+}
+
+// SetStateIf - Set the Job State in the kvp API for id if it is still at the
+// modified index.
+func (d *Dao) SetStateIf(id string, state bundle.JobState, version types.Version) (string, types.Version, error) {
+	key := stateKey(id, state.Token)
+	newVersion, err := d.setObjectIf(key, state, version, types.ConflictError{Kind: "job state", ID: key})
+	return key, newVersion, err
+}
+
+// SetDeadLetter - Create or update a dead letter in the kvp API.
+func (d *Dao) SetDeadLetter(letter *types.DeadLetter) error {
+	return d.setObject(deadLetterKey(letter.ID), letter)
+}
+
+// GetDeadLetter - Retrieve a dead letter from the kvp API.
+func (d *Dao) GetDeadLetter(id string) (*types.DeadLetter, error) {
+	letter := &types.DeadLetter{}
+	if err := d.getObject(deadLetterKey(id), letter); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+// BatchGetDeadLetters - Retrieve all the dead letters from the kvp API.
+func (d *Dao) BatchGetDeadLetters() ([]*types.DeadLetter, error) {
+	payloads, err := d.BatchGetRaw("/dead_letter")
+	if client.IsKeyNotFound(err) {
+		return []*types.DeadLetter{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	letters := make([]*types.DeadLetter, len(*payloads))
+	for i, payload := range *payloads {
+		letter := &types.DeadLetter{}
+		if _, err := types.DecodeRecord(types.DeadLetterRecord, payload, letter); err != nil {
+			return nil, err
+		}
+		letters[i] = letter
+	}
+	return letters, nil
+}
+
+// DeleteDeadLetter - Delete the dead letter for an id in the kvp API.
+func (d *Dao) DeleteDeadLetter(id string) error {
+	log.Debugf("Dao::DeleteDeadLetter -> [ %s ]", id)
+	_, err := d.kapi.Delete(context.Background(), deadLetterKey(id), nil)
+	return err
+}
+
 // IsNotFoundError - Will determine if an error is a key is not found error.
 func (d *Dao) IsNotFoundError(err error) bool {
 	return client.IsKeyNotFound(err)
 }
 
+// ListJobStates - Retrieve a page of the job states matching the filter,
+// ordered by instance or binding id and token, with a prefix scan of the job
+// states, of the instance or binding only if the filter has one.
+func (d *Dao) ListJobStates(filter types.JobStateFilter, page types.Page) (types.JobStatePage, error) {
+	result := types.JobStatePage{JobStates: []bundle.RecoverStatus{}}
+	prefix := "/state"
+	if filter.ID != "" {
+		prefix = fmt.Sprintf("/state/%s/job", filter.ID)
+	}
+	nodes, err := d.scan(prefix)
+	if err != nil {
+		return result, err
+	}
+	pager := types.NewPager(page)
+	for _, node := range nodes {
+		if pager.Full() {
+			break
+		}
+		js := bundle.JobState{}
+		if err := types.DecodeKeyRecord(node.Key, node.Value, &js); err != nil {
+			log.Warningf("Error processing jobstate record %s, moving on to next. %v", node.Key, err)
+			continue
+		}
+		id := stateKeyID(path.Dir(node.Key))
+		if filter.Match(id, js) && pager.Take(types.JobStateCursor(id, path.Base(node.Key))) {
+			result.JobStates = append(result.JobStates, bundle.RecoverStatus{InstanceID: uuid.Parse(id), State: js})
+		}
+	}
+	result.Next = pager.Next
+	return result, nil
+}
+
+// RewriteOutdatedRecords - rewrites the records stored with an older schema
+// version with the current one, unless they are written in the meantime.
+func (d *Dao) RewriteOutdatedRecords() (int, error) {
+	rewritten := 0
+	for _, prefix := range []string{"/spec", "/service_instance", "/bind_instance", "/state", "/dead_letter"} {
+		nodes, err := d.scan(prefix)
+		if err != nil {
+			return rewritten, err
+		}
+		for _, node := range nodes {
+			kind, ok := types.KeyRecordKind(node.Key)
+			if !ok {
+				continue
+			}
+			payload, outdated, err := types.RewriteRecord(kind, node.Value)
+			if err != nil {
+				log.Warningf("unable to rewrite record %s - %v", node.Key, err)
+				continue
+			}
+			if !outdated {
+				continue
+			}
+			_, err = d.kapi.Set(context.Background(), node.Key, payload, &client.SetOptions{PrevIndex: node.ModifiedIndex})
+			if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeTestFailed {
+				// written with the current schema version in the meantime
+				continue
+			}
+			if err != nil {
+				return rewritten, err
+			}
+			rewritten++
+		}
+	}
+	return rewritten, nil
+}
+
+// scan - the keys under the prefix, sorted, none if the prefix does not exist.
+func (d *Dao) scan(prefix string) ([]*client.Node, error) {
+	res, err := d.kapi.Get(context.Background(), prefix, &client.GetOptions{Recursive: true, Sort: true})
+	if client.IsKeyNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	keys := []*client.Node{}
+	var walk func(node *client.Node)
+	walk = func(node *client.Node) {
+		if !node.Dir {
+			keys = append(keys, node)
+			return
+		}
+		for _, child := range node.Nodes {
+			walk(child)
+		}
+	}
+	walk(res.Node)
+	return keys, nil
+}
+
+// setCreated - records the time the object of the key is created at, unless
+// it already is. The creation time only serves filters, failing to record it
+// is not an error.
+func (d *Dao) setCreated(key string) {
+	_, err := d.kapi.Set(context.Background(), createdKey(key), time.Now().UTC().Format(time.RFC3339Nano),
+		&client.SetOptions{PrevExist: client.PrevNoExist})
+	if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeNodeExist {
+		return
+	}
+	if err != nil {
+		log.Warningf("unable to record the creation time of %s - %v", key, err)
+	}
+}
+
 func (d *Dao) getObject(key string, data interface{}) error {
 	raw, err := d.GetRaw(key)
 	if err != nil {
 		return err
 	}
-	bundle.LoadJSON(raw, data)
-	return nil
+	return types.DecodeKeyRecord(key, raw, data)
 }
 
 func (d *Dao) setObject(key string, data interface{}) error {
-	payload, err := bundle.DumpJSON(data)
+	payload, err := types.EncodeKeyRecord(key, data)
 	if err != nil {
 		return err
 	}
 	return d.SetRaw(key, payload)
 }
 
+func (d *Dao) getObjectVersion(key string, data interface{}) (types.Version, error) {
+	res, err := d.kapi.Get(context.Background(), key, nil)
+	if err != nil {
+		return types.NoVersion, err
+	}
+	if err := types.DecodeKeyRecord(key, res.Node.Value, data); err != nil {
+		return types.NoVersion, err
+	}
+	return modifiedIndexVersion(res.Node.ModifiedIndex), nil
+}
+
+// setObjectIf - sets the object with a compare-and-swap on the modified index,
+// or on the key not existing for NoVersion. A failed comparison returns the
+// conflict.
+func (d *Dao) setObjectIf(key string, data interface{}, version types.Version, conflict error) (types.Version, error) {
+	payload, err := types.EncodeKeyRecord(key, data)
+	if err != nil {
+		return types.NoVersion, err
+	}
+	opts := &client.SetOptions{PrevExist: client.PrevNoExist}
+	if version != types.NoVersion {
+		index, err := strconv.ParseUint(string(version), 10, 64)
+		if err != nil {
+			return types.NoVersion, fmt.Errorf("invalid version %q of %s - %v", version, key, err)
+		}
+		opts = &client.SetOptions{PrevIndex: index}
+	}
+	res, err := d.kapi.Set(context.Background(), key, payload, opts)
+	if e, ok := err.(client.Error); ok {
+		switch e.Code {
+		case client.ErrorCodeTestFailed, client.ErrorCodeNodeExist, client.ErrorCodeKeyNotFound:
+			return types.NoVersion, conflict
+		}
+	}
+	if err != nil {
+		return types.NoVersion, err
+	}
+	return modifiedIndexVersion(res.Node.ModifiedIndex), nil
+}
+
+func modifiedIndexVersion(index uint64) types.Version {
+	return types.Version(strconv.FormatUint(index, 10))
+}
+
 ////////////////////////////////////////////////////////////
 // Key generators
 ////////////////////////////////////////////////////////////
@@ -406,6 +699,11 @@ func stateKey(id string, jobid string) string {
 	return fmt.Sprintf("/state/%s/job/%s", id, jobid)
 }
 
+// createdKey - the key of the creation time of the object under the key.
+func createdKey(key string) string {
+	return "/created" + key
+}
+
 func stateKeyID(key string) string {
 	s := strings.TrimPrefix(key, "/state/")
 	s = strings.TrimSuffix(s, "/job")
@@ -428,6 +726,10 @@ func bindInstanceKey(id string) string {
 	return fmt.Sprintf("/bind_instance/%s", id)
 }
 
+func deadLetterKey(id string) string {
+	return fmt.Sprintf("/dead_letter/%s", id)
+}
+
 func planNameKey(id string) string {
 	return fmt.Sprintf("/plan_name/%s", id)
 }
@@ -0,0 +1,164 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao_test
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coreos/etcd/client"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/openshift/ansible-service-broker/pkg/dao/daotest"
+	etcd "github.com/openshift/ansible-service-broker/pkg/dao/etcd"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+)
+
+// fakeKeysAPI - an in memory etcd v2 key space, the keys are the leaves and
+// the directories are implied by them.
+type fakeKeysAPI struct {
+	client.KeysAPI
+	mutex    sync.Mutex
+	keys     map[string]string
+	modified map[string]uint64
+	index    uint64
+}
+
+func newFakeKeysAPI() *fakeKeysAPI {
+	return &fakeKeysAPI{keys: map[string]string{}, modified: map[string]uint64{}}
+}
+
+func keyNotFound(key string) error {
+	return client.Error{Code: client.ErrorCodeKeyNotFound, Message: "Key not found", Cause: key}
+}
+
+func (f *fakeKeysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	key = strings.TrimSuffix(key, "/")
+	recursive := opts != nil && opts.Recursive
+	node := f.node(key, recursive)
+	if node == nil {
+		return nil, keyNotFound(key)
+	}
+	return &client.Response{Action: "get", Node: node}, nil
+}
+
+// node - the node of a key, with its children if it is a directory.
+func (f *fakeKeysAPI) node(key string, recursive bool) *client.Node {
+	if value, ok := f.keys[key]; ok {
+		return &client.Node{Key: key, Value: value, ModifiedIndex: f.modified[key]}
+	}
+	children := map[string]bool{}
+	for k := range f.keys {
+		if strings.HasPrefix(k, key+"/") {
+			child := strings.SplitN(strings.TrimPrefix(k, key+"/"), "/", 2)[0]
+			children[key+"/"+child] = true
+		}
+	}
+	if len(children) == 0 {
+		return nil
+	}
+	node := &client.Node{Key: key, Dir: true}
+	keys := []string{}
+	for child := range children {
+		keys = append(keys, child)
+	}
+	sort.Strings(keys)
+	for _, child := range keys {
+		if value, ok := f.keys[child]; ok {
+			node.Nodes = append(node.Nodes, &client.Node{Key: child, Value: value, ModifiedIndex: f.modified[child]})
+		} else if recursive {
+			node.Nodes = append(node.Nodes, f.node(child, true))
+		} else {
+			node.Nodes = append(node.Nodes, &client.Node{Key: child, Dir: true})
+		}
+	}
+	return node
+}
+
+func (f *fakeKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, exists := f.keys[key]
+	if opts != nil && opts.PrevExist == client.PrevNoExist && exists {
+		return nil, client.Error{Code: client.ErrorCodeNodeExist, Message: "Key already exists", Cause: key}
+	}
+	if opts != nil && opts.PrevIndex != 0 {
+		if !exists {
+			return nil, keyNotFound(key)
+		}
+		if f.modified[key] != opts.PrevIndex {
+			return nil, client.Error{Code: client.ErrorCodeTestFailed, Message: "Compare failed", Cause: key}
+		}
+	}
+	f.index++
+	f.keys[key] = value
+	f.modified[key] = f.index
+	return &client.Response{Action: "set", Node: &client.Node{Key: key, Value: value, ModifiedIndex: f.index}}, nil
+}
+
+func (f *fakeKeysAPI) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, ok := f.keys[key]; !ok {
+		return nil, keyNotFound(key)
+	}
+	delete(f.keys, key)
+	delete(f.modified, key)
+	return &client.Response{Action: "delete", Node: &client.Node{Key: key}}, nil
+}
+
+func TestConformance(t *testing.T) {
+	daotest.RunConformance(t, func(t *testing.T) dao.Dao {
+		return etcd.NewDaoWithKeysAPI(newFakeKeysAPI())
+	})
+}
+
+func TestRewriteOutdatedRecords(t *testing.T) {
+	// the specs stored without a schema version are outdated
+	defer types.RegisterTestUpgrade(types.SpecRecord, func(map[string]interface{}) error { return nil })()
+	payload, err := ioutil.ReadFile("../types/testdata/schema/v1/spec.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := newFakeKeysAPI()
+	keys.Set(context.Background(), "/spec/dh-postgresql-apb", string(payload), nil)
+	d := etcd.NewDaoWithKeysAPI(keys)
+
+	spec, err := d.GetSpec("dh-postgresql-apb")
+	if err != nil {
+		t.Fatalf("unable to read the outdated spec - %v", err)
+	}
+	if spec.FQName != "dh-postgresql-apb" || len(spec.Plans) != 1 {
+		t.Fatalf("unexpected spec %#v", spec)
+	}
+
+	n, err := d.RewriteOutdatedRecords()
+	if err != nil || n != 1 {
+		t.Fatalf("rewrote %d records - %v", n, err)
+	}
+	if !strings.HasPrefix(keys.keys["/spec/dh-postgresql-apb"], `{"schema_version":2,`) {
+		t.Fatalf("the spec was not rewritten: %s", keys.keys["/spec/dh-postgresql-apb"])
+	}
+	if n, err := d.RewriteOutdatedRecords(); err != nil || n != 0 {
+		t.Fatalf("rewrote %d current records - %v", n, err)
+	}
+}
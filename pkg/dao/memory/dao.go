@@ -0,0 +1,588 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// notFoundError - the error returned for a key that does not exist.
+type notFoundError struct {
+	key string
+}
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("key not found: %s", e.key)
+}
+
+// Dao - keeps the objects in memory as json, under the same keys as the etcd
+// dao. When a snapshot file is given, every change is written to it and the
+// objects are loaded from it on start. The version of an object is the
+// revision of the dao when it was last written, like the modified index of
+// etcd; versions are not part of the snapshot.
+type Dao struct {
+	mutex    sync.RWMutex
+	objects  map[string]string
+	versions map[string]int64
+	revision int64
+	snapshot string
+}
+
+// NewDao - Create a new Dao object. The snapshot file is optional.
+func NewDao(snapshot string) (*Dao, error) {
+	d := &Dao{objects: map[string]string{}, versions: map[string]int64{}, snapshot: snapshot}
+	if snapshot == "" {
+		return d, nil
+	}
+	b, err := ioutil.ReadFile(snapshot)
+	if os.IsNotExist(err) {
+		log.Infof("snapshot %s does not exist yet, starting empty", snapshot)
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &d.objects); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s - %v", snapshot, err)
+	}
+	log.Infof("loaded %d objects from snapshot %s", len(d.objects), snapshot)
+	return d, nil
+}
+
+// GetSpec - Retrieve the spec from memory.
+func (d *Dao) GetSpec(id string) (*bundle.Spec, error) {
+	spec := &bundle.Spec{}
+	if err := d.getObject(specKey(id), spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// SetSpec - set spec for an id in memory.
+func (d *Dao) SetSpec(id string, spec *bundle.Spec) error {
+	return d.setObject(specKey(id), spec)
+}
+
+// DeleteSpec - Delete the spec for a given spec id.
+func (d *Dao) DeleteSpec(specID string) error {
+	log.Debugf("Dao::DeleteSpec-> [ %s ]", specID)
+	return d.deleteKey(specKey(specID))
+}
+
+// BatchSetSpecs - set specs based on SpecManifest in memory.
+func (d *Dao) BatchSetSpecs(specs bundle.SpecManifest) error {
+	for id, spec := range specs {
+		if err := d.SetSpec(id, spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BatchGetSpecs - Retrieve all the specs for dir.
+func (d *Dao) BatchGetSpecs(dir string) ([]*bundle.Spec, error) {
+	specs := []*bundle.Spec{}
+	for _, payload := range d.list(dir) {
+		spec := &bundle.Spec{}
+		if _, err := types.DecodeRecord(types.SpecRecord, payload, spec); err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// BatchGetBundleInstances - get list of bundleinstances
+func (d *Dao) BatchGetBundleInstances() ([]*bundle.ServiceInstance, error) {
+	instances := []*bundle.ServiceInstance{}
+	for _, payload := range d.list("/service_instance") {
+		si := &bundle.ServiceInstance{}
+		if _, err := types.DecodeRecord(types.ServiceInstanceRecord, payload, si); err != nil {
+			return nil, err
+		}
+		instances = append(instances, si)
+	}
+	return instances, nil
+}
+
+// BatchDeleteSpecs - delete the specs from memory.
+func (d *Dao) BatchDeleteSpecs(specs []*bundle.Spec) error {
+	for _, spec := range specs {
+		if err := d.DeleteSpec(spec.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindJobStateByState - Retrieve all the jobs that match the specified state
+func (d *Dao) FindJobStateByState(state bundle.State) ([]bundle.RecoverStatus, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	statuses := []bundle.RecoverStatus{}
+	for _, key := range d.sortedKeys("/state/") {
+		js := bundle.JobState{}
+		if err := types.DecodeKeyRecord(key, d.objects[key], &js); err != nil {
+			log.Warningf("Error processing jobstate record %s, moving on to next. %v", key, err)
+			continue
+		}
+		if js.State == state {
+			statuses = append(statuses, bundle.RecoverStatus{
+				InstanceID: uuid.Parse(stateKeyID(key)),
+				State:      js,
+			})
+		}
+	}
+	return statuses, nil
+}
+
+// GetSvcInstJobsByState - Lookup all jobs of a given state for a specific instance
+func (d *Dao) GetSvcInstJobsByState(instanceID string, reqState bundle.State) ([]bundle.JobState, error) {
+	jobs := []bundle.JobState{}
+	for _, payload := range d.list(fmt.Sprintf("/state/%s/job", instanceID)) {
+		js := bundle.JobState{}
+		if _, err := types.DecodeRecord(types.JobStateRecord, payload, &js); err != nil {
+			return nil, err
+		}
+		if js.State == reqState {
+			jobs = append(jobs, js)
+		}
+	}
+	return jobs, nil
+}
+
+// GetServiceInstance - Retrieve specific service instance from memory.
+func (d *Dao) GetServiceInstance(id string) (*bundle.ServiceInstance, error) {
+	si := &bundle.ServiceInstance{}
+	if err := d.getObject(serviceInstanceKey(id), si); err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+// SetServiceInstance - Set service instance for an id in memory.
+func (d *Dao) SetServiceInstance(id string, serviceInstance *bundle.ServiceInstance) error {
+	return d.setObject(serviceInstanceKey(id), serviceInstance)
+}
+
+// GetServiceInstanceVersion - Retrieve specific service instance from memory
+// along with its version.
+func (d *Dao) GetServiceInstanceVersion(id string) (*bundle.ServiceInstance, types.Version, error) {
+	si := &bundle.ServiceInstance{}
+	version, err := d.getObjectVersion(serviceInstanceKey(id), si)
+	if err != nil {
+		return nil, types.NoVersion, err
+	}
+	return si, version, nil
+}
+
+// SetServiceInstanceIf - Set service instance for an id in memory if it is
+// still at the version.
+func (d *Dao) SetServiceInstanceIf(
+	id string, serviceInstance *bundle.ServiceInstance, version types.Version,
+) (types.Version, error) {
+	return d.setObjectIf(serviceInstanceKey(id), serviceInstance, version,
+		types.ConflictError{Kind: "service instance", ID: id})
+}
+
+// ListServiceInstances - Retrieve a page of the service instances matching
+// the filter, ordered by id.
+func (d *Dao) ListServiceInstances(
+	filter types.ServiceInstanceFilter, page types.Page,
+) (types.ServiceInstancePage, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	result := types.ServiceInstancePage{ServiceInstances: []*bundle.ServiceInstance{}}
+	pager := types.NewPager(page)
+	prefix := serviceInstanceKey("")
+	for _, key := range d.sortedKeys(prefix) {
+		if pager.Full() {
+			break
+		}
+		si := &bundle.ServiceInstance{}
+		if err := types.DecodeKeyRecord(key, d.objects[key], si); err != nil {
+			return types.ServiceInstancePage{}, err
+		}
+		if filter.Match(si, d.created(key)) && pager.Take(strings.TrimPrefix(key, prefix)) {
+			result.ServiceInstances = append(result.ServiceInstances, si)
+		}
+	}
+	result.Next = pager.Next
+	return result, nil
+}
+
+// DeleteServiceInstance - Delete the service instance for an service instance id.
+func (d *Dao) DeleteServiceInstance(id string) error {
+	log.Debugf("Dao::DeleteServiceInstance -> [ %s ]", id)
+	return d.deleteKey(serviceInstanceKey(id))
+}
+
+// GetBindInstance - Retrieve a specific bind instance from memory.
+func (d *Dao) GetBindInstance(id string) (*bundle.BindInstance, error) {
+	bi := &bundle.BindInstance{}
+	if err := d.getObject(bindInstanceKey(id), bi); err != nil {
+		return nil, err
+	}
+	return bi, nil
+}
+
+// SetBindInstance - Set the bind instance for id in memory.
+func (d *Dao) SetBindInstance(id string, bindInstance *bundle.BindInstance) error {
+	return d.setObject(bindInstanceKey(id), bindInstance)
+}
+
+// DeleteBindInstance - Delete the binding instance for an id in memory.
+func (d *Dao) DeleteBindInstance(id string) error {
+	log.Debugf("Dao::DeleteBindInstance -> [ %s ]", id)
+	return d.deleteKey(bindInstanceKey(id))
+}
+
+// DeleteBinding - Delete the binding instance and remove the association with
+// the latest version of the service instance.
+func (d *Dao) DeleteBinding(bindingInstance bundle.BindInstance, serviceInstance bundle.ServiceInstance) error {
+	if err := d.DeleteBindInstance(bindingInstance.ID.String()); err != nil {
+		return err
+	}
+	return types.UpdateServiceInstance(d, serviceInstance.ID.String(), func(si *bundle.ServiceInstance) error {
+		si.RemoveBinding(bindingInstance.ID)
+		return nil
+	})
+}
+
+// SetState - Set the Job State in memory for id.
+func (d *Dao) SetState(id string, state bundle.JobState) (string, error) {
+	key := stateKey(id, state.Token)
+	return key, d.setObject(key, state)
+}
+
+// GetState - Retrieve a job state from memory for an ID and Token.
+func (d *Dao) GetState(id string, token string) (bundle.JobState, error) {
+	return d.GetStateByKey(stateKey(id, token))
+}
+
+// GetStateByKey - Retrieve a job state from memory for a job key
+func (d *Dao) GetStateByKey(key string) (bundle.JobState, error) {
+	state := bundle.JobState{}
+	if err := d.getObject(key, &state); err != nil {
+		return bundle.JobState{State: bundle.StateFailed}, err
+	}
+	return state, nil
+}
+
+// GetStateVersion - Retrieve a job state from memory for an ID and Token
+// along with its version.
+func (d *Dao) GetStateVersion(id string, token string) (bundle.JobState, types.Version, error) {
+	state := bundle.JobState{}
+	version, err := d.getObjectVersion(stateKey(id, token), &state)
+	if err != nil {
+		return bundle.JobState{State: bundle.StateFailed}, types.NoVersion, err
+	}
+	return state, version, nil
+}
+
+// SetStateIf - Set the Job State in memory for id if it is still at the
+// version.
+func (d *Dao) SetStateIf(id string, state bundle.JobState, version types.Version) (string, types.Version, error) {
+	key := stateKey(id, state.Token)
+	newVersion, err := d.setObjectIf(key, state, version, types.ConflictError{Kind: "job state", ID: key})
+	return key, newVersion, err
+}
+
+// ListJobStates - Retrieve a page of the job states matching the filter,
+// ordered by instance or binding id and token.
+func (d *Dao) ListJobStates(filter types.JobStateFilter, page types.Page) (types.JobStatePage, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	result := types.JobStatePage{JobStates: []bundle.RecoverStatus{}}
+	pager := types.NewPager(page)
+	prefix := "/state/"
+	if filter.ID != "" {
+		prefix = stateKey(filter.ID, "")
+	}
+	for _, key := range d.sortedKeys(prefix) {
+		if pager.Full() {
+			break
+		}
+		js := bundle.JobState{}
+		if err := types.DecodeKeyRecord(key, d.objects[key], &js); err != nil {
+			log.Warningf("Error processing jobstate record %s, moving on to next. %v", key, err)
+			continue
+		}
+		id, token := stateKeyID(key), key[strings.LastIndex(key, "/")+1:]
+		if filter.Match(id, js) && pager.Take(types.JobStateCursor(id, token)) {
+			result.JobStates = append(result.JobStates, bundle.RecoverStatus{InstanceID: uuid.Parse(id), State: js})
+		}
+	}
+	result.Next = pager.Next
+	return result, nil
+}
+
+// SetDeadLetter - Create or update a dead letter in memory.
+func (d *Dao) SetDeadLetter(letter *types.DeadLetter) error {
+	return d.setObject(deadLetterKey(letter.ID), letter)
+}
+
+// GetDeadLetter - Retrieve a dead letter from memory.
+func (d *Dao) GetDeadLetter(id string) (*types.DeadLetter, error) {
+	letter := &types.DeadLetter{}
+	if err := d.getObject(deadLetterKey(id), letter); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+// BatchGetDeadLetters - Retrieve all the dead letters from memory.
+func (d *Dao) BatchGetDeadLetters() ([]*types.DeadLetter, error) {
+	letters := []*types.DeadLetter{}
+	for _, payload := range d.list("/dead_letter") {
+		letter := &types.DeadLetter{}
+		if _, err := types.DecodeRecord(types.DeadLetterRecord, payload, letter); err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// DeleteDeadLetter - Delete the dead letter for an id in memory.
+func (d *Dao) DeleteDeadLetter(id string) error {
+	log.Debugf("Dao::DeleteDeadLetter -> [ %s ]", id)
+	return d.deleteKey(deadLetterKey(id))
+}
+
+// RewriteOutdatedRecords - rewrites the records stored with an older schema
+// version with the current one.
+func (d *Dao) RewriteOutdatedRecords() (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	rewritten := 0
+	for _, key := range d.sortedKeys("/") {
+		kind, ok := types.KeyRecordKind(key)
+		if !ok {
+			continue
+		}
+		payload, outdated, err := types.RewriteRecord(kind, d.objects[key])
+		if err != nil {
+			log.Warningf("unable to rewrite record %s - %v", key, err)
+			continue
+		}
+		if outdated {
+			d.write(key, payload)
+			rewritten++
+		}
+	}
+	if rewritten == 0 {
+		return 0, nil
+	}
+	return rewritten, d.save()
+}
+
+// IsNotFoundError - Will determine if an error is a key is not found error.
+func (d *Dao) IsNotFoundError(err error) bool {
+	_, ok := err.(notFoundError)
+	return ok
+}
+
+func (d *Dao) getObject(key string, data interface{}) error {
+	d.mutex.RLock()
+	payload, ok := d.objects[key]
+	d.mutex.RUnlock()
+	if !ok {
+		return notFoundError{key}
+	}
+	return types.DecodeKeyRecord(key, payload, data)
+}
+
+func (d *Dao) getObjectVersion(key string, data interface{}) (types.Version, error) {
+	d.mutex.RLock()
+	payload, ok := d.objects[key]
+	version := d.version(key)
+	d.mutex.RUnlock()
+	if !ok {
+		return types.NoVersion, notFoundError{key}
+	}
+	return version, types.DecodeKeyRecord(key, payload, data)
+}
+
+func (d *Dao) setObject(key string, data interface{}) error {
+	payload, err := types.EncodeKeyRecord(key, data)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.write(key, payload)
+	return d.save()
+}
+
+// setObjectIf - sets the object unless its version is no longer the given
+// one, in which case the conflict is returned.
+func (d *Dao) setObjectIf(key string, data interface{}, version types.Version, conflict error) (types.Version, error) {
+	payload, err := types.EncodeKeyRecord(key, data)
+	if err != nil {
+		return types.NoVersion, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.version(key) != version {
+		return types.NoVersion, conflict
+	}
+	d.write(key, payload)
+	return d.version(key), d.save()
+}
+
+// version - the version of the object under the key, NoVersion if there is
+// none. Must be called with the mutex held.
+func (d *Dao) version(key string) types.Version {
+	if _, ok := d.objects[key]; !ok {
+		return types.NoVersion
+	}
+	return types.Version(strconv.FormatInt(d.versions[key], 10))
+}
+
+// write - stores the payload under the key at the next revision, recording
+// when a service instance is created. Must be called with the mutex held.
+func (d *Dao) write(key string, payload string) {
+	if _, ok := d.objects[key]; !ok && strings.HasPrefix(key, serviceInstanceKey("")) {
+		d.objects[createdKey(key)] = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	d.revision++
+	d.objects[key] = payload
+	d.versions[key] = d.revision
+}
+
+func (d *Dao) deleteKey(key string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.objects[key]; !ok {
+		return notFoundError{key}
+	}
+	delete(d.objects, key)
+	delete(d.objects, createdKey(key))
+	delete(d.versions, key)
+	return d.save()
+}
+
+// created - when the object under the key was created, zero if unknown. Must
+// be called with the mutex held.
+func (d *Dao) created(key string) time.Time {
+	created, _ := time.Parse(time.RFC3339Nano, d.objects[createdKey(key)])
+	return created
+}
+
+// list - the objects directly under the dir, ordered by key.
+func (d *Dao) list(dir string) []string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	payloads := []string{}
+	for _, key := range d.sortedKeys(prefix) {
+		if strings.Contains(strings.TrimPrefix(key, prefix), "/") {
+			continue
+		}
+		payloads = append(payloads, d.objects[key])
+	}
+	return payloads
+}
+
+// sortedKeys - the keys starting with the prefix. Must be called with the
+// mutex held.
+func (d *Dao) sortedKeys(prefix string) []string {
+	keys := []string{}
+	for key := range d.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// save - writes the objects to the snapshot file, if any. The file is
+// replaced at once so that a crash never leaves a partial snapshot. Must be
+// called with the mutex held.
+func (d *Dao) save() error {
+	if d.snapshot == "" {
+		return nil
+	}
+	b, err := json.Marshal(d.objects)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(d.snapshot), filepath.Base(d.snapshot)+".")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), d.snapshot)
+}
+
+////////////////////////////////////////////////////////////
+// Key generators, the same as the etcd dao
+////////////////////////////////////////////////////////////
+
+func stateKey(id string, jobid string) string {
+	return fmt.Sprintf("/state/%s/job/%s", id, jobid)
+}
+
+func stateKeyID(key string) string {
+	s := strings.TrimPrefix(key, "/state/")
+	return strings.SplitN(s, "/", 2)[0]
+}
+
+func specKey(id string) string {
+	return fmt.Sprintf("/spec/%s", id)
+}
+
+func serviceInstanceKey(id string) string {
+	return fmt.Sprintf("/service_instance/%s", id)
+}
+
+func bindInstanceKey(id string) string {
+	return fmt.Sprintf("/bind_instance/%s", id)
+}
+
+func deadLetterKey(id string) string {
+	return fmt.Sprintf("/dead_letter/%s", id)
+}
+
+// createdKey - the key of the creation time of the object under the key.
+func createdKey(key string) string {
+	return "/created" + key
+}
@@ -0,0 +1,123 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/openshift/ansible-service-broker/pkg/dao/daotest"
+	memory "github.com/openshift/ansible-service-broker/pkg/dao/memory"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
+	"github.com/pborman/uuid"
+)
+
+func TestConformance(t *testing.T) {
+	daotest.RunConformance(t, func(t *testing.T) dao.Dao {
+		d, err := memory.NewDao("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
+
+func TestConformanceWithSnapshot(t *testing.T) {
+	daotest.RunConformance(t, func(t *testing.T) dao.Dao {
+		d, err := memory.NewDao(filepath.Join(t.TempDir(), "snapshot.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "snapshot.json")
+	d, err := memory.NewDao(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instanceID := uuid.NewRandom()
+	bindingID := uuid.NewRandom()
+	spec := &bundle.Spec{ID: "spec", FQName: "dh-postgresql-apb"}
+	ft.AssertNil(t, d.SetSpec(spec.ID, spec))
+	ft.AssertNil(t, d.SetServiceInstance(instanceID.String(), &bundle.ServiceInstance{
+		ID:      instanceID,
+		Spec:    spec,
+		Context: &bundle.Context{Namespace: "project"},
+	}))
+	ft.AssertNil(t, d.SetBindInstance(bindingID.String(), &bundle.BindInstance{ID: bindingID, ServiceID: instanceID}))
+	_, err = d.SetState(instanceID.String(), bundle.JobState{
+		Token: "token", State: bundle.StateSucceeded, Method: bundle.JobMethodProvision})
+	ft.AssertNil(t, err)
+	ft.AssertNil(t, d.SetDeadLetter(&types.DeadLetter{ID: "letter", SubscriberID: "jobstate", JobToken: "token"}))
+	ft.AssertNil(t, d.SetSpec("deleted", &bundle.Spec{ID: "deleted"}))
+	ft.AssertNil(t, d.DeleteSpec("deleted"))
+
+	// a new dao loads what the first one saved
+	loaded, err := memory.NewDao(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := loaded.GetSpec("spec")
+	ft.AssertNil(t, err)
+	ft.AssertEqual(t, s.FQName, "dh-postgresql-apb")
+	si, err := loaded.GetServiceInstance(instanceID.String())
+	ft.AssertNil(t, err)
+	ft.AssertEqual(t, si.Context.Namespace, "project")
+	ft.AssertEqual(t, si.Spec.ID, "spec")
+	bi, err := loaded.GetBindInstance(bindingID.String())
+	ft.AssertNil(t, err)
+	ft.AssertTrue(t, uuid.Equal(bi.ServiceID, instanceID))
+	state, err := loaded.GetState(instanceID.String(), "token")
+	ft.AssertNil(t, err)
+	ft.AssertEqual(t, state.State, bundle.StateSucceeded)
+	letter, err := loaded.GetDeadLetter("letter")
+	ft.AssertNil(t, err)
+	ft.AssertEqual(t, letter.SubscriberID, "jobstate")
+	_, err = loaded.GetSpec("deleted")
+	ft.AssertTrue(t, loaded.IsNotFoundError(err), "deleted objects are not in the snapshot")
+
+	// the instances keep their creation time, instances without one never
+	// match a bound
+	page, err := loaded.ListServiceInstances(types.ServiceInstanceFilter{
+		CreatedAfter: time.Now().Add(-time.Hour)}, types.Page{})
+	ft.AssertNil(t, err)
+	ft.AssertEqual(t, len(page.ServiceInstances), 1)
+}
+
+func TestSnapshotMissingAndInvalid(t *testing.T) {
+	dir := t.TempDir()
+	d, err := memory.NewDao(filepath.Join(dir, "missing.json"))
+	ft.AssertNil(t, err)
+	_, err = d.GetSpec("spec")
+	ft.AssertTrue(t, d.IsNotFoundError(err), "a missing snapshot starts empty")
+
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := ioutil.WriteFile(invalid, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = memory.NewDao(invalid)
+	ft.AssertNotNil(t, err)
+}
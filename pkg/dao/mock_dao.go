@@ -6,6 +6,7 @@ package dao
 
 import apb "github.com/automationbroker/bundle-lib/bundle"
 import mock "github.com/stretchr/testify/mock"
+import types "github.com/openshift/ansible-service-broker/pkg/dao/types"
 
 // MockDao is an autogenerated mock type for the Dao type
 type MockDao struct {
@@ -49,6 +50,29 @@ func (_m *MockDao) BatchGetBundleInstances() ([]*apb.ServiceInstance, error) {
 	return r0, r1
 }
 
+// BatchGetDeadLetters provides a mock function with given fields:
+func (_m *MockDao) BatchGetDeadLetters() ([]*types.DeadLetter, error) {
+	ret := _m.Called()
+
+	var r0 []*types.DeadLetter
+	if rf, ok := ret.Get(0).(func() []*types.DeadLetter); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*types.DeadLetter)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // BatchGetSpecs provides a mock function with given fields: _a0
 func (_m *MockDao) BatchGetSpecs(_a0 string) ([]*apb.Spec, error) {
 	ret := _m.Called(_a0)
@@ -114,6 +138,20 @@ func (_m *MockDao) DeleteBinding(_a0 apb.BindInstance, _a1 apb.ServiceInstance)
 	return r0
 }
 
+// DeleteDeadLetter provides a mock function with given fields: _a0
+func (_m *MockDao) DeleteDeadLetter(_a0 string) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // DeleteServiceInstance provides a mock function with given fields: _a0
 func (_m *MockDao) DeleteServiceInstance(_a0 string) error {
 	ret := _m.Called(_a0)
@@ -188,6 +226,29 @@ func (_m *MockDao) GetBindInstance(_a0 string) (*apb.BindInstance, error) {
 	return r0, r1
 }
 
+// GetDeadLetter provides a mock function with given fields: _a0
+func (_m *MockDao) GetDeadLetter(_a0 string) (*types.DeadLetter, error) {
+	ret := _m.Called(_a0)
+
+	var r0 *types.DeadLetter
+	if rf, ok := ret.Get(0).(func(string) *types.DeadLetter); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*types.DeadLetter)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetServiceInstance provides a mock function with given fields: _a0
 func (_m *MockDao) GetServiceInstance(_a0 string) (*apb.ServiceInstance, error) {
 	ret := _m.Called(_a0)
@@ -211,6 +272,36 @@ func (_m *MockDao) GetServiceInstance(_a0 string) (*apb.ServiceInstance, error)
 	return r0, r1
 }
 
+// GetServiceInstanceVersion provides a mock function with given fields: _a0
+func (_m *MockDao) GetServiceInstanceVersion(_a0 string) (*apb.ServiceInstance, types.Version, error) {
+	ret := _m.Called(_a0)
+
+	var r0 *apb.ServiceInstance
+	if rf, ok := ret.Get(0).(func(string) *apb.ServiceInstance); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*apb.ServiceInstance)
+		}
+	}
+
+	var r1 types.Version
+	if rf, ok := ret.Get(1).(func(string) types.Version); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Get(1).(types.Version)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(string) error); ok {
+		r2 = rf(_a0)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
 // GetSpec provides a mock function with given fields: _a0
 func (_m *MockDao) GetSpec(_a0 string) (*apb.Spec, error) {
 	ret := _m.Called(_a0)
@@ -276,6 +367,34 @@ func (_m *MockDao) GetStateByKey(key string) (apb.JobState, error) {
 	return r0, r1
 }
 
+// GetStateVersion provides a mock function with given fields: _a0, _a1
+func (_m *MockDao) GetStateVersion(_a0 string, _a1 string) (apb.JobState, types.Version, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 apb.JobState
+	if rf, ok := ret.Get(0).(func(string, string) apb.JobState); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(apb.JobState)
+	}
+
+	var r1 types.Version
+	if rf, ok := ret.Get(1).(func(string, string) types.Version); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Get(1).(types.Version)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(string, string) error); ok {
+		r2 = rf(_a0, _a1)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
 // GetSvcInstJobsByState provides a mock function with given fields: _a0, _a1
 func (_m *MockDao) GetSvcInstJobsByState(_a0 string, _a1 apb.State) ([]apb.JobState, error) {
 	ret := _m.Called(_a0, _a1)
@@ -313,6 +432,48 @@ func (_m *MockDao) IsNotFoundError(err error) bool {
 	return r0
 }
 
+// ListJobStates provides a mock function with given fields: _a0, _a1
+func (_m *MockDao) ListJobStates(_a0 types.JobStateFilter, _a1 types.Page) (types.JobStatePage, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 types.JobStatePage
+	if rf, ok := ret.Get(0).(func(types.JobStateFilter, types.Page) types.JobStatePage); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(types.JobStatePage)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(types.JobStateFilter, types.Page) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListServiceInstances provides a mock function with given fields: _a0, _a1
+func (_m *MockDao) ListServiceInstances(_a0 types.ServiceInstanceFilter, _a1 types.Page) (types.ServiceInstancePage, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 types.ServiceInstancePage
+	if rf, ok := ret.Get(0).(func(types.ServiceInstanceFilter, types.Page) types.ServiceInstancePage); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(types.ServiceInstancePage)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(types.ServiceInstanceFilter, types.Page) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // SetBindInstance provides a mock function with given fields: _a0, _a1
 func (_m *MockDao) SetBindInstance(_a0 string, _a1 *apb.BindInstance) error {
 	ret := _m.Called(_a0, _a1)
@@ -327,6 +488,20 @@ func (_m *MockDao) SetBindInstance(_a0 string, _a1 *apb.BindInstance) error {
 	return r0
 }
 
+// SetDeadLetter provides a mock function with given fields: _a0
+func (_m *MockDao) SetDeadLetter(_a0 *types.DeadLetter) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*types.DeadLetter) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // SetServiceInstance provides a mock function with given fields: _a0, _a1
 func (_m *MockDao) SetServiceInstance(_a0 string, _a1 *apb.ServiceInstance) error {
 	ret := _m.Called(_a0, _a1)
@@ -341,6 +516,27 @@ func (_m *MockDao) SetServiceInstance(_a0 string, _a1 *apb.ServiceInstance) erro
 	return r0
 }
 
+// SetServiceInstanceIf provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockDao) SetServiceInstanceIf(_a0 string, _a1 *apb.ServiceInstance, _a2 types.Version) (types.Version, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 types.Version
+	if rf, ok := ret.Get(0).(func(string, *apb.ServiceInstance, types.Version) types.Version); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(types.Version)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, *apb.ServiceInstance, types.Version) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // SetSpec provides a mock function with given fields: _a0, _a1
 func (_m *MockDao) SetSpec(_a0 string, _a1 *apb.Spec) error {
 	ret := _m.Called(_a0, _a1)
@@ -375,3 +571,31 @@ func (_m *MockDao) SetState(_a0 string, _a1 apb.JobState) (string, error) {
 
 	return r0, r1
 }
+
+// SetStateIf provides a mock function with given fields: _a0, _a1, _a2
+func (_m *MockDao) SetStateIf(_a0 string, _a1 apb.JobState, _a2 types.Version) (string, types.Version, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string, apb.JobState, types.Version) string); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 types.Version
+	if rf, ok := ret.Get(1).(func(string, apb.JobState, types.Version) types.Version); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Get(1).(types.Version)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(string, apb.JobState, types.Version) error); ok {
+		r2 = rf(_a0, _a1, _a2)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
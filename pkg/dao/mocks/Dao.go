@@ -4,6 +4,7 @@ package mocks
 import bundle "github.com/automationbroker/bundle-lib/bundle"
 
 import mock "github.com/stretchr/testify/mock"
+import types "github.com/openshift/ansible-service-broker/pkg/dao/types"
 
 // Dao is an autogenerated mock type for the Dao type
 type Dao struct {
@@ -47,6 +48,29 @@ func (_m *Dao) BatchGetBundleInstances() ([]*bundle.ServiceInstance, error) {
 	return r0, r1
 }
 
+// BatchGetDeadLetters provides a mock function with given fields:
+func (_m *Dao) BatchGetDeadLetters() ([]*types.DeadLetter, error) {
+	ret := _m.Called()
+
+	var r0 []*types.DeadLetter
+	if rf, ok := ret.Get(0).(func() []*types.DeadLetter); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*types.DeadLetter)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // BatchGetSpecs provides a mock function with given fields: _a0
 func (_m *Dao) BatchGetSpecs(_a0 string) ([]*bundle.Spec, error) {
 	ret := _m.Called(_a0)
@@ -112,6 +136,20 @@ func (_m *Dao) DeleteBinding(_a0 bundle.BindInstance, _a1 bundle.ServiceInstance
 	return r0
 }
 
+// DeleteDeadLetter provides a mock function with given fields: _a0
+func (_m *Dao) DeleteDeadLetter(_a0 string) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // DeleteServiceInstance provides a mock function with given fields: _a0
 func (_m *Dao) DeleteServiceInstance(_a0 string) error {
 	ret := _m.Called(_a0)
@@ -186,6 +224,29 @@ func (_m *Dao) GetBindInstance(_a0 string) (*bundle.BindInstance, error) {
 	return r0, r1
 }
 
+// GetDeadLetter provides a mock function with given fields: _a0
+func (_m *Dao) GetDeadLetter(_a0 string) (*types.DeadLetter, error) {
+	ret := _m.Called(_a0)
+
+	var r0 *types.DeadLetter
+	if rf, ok := ret.Get(0).(func(string) *types.DeadLetter); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*types.DeadLetter)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetServiceInstance provides a mock function with given fields: _a0
 func (_m *Dao) GetServiceInstance(_a0 string) (*bundle.ServiceInstance, error) {
 	ret := _m.Called(_a0)
@@ -209,6 +270,36 @@ func (_m *Dao) GetServiceInstance(_a0 string) (*bundle.ServiceInstance, error) {
 	return r0, r1
 }
 
+// GetServiceInstanceVersion provides a mock function with given fields: _a0
+func (_m *Dao) GetServiceInstanceVersion(_a0 string) (*bundle.ServiceInstance, types.Version, error) {
+	ret := _m.Called(_a0)
+
+	var r0 *bundle.ServiceInstance
+	if rf, ok := ret.Get(0).(func(string) *bundle.ServiceInstance); ok {
+		r0 = rf(_a0)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*bundle.ServiceInstance)
+		}
+	}
+
+	var r1 types.Version
+	if rf, ok := ret.Get(1).(func(string) types.Version); ok {
+		r1 = rf(_a0)
+	} else {
+		r1 = ret.Get(1).(types.Version)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(string) error); ok {
+		r2 = rf(_a0)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
 // GetSpec provides a mock function with given fields: _a0
 func (_m *Dao) GetSpec(_a0 string) (*bundle.Spec, error) {
 	ret := _m.Called(_a0)
@@ -274,6 +365,34 @@ func (_m *Dao) GetStateByKey(key string) (bundle.JobState, error) {
 	return r0, r1
 }
 
+// GetStateVersion provides a mock function with given fields: _a0, _a1
+func (_m *Dao) GetStateVersion(_a0 string, _a1 string) (bundle.JobState, types.Version, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 bundle.JobState
+	if rf, ok := ret.Get(0).(func(string, string) bundle.JobState); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(bundle.JobState)
+	}
+
+	var r1 types.Version
+	if rf, ok := ret.Get(1).(func(string, string) types.Version); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Get(1).(types.Version)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(string, string) error); ok {
+		r2 = rf(_a0, _a1)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
 // GetSvcInstJobsByState provides a mock function with given fields: _a0, _a1
 func (_m *Dao) GetSvcInstJobsByState(_a0 string, _a1 bundle.State) ([]bundle.JobState, error) {
 	ret := _m.Called(_a0, _a1)
@@ -311,6 +430,48 @@ func (_m *Dao) IsNotFoundError(err error) bool {
 	return r0
 }
 
+// ListJobStates provides a mock function with given fields: _a0, _a1
+func (_m *Dao) ListJobStates(_a0 types.JobStateFilter, _a1 types.Page) (types.JobStatePage, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 types.JobStatePage
+	if rf, ok := ret.Get(0).(func(types.JobStateFilter, types.Page) types.JobStatePage); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(types.JobStatePage)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(types.JobStateFilter, types.Page) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListServiceInstances provides a mock function with given fields: _a0, _a1
+func (_m *Dao) ListServiceInstances(_a0 types.ServiceInstanceFilter, _a1 types.Page) (types.ServiceInstancePage, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 types.ServiceInstancePage
+	if rf, ok := ret.Get(0).(func(types.ServiceInstanceFilter, types.Page) types.ServiceInstancePage); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(types.ServiceInstancePage)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(types.ServiceInstanceFilter, types.Page) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // SetBindInstance provides a mock function with given fields: _a0, _a1
 func (_m *Dao) SetBindInstance(_a0 string, _a1 *bundle.BindInstance) error {
 	ret := _m.Called(_a0, _a1)
@@ -325,6 +486,20 @@ func (_m *Dao) SetBindInstance(_a0 string, _a1 *bundle.BindInstance) error {
 	return r0
 }
 
+// SetDeadLetter provides a mock function with given fields: _a0
+func (_m *Dao) SetDeadLetter(_a0 *types.DeadLetter) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*types.DeadLetter) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // SetServiceInstance provides a mock function with given fields: _a0, _a1
 func (_m *Dao) SetServiceInstance(_a0 string, _a1 *bundle.ServiceInstance) error {
 	ret := _m.Called(_a0, _a1)
@@ -339,6 +514,27 @@ func (_m *Dao) SetServiceInstance(_a0 string, _a1 *bundle.ServiceInstance) error
 	return r0
 }
 
+// SetServiceInstanceIf provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Dao) SetServiceInstanceIf(_a0 string, _a1 *bundle.ServiceInstance, _a2 types.Version) (types.Version, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 types.Version
+	if rf, ok := ret.Get(0).(func(string, *bundle.ServiceInstance, types.Version) types.Version); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(types.Version)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, *bundle.ServiceInstance, types.Version) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // SetSpec provides a mock function with given fields: _a0, _a1
 func (_m *Dao) SetSpec(_a0 string, _a1 *bundle.Spec) error {
 	ret := _m.Called(_a0, _a1)
@@ -373,3 +569,31 @@ func (_m *Dao) SetState(_a0 string, _a1 bundle.JobState) (string, error) {
 
 	return r0, r1
 }
+
+// SetStateIf provides a mock function with given fields: _a0, _a1, _a2
+func (_m *Dao) SetStateIf(_a0 string, _a1 bundle.JobState, _a2 types.Version) (string, types.Version, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(string, bundle.JobState, types.Version) string); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 types.Version
+	if rf, ok := ret.Get(1).(func(string, bundle.JobState, types.Version) types.Version); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Get(1).(types.Version)
+	}
+
+	var r2 error
+	if rf, ok := ret.Get(2).(func(string, bundle.JobState, types.Version) error); ok {
+		r2 = rf(_a0, _a1, _a2)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
@@ -0,0 +1,729 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"github.com/pborman/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Dao - keeps the objects in the tables of a relational database. The objects
+// are stored as json, along with the columns they are looked up by. Service
+// instances and job states have a version column, incremented by every write.
+type Dao struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// NewDao - Create a new Dao object, connecting with the database/sql driver
+// and migrating the schema to the latest version. The driver must have been
+// compiled in, see sqlite.go and postgres.go.
+func NewDao(driver string, dsn string) (*Dao, error) {
+	d, err := dialectFor(driver)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the %s database, was the broker built with its driver? - %v", driver, err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		// sqlite only allows one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+	if err := migrate(db, d); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Dao{db: db, dialect: d}, nil
+}
+
+// Close - closes the connections to the database.
+func (d *Dao) Close() error {
+	return d.db.Close()
+}
+
+// GetSpec - Retrieve the spec from the specs table.
+func (d *Dao) GetSpec(id string) (*bundle.Spec, error) {
+	spec := &bundle.Spec{}
+	if err := d.getObject(types.SpecRecord, `SELECT data FROM specs WHERE id = ?`, spec, id); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// SetSpec - set spec for an id in the specs table.
+func (d *Dao) SetSpec(id string, spec *bundle.Spec) error {
+	return d.setSpec(d.db, id, spec)
+}
+
+func (d *Dao) setSpec(e execer, id string, spec *bundle.Spec) error {
+	data, err := types.EncodeRecord(types.SpecRecord, spec)
+	if err != nil {
+		return err
+	}
+	return d.exec(e, `INSERT INTO specs (id, fq_name, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET fq_name = excluded.fq_name, data = excluded.data`,
+		id, spec.FQName, data)
+}
+
+// DeleteSpec - Delete the spec for a given spec id.
+func (d *Dao) DeleteSpec(specID string) error {
+	log.Debugf("Dao::DeleteSpec-> [ %s ]", specID)
+	return d.delete(`DELETE FROM specs WHERE id = ?`, specID)
+}
+
+// BatchSetSpecs - set specs based on SpecManifest in one transaction.
+func (d *Dao) BatchSetSpecs(specs bundle.SpecManifest) error {
+	return d.transaction(func(tx *sql.Tx) error {
+		for id, spec := range specs {
+			if err := d.setSpec(tx, id, spec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BatchGetSpecs - Retrieve all the specs. The dir is ignored, there is only
+// one table of specs.
+func (d *Dao) BatchGetSpecs(dir string) ([]*bundle.Spec, error) {
+	specs := []*bundle.Spec{}
+	err := d.query(`SELECT data FROM specs ORDER BY id`, func(data string) error {
+		spec := &bundle.Spec{}
+		if _, err := types.DecodeRecord(types.SpecRecord, data, spec); err != nil {
+			return err
+		}
+		specs = append(specs, spec)
+		return nil
+	})
+	return specs, err
+}
+
+// BatchGetBundleInstances - get list of bundleinstances
+func (d *Dao) BatchGetBundleInstances() ([]*bundle.ServiceInstance, error) {
+	instances := []*bundle.ServiceInstance{}
+	err := d.query(`SELECT data FROM service_instances ORDER BY id`, func(data string) error {
+		si := &bundle.ServiceInstance{}
+		if _, err := types.DecodeRecord(types.ServiceInstanceRecord, data, si); err != nil {
+			return err
+		}
+		instances = append(instances, si)
+		return nil
+	})
+	return instances, err
+}
+
+// BatchDeleteSpecs - delete the specs in one transaction.
+func (d *Dao) BatchDeleteSpecs(specs []*bundle.Spec) error {
+	return d.transaction(func(tx *sql.Tx) error {
+		for _, spec := range specs {
+			if err := d.exec(tx, `DELETE FROM specs WHERE id = ?`, spec.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FindJobStateByState - Retrieve all the jobs that match the specified state
+func (d *Dao) FindJobStateByState(state bundle.State) ([]bundle.RecoverStatus, error) {
+	rows, err := d.db.Query(d.dialect.rebind(
+		`SELECT id, data FROM job_states WHERE state = ? ORDER BY updated_at`), string(state))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	statuses := []bundle.RecoverStatus{}
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		js := bundle.JobState{}
+		if _, err := types.DecodeRecord(types.JobStateRecord, data, &js); err != nil {
+			log.Warningf("Error processing jobstate record %s, moving on to next. %v", id, err)
+			continue
+		}
+		statuses = append(statuses, bundle.RecoverStatus{InstanceID: uuid.Parse(id), State: js})
+	}
+	return statuses, rows.Err()
+}
+
+// GetSvcInstJobsByState - Lookup all jobs of a given state for a specific instance
+func (d *Dao) GetSvcInstJobsByState(instanceID string, state bundle.State) ([]bundle.JobState, error) {
+	jobs := []bundle.JobState{}
+	err := d.query(`SELECT data FROM job_states WHERE id = ? AND state = ? ORDER BY updated_at`,
+		func(data string) error {
+			js := bundle.JobState{}
+			if _, err := types.DecodeRecord(types.JobStateRecord, data, &js); err != nil {
+				return err
+			}
+			jobs = append(jobs, js)
+			return nil
+		}, instanceID, string(state))
+	return jobs, err
+}
+
+// GetServiceInstance - Retrieve specific service instance from the service_instances table.
+func (d *Dao) GetServiceInstance(id string) (*bundle.ServiceInstance, error) {
+	si := &bundle.ServiceInstance{}
+	if err := d.getObject(types.ServiceInstanceRecord, `SELECT data FROM service_instances WHERE id = ?`, si, id); err != nil {
+		return nil, err
+	}
+	return si, nil
+}
+
+// GetServiceInstanceVersion - Retrieve specific service instance from the
+// service_instances table along with its version.
+func (d *Dao) GetServiceInstanceVersion(id string) (*bundle.ServiceInstance, types.Version, error) {
+	si := &bundle.ServiceInstance{}
+	version, err := d.getObjectVersion(types.ServiceInstanceRecord, `SELECT data, version FROM service_instances WHERE id = ?`, si, id)
+	if err != nil {
+		return nil, types.NoVersion, err
+	}
+	return si, version, nil
+}
+
+// SetServiceInstance - Set service instance for an id in the service_instances table.
+func (d *Dao) SetServiceInstance(id string, serviceInstance *bundle.ServiceInstance) error {
+	data, specID, namespace, err := serviceInstanceColumns(serviceInstance)
+	if err != nil {
+		return err
+	}
+	return d.exec(d.db, `INSERT INTO service_instances (id, spec_id, namespace, data, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET spec_id = excluded.spec_id, namespace = excluded.namespace,
+			data = excluded.data, version = service_instances.version + 1`,
+		id, specID, namespace, data, time.Now().UTC())
+}
+
+// SetServiceInstanceIf - Set service instance for an id in the
+// service_instances table if it is still at the version.
+func (d *Dao) SetServiceInstanceIf(
+	id string, serviceInstance *bundle.ServiceInstance, version types.Version,
+) (types.Version, error) {
+	data, specID, namespace, err := serviceInstanceColumns(serviceInstance)
+	if err != nil {
+		return types.NoVersion, err
+	}
+	conflict := types.ConflictError{Kind: "service instance", ID: id}
+	if version == types.NoVersion {
+		return d.insertIf(conflict, `INSERT INTO service_instances (id, spec_id, namespace, data, created_at)
+			VALUES (?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`, id, specID, namespace, data, time.Now().UTC())
+	}
+	return d.updateIf(conflict, version, `UPDATE service_instances
+		SET spec_id = ?, namespace = ?, data = ?, version = version + 1
+		WHERE id = ? AND version = ?`, specID, namespace, data, id)
+}
+
+// serviceInstanceColumns - the data, spec_id and namespace columns of a
+// service instance.
+func serviceInstanceColumns(si *bundle.ServiceInstance) (string, string, string, error) {
+	data, err := types.EncodeRecord(types.ServiceInstanceRecord, si)
+	if err != nil {
+		return "", "", "", err
+	}
+	specID, namespace := "", ""
+	if si.Spec != nil {
+		specID = si.Spec.ID
+	}
+	if si.Context != nil {
+		namespace = si.Context.Namespace
+	}
+	return data, specID, namespace, nil
+}
+
+// ListServiceInstances - Retrieve a page of the service instances matching
+// the filter, ordered by id. The plan is not a column, it is filtered on once
+// the rows are read.
+func (d *Dao) ListServiceInstances(
+	filter types.ServiceInstanceFilter, page types.Page,
+) (types.ServiceInstancePage, error) {
+	result := types.ServiceInstancePage{ServiceInstances: []*bundle.ServiceInstance{}}
+	query, args := `SELECT id, data, created_at FROM service_instances WHERE id > ?`, []interface{}{page.Cursor}
+	for _, column := range []struct {
+		condition string
+		value     string
+	}{
+		{` AND namespace = ?`, filter.Namespace},
+		{` AND spec_id = ?`, filter.SpecID},
+	} {
+		if column.value != "" {
+			query, args = query+column.condition, append(args, column.value)
+		}
+	}
+	if !filter.CreatedAfter.IsZero() {
+		query, args = query+` AND created_at > ?`, append(args, filter.CreatedAfter.UTC())
+	}
+	if !filter.CreatedBefore.IsZero() {
+		query, args = query+` AND created_at < ?`, append(args, filter.CreatedBefore.UTC())
+	}
+	rows, err := d.db.Query(d.dialect.rebind(query+` ORDER BY id`), args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	// the cursor is applied by the query, in the order of the database
+	pager := types.NewPager(types.Page{Limit: page.Limit})
+	for rows.Next() && !pager.Full() {
+		var id, data string
+		var created nullTime
+		if err := rows.Scan(&id, &data, &created); err != nil {
+			return types.ServiceInstancePage{}, err
+		}
+		si := &bundle.ServiceInstance{}
+		if _, err := types.DecodeRecord(types.ServiceInstanceRecord, data, si); err != nil {
+			return types.ServiceInstancePage{}, err
+		}
+		if filter.Match(si, created.Time) && pager.Take(id) {
+			result.ServiceInstances = append(result.ServiceInstances, si)
+		}
+	}
+	result.Next = pager.Next
+	return result, rows.Err()
+}
+
+// DeleteServiceInstance - Delete the service instance for an service instance id.
+func (d *Dao) DeleteServiceInstance(id string) error {
+	log.Debugf("Dao::DeleteServiceInstance -> [ %s ]", id)
+	return d.delete(`DELETE FROM service_instances WHERE id = ?`, id)
+}
+
+// GetBindInstance - Retrieve a specific bind instance from the bind_instances table.
+func (d *Dao) GetBindInstance(id string) (*bundle.BindInstance, error) {
+	bi := &bundle.BindInstance{}
+	if err := d.getObject(types.BindInstanceRecord, `SELECT data FROM bind_instances WHERE id = ?`, bi, id); err != nil {
+		return nil, err
+	}
+	return bi, nil
+}
+
+// SetBindInstance - Set the bind instance for id in the bind_instances table.
+func (d *Dao) SetBindInstance(id string, bindInstance *bundle.BindInstance) error {
+	data, err := types.EncodeRecord(types.BindInstanceRecord, bindInstance)
+	if err != nil {
+		return err
+	}
+	return d.exec(d.db, `INSERT INTO bind_instances (id, instance_id, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET instance_id = excluded.instance_id, data = excluded.data`,
+		id, bindInstance.ServiceID.String(), data)
+}
+
+// DeleteBindInstance - Delete the binding instance for an id in the bind_instances table.
+func (d *Dao) DeleteBindInstance(id string) error {
+	log.Debugf("Dao::DeleteBindInstance -> [ %s ]", id)
+	return d.delete(`DELETE FROM bind_instances WHERE id = ?`, id)
+}
+
+// DeleteBinding - Delete the binding instance and remove the association with
+// the latest version of the service instance.
+func (d *Dao) DeleteBinding(bindingInstance bundle.BindInstance, serviceInstance bundle.ServiceInstance) error {
+	if err := d.DeleteBindInstance(bindingInstance.ID.String()); err != nil {
+		return err
+	}
+	return types.UpdateServiceInstance(d, serviceInstance.ID.String(), func(si *bundle.ServiceInstance) error {
+		si.RemoveBinding(bindingInstance.ID)
+		return nil
+	})
+}
+
+// SetState - Set the Job State in the job_states table for id. Returns the
+// key of the state, in the format of the etcd dao.
+func (d *Dao) SetState(id string, state bundle.JobState) (string, error) {
+	data, err := types.EncodeRecord(types.JobStateRecord, state)
+	if err != nil {
+		return "", err
+	}
+	err = d.exec(d.db, `INSERT INTO job_states (id, token, state, method, podname, data, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id, token) DO UPDATE SET state = excluded.state, method = excluded.method,
+			podname = excluded.podname, data = excluded.data, updated_at = excluded.updated_at,
+			version = job_states.version + 1`,
+		id, state.Token, string(state.State), string(state.Method), state.Podname, data, time.Now().UTC())
+	return stateKey(id, state.Token), err
+}
+
+// SetStateIf - Set the Job State in the job_states table for id if it is
+// still at the version.
+func (d *Dao) SetStateIf(id string, state bundle.JobState, version types.Version) (string, types.Version, error) {
+	key := stateKey(id, state.Token)
+	data, err := types.EncodeRecord(types.JobStateRecord, state)
+	if err != nil {
+		return key, types.NoVersion, err
+	}
+	conflict := types.ConflictError{Kind: "job state", ID: key}
+	if version == types.NoVersion {
+		newVersion, err := d.insertIf(conflict, `INSERT INTO job_states
+			(id, token, state, method, podname, data, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id, token) DO NOTHING`,
+			id, state.Token, string(state.State), string(state.Method), state.Podname, data, time.Now().UTC())
+		return key, newVersion, err
+	}
+	newVersion, err := d.updateIf(conflict, version, `UPDATE job_states
+		SET state = ?, method = ?, podname = ?, data = ?, updated_at = ?, version = version + 1
+		WHERE id = ? AND token = ? AND version = ?`,
+		string(state.State), string(state.Method), state.Podname, data, time.Now().UTC(), id, state.Token)
+	return key, newVersion, err
+}
+
+// ListJobStates - Retrieve a page of the job states matching the filter,
+// ordered by instance or binding id and token.
+func (d *Dao) ListJobStates(filter types.JobStateFilter, page types.Page) (types.JobStatePage, error) {
+	result := types.JobStatePage{JobStates: []bundle.RecoverStatus{}}
+	query, args := `SELECT id, token, data FROM job_states WHERE 1 = 1`, []interface{}{}
+	if page.Cursor != "" {
+		parts := strings.SplitN(page.Cursor, "/", 2)
+		if len(parts) != 2 {
+			return result, fmt.Errorf("invalid job state cursor %q", page.Cursor)
+		}
+		query, args = query+` AND (id > ? OR (id = ? AND token > ?))`, append(args, parts[0], parts[0], parts[1])
+	}
+	for _, column := range []struct {
+		condition string
+		value     string
+	}{
+		{` AND id = ?`, filter.ID},
+		{` AND state = ?`, string(filter.State)},
+		{` AND method = ?`, string(filter.Method)},
+	} {
+		if column.value != "" {
+			query, args = query+column.condition, append(args, column.value)
+		}
+	}
+	rows, err := d.db.Query(d.dialect.rebind(query+` ORDER BY id, token`), args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	// the cursor is applied by the query, in the order of the database
+	pager := types.NewPager(types.Page{Limit: page.Limit})
+	for rows.Next() && !pager.Full() {
+		var id, token, data string
+		if err := rows.Scan(&id, &token, &data); err != nil {
+			return types.JobStatePage{}, err
+		}
+		js := bundle.JobState{}
+		if _, err := types.DecodeRecord(types.JobStateRecord, data, &js); err != nil {
+			log.Warningf("Error processing jobstate record %s, moving on to next. %v", stateKey(id, token), err)
+			continue
+		}
+		if pager.Take(types.JobStateCursor(id, token)) {
+			result.JobStates = append(result.JobStates, bundle.RecoverStatus{InstanceID: uuid.Parse(id), State: js})
+		}
+	}
+	result.Next = pager.Next
+	return result, rows.Err()
+}
+
+// GetState - Retrieve a job state from the job_states table for an ID and Token.
+func (d *Dao) GetState(id string, token string) (bundle.JobState, error) {
+	state := bundle.JobState{}
+	if err := d.getObject(types.JobStateRecord, `SELECT data FROM job_states WHERE id = ? AND token = ?`, &state, id, token); err != nil {
+		return bundle.JobState{State: bundle.StateFailed}, err
+	}
+	return state, nil
+}
+
+// GetStateVersion - Retrieve a job state from the job_states table for an ID
+// and Token along with its version.
+func (d *Dao) GetStateVersion(id string, token string) (bundle.JobState, types.Version, error) {
+	state := bundle.JobState{}
+	version, err := d.getObjectVersion(types.JobStateRecord, `SELECT data, version FROM job_states WHERE id = ? AND token = ?`,
+		&state, id, token)
+	if err != nil {
+		return bundle.JobState{State: bundle.StateFailed}, types.NoVersion, err
+	}
+	return state, version, nil
+}
+
+// GetStateByKey - Retrieve a job state for a job key, in the format of the
+// etcd dao: /state/<id>/job/<token>.
+func (d *Dao) GetStateByKey(key string) (bundle.JobState, error) {
+	parts := strings.Split(strings.TrimPrefix(key, "/state/"), "/job/")
+	if len(parts) != 2 {
+		return bundle.JobState{State: bundle.StateFailed}, fmt.Errorf("invalid job state key %q", key)
+	}
+	return d.GetState(parts[0], parts[1])
+}
+
+// SetDeadLetter - Create or update a dead letter in the dead_letters table.
+func (d *Dao) SetDeadLetter(letter *types.DeadLetter) error {
+	data, err := types.EncodeRecord(types.DeadLetterRecord, letter)
+	if err != nil {
+		return err
+	}
+	return d.exec(d.db, `INSERT INTO dead_letters (id, data) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data`, letter.ID, data)
+}
+
+// GetDeadLetter - Retrieve a dead letter from the dead_letters table.
+func (d *Dao) GetDeadLetter(id string) (*types.DeadLetter, error) {
+	letter := &types.DeadLetter{}
+	if err := d.getObject(types.DeadLetterRecord, `SELECT data FROM dead_letters WHERE id = ?`, letter, id); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+// BatchGetDeadLetters - Retrieve all the dead letters from the dead_letters table.
+func (d *Dao) BatchGetDeadLetters() ([]*types.DeadLetter, error) {
+	letters := []*types.DeadLetter{}
+	err := d.query(`SELECT data FROM dead_letters ORDER BY id`, func(data string) error {
+		letter := &types.DeadLetter{}
+		if _, err := types.DecodeRecord(types.DeadLetterRecord, data, letter); err != nil {
+			return err
+		}
+		letters = append(letters, letter)
+		return nil
+	})
+	return letters, err
+}
+
+// DeleteDeadLetter - Delete the dead letter for an id in the dead_letters table.
+func (d *Dao) DeleteDeadLetter(id string) error {
+	log.Debugf("Dao::DeleteDeadLetter -> [ %s ]", id)
+	return d.delete(`DELETE FROM dead_letters WHERE id = ?`, id)
+}
+
+// recordTables - the tables of records and the columns of their keys.
+var recordTables = []struct {
+	kind types.RecordKind
+	name string
+	keys []string
+}{
+	{types.SpecRecord, "specs", []string{"id"}},
+	{types.ServiceInstanceRecord, "service_instances", []string{"id"}},
+	{types.BindInstanceRecord, "bind_instances", []string{"id"}},
+	{types.JobStateRecord, "job_states", []string{"id", "token"}},
+	{types.DeadLetterRecord, "dead_letters", []string{"id"}},
+}
+
+// RewriteOutdatedRecords - rewrites the records stored with an older schema
+// version with the current one, unless they are written in the meantime. The
+// version column is left alone, the record does not change for the broker.
+func (d *Dao) RewriteOutdatedRecords() (int, error) {
+	rewritten := 0
+	for _, table := range recordTables {
+		type outdated struct {
+			keys          []interface{}
+			data, payload string
+		}
+		records := []outdated{}
+		rows, err := d.db.Query(fmt.Sprintf(`SELECT %s, data FROM %s`, strings.Join(table.keys, ", "), table.name))
+		if err != nil {
+			return rewritten, err
+		}
+		for rows.Next() {
+			keys := make([]string, len(table.keys))
+			dest := []interface{}{}
+			for i := range keys {
+				dest = append(dest, &keys[i])
+			}
+			var data string
+			if err := rows.Scan(append(dest, &data)...); err != nil {
+				rows.Close()
+				return rewritten, err
+			}
+			payload, ok, err := types.RewriteRecord(table.kind, data)
+			if err != nil {
+				log.Warningf("unable to rewrite record %s %s - %v", table.kind, strings.Join(keys, "/"), err)
+				continue
+			}
+			if ok {
+				rec := outdated{data: data, payload: payload}
+				for _, key := range keys {
+					rec.keys = append(rec.keys, key)
+				}
+				records = append(records, rec)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return rewritten, err
+		}
+
+		where := []string{}
+		for _, key := range table.keys {
+			where = append(where, key+" = ?")
+		}
+		query := fmt.Sprintf(`UPDATE %s SET data = ? WHERE %s AND data = ?`, table.name, strings.Join(where, " AND "))
+		for _, rec := range records {
+			args := append(append([]interface{}{rec.payload}, rec.keys...), rec.data)
+			err := d.execRow(d.db, query, args...)
+			if err == sql.ErrNoRows {
+				// written with the current schema version in the meantime
+				continue
+			}
+			if err != nil {
+				return rewritten, err
+			}
+			rewritten++
+		}
+	}
+	return rewritten, nil
+}
+
+// IsNotFoundError - Will determine if an error is a row not found error.
+func (d *Dao) IsNotFoundError(err error) bool {
+	return err == sql.ErrNoRows
+}
+
+// execer - a database or a transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (d *Dao) exec(e execer, query string, args ...interface{}) error {
+	_, err := e.Exec(d.dialect.rebind(query), args...)
+	return err
+}
+
+// delete - runs the delete statement, sql.ErrNoRows if it deleted nothing.
+func (d *Dao) delete(query string, args ...interface{}) error {
+	return d.execRow(d.db, query, args...)
+}
+
+// execRow - runs the statement, sql.ErrNoRows if it affected no row.
+func (d *Dao) execRow(e execer, query string, args ...interface{}) error {
+	res, err := e.Exec(d.dialect.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *Dao) getObject(kind types.RecordKind, query string, obj interface{}, args ...interface{}) error {
+	var data string
+	if err := d.db.QueryRow(d.dialect.rebind(query), args...).Scan(&data); err != nil {
+		return err
+	}
+	_, err := types.DecodeRecord(kind, data, obj)
+	return err
+}
+
+func (d *Dao) getObjectVersion(
+	kind types.RecordKind, query string, obj interface{}, args ...interface{},
+) (types.Version, error) {
+	var data string
+	var version int64
+	if err := d.db.QueryRow(d.dialect.rebind(query), args...).Scan(&data, &version); err != nil {
+		return types.NoVersion, err
+	}
+	if _, err := types.DecodeRecord(kind, data, obj); err != nil {
+		return types.NoVersion, err
+	}
+	return types.Version(strconv.FormatInt(version, 10)), nil
+}
+
+// insertIf - runs the insert statement, which must do nothing for an existing
+// row, the conflict if it inserted nothing.
+func (d *Dao) insertIf(conflict error, query string, args ...interface{}) (types.Version, error) {
+	if err := d.execRow(d.db, query, args...); err == sql.ErrNoRows {
+		return types.NoVersion, conflict
+	} else if err != nil {
+		return types.NoVersion, err
+	}
+	return types.Version("1"), nil
+}
+
+// updateIf - runs the update statement with the version appended to its
+// arguments, the conflict if it updated nothing.
+func (d *Dao) updateIf(conflict error, version types.Version, query string, args ...interface{}) (types.Version, error) {
+	current, err := strconv.ParseInt(string(version), 10, 64)
+	if err != nil {
+		return types.NoVersion, fmt.Errorf("invalid version %q - %v", version, err)
+	}
+	if err := d.execRow(d.db, query, append(args, current)...); err == sql.ErrNoRows {
+		return types.NoVersion, conflict
+	} else if err != nil {
+		return types.NoVersion, err
+	}
+	return types.Version(strconv.FormatInt(current+1, 10)), nil
+}
+
+// query - calls fn with the data column of every row of the query.
+func (d *Dao) query(query string, fn func(data string) error, args ...interface{}) error {
+	rows, err := d.db.Query(d.dialect.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (d *Dao) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// nullTime - a nullable timestamp column, zero when null.
+type nullTime struct {
+	Time time.Time
+}
+
+// Scan - implements sql.Scanner.
+func (t *nullTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = v
+	default:
+		return fmt.Errorf("cannot scan %T into a timestamp", value)
+	}
+	return nil
+}
+
+func stateKey(id string, token string) string {
+	return fmt.Sprintf("/state/%s/job/%s", id, token)
+}
@@ -0,0 +1,40 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//go:build sqlite
+// +build sqlite
+
+package dao_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/openshift/ansible-service-broker/pkg/dao/daotest"
+	sqldao "github.com/openshift/ansible-service-broker/pkg/dao/sql"
+)
+
+func TestConformance(t *testing.T) {
+	daotest.RunConformance(t, func(t *testing.T) dao.Dao {
+		d, err := sqldao.NewDao("sqlite3", filepath.Join(t.TempDir(), "broker.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	})
+}
@@ -0,0 +1,63 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dialect - what differs between the supported databases. Queries are written
+// with ? placeholders and rebound for the database.
+type dialect struct {
+	name string
+	// numbered - placeholders are numbered, $1, $2... instead of ?
+	numbered bool
+}
+
+var dialects = map[string]dialect{
+	"sqlite3":  {name: "sqlite3"},
+	"postgres": {name: "postgres", numbered: true},
+}
+
+// dialectFor - the dialect of a database/sql driver.
+func dialectFor(driver string) (dialect, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return dialect{}, fmt.Errorf("unsupported sql driver %q", driver)
+	}
+	return d, nil
+}
+
+// rebind - replaces the ? placeholders of the query with the ones of the
+// database.
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	b := strings.Builder{}
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
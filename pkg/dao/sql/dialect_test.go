@@ -0,0 +1,60 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao
+
+import (
+	"testing"
+
+	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
+)
+
+func TestDialectFor(t *testing.T) {
+	d, err := dialectFor("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft.AssertEqual(t, d.name, "postgres")
+	ft.AssertTrue(t, d.numbered)
+
+	_, err = dialectFor("mysql")
+	ft.AssertNotNil(t, err)
+}
+
+func TestRebind(t *testing.T) {
+	query := `UPDATE job_states SET state = ? WHERE id = ? AND token = ?`
+	testCases := []struct {
+		name     string
+		dialect  dialect
+		expected string
+	}{
+		{
+			name:     "sqlite keeps the placeholders",
+			dialect:  dialects["sqlite3"],
+			expected: query,
+		},
+		{
+			name:     "postgres numbers the placeholders",
+			dialect:  dialects["postgres"],
+			expected: `UPDATE job_states SET state = $1 WHERE id = $2 AND token = $3`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ft.AssertEqual(t, tc.dialect.rebind(query), tc.expected)
+		})
+	}
+}
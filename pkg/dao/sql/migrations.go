@@ -0,0 +1,148 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package dao
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migration - a versioned change of the schema. Migrations are applied in
+// order, each in its own transaction, and are never changed once released:
+// a new migration is added instead.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// migrations - the schema of the dao. The statements must work with every
+// supported database.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create the tables of specs, instances, bindings, job states and dead letters",
+		statements: []string{
+			`CREATE TABLE specs (
+				id VARCHAR(255) PRIMARY KEY,
+				fq_name VARCHAR(255) NOT NULL,
+				data TEXT NOT NULL
+			)`,
+			`CREATE TABLE service_instances (
+				id VARCHAR(64) PRIMARY KEY,
+				spec_id VARCHAR(255) NOT NULL,
+				namespace VARCHAR(255) NOT NULL,
+				data TEXT NOT NULL
+			)`,
+			`CREATE INDEX service_instances_spec_id ON service_instances (spec_id)`,
+			`CREATE TABLE bind_instances (
+				id VARCHAR(64) PRIMARY KEY,
+				instance_id VARCHAR(64) NOT NULL,
+				data TEXT NOT NULL
+			)`,
+			`CREATE INDEX bind_instances_instance_id ON bind_instances (instance_id)`,
+			`CREATE TABLE job_states (
+				id VARCHAR(64) NOT NULL,
+				token VARCHAR(64) NOT NULL,
+				state VARCHAR(32) NOT NULL,
+				method VARCHAR(32) NOT NULL,
+				podname VARCHAR(255) NOT NULL,
+				data TEXT NOT NULL,
+				updated_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (id, token)
+			)`,
+			`CREATE INDEX job_states_state ON job_states (state)`,
+			`CREATE INDEX job_states_method ON job_states (method)`,
+			`CREATE TABLE dead_letters (
+				id VARCHAR(64) PRIMARY KEY,
+				data TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		version:     2,
+		description: "version the service instances and job states for conditional writes",
+		statements: []string{
+			`ALTER TABLE service_instances ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+			`ALTER TABLE job_states ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+		},
+	},
+	{
+		version:     3,
+		description: "record when service instances are created and index their namespace for listing",
+		statements: []string{
+			`ALTER TABLE service_instances ADD COLUMN created_at TIMESTAMP`,
+			`CREATE INDEX service_instances_namespace ON service_instances (namespace)`,
+		},
+	},
+}
+
+// migrate - applies the migrations newer than the version of the schema.
+func migrate(db *sql.DB, d dialect) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("unable to create the schema_migrations table - %v", err)
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		log.Infof("applying schema migration %d: %s", m.version, m.description)
+		if err := apply(db, d, m); err != nil {
+			return fmt.Errorf("schema migration %d failed - %v", m.version, err)
+		}
+	}
+	return nil
+}
+
+// schemaVersion - the version of the last migration applied, zero if none.
+func schemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("unable to read the schema version - %v", err)
+	}
+	return int(version.Int64), nil
+}
+
+func apply(db *sql.DB, d dialect, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range m.statements {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(d.rebind(`INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`),
+		m.version, m.description, time.Now().UTC()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
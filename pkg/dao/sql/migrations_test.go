@@ -0,0 +1,90 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//go:build sqlite
+// +build sqlite
+
+package dao
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "broker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Migrating twice only applies the migrations once.
+	for i := 0; i < 2; i++ {
+		if err := migrate(db, dialects["sqlite3"]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft.AssertEqual(t, version, migrations[len(migrations)-1].version)
+
+	var applied int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	ft.AssertEqual(t, applied, len(migrations))
+
+	for _, table := range []string{"specs", "service_instances", "bind_instances", "job_states", "dead_letters"} {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			t.Errorf("table %s was not created - %v", table, err)
+		}
+	}
+}
+
+func TestMigrateFromVersion(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "broker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(db, dialects["sqlite3"], migrations[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrate(db, dialects["sqlite3"]); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM service_instances WHERE version = 1 AND created_at IS NULL`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	ft.AssertEqual(t, n, 0)
+}
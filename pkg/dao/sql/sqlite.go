@@ -0,0 +1,24 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//go:build sqlite
+// +build sqlite
+
+package dao
+
+// Registers the SQLite driver with database/sql. The driver needs cgo and is
+// not vendored, it is only built in with the sqlite tag.
+import _ "github.com/mattn/go-sqlite3"
@@ -0,0 +1,37 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// DeadLetter - a job message that could not be delivered to a work
+// subscriber. It is kept until it is delivered by a retry or a replay.
+type DeadLetter struct {
+	ID           string `json:"id"`
+	SubscriberID string `json:"subscriber_id"`
+	Topic        string `json:"topic"`
+	JobToken     string `json:"job_token"`
+	// the JSON encoded job message
+	Payload     json.RawMessage `json:"payload"`
+	Error       string          `json:"error"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   time.Time       `json:"created_at"`
+	NextAttempt time.Time       `json:"next_attempt"`
+}
@@ -0,0 +1,211 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package types
+
+import (
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+)
+
+// PlanParameterKey - the parameter of a service instance holding the name of
+// its plan.
+const PlanParameterKey = "_apb_plan_id"
+
+// ServiceInstanceFilter - the service instances a list returns. Empty fields
+// match every instance.
+type ServiceInstanceFilter struct {
+	Namespace string
+	SpecID    string
+	// Plan - the name of the plan.
+	Plan string
+	// CreatedAfter and CreatedBefore bound the time the dao created the
+	// instance at. Instances whose creation time the dao does not know, e.g.
+	// saved by an older broker, never match a bound.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// Match - true if the instance, created at the given time, is listed.
+func (f ServiceInstanceFilter) Match(si *bundle.ServiceInstance, created time.Time) bool {
+	if si == nil {
+		return false
+	}
+	if f.Namespace != "" && (si.Context == nil || si.Context.Namespace != f.Namespace) {
+		return false
+	}
+	if f.SpecID != "" && (si.Spec == nil || si.Spec.ID != f.SpecID) {
+		return false
+	}
+	if f.Plan != "" && Plan(si) != f.Plan {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && (created.IsZero() || !created.After(f.CreatedAfter)) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && (created.IsZero() || !created.Before(f.CreatedBefore)) {
+		return false
+	}
+	return true
+}
+
+// Plan - the name of the plan of the instance.
+func Plan(si *bundle.ServiceInstance) string {
+	if si.Parameters == nil {
+		return ""
+	}
+	plan, _ := (*si.Parameters)[PlanParameterKey].(string)
+	return plan
+}
+
+// JobStateFilter - the job states a list returns. Empty fields match every
+// job state.
+type JobStateFilter struct {
+	// ID - the instance or binding the jobs ran for.
+	ID     string
+	State  bundle.State
+	Method bundle.JobMethod
+}
+
+// Match - true if the job state of the instance or binding id is listed.
+func (f JobStateFilter) Match(id string, js bundle.JobState) bool {
+	return (f.ID == "" || f.ID == id) &&
+		(f.State == "" || f.State == js.State) &&
+		(f.Method == "" || f.Method == js.Method)
+}
+
+// JobStateCursor - the cursor of a job state, job states are listed in the
+// order of their cursor.
+func JobStateCursor(id string, token string) string {
+	return id + "/" + token
+}
+
+// Page - the part of a list to return. The first page has no cursor, the
+// next ones the cursor returned with the previous page. A zero limit returns
+// everything after the cursor.
+type Page struct {
+	Cursor string
+	Limit  int
+}
+
+// ServiceInstancePage - a page of service instances, ordered by id. Next is
+// the cursor of the next page, empty for the last one.
+type ServiceInstancePage struct {
+	ServiceInstances []*bundle.ServiceInstance
+	Next             string
+}
+
+// JobStatePage - a page of job states, ordered by their JobStateCursor. Next
+// is the cursor of the next page, empty for the last one.
+type JobStatePage struct {
+	JobStates []bundle.RecoverStatus
+	Next      string
+}
+
+// Pager - builds a page out of the matching records, visited in the order of
+// their cursor.
+type Pager struct {
+	page  Page
+	count int
+	last  string
+	// Next - the cursor of the next page, once the page is full.
+	Next string
+}
+
+// NewPager - a pager for the page.
+func NewPager(page Page) *Pager {
+	return &Pager{page: page}
+}
+
+// Take - true if the record with the cursor belongs to the page. Once the
+// page is full, the next record sets the cursor of the next page.
+func (p *Pager) Take(cursor string) bool {
+	if p.Full() || (p.page.Cursor != "" && cursor <= p.page.Cursor) {
+		return false
+	}
+	if p.page.Limit > 0 && p.count == p.page.Limit {
+		p.Next = p.last
+		return false
+	}
+	p.count++
+	p.last = cursor
+	return true
+}
+
+// Full - true once a record past the page was visited, the rest of the
+// records need not be visited.
+func (p *Pager) Full() bool {
+	return p.Next != ""
+}
+
+// ServiceInstanceLister - lists the service instances.
+type ServiceInstanceLister interface {
+	ListServiceInstances(filter ServiceInstanceFilter, page Page) (ServiceInstancePage, error)
+}
+
+// JobStateLister - lists the job states.
+type JobStateLister interface {
+	ListJobStates(filter JobStateFilter, page Page) (JobStatePage, error)
+}
+
+// JobStateWalker - a JobStateLister which reads every job state at once for
+// each page, and lists them all in one go instead.
+type JobStateWalker interface {
+	JobStateLister
+	// AllJobStates - every job state matching the filter, ordered as
+	// ListJobStates orders them.
+	AllJobStates(filter JobStateFilter) ([]bundle.RecoverStatus, error)
+}
+
+// AllJobStates - every job state matching the filter, listed a page of the
+// given size at a time, or at once by a JobStateWalker.
+func AllJobStates(d JobStateLister, filter JobStateFilter, pageSize int) ([]bundle.RecoverStatus, error) {
+	if w, ok := d.(JobStateWalker); ok {
+		return w.AllJobStates(filter)
+	}
+	statuses := []bundle.RecoverStatus{}
+	page := Page{Limit: pageSize}
+	for {
+		p, err := d.ListJobStates(filter, page)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, p.JobStates...)
+		if p.Next == "" {
+			return statuses, nil
+		}
+		page.Cursor = p.Next
+	}
+}
+
+// AllServiceInstances - every service instance matching the filter, listed a
+// page of the given size at a time.
+func AllServiceInstances(d ServiceInstanceLister, filter ServiceInstanceFilter, pageSize int) ([]*bundle.ServiceInstance, error) {
+	instances := []*bundle.ServiceInstance{}
+	page := Page{Limit: pageSize}
+	for {
+		p, err := d.ListServiceInstances(filter, page)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, p.ServiceInstances...)
+		if p.Next == "" {
+			return instances, nil
+		}
+		page.Cursor = p.Next
+	}
+}
@@ -0,0 +1,244 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// RecordKind - a kind of persisted record, each has its own schema version.
+type RecordKind string
+
+const (
+	// SpecRecord - a bundle.Spec.
+	SpecRecord RecordKind = "spec"
+	// ServiceInstanceRecord - a bundle.ServiceInstance.
+	ServiceInstanceRecord RecordKind = "service_instance"
+	// BindInstanceRecord - a bundle.BindInstance.
+	BindInstanceRecord RecordKind = "bind_instance"
+	// JobStateRecord - a bundle.JobState.
+	JobStateRecord RecordKind = "job_state"
+	// DeadLetterRecord - a DeadLetter.
+	DeadLetterRecord RecordKind = "dead_letter"
+)
+
+// SchemaVersionField - the field of a stored record holding the version of
+// its schema. The records stored before it existed are version 1.
+const SchemaVersionField = "schema_version"
+
+// Upgrade - upgrades a record, decoded as a JSON object, from the version
+// before the one it is registered for.
+type Upgrade func(record map[string]interface{}) error
+
+// upgrades - the upgrades of every kind of record, the upgrade to version n
+// at index n-2.
+var upgrades = map[RecordKind][]Upgrade{}
+
+// RegisterUpgrade - registers the upgrade of a kind of record to a version,
+// which becomes the current version of the kind. The upgrades of a kind are
+// registered in order, from init functions. An upgrade is never changed once
+// released, a new one is added instead along with a fixture of the records it
+// upgrades in testdata/schema.
+func RegisterUpgrade(kind RecordKind, version int, upgrade Upgrade) {
+	if version != SchemaVersion(kind)+1 {
+		panic(fmt.Sprintf("upgrade of %s to version %d registered after version %d", kind, version, SchemaVersion(kind)))
+	}
+	upgrades[kind] = append(upgrades[kind], upgrade)
+}
+
+// RegisterTestUpgrade - registers an upgrade of a kind of record to the
+// version after its current one, for a test. The returned function removes
+// the upgrade again, so that the other tests keep the versions of the broker.
+func RegisterTestUpgrade(kind RecordKind, upgrade Upgrade) (unregister func()) {
+	previous := upgrades[kind]
+	RegisterUpgrade(kind, SchemaVersion(kind)+1, upgrade)
+	return func() { upgrades[kind] = previous }
+}
+
+// SchemaVersion - the current schema version of a kind of record.
+func SchemaVersion(kind RecordKind) int {
+	return len(upgrades[kind]) + 1
+}
+
+// SchemaVersionError - a record was stored with a schema version this broker
+// does not know, by a later version of the broker.
+type SchemaVersionError struct {
+	Kind    RecordKind
+	Version int
+}
+
+func (e SchemaVersionError) Error() string {
+	return fmt.Sprintf("%s record has schema version %d, newer than the supported version %d",
+		e.Kind, e.Version, SchemaVersion(e.Kind))
+}
+
+// EncodeRecord - the JSON of a record, with the current schema version of
+// its kind.
+func EncodeRecord(kind RecordKind, record interface{}) (string, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	if len(payload) < 2 || payload[0] != '{' {
+		return "", fmt.Errorf("%s record is not a JSON object", kind)
+	}
+	field := fmt.Sprintf(`{"%s":%d`, SchemaVersionField, SchemaVersion(kind))
+	if bytes.Equal(payload, []byte("{}")) {
+		return field + "}", nil
+	}
+	return field + "," + string(payload[1:]), nil
+}
+
+// StoredSchemaVersion - the schema version a record was stored with.
+func StoredSchemaVersion(payload string) (int, error) {
+	stored := struct {
+		Version *int `json:"schema_version"`
+	}{}
+	if err := json.NewDecoder(strings.NewReader(payload)).Decode(&stored); err != nil {
+		return 0, err
+	}
+	if stored.Version == nil || *stored.Version < 1 {
+		return 1, nil
+	}
+	return *stored.Version, nil
+}
+
+// DecodeRecord - decodes the JSON of a record, upgraded to the current
+// schema version of its kind. Returns the version it was stored with.
+func DecodeRecord(kind RecordKind, payload string, record interface{}) (int, error) {
+	version, err := StoredSchemaVersion(payload)
+	if err != nil {
+		return 0, err
+	}
+	if version == SchemaVersion(kind) {
+		return version, json.Unmarshal([]byte(payload), record)
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return version, err
+	}
+	if err := upgrade(kind, version, fields); err != nil {
+		return version, err
+	}
+	return version, remarshal(fields, record)
+}
+
+// UpgradeRecord - upgrades a decoded record stored with a schema version to
+// the current version of its kind, for the daos that do not store JSON. The
+// record must be a pointer.
+func UpgradeRecord(kind RecordKind, version int, record interface{}) error {
+	if version == SchemaVersion(kind) {
+		return nil
+	}
+	fields := map[string]interface{}{}
+	if err := remarshal(record, &fields); err != nil {
+		return err
+	}
+	if err := upgrade(kind, version, fields); err != nil {
+		return err
+	}
+	// the fields an upgrade drops must not be kept
+	value := reflect.ValueOf(record).Elem()
+	value.Set(reflect.Zero(value.Type()))
+	return remarshal(fields, record)
+}
+
+// upgrade - applies the upgrades of the kind from the version on.
+func upgrade(kind RecordKind, version int, fields map[string]interface{}) error {
+	if version > SchemaVersion(kind) {
+		return SchemaVersionError{Kind: kind, Version: version}
+	}
+	for v := version; v < SchemaVersion(kind); v++ {
+		if err := upgrades[kind][v-1](fields); err != nil {
+			return fmt.Errorf("unable to upgrade %s record to version %d - %v", kind, v+1, err)
+		}
+	}
+	delete(fields, SchemaVersionField)
+	return nil
+}
+
+// remarshal - converts from one representation of a record to another
+// through JSON.
+func remarshal(from interface{}, to interface{}) error {
+	payload, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, to)
+}
+
+// KeyRecordKind - the kind of record stored under a key of the etcd and
+// memory daos, false for the keys that do not hold a record.
+func KeyRecordKind(key string) (RecordKind, bool) {
+	switch {
+	case strings.HasPrefix(key, "/spec/"):
+		return SpecRecord, true
+	case strings.HasPrefix(key, "/service_instance/"):
+		return ServiceInstanceRecord, true
+	case strings.HasPrefix(key, "/bind_instance/"):
+		return BindInstanceRecord, true
+	case strings.HasPrefix(key, "/state/"):
+		return JobStateRecord, true
+	case strings.HasPrefix(key, "/dead_letter/"):
+		return DeadLetterRecord, true
+	}
+	return "", false
+}
+
+// RewriteRecord - the payload of a record stored with an older schema
+// version upgraded to the current one, false if it already is.
+func RewriteRecord(kind RecordKind, payload string) (string, bool, error) {
+	version, err := StoredSchemaVersion(payload)
+	if err != nil {
+		return "", false, err
+	}
+	if version == SchemaVersion(kind) {
+		return payload, false, nil
+	}
+	fields := map[string]interface{}{}
+	if _, err := DecodeRecord(kind, payload, &fields); err != nil {
+		return "", false, err
+	}
+	rewritten, err := EncodeRecord(kind, fields)
+	return rewritten, err == nil, err
+}
+
+// EncodeKeyRecord - EncodeRecord for the record stored under a key of the
+// etcd and memory daos, plain JSON for the keys that do not hold a record.
+func EncodeKeyRecord(key string, record interface{}) (string, error) {
+	kind, ok := KeyRecordKind(key)
+	if !ok {
+		payload, err := json.Marshal(record)
+		return string(payload), err
+	}
+	return EncodeRecord(kind, record)
+}
+
+// DecodeKeyRecord - DecodeRecord for the record stored under a key of the
+// etcd and memory daos, plain JSON for the keys that do not hold a record.
+func DecodeKeyRecord(key string, payload string, record interface{}) error {
+	kind, ok := KeyRecordKind(key)
+	if !ok {
+		return json.Unmarshal([]byte(payload), record)
+	}
+	_, err := DecodeRecord(kind, payload, record)
+	return err
+}
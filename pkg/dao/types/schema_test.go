@@ -0,0 +1,243 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package types
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden records of testdata/schema/current")
+
+// records - a new record of every kind.
+var records = map[RecordKind]func() interface{}{
+	SpecRecord:            func() interface{} { return &bundle.Spec{} },
+	ServiceInstanceRecord: func() interface{} { return &bundle.ServiceInstance{} },
+	BindInstanceRecord:    func() interface{} { return &bundle.BindInstance{} },
+	JobStateRecord:        func() interface{} { return &bundle.JobState{} },
+	DeadLetterRecord:      func() interface{} { return &DeadLetter{} },
+}
+
+// TestOlderRecords - the records stored by every older schema version, kept
+// in testdata/schema/v<version>, decode to the golden records of the current
+// version kept in testdata/schema/current.
+func TestOlderRecords(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/schema/v*/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixture in testdata/schema")
+	}
+	for _, fixture := range fixtures {
+		kind := RecordKind(strings.TrimSuffix(filepath.Base(fixture), ".json"))
+		t.Run(fixture, func(t *testing.T) {
+			newRecord, ok := records[kind]
+			if !ok {
+				t.Fatalf("unknown kind of record %s", kind)
+			}
+			payload, err := ioutil.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record := newRecord()
+			if _, err := DecodeRecord(kind, string(payload), record); err != nil {
+				t.Fatalf("unable to decode - %v", err)
+			}
+			encoded, err := EncodeRecord(kind, record)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", "schema", "current", string(kind)+".json")
+			if *update {
+				if err := ioutil.WriteFile(golden, []byte(encoded+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoded != strings.TrimSpace(string(expected)) {
+				t.Fatalf("%s decoded to\n%s\nexpected\n%s", fixture, encoded, expected)
+			}
+		})
+	}
+}
+
+func TestEncodeRecord(t *testing.T) {
+	payload, err := EncodeRecord(JobStateRecord, bundle.JobState{Token: "token", State: bundle.StateSucceeded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(payload, `{"schema_version":1,"token":"token"`) {
+		t.Fatalf("unexpected payload %s", payload)
+	}
+	version, err := StoredSchemaVersion(payload)
+	if err != nil || version != 1 {
+		t.Fatalf("stored version %d - %v", version, err)
+	}
+
+	payload, err = EncodeRecord("empty", struct{}{})
+	if err != nil || payload != `{"schema_version":1}` {
+		t.Fatalf("unexpected payload %s - %v", payload, err)
+	}
+	if _, err := EncodeRecord("list", []string{}); err == nil {
+		t.Fatal("encoded a record which is not an object")
+	}
+}
+
+type renamed struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+const renamedRecord RecordKind = "test_renamed"
+
+func init() {
+	// version 2 renames the title to the name, version 3 adds the count
+	RegisterUpgrade(renamedRecord, 2, func(record map[string]interface{}) error {
+		record["name"] = record["title"]
+		delete(record, "title")
+		return nil
+	})
+	RegisterUpgrade(renamedRecord, 3, func(record map[string]interface{}) error {
+		if _, ok := record["count"]; !ok {
+			record["count"] = 1
+		}
+		return nil
+	})
+}
+
+func TestDecodeRecordUpgrades(t *testing.T) {
+	testCases := []struct {
+		name     string
+		payload  string
+		version  int
+		expected renamed
+	}{
+		{
+			name:     "unversioned",
+			payload:  `{"title":"one"}`,
+			version:  1,
+			expected: renamed{Name: "one", Count: 1},
+		},
+		{
+			name:     "version 2",
+			payload:  `{"schema_version":2,"name":"two"}`,
+			version:  2,
+			expected: renamed{Name: "two", Count: 1},
+		},
+		{
+			name:     "current",
+			payload:  `{"schema_version":3,"name":"three","count":3}`,
+			version:  3,
+			expected: renamed{Name: "three", Count: 3},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			record := renamed{}
+			version, err := DecodeRecord(renamedRecord, tc.payload, &record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != tc.version {
+				t.Fatalf("stored version %d, expected %d", version, tc.version)
+			}
+			if record != tc.expected {
+				t.Fatalf("decoded %#v, expected %#v", record, tc.expected)
+			}
+		})
+	}
+}
+
+func TestDecodeRecordNewerVersion(t *testing.T) {
+	record := renamed{}
+	_, err := DecodeRecord(renamedRecord, `{"schema_version":4,"name":"four"}`, &record)
+	if _, ok := err.(SchemaVersionError); !ok {
+		t.Fatalf("expected a schema version error, got %v", err)
+	}
+}
+
+func TestUpgradeRecord(t *testing.T) {
+	record := map[string]interface{}{"title": "one"}
+	if err := UpgradeRecord(renamedRecord, 1, &record); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"name": "one", "count": float64(1)}
+	if !reflect.DeepEqual(record, expected) {
+		t.Fatalf("upgraded %#v, expected %#v", record, expected)
+	}
+}
+
+func TestRewriteRecord(t *testing.T) {
+	payload, ok, err := RewriteRecord(renamedRecord, `{"title":"one"}`)
+	if err != nil || !ok {
+		t.Fatalf("not rewritten - %v", err)
+	}
+	if payload != `{"schema_version":3,"count":1,"name":"one"}` {
+		t.Fatalf("unexpected payload %s", payload)
+	}
+	if _, ok, err := RewriteRecord(renamedRecord, payload); err != nil || ok {
+		t.Fatalf("rewrote a current record - %v", err)
+	}
+}
+
+func TestRegisterUpgradeOutOfOrder(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registered an upgrade out of order")
+		}
+	}()
+	RegisterUpgrade(renamedRecord, 5, func(map[string]interface{}) error { return nil })
+}
+
+func TestRegisterTestUpgrade(t *testing.T) {
+	unregister := RegisterTestUpgrade(renamedRecord, func(map[string]interface{}) error { return nil })
+	if version := SchemaVersion(renamedRecord); version != 4 {
+		t.Fatalf("schema version %d with the test upgrade, expected 4", version)
+	}
+	unregister()
+	if version := SchemaVersion(renamedRecord); version != 3 {
+		t.Fatalf("schema version %d after removing the test upgrade, expected 3", version)
+	}
+}
+
+func TestKeyRecordKind(t *testing.T) {
+	testCases := map[string]RecordKind{
+		"/spec/1":                     SpecRecord,
+		"/service_instance/1":         ServiceInstanceRecord,
+		"/bind_instance/1":            BindInstanceRecord,
+		"/state/1/job/2":              JobStateRecord,
+		"/dead_letter/1":              DeadLetterRecord,
+		"/created/service_instance/1": "",
+	}
+	for key, expected := range testCases {
+		kind, ok := KeyRecordKind(key)
+		if kind != expected || ok != (expected != "") {
+			t.Errorf("%s is a %q record, expected %q", key, kind, expected)
+		}
+	}
+}
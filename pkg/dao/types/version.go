@@ -0,0 +1,125 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package types
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	log "github.com/sirupsen/logrus"
+)
+
+// Version - the version of a stored record, it changes with every write of
+// the record. It is opaque to the users of a dao: a resource version for the
+// CRD dao, a modified index for etcd, a counter for the others.
+type Version string
+
+// NoVersion - the version of a record that does not exist. A conditional
+// write with NoVersion only creates the record.
+const NoVersion Version = ""
+
+// ConflictError - a conditional write failed because the record was written
+// since the version the write is based on was read.
+type ConflictError struct {
+	// Kind - the kind of record, e.g. service instance or job state.
+	Kind string
+	ID   string
+}
+
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("%s %s was modified concurrently", e.Kind, e.ID)
+}
+
+// IsConflictError - true if err is a ConflictError.
+func IsConflictError(err error) bool {
+	switch err.(type) {
+	case ConflictError, *ConflictError:
+		return true
+	}
+	return false
+}
+
+// MaxConflictRetries - how many times a read-modify-write cycle is attempted
+// before giving up on conflicts.
+const MaxConflictRetries = 10
+
+// RetryOnConflict - runs the read-modify-write cycle fn again, after a short
+// random delay, for as long as it fails with a ConflictError.
+func RetryOnConflict(fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= MaxConflictRetries; attempt++ {
+		if err = fn(); !IsConflictError(err) {
+			return err
+		}
+		log.Debugf("attempt %d of %d failed - %v", attempt, MaxConflictRetries, err)
+		time.Sleep(time.Duration(rand.Intn(10*attempt)) * time.Millisecond)
+	}
+	return err
+}
+
+// VersionedServiceInstances - the conditional writes of service instances.
+type VersionedServiceInstances interface {
+	GetServiceInstanceVersion(id string) (*bundle.ServiceInstance, Version, error)
+	SetServiceInstanceIf(id string, serviceInstance *bundle.ServiceInstance, version Version) (Version, error)
+}
+
+// UpdateServiceInstance - reads the service instance, applies update to it
+// and saves it unless it was written in the meantime, in which case it is
+// read and updated again.
+func UpdateServiceInstance(
+	d VersionedServiceInstances, id string, update func(*bundle.ServiceInstance) error,
+) error {
+	return RetryOnConflict(func() error {
+		si, version, err := d.GetServiceInstanceVersion(id)
+		if err != nil {
+			return err
+		}
+		if err := update(si); err != nil {
+			return err
+		}
+		_, err = d.SetServiceInstanceIf(id, si, version)
+		return err
+	})
+}
+
+// VersionedJobStates - the conditional writes of job states.
+type VersionedJobStates interface {
+	GetStateVersion(id string, token string) (bundle.JobState, Version, error)
+	SetStateIf(id string, state bundle.JobState, version Version) (string, Version, error)
+	IsNotFoundError(err error) bool
+}
+
+// UpdateState - reads the job state of id with the token, applies update to
+// it and saves it unless it was written in the meantime, in which case it is
+// read and updated again. The job state is created if it does not exist.
+func UpdateState(d VersionedJobStates, id string, token string, update func(*bundle.JobState) error) error {
+	return RetryOnConflict(func() error {
+		state, version, err := d.GetStateVersion(id, token)
+		if d.IsNotFoundError(err) {
+			state, version = bundle.JobState{Token: token}, NoVersion
+		} else if err != nil {
+			return err
+		}
+		if err := update(&state); err != nil {
+			return err
+		}
+		_, _, err = d.SetStateIf(id, state, version)
+		return err
+	})
+}
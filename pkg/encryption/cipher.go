@@ -0,0 +1,241 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// envelopeKey - the only key of the map an encrypted value is stored as.
+const envelopeKey = "$encrypted"
+
+var (
+	// ErrDecrypt - a value could not be decrypted, it was altered or
+	// encrypted with another key of the same id.
+	ErrDecrypt = errors.New("unable to decrypt the value")
+	// ErrNoKey - a value is encrypted but no keyring is configured.
+	ErrNoKey = errors.New("the value is encrypted but no encryption key is configured")
+)
+
+// Cipher - envelope encrypts values. Every value is sealed with a new data
+// key, itself sealed with the primary key of the keyring, so a key rotation
+// only seals the data keys again. A nil Cipher does not encrypt.
+type Cipher struct {
+	keyring *Keyring
+}
+
+// NewCipher - creates a Cipher encrypting with the keys of the keyring.
+func NewCipher(keyring *Keyring) *Cipher {
+	return &Cipher{keyring: keyring}
+}
+
+// envelope - an encrypted value, with the sealed data key and the id of the
+// key that sealed it.
+type envelope struct {
+	keyID string
+	key   []byte
+	data  []byte
+}
+
+// value - the envelope as it is stored in the parameters.
+func (e envelope) value() interface{} {
+	return map[string]interface{}{
+		envelopeKey: map[string]interface{}{
+			"kid":  e.keyID,
+			"key":  base64.StdEncoding.EncodeToString(e.key),
+			"data": base64.StdEncoding.EncodeToString(e.data),
+		},
+	}
+}
+
+// parseEnvelope - returns the envelope of an encrypted value, false if the
+// value is not encrypted.
+func parseEnvelope(value interface{}) (envelope, bool) {
+	outer, ok := value.(map[string]interface{})
+	if !ok || len(outer) != 1 {
+		return envelope{}, false
+	}
+	inner, ok := outer[envelopeKey].(map[string]interface{})
+	if !ok {
+		return envelope{}, false
+	}
+	keyID, _ := inner["kid"].(string)
+	key, kerr := decodeField(inner["key"])
+	data, derr := decodeField(inner["data"])
+	if keyID == "" || kerr != nil || derr != nil {
+		return envelope{}, false
+	}
+	return envelope{keyID: keyID, key: key, data: data}, true
+}
+
+func decodeField(field interface{}) ([]byte, error) {
+	s, ok := field.(string)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// IsEncrypted - whether the value is encrypted.
+func IsEncrypted(value interface{}) bool {
+	_, ok := parseEnvelope(value)
+	return ok
+}
+
+// KeyID - the id of the key an encrypted value is sealed with, false if the
+// value is not encrypted.
+func KeyID(value interface{}) (string, bool) {
+	e, ok := parseEnvelope(value)
+	return e.keyID, ok
+}
+
+// Encrypt - encrypts the value of a parameter. The name is authenticated, an
+// encrypted value can only be decrypted under the same name.
+func (c *Cipher) Encrypt(name string, value interface{}) (interface{}, error) {
+	if c == nil {
+		return value, nil
+	}
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	data, err := seal(dataKey, plaintext, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	e, err := c.sealKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	e.data = data
+	return e.value(), nil
+}
+
+// Decrypt - decrypts the value of a parameter, a value that is not encrypted
+// is returned as it is.
+func (c *Cipher) Decrypt(name string, value interface{}) (interface{}, error) {
+	e, ok := parseEnvelope(value)
+	if !ok {
+		return value, nil
+	}
+	dataKey, err := c.openKey(e)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(dataKey, e.data, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	var decrypted interface{}
+	if err := json.Unmarshal(plaintext, &decrypted); err != nil {
+		return nil, err
+	}
+	return decrypted, nil
+}
+
+// Rewrap - seals the data key of an encrypted value with the primary key,
+// without decrypting the value. Returns whether the value changed.
+func (c *Cipher) Rewrap(value interface{}) (interface{}, bool, error) {
+	e, ok := parseEnvelope(value)
+	if !ok || c == nil || e.keyID == c.keyring.Primary() {
+		return value, false, nil
+	}
+	dataKey, err := c.openKey(e)
+	if err != nil {
+		return nil, false, err
+	}
+	rewrapped, err := c.sealKey(dataKey)
+	if err != nil {
+		return nil, false, err
+	}
+	rewrapped.data = e.data
+	return rewrapped.value(), true, nil
+}
+
+// sealKey - seals a data key with the primary key.
+func (c *Cipher) sealKey(dataKey []byte) (envelope, error) {
+	keyID := c.keyring.Primary()
+	kek, err := c.keyring.key(keyID)
+	if err != nil {
+		return envelope{}, err
+	}
+	key, err := seal(kek, dataKey, []byte(keyID))
+	if err != nil {
+		return envelope{}, err
+	}
+	return envelope{keyID: keyID, key: key}, nil
+}
+
+// openKey - opens the data key of an envelope.
+func (c *Cipher) openKey(e envelope) ([]byte, error) {
+	if c == nil {
+		return nil, ErrNoKey
+	}
+	kek, err := c.keyring.key(e.keyID)
+	if err != nil {
+		return nil, err
+	}
+	return open(kek, e.key, []byte(e.keyID))
+}
+
+// seal - encrypts with AES-GCM, the nonce is prepended to the ciphertext.
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open - decrypts what seal encrypted.
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
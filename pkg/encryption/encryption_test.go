@@ -0,0 +1,200 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/stretchr/testify/assert"
+)
+
+func newKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, keySize)
+}
+
+func newCipher(t *testing.T, primary string) *Cipher {
+	keyring, err := NewKeyring(primary, map[string][]byte{"key1": newKey(1), "key2": newKey(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewCipher(keyring)
+}
+
+// stored - round trips the parameters through JSON, like a dao does.
+func stored(t *testing.T, params *bundle.Parameters) *bundle.Parameters {
+	data, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bundle.Parameters
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return &out
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, value string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("key1", base64.StdEncoding.EncodeToString(newKey(1))+"\n")
+	keyring, err := LoadKeyring(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "key1", keyring.Primary(), "a single key is the primary key")
+
+	// the files of a mounted secret
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "..data"), 0700))
+	write("key2", base64.StdEncoding.EncodeToString(newKey(2)))
+	_, err = LoadKeyring(dir)
+	assert.Error(t, err, "the primary key must be named")
+
+	write(PrimaryKeyName, "key2")
+	keyring, err = LoadKeyring(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "key2", keyring.Primary())
+	assert.Equal(t, []string{"key1", "key2"}, keyring.IDs())
+
+	write(PrimaryKeyName, "key3")
+	_, err = LoadKeyring(dir)
+	assert.Error(t, err)
+
+	write(PrimaryKeyName, "key2")
+	write("key3", base64.StdEncoding.EncodeToString([]byte("short")))
+	_, err = LoadKeyring(dir)
+	assert.Error(t, err)
+}
+
+func TestEncryptAndDecrypt(t *testing.T) {
+	c := newCipher(t, "key1")
+	creds := map[string]interface{}{"user": "admin", "port": float64(5432)}
+
+	encrypted, err := c.Encrypt("creds", creds)
+	assert.NoError(t, err)
+	assert.True(t, IsEncrypted(encrypted))
+	keyID, _ := KeyID(encrypted)
+	assert.Equal(t, "key1", keyID)
+
+	params := stored(t, &bundle.Parameters{"creds": encrypted})
+	decrypted, err := c.Decrypt("creds", (*params)["creds"])
+	assert.NoError(t, err)
+	assert.Equal(t, creds, decrypted)
+
+	_, err = c.Decrypt("other", (*params)["creds"])
+	assert.Equal(t, ErrDecrypt, err, "a value can not be moved to another parameter")
+
+	var none *Cipher
+	_, err = none.Decrypt("creds", encrypted)
+	assert.Equal(t, ErrNoKey, err)
+
+	value, err := c.Decrypt("plain", "text")
+	assert.NoError(t, err)
+	assert.Equal(t, "text", value)
+}
+
+func TestSealAndOpen(t *testing.T) {
+	c := newCipher(t, "key1")
+	spec := &bundle.Spec{Plans: []bundle.Plan{{
+		Name: "dev",
+		Parameters: []bundle.ParameterDescriptor{
+			{Name: "db_password", DisplayType: "password"},
+			{Name: "db_name"},
+		},
+		BindParameters: []bundle.ParameterDescriptor{{Name: "token", DisplayType: "secret"}},
+	}}}
+	secret := SecretParameters(spec, "dev")
+	assert.Equal(t, map[string]bool{
+		"db_password":                  true,
+		"token":                        true,
+		bundle.ProvisionCredentialsKey: true,
+		bundle.BindCredentialsKey:      true,
+	}, secret)
+
+	params := &bundle.Parameters{
+		"db_password":                  "s3cr3t",
+		"db_name":                      "app",
+		bundle.ProvisionCredentialsKey: map[string]interface{}{"password": "s3cr3t"},
+	}
+	sealed, err := c.Seal(params, secret)
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", (*params)["db_password"], "the parameters are copied")
+	assert.Equal(t, "app", (*sealed)["db_name"])
+	assert.True(t, IsEncrypted((*sealed)["db_password"]))
+	assert.True(t, IsEncrypted((*sealed)[bundle.ProvisionCredentialsKey]))
+	data, _ := json.Marshal(sealed)
+	assert.NotContains(t, string(data), "s3cr3t")
+
+	again, err := c.Seal(sealed, secret)
+	assert.NoError(t, err)
+	assert.Equal(t, sealed, again, "encrypted values are kept")
+
+	opened, err := c.Open(stored(t, sealed))
+	assert.NoError(t, err)
+	assert.Equal(t, params, opened)
+
+	var none *Cipher
+	unsealed, err := none.Seal(params, secret)
+	assert.NoError(t, err)
+	assert.Equal(t, params, unsealed)
+	_, err = none.Open(sealed)
+	assert.Error(t, err)
+}
+
+func TestReencryptParameters(t *testing.T) {
+	old := newCipher(t, "key1")
+	sealed, err := old.Seal(&bundle.Parameters{"password": "s3cr3t"}, map[string]bool{"password": true})
+	assert.NoError(t, err)
+	params := stored(t, sealed)
+	(*params)["token"] = "plain"
+
+	rotated := newCipher(t, "key2")
+	reencrypted, changed, err := rotated.ReencryptParameters(params, map[string]bool{"password": true, "token": true})
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	for _, name := range []string{"password", "token"} {
+		keyID, ok := KeyID((*reencrypted)[name])
+		assert.True(t, ok)
+		assert.Equal(t, "key2", keyID)
+	}
+
+	_, changed, err = rotated.ReencryptParameters(reencrypted, map[string]bool{"password": true, "token": true})
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	onlyNew, err := NewKeyring("key2", map[string][]byte{"key2": newKey(2)})
+	assert.NoError(t, err)
+	opened, err := NewCipher(onlyNew).Open(stored(t, reencrypted))
+	assert.NoError(t, err, "the old key is no longer needed")
+	assert.Equal(t, &bundle.Parameters{"password": "s3cr3t", "token": "plain"}, opened)
+
+	_, err = NewCipher(onlyNew).Open(params)
+	assert.Error(t, err, "the value was sealed with the old key")
+}
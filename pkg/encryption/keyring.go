@@ -0,0 +1,129 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package encryption
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PrimaryKeyName - the key of the secret naming the key new values are
+// encrypted with.
+const PrimaryKeyName = "primary"
+
+// keySize - the size of the key encryption keys, AES-256.
+const keySize = 32
+
+// ErrUnknownKey - a value was encrypted with a key the keyring does not have.
+var ErrUnknownKey = errors.New("encryption key not found")
+
+// Keyring - the key encryption keys by id, and the id of the primary key new
+// values are encrypted with. The other keys are kept to decrypt the values
+// encrypted before a rotation.
+type Keyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// NewKeyring - creates a keyring from the keys by id.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("the keyring has no key")
+	}
+	k := &Keyring{primary: primary, keys: map[string][]byte{}}
+	for id, key := range keys {
+		if len(key) != keySize {
+			return nil, fmt.Errorf("key %s is %d bytes long, expected %d", id, len(key), keySize)
+		}
+		k.keys[id] = key
+	}
+	if _, ok := k.keys[primary]; !ok {
+		return nil, fmt.Errorf("primary key %q is not in the keyring", primary)
+	}
+	return k, nil
+}
+
+// LoadKeyring - reads the keyring from the directory a Kubernetes Secret is
+// mounted in. Every key of the secret is a base64 encoded 32 bytes key,
+// except for `primary` which holds the id of the primary key. The primary key
+// may be omitted if the secret has a single key.
+func LoadKeyring(dir string) (*Keyring, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var primary string
+	keys := map[string][]byte{}
+	for _, file := range files {
+		// skips the ..data links of the mounted secret
+		if strings.HasPrefix(file.Name(), ".") || file.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		value := strings.TrimSpace(string(data))
+		if file.Name() == PrimaryKeyName {
+			primary = value
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode key %s - %v", file.Name(), err)
+		}
+		keys[file.Name()] = key
+	}
+	if primary == "" && len(keys) == 1 {
+		for id := range keys {
+			primary = id
+		}
+	}
+	if primary == "" {
+		return nil, fmt.Errorf("%s names no %s key", dir, PrimaryKeyName)
+	}
+	return NewKeyring(primary, keys)
+}
+
+// Primary - the id of the key new values are encrypted with.
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// IDs - the ids of the keys, sorted.
+func (k *Keyring) IDs() []string {
+	ids := []string{}
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// key - returns the key for an id.
+func (k *Keyring) key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
@@ -0,0 +1,146 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package encryption
+
+import (
+	"fmt"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+)
+
+// credentialKeys - the parameters holding the extracted credentials of an
+// instance or a binding, always encrypted.
+var credentialKeys = []string{bundle.ProvisionCredentialsKey, bundle.BindCredentialsKey}
+
+// secretDisplayTypes - the display types of the parameters to encrypt.
+var secretDisplayTypes = map[string]bool{
+	"password": true,
+	"secret":   true,
+}
+
+// IsSecret - whether the values of the parameter are encrypted, that is if
+// its display type is `password` or `secret`.
+func IsSecret(pd bundle.ParameterDescriptor) bool {
+	return secretDisplayTypes[pd.DisplayType]
+}
+
+// SecretParameters - the names of the parameters to encrypt for a plan of
+// the spec: its secret provision and bind parameters, and the credentials.
+// The secret parameters of every plan are returned if the plan is unknown.
+func SecretParameters(spec *bundle.Spec, plan string) map[string]bool {
+	secret := map[string]bool{}
+	for _, key := range credentialKeys {
+		secret[key] = true
+	}
+	if spec == nil {
+		return secret
+	}
+	plans := spec.Plans
+	if p, ok := spec.GetPlan(plan); ok {
+		plans = []bundle.Plan{p}
+	}
+	for _, p := range plans {
+		for _, descriptors := range [][]bundle.ParameterDescriptor{p.Parameters, p.BindParameters} {
+			for _, pd := range descriptors {
+				if IsSecret(pd) {
+					secret[pd.Name] = true
+				}
+			}
+		}
+	}
+	return secret
+}
+
+// Seal - returns a copy of the parameters with the secret ones encrypted, to
+// be stored. The values already encrypted are kept as they are.
+func (c *Cipher) Seal(params *bundle.Parameters, secret map[string]bool) (*bundle.Parameters, error) {
+	if c == nil || params == nil {
+		return params, nil
+	}
+	sealed := bundle.Parameters{}
+	for name, value := range *params {
+		if secret[name] && !IsEncrypted(value) {
+			encrypted, err := c.Encrypt(name, value)
+			if err != nil {
+				return nil, fmt.Errorf("unable to encrypt parameter %s - %v", name, err)
+			}
+			value = encrypted
+		}
+		sealed[name] = value
+	}
+	return &sealed, nil
+}
+
+// Open - returns a copy of the parameters with every encrypted value
+// decrypted, to be handed to the executor.
+func (c *Cipher) Open(params *bundle.Parameters) (*bundle.Parameters, error) {
+	if params == nil {
+		return nil, nil
+	}
+	opened := bundle.Parameters{}
+	for name, value := range *params {
+		decrypted, err := c.Decrypt(name, value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt parameter %s - %v", name, err)
+		}
+		opened[name] = decrypted
+	}
+	return &opened, nil
+}
+
+// ReencryptParameters - returns a copy of the parameters with the data keys
+// of the encrypted values sealed with the primary key, and the secret values
+// stored before the encryption was enabled encrypted. Returns whether any
+// value changed.
+func (c *Cipher) ReencryptParameters(params *bundle.Parameters, secret map[string]bool) (*bundle.Parameters, bool, error) {
+	if c == nil || params == nil {
+		return params, false, nil
+	}
+	changed := false
+	reencrypted := bundle.Parameters{}
+	for name, value := range *params {
+		var (
+			err     error
+			updated bool
+		)
+		switch {
+		case IsEncrypted(value):
+			value, updated, err = c.Rewrap(value)
+		case secret[name]:
+			value, err = c.Encrypt(name, value)
+			updated = true
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to encrypt parameter %s - %v", name, err)
+		}
+		changed = changed || updated
+		reencrypted[name] = value
+	}
+	return &reencrypted, changed, nil
+}
+
+// Redact - returns a copy of the parameters without the encrypted values, to
+// be returned to a client.
+func Redact(params bundle.Parameters) bundle.Parameters {
+	redacted := bundle.Parameters{}
+	for name, value := range params {
+		if !IsEncrypted(value) {
+			redacted[name] = value
+		}
+	}
+	return redacted
+}
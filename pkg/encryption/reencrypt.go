@@ -0,0 +1,139 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+)
+
+// listPageSize - the number of service instances read at a time.
+const listPageSize = 500
+
+var (
+	// errUnchanged - the parameters of the record are already sealed with
+	// the primary key.
+	errUnchanged = errors.New("unchanged")
+	// errDryRun - the record would be sealed again but is not written.
+	errDryRun = errors.New("dry run")
+)
+
+// Report - the records a re-encryption sealed again and the ones it failed
+// to.
+type Report struct {
+	ServiceInstances int
+	BindInstances    int
+	Unchanged        int
+	// Problems - the ids of the records that failed, with the reason.
+	Problems []string
+}
+
+// Failed - whether a record could not be sealed again.
+func (r Report) Failed() bool {
+	return len(r.Problems) > 0
+}
+
+// Write - writes the report in a human readable form.
+func (r Report) Write(w io.Writer) {
+	fmt.Fprintf(w, "service instances: %d\nbind instances: %d\nunchanged: %d\n",
+		r.ServiceInstances, r.BindInstances, r.Unchanged)
+	for _, problem := range r.Problems {
+		fmt.Fprintf(w, "failed: %s\n", problem)
+	}
+}
+
+// Reencrypt - seals the secret parameters of every service instance and
+// binding of the dao with the primary key. The values encrypted with another
+// key have their data key sealed again, the secret values stored before the
+// encryption was enabled are encrypted. With dryRun the records that would
+// change are counted but not written. Once it succeeds, the keys other than
+// the primary one are no longer needed.
+func (c *Cipher) Reencrypt(d dao.Dao, dryRun bool) (Report, error) {
+	report := Report{}
+	instances, err := types.AllServiceInstances(d, types.ServiceInstanceFilter{}, listPageSize)
+	if err != nil {
+		return report, err
+	}
+	for _, si := range instances {
+		id := si.ID.String()
+		secret := SecretParameters(si.Spec, types.Plan(si))
+		err := types.UpdateServiceInstance(d, id, func(latest *bundle.ServiceInstance) error {
+			params, changed, err := c.ReencryptParameters(latest.Parameters, secret)
+			if err != nil {
+				return err
+			}
+			if err = unchanged(changed, dryRun); err != nil {
+				return err
+			}
+			latest.Parameters = params
+			return nil
+		})
+		report.count(&report.ServiceInstances, "service instance "+id, err)
+
+		for bindingID := range si.BindingIDs {
+			err := c.reencryptBinding(d, bindingID, secret, dryRun)
+			report.count(&report.BindInstances, "bind instance "+bindingID, err)
+		}
+	}
+	return report, nil
+}
+
+// reencryptBinding - seals the secret parameters of a binding again.
+func (c *Cipher) reencryptBinding(d dao.Dao, id string, secret map[string]bool, dryRun bool) error {
+	bi, err := d.GetBindInstance(id)
+	if err != nil {
+		return err
+	}
+	params, changed, err := c.ReencryptParameters(bi.Parameters, secret)
+	if err != nil {
+		return err
+	}
+	if err = unchanged(changed, dryRun); err != nil {
+		return err
+	}
+	bi.Parameters = params
+	return d.SetBindInstance(id, bi)
+}
+
+// unchanged - the error telling a record is not written.
+func unchanged(changed bool, dryRun bool) error {
+	switch {
+	case !changed:
+		return errUnchanged
+	case dryRun:
+		return errDryRun
+	}
+	return nil
+}
+
+// count - records the outcome of a record, the records a dry run would
+// write are counted as written.
+func (r *Report) count(written *int, record string, err error) {
+	switch err {
+	case nil, errDryRun:
+		*written++
+	case errUnchanged:
+		r.Unchanged++
+	default:
+		r.Problems = append(r.Problems, fmt.Sprintf("%s - %v", record, err))
+	}
+}
@@ -0,0 +1,102 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package encryption
+
+import (
+	"testing"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	memory "github.com/openshift/ansible-service-broker/pkg/dao/memory"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReencryptDao(t *testing.T) {
+	d, err := memory.NewDao("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &bundle.Spec{ID: "spec-postgresql", Plans: []bundle.Plan{{
+		Name:       "dev",
+		Parameters: []bundle.ParameterDescriptor{{Name: "db_password", DisplayType: "password"}},
+	}}}
+	old := newCipher(t, "key1")
+
+	// stored before the encryption was enabled
+	plain := &bundle.ServiceInstance{
+		ID:         uuid.NewRandom(),
+		Spec:       spec,
+		Parameters: &bundle.Parameters{"_apb_plan_id": "dev", "db_password": "s3cr3t"},
+		BindingIDs: map[string]bool{},
+	}
+	// sealed with the old key
+	params, err := old.Seal(&bundle.Parameters{"_apb_plan_id": "dev", "db_password": "s3cr3t"}, SecretParameters(spec, "dev"))
+	assert.NoError(t, err)
+	sealed := &bundle.ServiceInstance{ID: uuid.NewRandom(), Spec: spec, Parameters: params, BindingIDs: map[string]bool{}}
+	params, err = old.Seal(&bundle.Parameters{bundle.ProvisionCredentialsKey: map[string]interface{}{"user": "admin"}}, SecretParameters(spec, "dev"))
+	assert.NoError(t, err)
+	binding := &bundle.BindInstance{ID: uuid.NewRandom(), ServiceID: sealed.ID, Parameters: params}
+	sealed.AddBinding(binding.ID)
+	// nothing to encrypt
+	other := &bundle.ServiceInstance{ID: uuid.NewRandom(), Spec: spec, Parameters: &bundle.Parameters{"_apb_plan_id": "dev"}}
+
+	for _, si := range []*bundle.ServiceInstance{plain, sealed, other} {
+		assert.NoError(t, d.SetServiceInstance(si.ID.String(), si))
+	}
+	assert.NoError(t, d.SetBindInstance(binding.ID.String(), binding))
+
+	rotated := newCipher(t, "key2")
+	report, err := rotated.Reencrypt(d, true)
+	assert.NoError(t, err)
+	assert.Equal(t, Report{ServiceInstances: 2, BindInstances: 1, Unchanged: 1}, report)
+	stored, err := d.GetServiceInstance(plain.ID.String())
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cr3t", (*stored.Parameters)["db_password"], "a dry run writes nothing")
+
+	report, err = rotated.Reencrypt(d, false)
+	assert.NoError(t, err)
+	assert.False(t, report.Failed())
+	assert.Equal(t, 2, report.ServiceInstances)
+
+	onlyNew, err := NewKeyring("key2", map[string][]byte{"key2": newKey(2)})
+	assert.NoError(t, err)
+	c := NewCipher(onlyNew)
+	for _, si := range []*bundle.ServiceInstance{plain, sealed} {
+		stored, err := d.GetServiceInstance(si.ID.String())
+		assert.NoError(t, err)
+		keyID, _ := KeyID((*stored.Parameters)["db_password"])
+		assert.Equal(t, "key2", keyID)
+		opened, err := c.Open(stored.Parameters)
+		assert.NoError(t, err)
+		assert.Equal(t, "s3cr3t", (*opened)["db_password"])
+	}
+	bi, err := d.GetBindInstance(binding.ID.String())
+	assert.NoError(t, err)
+	opened, err := c.Open(bi.Parameters)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"user": "admin"}, (*opened)[bundle.ProvisionCredentialsKey])
+
+	report, err = rotated.Reencrypt(d, false)
+	assert.NoError(t, err)
+	assert.Equal(t, Report{Unchanged: 4}, report)
+
+	// a value sealed with a key that is no longer in the keyring
+	assert.NoError(t, d.SetBindInstance(binding.ID.String(), binding))
+	report, err = NewCipher(onlyNew).Reencrypt(d, false)
+	assert.NoError(t, err)
+	assert.True(t, report.Failed())
+}
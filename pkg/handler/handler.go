@@ -19,14 +19,17 @@ package handler
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	yaml "gopkg.in/yaml.v1"
 
@@ -37,8 +40,10 @@ import (
 	"github.com/automationbroker/config"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/openshift/ansible-service-broker/pkg/audit"
 	"github.com/openshift/ansible-service-broker/pkg/auth"
 	"github.com/openshift/ansible-service-broker/pkg/broker"
+	"github.com/openshift/ansible-service-broker/pkg/encryption"
 	"github.com/openshift/ansible-service-broker/pkg/version"
 	"github.com/pborman/uuid"
 	log "github.com/sirupsen/logrus"
@@ -47,6 +52,9 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// streamKeepAlive - how often a comment is sent on an idle job stream.
+const streamKeepAlive = 15 * time.Second
+
 // RequestContextKey - keys that will be used in the request context
 type RequestContextKey string
 
@@ -57,6 +65,9 @@ const (
 	// UserInfoContext - Broker.UserInfo retrieved from the
 	// originating identity header
 	UserInfoContext RequestContextKey = "userInfo"
+	// AdminTokenHeader is the header holding the token of the admin routes,
+	// on top of the credentials of the open service broker api
+	AdminTokenHeader = "X-Broker-Admin-Token"
 )
 
 type handler struct {
@@ -94,6 +105,35 @@ func authHandler(h http.Handler, providers []auth.Provider) http.Handler {
 	})
 }
 
+// adminAuthHandler - only lets the requests with the admin token through.
+func adminAuthHandler(h http.Handler, token []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(AdminTokenHeader)), token) != 1 {
+			log.Debugf("invalid admin token for %s %s", r.Method, r.URL.Path)
+			writeResponse(w, http.StatusForbidden, broker.ErrorResponse{Description: "invalid admin token"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// readAdminToken - reads the admin token from the file, without its
+// surrounding white space.
+func readAdminToken(file string) ([]byte, error) {
+	if file == "" {
+		return nil, fmt.Errorf("no admin_token_file configured")
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	token := bytes.TrimSpace(b)
+	if len(token) == 0 {
+		return nil, fmt.Errorf("the admin token file %s is empty", file)
+	}
+	return token, nil
+}
+
 func userInfoHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		//Retrieve the UserInfo from request if available.
@@ -171,21 +211,32 @@ func NewHandler(b broker.Broker, brokerConfig *config.Config, prefix string,
 	}
 
 	s.HandleFunc("/v2/bootstrap", createVarHandler(h.bootstrap)).Methods("POST")
-	s.HandleFunc("/v2/catalog", createVarHandler(h.catalog)).Methods("GET")
-	s.HandleFunc("/v2/service_instances/{instance_uuid}", createVarHandler(h.getinstance)).Methods("GET")
-	s.HandleFunc("/v2/service_instances/{instance_uuid}", createVarHandler(h.provision)).Methods("PUT")
-	s.HandleFunc("/v2/service_instances/{instance_uuid}", createVarHandler(h.update)).Methods("PATCH")
-	s.HandleFunc("/v2/service_instances/{instance_uuid}", createVarHandler(h.deprovision)).Methods("DELETE")
-	s.HandleFunc("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}",
-		createVarHandler(h.getbind)).Methods("GET")
-	s.HandleFunc("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}",
-		createVarHandler(h.bind)).Methods("PUT")
-	s.HandleFunc("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}",
-		createVarHandler(h.unbind)).Methods("DELETE")
-	s.HandleFunc("/v2/service_instances/{instance_uuid}/last_operation",
-		createVarHandler(h.lastoperation)).Methods("GET")
-	s.HandleFunc("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}/last_operation",
-		createVarHandler(h.lastoperation)).Methods("GET")
+	// the open service broker api routes negotiate an api version, unlike
+	// the broker's own bootstrap, stream, apb and admin routes.
+	minVersion, maxVersion := apiVersionRange(brokerConfig)
+	osb := func(v VarHandler) http.Handler {
+		return NewAPIVersionHandler(http.HandlerFunc(createVarHandler(v)), minVersion, maxVersion)
+	}
+	s.Handle("/v2/catalog", osb(h.catalog)).Methods("GET")
+	s.Handle("/v2/service_instances/{instance_uuid}",
+		osb(requireAPIVersion(retrievableVersion, h.getinstance))).Methods("GET")
+	s.Handle("/v2/service_instances/{instance_uuid}", osb(h.provision)).Methods("PUT")
+	s.Handle("/v2/service_instances/{instance_uuid}", osb(h.update)).Methods("PATCH")
+	s.Handle("/v2/service_instances/{instance_uuid}", osb(h.deprovision)).Methods("DELETE")
+	s.Handle("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}",
+		osb(requireAPIVersion(retrievableVersion, h.getbind))).Methods("GET")
+	s.Handle("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}",
+		osb(h.bind)).Methods("PUT")
+	s.Handle("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}",
+		osb(h.unbind)).Methods("DELETE")
+	s.Handle("/v2/service_instances/{instance_uuid}/last_operation",
+		osb(h.lastoperation)).Methods("GET")
+	s.Handle("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}/last_operation",
+		osb(requireAPIVersion(asyncBindingAPIVersion, h.lastoperation))).Methods("GET")
+	s.HandleFunc("/v2/service_instances/{instance_uuid}/last_operation/stream",
+		createVarHandler(h.lastOperationStream)).Methods("GET")
+	s.HandleFunc("/v2/service_instances/{instance_uuid}/service_bindings/{binding_uuid}/last_operation/stream",
+		createVarHandler(h.lastOperationStream)).Methods("GET")
 
 	if brokerConfig.GetBool("broker.dev_broker") {
 		s.HandleFunc("/v2/apb", createVarHandler(h.apbAddSpec)).Methods("POST")
@@ -193,6 +244,22 @@ func NewHandler(b broker.Broker, brokerConfig *config.Config, prefix string,
 		s.HandleFunc("/v2/apb", createVarHandler(h.apbRemoveSpecs)).Methods("DELETE")
 	}
 
+	if brokerConfig.GetBool("broker.admin_api") {
+		// the admin routes are not served without their own token
+		token, err := readAdminToken(brokerConfig.GetString("broker.admin_token_file"))
+		if err != nil {
+			log.Errorf("the admin routes are disabled, unable to read the admin token - %v", err)
+		} else {
+			admin := func(v VarHandler) http.Handler {
+				return adminAuthHandler(http.HandlerFunc(createVarHandler(v)), token)
+			}
+			s.Handle("/admin/jobs/{job_token}", admin(h.cancelJob)).Methods("DELETE")
+			s.Handle("/admin/dead_letters", admin(h.listDeadLetters)).Methods("GET")
+			s.Handle("/admin/dead_letters/{letter_id}/replay", admin(h.replayDeadLetter)).Methods("POST")
+			s.Handle("/admin/audit", admin(h.auditRecords)).Methods("GET")
+		}
+	}
+
 	return handlers.LoggingHandler(os.Stdout, userInfoHandler(authHandler(h, providers)))
 }
 
@@ -220,6 +287,9 @@ func (h handler) catalog(w http.ResponseWriter, r *http.Request, params map[stri
 	h.printRequest(r)
 
 	resp, err := h.broker.Catalog()
+	if resp != nil {
+		resp = shapeCatalog(resp, requestAPIVersion(r))
+	}
 
 	writeDefaultResponse(w, http.StatusOK, resp, err)
 }
@@ -256,7 +326,10 @@ func (h handler) getinstance(w http.ResponseWriter, r *http.Request, params map[
 		log.Warning("Could not retrieve the current plan name from parameters")
 	}
 
-	sir := broker.ServiceInstanceResponse{ServiceID: si.ID.String(), PlanID: planID, Parameters: *si.Parameters}
+	// the secret parameters are encrypted at rest and never returned
+	sir := broker.ServiceInstanceResponse{
+		ServiceID: si.ID.String(), PlanID: planID, Parameters: encryption.Redact(*si.Parameters),
+	}
 
 	writeDefaultResponse(w, http.StatusOK, sir, err)
 }
@@ -787,6 +860,100 @@ func (h handler) lastoperation(w http.ResponseWriter, r *http.Request, params ma
 	writeDefaultResponse(w, http.StatusOK, resp, err)
 }
 
+// lastOperationStream - streams the messages of a job as server-sent events,
+// starting with its latest state, until the job is done.
+func (h handler) lastOperationStream(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	h.printRequest(r)
+
+	streamer, ok := h.broker.(broker.JobStreamer)
+	if !ok {
+		log.Errorf("unable to use broker - %T to stream jobs", h.broker)
+		writeResponse(w, http.StatusInternalServerError, broker.ErrorResponse{Description: "Internal server error"})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeResponse(w, http.StatusInternalServerError, broker.ErrorResponse{Description: "streaming is not supported"})
+		return
+	}
+
+	id := uuid.Parse(params["instance_uuid"])
+	if id == nil {
+		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "invalid instance_uuid"})
+		return
+	}
+	if strings.Index(r.URL.Path, "/service_bindings/") > 0 {
+		// the jobs of a binding are kept under the binding id
+		id = uuid.Parse(params["binding_uuid"])
+		if id == nil {
+			writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "invalid binding_uuid"})
+			return
+		}
+	}
+	token := r.FormValue("operation")
+	if token == "" {
+		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: "operation not supplied"})
+		return
+	}
+
+	stream, err := streamer.StreamJob(id, token)
+	switch {
+	case err == broker.ErrorNotFound:
+		writeResponse(w, http.StatusNotFound, broker.ErrorResponse{
+			Description: fmt.Sprintf("no job found for operation %s", token)})
+		return
+	case err != nil:
+		log.Errorf("unable to stream job %s - %v", token, err)
+		writeResponse(w, http.StatusInternalServerError, broker.ErrorResponse{Description: err.Error()})
+		return
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := writeJobEvent(w, stream.Latest); err != nil {
+		log.Errorf("unable to stream job %s - %v", token, err)
+		return
+	}
+	flusher.Flush()
+	if stream.Done() {
+		return
+	}
+
+	// comments keep idle connections from being closed by proxies
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case msg, ok := <-stream.Msgs:
+			if !ok {
+				return
+			}
+			if err := writeJobEvent(w, msg); err != nil {
+				log.Errorf("unable to stream job %s - %v", token, err)
+				return
+			}
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeJobEvent - writes the job message as a server-sent event.
+func writeJobEvent(w http.ResponseWriter, msg broker.JobMsg) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+	return err
+}
+
 // apbAddSpec - Development only route. Will be used by for local developers to add images to the catalog.
 func (h handler) apbAddSpec(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	log.Debug("handler::apbAddSpec")
@@ -870,6 +1037,108 @@ func (h handler) apbRemoveSpecs(w http.ResponseWriter, r *http.Request, params m
 	writeDefaultResponse(w, http.StatusNoContent, struct{}{}, err)
 }
 
+// cancelJob - Admin route. Cancels a queued or running job by its token.
+func (h handler) cancelJob(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	adminBroker, ok := h.broker.(broker.AdminBroker)
+	if !ok {
+		log.Errorf("unable to use broker - %T as admin broker", h.broker)
+		writeResponse(w, http.StatusInternalServerError, broker.ErrorResponse{Description: "Internal server error"})
+		return
+	}
+	token := params["job_token"]
+	userInfo, _ := r.Context().Value(UserInfoContext).(broker.UserInfo)
+
+	err := adminBroker.CancelJob(token, userInfo)
+	switch {
+	case err == broker.ErrorNotFound:
+		writeResponse(w, http.StatusNotFound, broker.ErrorResponse{
+			Description: fmt.Sprintf("no queued or running job found for token %s", token)})
+	case err != nil:
+		log.Errorf("unable to cancel job %s - %v", token, err)
+		writeResponse(w, http.StatusInternalServerError, broker.ErrorResponse{Description: err.Error()})
+	default:
+		writeResponse(w, http.StatusAccepted, struct{}{})
+	}
+}
+
+func (h handler) listDeadLetters(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	adminBroker, ok := h.broker.(broker.AdminBroker)
+	if !ok {
+		log.Errorf("unable to use broker - %T as admin broker", h.broker)
+		writeResponse(w, http.StatusInternalServerError, broker.ErrorResponse{Description: "Internal server error"})
+		return
+	}
+	letters, err := adminBroker.DeadLetters()
+	if err != nil {
+		log.Errorf("unable to list dead letters - %v", err)
+	}
+	writeDefaultResponse(w, http.StatusOK, letters, err)
+}
+
+func (h handler) replayDeadLetter(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	adminBroker, ok := h.broker.(broker.AdminBroker)
+	if !ok {
+		log.Errorf("unable to use broker - %T as admin broker", h.broker)
+		writeResponse(w, http.StatusInternalServerError, broker.ErrorResponse{Description: "Internal server error"})
+		return
+	}
+	id := params["letter_id"]
+
+	err := adminBroker.ReplayDeadLetter(id)
+	switch {
+	case err == broker.ErrorNotFound:
+		writeResponse(w, http.StatusNotFound, broker.ErrorResponse{
+			Description: fmt.Sprintf("no dead letter found for id %s", id)})
+	case err != nil:
+		log.Errorf("unable to replay dead letter %s - %v", id, err)
+		writeResponse(w, http.StatusInternalServerError, broker.ErrorResponse{Description: err.Error()})
+	default:
+		writeResponse(w, http.StatusOK, struct{}{})
+	}
+}
+
+func (h handler) auditRecords(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	adminBroker, ok := h.broker.(broker.AdminBroker)
+	if !ok {
+		log.Errorf("unable to use broker - %T as admin broker", h.broker)
+		writeResponse(w, http.StatusInternalServerError, broker.ErrorResponse{Description: "Internal server error"})
+		return
+	}
+	query := r.URL.Query()
+	filter := audit.Filter{
+		User:      query.Get("user"),
+		Namespace: query.Get("namespace"),
+	}
+	var err error
+	if filter.Since, err = parseQueryTime(query.Get("since")); err != nil {
+		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: fmt.Sprintf("invalid since - %v", err)})
+		return
+	}
+	if filter.Until, err = parseQueryTime(query.Get("until")); err != nil {
+		writeResponse(w, http.StatusBadRequest, broker.ErrorResponse{Description: fmt.Sprintf("invalid until - %v", err)})
+		return
+	}
+
+	records, err := adminBroker.AuditRecords(filter)
+	switch {
+	case err == audit.ErrorQueryNotSupported:
+		writeResponse(w, http.StatusNotImplemented, broker.ErrorResponse{Description: err.Error()})
+	case err != nil:
+		log.Errorf("unable to query the audit trail - %v", err)
+		writeResponse(w, http.StatusInternalServerError, broker.ErrorResponse{Description: err.Error()})
+	default:
+		writeResponse(w, http.StatusOK, records)
+	}
+}
+
+// parseQueryTime - parses an RFC3339 time, the zero time if empty.
+func parseQueryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
 // printRequest - will print the request with the body.
 func (h handler) printRequest(req *http.Request) {
 	if h.brokerConfig.GetBool("broker.output_request") {
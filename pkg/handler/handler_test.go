@@ -23,13 +23,16 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	apb "github.com/automationbroker/bundle-lib/bundle"
 	"github.com/automationbroker/config"
 	"github.com/gorilla/mux"
+	"github.com/openshift/ansible-service-broker/pkg/audit"
 	"github.com/openshift/ansible-service-broker/pkg/auth"
 	"github.com/openshift/ansible-service-broker/pkg/broker"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
 	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
 	"github.com/pborman/uuid"
 )
@@ -138,6 +141,40 @@ func (m MockBroker) GetBind(si apb.ServiceInstance, bindid uuid.UUID) (*broker.B
 	return nil, nil
 }
 
+func (m MockBroker) CancelJob(token string, userInfo broker.UserInfo) error {
+	m.called("cancelJob", true)
+	return m.Err
+}
+
+func (m MockBroker) DeadLetters() ([]*types.DeadLetter, error) {
+	m.called("deadLetters", true)
+	return []*types.DeadLetter{{ID: "letter", SubscriberID: "jobstate"}}, m.Err
+}
+
+func (m MockBroker) ReplayDeadLetter(id string) error {
+	m.called("replayDeadLetter", true)
+	return m.Err
+}
+
+func (m MockBroker) StreamJob(id uuid.UUID, token string) (*broker.JobStream, error) {
+	m.called("streamJob", true)
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	msgs := make(chan broker.JobMsg, 1)
+	msgs <- broker.JobMsg{JobToken: token, State: apb.JobState{State: apb.StateSucceeded}}
+	close(msgs)
+	return &broker.JobStream{
+		Latest: broker.JobMsg{JobToken: token, State: apb.JobState{State: apb.StateInProgress}},
+		Msgs:   msgs,
+	}, nil
+}
+
+func (m MockBroker) AuditRecords(filter audit.Filter) ([]audit.Record, error) {
+	m.called("auditRecords", true)
+	return []audit.Record{{Operation: "provision", User: audit.User{Username: filter.User}}}, m.Err
+}
+
 func TestNewHandler(t *testing.T) {
 	testb := MockBroker{Name: "testbroker"}
 	c, err := config.CreateConfig("testdata/broker.yaml")
@@ -258,6 +295,209 @@ func TestDevHandlerDoesHaveAPBSpecsDeleteRoute(t *testing.T) {
 	ft.AssertNotNil(t, testhandler, "handler wasn't created")
 }
 
+func TestNewHandlerDoesNotHaveCancelJobRoute(t *testing.T) {
+	testb := MockBroker{Name: "testbroker"}
+	c, err := config.CreateConfig("testdata/broker.yaml")
+	if err != nil {
+		t.Fail()
+	}
+	testhandler := NewHandler(testb, c, "", nil, nil)
+	req, err := http.NewRequest(http.MethodDelete, "/admin/jobs/token", nil)
+	if err != nil {
+		ft.AssertTrue(t, false, err.Error())
+	}
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, req)
+	ft.AssertEqual(t, w.Result().StatusCode, http.StatusNotFound, fmt.Sprintf("resulting status was not 404 - %v", w.Result().Status))
+}
+
+func TestAdminHandlerRequiresAdminToken(t *testing.T) {
+	c, err := config.CreateConfig("testdata/admin_broker.yaml")
+	if err != nil {
+		t.Fail()
+	}
+	for _, token := range []string{"", "s3cr3t"} {
+		testhandler := NewHandler(MockBroker{Name: "testbroker"}, c, "", nil, nil)
+		req, err := http.NewRequest(http.MethodDelete, "/admin/jobs/token", nil)
+		if err != nil {
+			ft.AssertTrue(t, false, err.Error())
+		}
+		if token != "" {
+			req.Header.Set(AdminTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, req)
+		ft.AssertEqual(t, w.Result().StatusCode, http.StatusForbidden, fmt.Sprintf("resulting status was not 403 - %v", w.Result().Status))
+	}
+
+	// the admin routes are not served without an admin token file
+	c, err = config.CreateConfig("testdata/admin_no_token_broker.yaml")
+	if err != nil {
+		t.Fail()
+	}
+	testhandler := NewHandler(MockBroker{Name: "testbroker"}, c, "", nil, nil)
+	req, err := http.NewRequest(http.MethodDelete, "/admin/jobs/token", nil)
+	if err != nil {
+		ft.AssertTrue(t, false, err.Error())
+	}
+	req.Header.Set(AdminTokenHeader, "s3cr3t-admin-token")
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, req)
+	ft.AssertEqual(t, w.Result().StatusCode, http.StatusNotFound, fmt.Sprintf("resulting status was not 404 - %v", w.Result().Status))
+}
+
+func TestAdminHandlerCancelJob(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{name: "job cancelled", status: http.StatusAccepted},
+		{name: "job not found", err: broker.ErrorNotFound, status: http.StatusNotFound},
+		{name: "other error", err: errors.New("boom"), status: http.StatusInternalServerError},
+	}
+	c, err := config.CreateConfig("testdata/admin_broker.yaml")
+	if err != nil {
+		t.Fail()
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			testb := MockBroker{Name: "testbroker", Err: tc.err}
+			testhandler := NewHandler(testb, c, "", nil, nil)
+			req, err := http.NewRequest(http.MethodDelete, "/admin/jobs/token", nil)
+			if err != nil {
+				ft.AssertTrue(t, false, err.Error())
+			}
+			req.Header.Set(AdminTokenHeader, "s3cr3t-admin-token")
+			w := httptest.NewRecorder()
+			testhandler.ServeHTTP(w, req)
+			ft.AssertEqual(t, w.Result().StatusCode, tc.status, fmt.Sprintf("unexpected status - %v", w.Result().Status))
+		})
+	}
+}
+
+func TestAdminHandlerListDeadLetters(t *testing.T) {
+	c, err := config.CreateConfig("testdata/admin_broker.yaml")
+	if err != nil {
+		t.Fail()
+	}
+	testhandler := NewHandler(MockBroker{Name: "testbroker"}, c, "", nil, nil)
+	req, err := http.NewRequest(http.MethodGet, "/admin/dead_letters", nil)
+	if err != nil {
+		ft.AssertTrue(t, false, err.Error())
+	}
+	req.Header.Set(AdminTokenHeader, "s3cr3t-admin-token")
+	w := httptest.NewRecorder()
+	testhandler.ServeHTTP(w, req)
+	ft.AssertEqual(t, w.Result().StatusCode, http.StatusOK, fmt.Sprintf("resulting status was not 200 - %v", w.Result().Status))
+	ft.AssertTrue(t, strings.Contains(w.Body.String(), `"subscriber_id": "jobstate"`), w.Body.String())
+}
+
+func TestAdminHandlerReplayDeadLetter(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{name: "letter delivered", status: http.StatusOK},
+		{name: "letter not found", err: broker.ErrorNotFound, status: http.StatusNotFound},
+		{name: "delivery failed", err: errors.New("boom"), status: http.StatusInternalServerError},
+	}
+	c, err := config.CreateConfig("testdata/admin_broker.yaml")
+	if err != nil {
+		t.Fail()
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			testb := MockBroker{Name: "testbroker", Err: tc.err}
+			testhandler := NewHandler(testb, c, "", nil, nil)
+			req, err := http.NewRequest(http.MethodPost, "/admin/dead_letters/letter/replay", nil)
+			if err != nil {
+				ft.AssertTrue(t, false, err.Error())
+			}
+			req.Header.Set(AdminTokenHeader, "s3cr3t-admin-token")
+			w := httptest.NewRecorder()
+			testhandler.ServeHTTP(w, req)
+			ft.AssertEqual(t, w.Result().StatusCode, tc.status, fmt.Sprintf("unexpected status - %v", w.Result().Status))
+		})
+	}
+}
+
+func TestAdminHandlerAuditRecords(t *testing.T) {
+	cases := []struct {
+		name   string
+		query  string
+		err    error
+		status int
+	}{
+		{name: "records listed", query: "?user=admin&since=2018-06-01T00:00:00Z", status: http.StatusOK},
+		{name: "invalid time", query: "?until=yesterday", status: http.StatusBadRequest},
+		{name: "query not supported", err: audit.ErrorQueryNotSupported, status: http.StatusNotImplemented},
+		{name: "query failed", err: errors.New("boom"), status: http.StatusInternalServerError},
+	}
+	c, err := config.CreateConfig("testdata/admin_broker.yaml")
+	if err != nil {
+		t.Fail()
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			testb := MockBroker{Name: "testbroker", Err: tc.err}
+			testhandler := NewHandler(testb, c, "", nil, nil)
+			req, err := http.NewRequest(http.MethodGet, "/admin/audit"+tc.query, nil)
+			if err != nil {
+				ft.AssertTrue(t, false, err.Error())
+			}
+			req.Header.Set(AdminTokenHeader, "s3cr3t-admin-token")
+			w := httptest.NewRecorder()
+			testhandler.ServeHTTP(w, req)
+			ft.AssertEqual(t, w.Result().StatusCode, tc.status, fmt.Sprintf("unexpected status - %v", w.Result().Status))
+			if tc.status == http.StatusOK {
+				ft.AssertTrue(t, strings.Contains(w.Body.String(), `"username": "admin"`), w.Body.String())
+			}
+		})
+	}
+}
+
+func TestLastOperationStream(t *testing.T) {
+	instanceID := uuid.NewRandom().String()
+	cases := []struct {
+		name   string
+		path   string
+		err    error
+		status int
+	}{
+		{name: "job streamed", path: "/v2/service_instances/" + instanceID + "/last_operation/stream?operation=token", status: http.StatusOK},
+		{name: "binding job streamed", path: "/v2/service_instances/" + instanceID + "/service_bindings/" + instanceID + "/last_operation/stream?operation=token", status: http.StatusOK},
+		{name: "operation missing", path: "/v2/service_instances/" + instanceID + "/last_operation/stream", status: http.StatusBadRequest},
+		{name: "invalid instance", path: "/v2/service_instances/invalid/last_operation/stream?operation=token", status: http.StatusBadRequest},
+		{name: "job not found", path: "/v2/service_instances/" + instanceID + "/last_operation/stream?operation=token", err: broker.ErrorNotFound, status: http.StatusNotFound},
+	}
+	c, err := config.CreateConfig("testdata/broker.yaml")
+	if err != nil {
+		t.Fail()
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			testhandler := NewHandler(MockBroker{Name: "testbroker", Err: tc.err}, c, "", nil, nil)
+			req, err := http.NewRequest(http.MethodGet, tc.path, nil)
+			if err != nil {
+				ft.AssertTrue(t, false, err.Error())
+			}
+			w := httptest.NewRecorder()
+			testhandler.ServeHTTP(w, req)
+			ft.AssertEqual(t, w.Result().StatusCode, tc.status, fmt.Sprintf("unexpected status - %v", w.Result().Status))
+			if tc.status == http.StatusOK {
+				ft.AssertEqual(t, w.Header().Get("Content-Type"), "text/event-stream")
+				events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+				ft.AssertEqual(t, len(events), 2, w.Body.String())
+				ft.AssertTrue(t, strings.HasPrefix(events[0], "data: "), events[0])
+				ft.AssertTrue(t, strings.Contains(events[0], `"state":"in progress"`), events[0])
+				ft.AssertTrue(t, strings.Contains(events[1], `"state":"succeeded"`), events[1])
+			}
+		})
+	}
+}
+
 func TestBootstrap(t *testing.T) {
 	testhandler, w, r := buildBootstrapHandler(nil)
 	testhandler.bootstrap(w, r, nil)
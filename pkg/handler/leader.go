@@ -0,0 +1,136 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openshift/ansible-service-broker/pkg/broker"
+	log "github.com/sirupsen/logrus"
+)
+
+// ForwardedByHeader - set on the requests a follower forwards to the leader,
+// a forwarded request is never forwarded again.
+const ForwardedByHeader = "X-Broker-Forwarded-By"
+
+// streamFlushInterval - how often the job events streamed by the leader are
+// flushed to the client of a follower.
+const streamFlushInterval = 100 * time.Millisecond
+
+// Leadership - tells whether this replica of the broker leads, and where the
+// leader is.
+type Leadership interface {
+	IsLeader() bool
+	// Leader - the identity and address of the leader, empty if there is
+	// none.
+	Leader() (string, string)
+}
+
+type leaderForwardingHandler struct {
+	handler    http.Handler
+	leadership Leadership
+	identity   string
+	transport  http.RoundTripper
+
+	mutex   sync.Mutex
+	proxies map[string]*httputil.ReverseProxy
+}
+
+// NewLeaderForwardingHandler - serves the read requests on every replica and
+// forwards the requests that need the jobs of the leader to it: the ones
+// changing instances and bindings, cancelling jobs, streaming jobs and
+// bootstrapping. Responds with 503 when there is no leader to forward to.
+func NewLeaderForwardingHandler(
+	h http.Handler, leadership Leadership, identity string, transport http.RoundTripper,
+) http.Handler {
+	return &leaderForwardingHandler{
+		handler:    h,
+		leadership: leadership,
+		identity:   identity,
+		transport:  transport,
+		proxies:    map[string]*httputil.ReverseProxy{},
+	}
+}
+
+func (f *leaderForwardingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !leaderOnly(r) || f.leadership.IsLeader() {
+		f.handler.ServeHTTP(w, r)
+		return
+	}
+	leader, address := f.leadership.Leader()
+	if by := r.Header.Get(ForwardedByHeader); by != "" {
+		log.Warningf("request %s %s forwarded by %s, but %s is not the leader", r.Method, r.URL.Path, by, f.identity)
+		writeNoLeader(w, "the broker the request was forwarded to is no longer the leader")
+		return
+	}
+	if address == "" {
+		writeNoLeader(w, "no broker is leading, try again later")
+		return
+	}
+	proxy, err := f.proxy(address)
+	if err != nil {
+		log.Errorf("unable to forward to leader %s at %s - %v", leader, address, err)
+		writeResponse(w, http.StatusBadGateway, broker.ErrorResponse{Description: err.Error()})
+		return
+	}
+	log.Debugf("forwarding %s %s to leader %s", r.Method, r.URL.Path, leader)
+	r.Header.Set(ForwardedByHeader, f.identity)
+	proxy.ServeHTTP(w, r)
+}
+
+func (f *leaderForwardingHandler) proxy(address string) (*httputil.ReverseProxy, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if proxy, ok := f.proxies[address]; ok {
+		return proxy, nil
+	}
+	target, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid leader address %q - %v", address, err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = f.transport
+	proxy.FlushInterval = streamFlushInterval
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Errorf("unable to forward %s %s to the leader at %s - %v", r.Method, r.URL.Path, address, err)
+		writeResponse(w, http.StatusBadGateway, broker.ErrorResponse{
+			Description: fmt.Sprintf("unable to reach the leading broker - %v", err),
+		})
+	}
+	f.proxies[address] = proxy
+	return proxy, nil
+}
+
+// leaderOnly - true for the requests only the leader can serve.
+func leaderOnly(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return true
+	}
+	// the job events are published by the engine running the job
+	return strings.HasSuffix(r.URL.Path, "/last_operation/stream")
+}
+
+func writeNoLeader(w http.ResponseWriter, description string) {
+	w.Header().Set("Retry-After", "1")
+	writeResponse(w, http.StatusServiceUnavailable, broker.ErrorResponse{Description: description})
+}
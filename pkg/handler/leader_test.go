@@ -0,0 +1,125 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
+)
+
+type fakeLeadership struct {
+	leader  bool
+	address string
+}
+
+func (l fakeLeadership) IsLeader() bool {
+	return l.leader
+}
+
+func (l fakeLeadership) Leader() (string, string) {
+	if l.address == "" {
+		return "", ""
+	}
+	return "broker-a", l.address
+}
+
+func TestLeaderForwardingHandler(t *testing.T) {
+	forwardedBy := make(chan string, 1)
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedBy <- r.Header.Get(ForwardedByHeader)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer leader.Close()
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	cases := []struct {
+		name          string
+		leadership    fakeLeadership
+		method        string
+		path          string
+		forwardedBy   string
+		expectedCode  int
+		expectForward bool
+	}{
+		{
+			name:         "reads are served by followers",
+			leadership:   fakeLeadership{address: leader.URL},
+			method:       http.MethodGet,
+			path:         "/osb/v2/service_instances/1234/last_operation",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:          "provision is forwarded to the leader",
+			leadership:    fakeLeadership{address: leader.URL},
+			method:        http.MethodPut,
+			path:          "/osb/v2/service_instances/1234",
+			expectedCode:  http.StatusAccepted,
+			expectForward: true,
+		},
+		{
+			name:          "job stream is forwarded to the leader",
+			leadership:    fakeLeadership{address: leader.URL},
+			method:        http.MethodGet,
+			path:          "/osb/v2/service_instances/1234/last_operation/stream",
+			expectedCode:  http.StatusAccepted,
+			expectForward: true,
+		},
+		{
+			name:         "leader serves everything",
+			leadership:   fakeLeadership{leader: true, address: leader.URL},
+			method:       http.MethodDelete,
+			path:         "/osb/v2/service_instances/1234",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "unavailable without a leader",
+			method:       http.MethodPatch,
+			path:         "/osb/v2/service_instances/1234",
+			expectedCode: http.StatusServiceUnavailable,
+		},
+		{
+			name:         "forwarded requests are not forwarded again",
+			leadership:   fakeLeadership{address: leader.URL},
+			method:       http.MethodPut,
+			path:         "/osb/v2/service_instances/1234",
+			forwardedBy:  "broker-c",
+			expectedCode: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewLeaderForwardingHandler(local, tc.leadership, "broker-b", http.DefaultTransport)
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.forwardedBy != "" {
+				r.Header.Set(ForwardedByHeader, tc.forwardedBy)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			ft.AssertEqual(t, w.Code, tc.expectedCode)
+			if tc.expectForward {
+				ft.AssertEqual(t, <-forwardedBy, "broker-b")
+			}
+			ft.AssertEqual(t, len(forwardedBy), 0)
+		})
+	}
+}
@@ -0,0 +1,204 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/automationbroker/config"
+	"github.com/openshift/ansible-service-broker/pkg/broker"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// APIVersionHeader - the header declaring the version of the open
+	// service broker api the platform speaks.
+	APIVersionHeader = "X-Broker-API-Version"
+	// APIVersionContext - the APIVersion negotiated with the platform, set
+	// on the context of the open service broker api requests.
+	APIVersionContext RequestContextKey = "apiVersion"
+)
+
+// APIVersion - a version of the open service broker api.
+type APIVersion struct {
+	Major int
+	Minor int
+}
+
+var (
+	// MinAPIVersion - the oldest version of the api the broker speaks.
+	MinAPIVersion = APIVersion{Major: 2, Minor: 11}
+	// MaxAPIVersion - the newest version of the api the broker speaks.
+	MaxAPIVersion = APIVersion{Major: 2, Minor: 14}
+
+	// the versions introducing the parts of the api the responses are
+	// shaped by.
+	planBindableVersion    = APIVersion{Major: 2, Minor: 12}
+	planSchemasVersion     = APIVersion{Major: 2, Minor: 13}
+	retrievableVersion     = APIVersion{Major: 2, Minor: 14}
+	asyncBindingAPIVersion = APIVersion{Major: 2, Minor: 14}
+)
+
+// ParseAPIVersion - parses a major.minor version, such as 2.13.
+func ParseAPIVersion(s string) (APIVersion, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) != 2 {
+		return APIVersion{}, fmt.Errorf("invalid api version %q, expected major.minor", s)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 0 {
+		return APIVersion{}, fmt.Errorf("invalid major version in api version %q", s)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil || minor < 0 {
+		return APIVersion{}, fmt.Errorf("invalid minor version in api version %q", s)
+	}
+	return APIVersion{Major: major, Minor: minor}, nil
+}
+
+func (v APIVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// Before - true when the version is older than o.
+func (v APIVersion) Before(o APIVersion) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	return v.Minor < o.Minor
+}
+
+type apiVersionHandler struct {
+	handler http.Handler
+	min     APIVersion
+	max     APIVersion
+}
+
+// NewAPIVersionHandler - validates the api version declared by the
+// X-Broker-API-Version header and sets it on the request context. Responds
+// with 412 when the header is missing or the version is outside of min and
+// max.
+func NewAPIVersionHandler(h http.Handler, min, max APIVersion) http.Handler {
+	return &apiVersionHandler{handler: h, min: min, max: max}
+}
+
+func (a *apiVersionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	header := r.Header.Get(APIVersionHeader)
+	if header == "" {
+		a.reject(w, fmt.Sprintf("the %s header is required", APIVersionHeader))
+		return
+	}
+	version, err := ParseAPIVersion(header)
+	if err != nil {
+		a.reject(w, err.Error())
+		return
+	}
+	if version.Before(a.min) || a.max.Before(version) {
+		a.reject(w, fmt.Sprintf("api version %s is not supported", version))
+		return
+	}
+	a.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), APIVersionContext, version)))
+}
+
+func (a *apiVersionHandler) reject(w http.ResponseWriter, reason string) {
+	log.Debugf("rejecting request - %s", reason)
+	writeResponse(w, http.StatusPreconditionFailed, broker.ErrorResponse{
+		Description: fmt.Sprintf("%s, the broker supports the versions %s to %s", reason, a.min, a.max),
+	})
+}
+
+// requestAPIVersion - the api version negotiated for the request, the newest
+// one when the request did not go through the api version handler.
+func requestAPIVersion(r *http.Request) APIVersion {
+	if version, ok := r.Context().Value(APIVersionContext).(APIVersion); ok {
+		return version
+	}
+	return MaxAPIVersion
+}
+
+// requireAPIVersion - responds with 412 to the requests negotiating a version
+// older than the one introducing the route.
+func requireAPIVersion(since APIVersion, h VarHandler) VarHandler {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		if version := requestAPIVersion(r); version.Before(since) {
+			writeResponse(w, http.StatusPreconditionFailed, broker.ErrorResponse{
+				Description: fmt.Sprintf("%s %s requires api version %s, got %s", r.Method, r.URL.Path, since, version),
+			})
+			return
+		}
+		h(w, r, params)
+	}
+}
+
+// apiVersionRange - the versions the broker is configured to accept, within
+// the ones it speaks.
+func apiVersionRange(c *config.Config) (APIVersion, APIVersion) {
+	min := configAPIVersion(c, "broker.min_api_version", MinAPIVersion)
+	max := configAPIVersion(c, "broker.max_api_version", MaxAPIVersion)
+	if max.Before(min) {
+		log.Errorf("broker.max_api_version %s is older than broker.min_api_version %s, accepting %s to %s",
+			max, min, MinAPIVersion, MaxAPIVersion)
+		return MinAPIVersion, MaxAPIVersion
+	}
+	return min, max
+}
+
+func configAPIVersion(c *config.Config, key string, def APIVersion) APIVersion {
+	s := c.GetString(key)
+	if s == "" {
+		return def
+	}
+	version, err := ParseAPIVersion(s)
+	if err != nil {
+		log.Errorf("%s - %v, using %s", key, err, def)
+		return def
+	}
+	if version.Before(MinAPIVersion) || MaxAPIVersion.Before(version) {
+		log.Errorf("%s %s is not a version the broker speaks, using %s", key, version, def)
+		return def
+	}
+	return version
+}
+
+// shapeCatalog - leaves out of the catalog the fields introduced after the
+// api version.
+func shapeCatalog(catalog *broker.CatalogResponse, version APIVersion) *broker.CatalogResponse {
+	shaped := &broker.CatalogResponse{Services: make([]broker.Service, len(catalog.Services))}
+	for i, svc := range catalog.Services {
+		if version.Before(retrievableVersion) {
+			svc.InstancesRetrievable = false
+			svc.BindingsRetrievable = false
+		}
+		plans := make([]broker.Plan, len(svc.Plans))
+		for j, plan := range svc.Plans {
+			if version.Before(planBindableVersion) {
+				plan.Bindable = false
+			}
+			if version.Before(planSchemasVersion) {
+				plan.Schemas = nil
+			}
+			plans[j] = plan
+		}
+		svc.Plans = plans
+		shaped.Services[i] = svc
+	}
+	return shaped
+}
@@ -0,0 +1,204 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/automationbroker/config"
+	"github.com/openshift/ansible-service-broker/pkg/broker"
+	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
+	"github.com/pborman/uuid"
+)
+
+func TestParseAPIVersion(t *testing.T) {
+	cases := []struct {
+		in       string
+		expected APIVersion
+		valid    bool
+	}{
+		{in: "2.13", expected: APIVersion{Major: 2, Minor: 13}, valid: true},
+		{in: " 2.9 ", expected: APIVersion{Major: 2, Minor: 9}, valid: true},
+		{in: "2"},
+		{in: "2.13.1"},
+		{in: "two.13"},
+		{in: "2.-1"},
+		{in: ""},
+	}
+	for _, tc := range cases {
+		version, err := ParseAPIVersion(tc.in)
+		ft.AssertEqual(t, err == nil, tc.valid, tc.in)
+		ft.AssertEqual(t, version, tc.expected, tc.in)
+	}
+}
+
+func TestAPIVersionBefore(t *testing.T) {
+	ft.AssertTrue(t, APIVersion{2, 9}.Before(APIVersion{2, 13}))
+	ft.AssertTrue(t, APIVersion{1, 20}.Before(APIVersion{2, 0}))
+	ft.AssertFalse(t, APIVersion{2, 13}.Before(APIVersion{2, 13}))
+	ft.AssertFalse(t, APIVersion{3, 0}.Before(APIVersion{2, 14}))
+}
+
+func TestAPIVersionHandler(t *testing.T) {
+	cases := []struct {
+		name         string
+		header       string
+		expectedCode int
+	}{
+		{name: "supported version", header: "2.13", expectedCode: http.StatusOK},
+		{name: "oldest version", header: "2.12", expectedCode: http.StatusOK},
+		{name: "missing header", expectedCode: http.StatusPreconditionFailed},
+		{name: "malformed header", header: "latest", expectedCode: http.StatusPreconditionFailed},
+		{name: "older version", header: "2.11", expectedCode: http.StatusPreconditionFailed},
+		{name: "newer version", header: "2.15", expectedCode: http.StatusPreconditionFailed},
+		{name: "newer major version", header: "3.0", expectedCode: http.StatusPreconditionFailed},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var negotiated APIVersion
+			h := NewAPIVersionHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				negotiated = requestAPIVersion(r)
+			}), APIVersion{2, 12}, APIVersion{2, 14})
+			r := httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+			if tc.header != "" {
+				r.Header.Set(APIVersionHeader, tc.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			ft.AssertEqual(t, w.Code, tc.expectedCode, w.Body.String())
+			if tc.expectedCode == http.StatusOK {
+				ft.AssertEqual(t, negotiated.String(), tc.header)
+			}
+		})
+	}
+}
+
+func TestRequireAPIVersion(t *testing.T) {
+	testhandler := NewHandler(MockBroker{Name: "testbroker"}, &config.Config{}, "", nil, nil)
+	path := "/v2/service_instances/" + uuid.New() + "/service_bindings/" + uuid.New() + "/last_operation?operation=token"
+	for header, expectedCode := range map[string]int{
+		"2.13": http.StatusPreconditionFailed,
+		"2.14": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set(APIVersionHeader, header)
+		w := httptest.NewRecorder()
+		testhandler.ServeHTTP(w, r)
+		ft.AssertEqual(t, w.Code, expectedCode, header)
+	}
+}
+
+func TestAPIVersionRange(t *testing.T) {
+	cases := []struct {
+		name string
+		file string
+		min  APIVersion
+		max  APIVersion
+	}{
+		{name: "defaults", file: "testdata/broker.yaml", min: MinAPIVersion, max: MaxAPIVersion},
+		{name: "configured", file: "testdata/api_version_broker.yaml", min: APIVersion{2, 13}, max: APIVersion{2, 13}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := config.CreateConfig(tc.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			min, max := apiVersionRange(c)
+			ft.AssertEqual(t, min, tc.min)
+			ft.AssertEqual(t, max, tc.max)
+		})
+	}
+}
+
+func TestShapeCatalog(t *testing.T) {
+	catalog := &broker.CatalogResponse{Services: []broker.Service{{
+		Name:                 "mediawiki",
+		InstancesRetrievable: true,
+		BindingsRetrievable:  true,
+		Plans: []broker.Plan{{
+			Name:     "default",
+			Bindable: true,
+			Schemas:  &broker.Schema{},
+		}},
+	}}}
+	cases := []struct {
+		version        APIVersion
+		serviceFields  []string
+		planFields     []string
+		omittedService []string
+		omittedPlan    []string
+	}{
+		{
+			version:       APIVersion{2, 14},
+			serviceFields: []string{"instances_retrievable", "bindings_retrievable"},
+			planFields:    []string{"bindable", "schemas"},
+		},
+		{
+			version:        APIVersion{2, 13},
+			planFields:     []string{"bindable", "schemas"},
+			omittedService: []string{"instances_retrievable", "bindings_retrievable"},
+		},
+		{
+			version:        APIVersion{2, 12},
+			planFields:     []string{"bindable"},
+			omittedService: []string{"instances_retrievable", "bindings_retrievable"},
+			omittedPlan:    []string{"schemas"},
+		},
+		{
+			version:        APIVersion{2, 11},
+			omittedService: []string{"instances_retrievable", "bindings_retrievable"},
+			omittedPlan:    []string{"bindable", "schemas"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.version.String(), func(t *testing.T) {
+			b, err := json.Marshal(shapeCatalog(catalog, tc.version))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var raw map[string][]map[string]interface{}
+			if err := json.Unmarshal(b, &raw); err != nil {
+				t.Fatal(err)
+			}
+			service := raw["services"][0]
+			plan := service["plans"].([]interface{})[0].(map[string]interface{})
+			for _, field := range tc.serviceFields {
+				_, ok := service[field]
+				ft.AssertTrue(t, ok, field)
+			}
+			for _, field := range tc.omittedService {
+				_, ok := service[field]
+				ft.AssertFalse(t, ok, field)
+			}
+			for _, field := range tc.planFields {
+				_, ok := plan[field]
+				ft.AssertTrue(t, ok, field)
+			}
+			for _, field := range tc.omittedPlan {
+				_, ok := plan[field]
+				ft.AssertFalse(t, ok, field)
+			}
+		})
+	}
+	// the catalog of the broker is left untouched
+	ft.AssertTrue(t, catalog.Services[0].InstancesRetrievable)
+	ft.AssertNotNil(t, catalog.Services[0].Plans[0].Schemas)
+}
@@ -0,0 +1,130 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package leader
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// RecordAnnotationKey - the annotation of the config map holding the record,
+// the same one the Kubernetes controllers use.
+const RecordAnnotationKey = "control-plane.alpha.kubernetes.io/leader"
+
+// ConfigMapLock - keeps the record in an annotation of a config map. The
+// coordination.k8s.io Lease API is not available to the broker's client, the
+// config map lock has the same semantics: updates are rejected with a
+// conflict if the config map changed since it was read.
+type ConfigMapLock struct {
+	Namespace string
+	Name      string
+	Client    corev1.ConfigMapsGetter
+
+	mutex sync.Mutex
+	cm    *v1.ConfigMap
+}
+
+// Get - returns the record of the config map, ErrorNoRecord if the config
+// map or its annotation does not exist.
+func (l *ConfigMapLock) Get() (*Record, error) {
+	cm, err := l.Client.ConfigMaps(l.Namespace).Get(l.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		l.mutex.Lock()
+		l.cm = nil
+		l.mutex.Unlock()
+		return nil, ErrorNoRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.mutex.Lock()
+	l.cm = cm
+	l.mutex.Unlock()
+	value, ok := cm.Annotations[RecordAnnotationKey]
+	if !ok {
+		return nil, ErrorNoRecord
+	}
+	record := &Record{}
+	if err := json.Unmarshal([]byte(value), record); err != nil {
+		return nil, fmt.Errorf("invalid leader election record in %s - %v", l.Describe(), err)
+	}
+	return record, nil
+}
+
+// Create - creates the config map holding the record. If the config map
+// exists without a record, the record is added to it.
+func (l *ConfigMapLock) Create(record Record) error {
+	l.mutex.Lock()
+	existing := l.cm
+	l.mutex.Unlock()
+	if existing != nil {
+		return l.Update(record)
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	cm, err := l.Client.ConfigMaps(l.Namespace).Create(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        l.Name,
+			Namespace:   l.Namespace,
+			Annotations: map[string]string{RecordAnnotationKey: string(value)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	l.cm = cm
+	l.mutex.Unlock()
+	return nil
+}
+
+// Update - saves the record in the config map last returned by Get.
+func (l *ConfigMapLock) Update(record Record) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.cm == nil {
+		return fmt.Errorf("%s must be read before it is updated", l.Describe())
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	cm := l.cm.DeepCopy()
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	cm.Annotations[RecordAnnotationKey] = string(value)
+	updated, err := l.Client.ConfigMaps(l.Namespace).Update(cm)
+	if err != nil {
+		return err
+	}
+	l.cm = updated
+	return nil
+}
+
+// Describe - the namespace and name of the config map.
+func (l *ConfigMapLock) Describe() string {
+	return fmt.Sprintf("config map %s/%s", l.Namespace, l.Name)
+}
@@ -0,0 +1,274 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package leader elects the broker replica that runs the jobs, the bootstrap
+// and the recovery. The other replicas follow and only serve read requests.
+package leader
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrorNoRecord - returned by a Lock that does not hold a record yet.
+var ErrorNoRecord = errors.New("no leader election record")
+
+// Record - the leader election record kept by a Lock.
+type Record struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	HolderAddress        string    `json:"holderAddress,omitempty"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+	LeaderTransitions    int       `json:"leaderTransitions"`
+}
+
+// Lock - keeps the leader election record. Update must fail if the record
+// was changed since it was last returned by Get.
+type Lock interface {
+	Get() (*Record, error)
+	Create(record Record) error
+	Update(record Record) error
+	// Describe - a human readable name of the lock, used in the logs.
+	Describe() string
+}
+
+// Config - the settings of an Elector.
+type Config struct {
+	Lock Lock
+	// Identity - the unique name of the replica, the name of its pod.
+	Identity string
+	// Address - the URL the other replicas forward requests for the leader
+	// to.
+	Address string
+	// LeaseDuration - how long followers wait after the last renewal before
+	// taking over the lead.
+	LeaseDuration time.Duration
+	// RenewDeadline - how long the leader keeps trying to renew its lease
+	// before giving up the lead.
+	RenewDeadline time.Duration
+	// RetryPeriod - how often the lock is tried.
+	RetryPeriod time.Duration
+	// OnStartedLeading - called once the lead is acquired. The stop channel
+	// is closed when the lead is lost.
+	OnStartedLeading func(stop <-chan struct{})
+	// OnStoppedLeading - called once the lead is lost.
+	OnStoppedLeading func()
+	// OnNewLeader - called when another replica is observed as the leader.
+	OnNewLeader func(identity string)
+}
+
+// Elector - takes part in the election of the leader, renewing the lease of
+// the record while it leads.
+type Elector struct {
+	config Config
+	now    func() time.Time
+
+	mutex        sync.RWMutex
+	observed     Record
+	observedTime time.Time
+	leading      bool
+}
+
+// NewElector - validates the config and creates the elector.
+func NewElector(config Config) (*Elector, error) {
+	switch {
+	case config.Lock == nil:
+		return nil, errors.New("leader election requires a lock")
+	case config.Identity == "":
+		return nil, errors.New("leader election requires an identity")
+	case config.RetryPeriod <= 0:
+		return nil, errors.New("retry period must be positive")
+	case config.RenewDeadline <= config.RetryPeriod:
+		return nil, fmt.Errorf("renew deadline %v must be longer than the retry period %v",
+			config.RenewDeadline, config.RetryPeriod)
+	case config.LeaseDuration <= config.RenewDeadline:
+		return nil, fmt.Errorf("lease duration %v must be longer than the renew deadline %v",
+			config.LeaseDuration, config.RenewDeadline)
+	}
+	return &Elector{config: config, now: time.Now}, nil
+}
+
+// Run - tries to acquire the lead until stopped, then renews it until it is
+// lost or stopped. The lead is released when stopped, so that another replica
+// takes over without waiting for the lease to expire.
+func (e *Elector) Run(stop <-chan struct{}) {
+	if !e.acquire(stop) {
+		return
+	}
+	leading := make(chan struct{})
+	if e.config.OnStartedLeading != nil {
+		go e.config.OnStartedLeading(leading)
+	}
+	e.renew(stop)
+	close(leading)
+	e.setLeading(false)
+	if e.config.OnStoppedLeading != nil {
+		e.config.OnStoppedLeading()
+	}
+}
+
+// IsLeader - true while this replica leads.
+func (e *Elector) IsLeader() bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.leading
+}
+
+// Leader - the identity and address of the last observed leader, empty if
+// there is none.
+func (e *Elector) Leader() (string, string) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.observed.HolderIdentity, e.observed.HolderAddress
+}
+
+func (e *Elector) acquire(stop <-chan struct{}) bool {
+	log.Infof("attempting to acquire the lead from %s as %s", e.config.Lock.Describe(), e.config.Identity)
+	ticker := time.NewTicker(e.config.RetryPeriod)
+	defer ticker.Stop()
+	for {
+		if e.tryAcquireOrRenew() {
+			log.Infof("%s acquired the lead", e.config.Identity)
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// renew - renews the lease every retry period. Returns once the lease could
+// not be renewed for the renew deadline, or once stopped.
+func (e *Elector) renew(stop <-chan struct{}) {
+	ticker := time.NewTicker(e.config.RetryPeriod)
+	defer ticker.Stop()
+	lastRenew := e.now()
+	for {
+		select {
+		case <-ticker.C:
+			if e.tryAcquireOrRenew() {
+				lastRenew = e.now()
+				continue
+			}
+			if e.now().Sub(lastRenew) >= e.config.RenewDeadline {
+				log.Errorf("%s failed to renew its lease for %v, giving up the lead", e.config.Identity, e.config.RenewDeadline)
+				return
+			}
+		case <-stop:
+			e.release()
+			return
+		}
+	}
+}
+
+// tryAcquireOrRenew - takes the lead if the record is free or its lease
+// expired, or renews the lease if this replica holds it. Returns true if
+// this replica leads.
+func (e *Elector) tryAcquireOrRenew() bool {
+	now := e.now()
+	record := Record{
+		HolderIdentity:       e.config.Identity,
+		HolderAddress:        e.config.Address,
+		LeaseDurationSeconds: int(e.config.LeaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	current, err := e.config.Lock.Get()
+	if err == ErrorNoRecord {
+		if err := e.config.Lock.Create(record); err != nil {
+			log.Errorf("unable to create the leader election record - %v", err)
+			return false
+		}
+		e.observe(record, now)
+		return true
+	}
+	if err != nil {
+		log.Errorf("unable to get the leader election record - %v", err)
+		return false
+	}
+
+	e.observe(*current, now)
+	held := current.HolderIdentity != "" && current.HolderIdentity != e.config.Identity
+	if held && e.observedTime.Add(e.config.LeaseDuration).After(now) {
+		// the lease of another replica has not expired yet
+		return false
+	}
+
+	if current.HolderIdentity == e.config.Identity {
+		record.AcquireTime = current.AcquireTime
+		record.LeaderTransitions = current.LeaderTransitions
+	} else {
+		record.LeaderTransitions = current.LeaderTransitions + 1
+	}
+	if err := e.config.Lock.Update(record); err != nil {
+		log.Errorf("unable to update the leader election record - %v", err)
+		return false
+	}
+	e.observe(record, now)
+	return true
+}
+
+// observe - keeps the record last read from the lock. The lease of another
+// replica is timed from when its record was last seen changing, so that the
+// clocks of the replicas do not have to agree.
+func (e *Elector) observe(record Record, now time.Time) {
+	e.mutex.Lock()
+	newLeader := e.observed.HolderIdentity != record.HolderIdentity
+	if e.observed != record {
+		e.observed = record
+		e.observedTime = now
+	}
+	e.leading = record.HolderIdentity == e.config.Identity
+	e.mutex.Unlock()
+
+	if newLeader && record.HolderIdentity != "" && record.HolderIdentity != e.config.Identity {
+		log.Infof("%s is the leader", record.HolderIdentity)
+		if e.config.OnNewLeader != nil {
+			e.config.OnNewLeader(record.HolderIdentity)
+		}
+	}
+}
+
+func (e *Elector) setLeading(leading bool) {
+	e.mutex.Lock()
+	e.leading = leading
+	e.mutex.Unlock()
+}
+
+// release - gives up the lead by clearing the holder of the record.
+func (e *Elector) release() {
+	if !e.IsLeader() {
+		return
+	}
+	e.mutex.RLock()
+	record := e.observed
+	e.mutex.RUnlock()
+	record.HolderIdentity = ""
+	record.HolderAddress = ""
+	if err := e.config.Lock.Update(record); err != nil {
+		log.Errorf("unable to release the lead - %v", err)
+		return
+	}
+	log.Infof("%s released the lead", e.config.Identity)
+}
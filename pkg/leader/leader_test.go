@@ -0,0 +1,282 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package leader
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	ft "github.com/openshift/ansible-service-broker/pkg/fusortest"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// configMapStore - the config maps of a fake API server, shared by the
+// clients of the replicas.
+type configMapStore struct {
+	mutex      sync.Mutex
+	configMaps map[string]*v1.ConfigMap
+	version    int
+}
+
+// fakeConfigMaps - a config map client of one replica, its requests fail
+// while the replica is partitioned from the API server.
+type fakeConfigMaps struct {
+	corev1.ConfigMapInterface
+	store       *configMapStore
+	mutex       sync.Mutex
+	partitioned bool
+}
+
+func (f *fakeConfigMaps) ConfigMaps(namespace string) corev1.ConfigMapInterface {
+	return f
+}
+
+func (f *fakeConfigMaps) partition(partitioned bool) {
+	f.mutex.Lock()
+	f.partitioned = partitioned
+	f.mutex.Unlock()
+}
+
+func (f *fakeConfigMaps) reachable() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.partitioned {
+		return fmt.Errorf("connection refused")
+	}
+	return nil
+}
+
+func (f *fakeConfigMaps) Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error) {
+	if err := f.reachable(); err != nil {
+		return nil, err
+	}
+	f.store.mutex.Lock()
+	defer f.store.mutex.Unlock()
+	cm, ok := f.store.configMaps[name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	return cm.DeepCopy(), nil
+}
+
+func (f *fakeConfigMaps) Create(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	if err := f.reachable(); err != nil {
+		return nil, err
+	}
+	f.store.mutex.Lock()
+	defer f.store.mutex.Unlock()
+	if _, ok := f.store.configMaps[cm.Name]; ok {
+		return nil, apierrors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+	}
+	return f.store.save(cm), nil
+}
+
+func (f *fakeConfigMaps) Update(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	if err := f.reachable(); err != nil {
+		return nil, err
+	}
+	f.store.mutex.Lock()
+	defer f.store.mutex.Unlock()
+	existing, ok := f.store.configMaps[cm.Name]
+	if !ok {
+		return nil, apierrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+	}
+	if existing.ResourceVersion != cm.ResourceVersion {
+		return nil, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, cm.Name,
+			fmt.Errorf("the object has been modified"))
+	}
+	return f.store.save(cm), nil
+}
+
+func (s *configMapStore) save(cm *v1.ConfigMap) *v1.ConfigMap {
+	s.version++
+	saved := cm.DeepCopy()
+	saved.ResourceVersion = fmt.Sprintf("%d", s.version)
+	s.configMaps[cm.Name] = saved
+	return saved.DeepCopy()
+}
+
+type replica struct {
+	elector *Elector
+	client  *fakeConfigMaps
+	stop    chan struct{}
+	started chan struct{}
+	stopped chan struct{}
+	done    chan struct{}
+}
+
+func newReplica(t *testing.T, store *configMapStore, identity string) *replica {
+	r := &replica{
+		client:  &fakeConfigMaps{store: store},
+		stop:    make(chan struct{}),
+		started: make(chan struct{}),
+		stopped: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	elector, err := NewElector(Config{
+		Lock:          &ConfigMapLock{Namespace: "broker", Name: "broker-leader", Client: r.client},
+		Identity:      identity,
+		Address:       fmt.Sprintf("https://%s:1338", identity),
+		LeaseDuration: 400 * time.Millisecond,
+		RenewDeadline: 200 * time.Millisecond,
+		RetryPeriod:   50 * time.Millisecond,
+		OnStartedLeading: func(stop <-chan struct{}) {
+			close(r.started)
+		},
+		OnStoppedLeading: func() {
+			close(r.stopped)
+		},
+	})
+	ft.AssertNil(t, err)
+	r.elector = elector
+	return r
+}
+
+func (r *replica) run() {
+	go func() {
+		r.elector.Run(r.stop)
+		close(r.done)
+	}()
+}
+
+func waitFor(t *testing.T, c <-chan struct{}, what string) {
+	select {
+	case <-c:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestElectorFailoverOnRelease(t *testing.T) {
+	store := &configMapStore{configMaps: map[string]*v1.ConfigMap{}}
+	a := newReplica(t, store, "broker-a")
+	b := newReplica(t, store, "broker-b")
+
+	a.run()
+	waitFor(t, a.started, "broker-a to lead")
+	ft.AssertTrue(t, a.elector.IsLeader())
+
+	b.run()
+	time.Sleep(200 * time.Millisecond)
+	ft.AssertFalse(t, b.elector.IsLeader())
+	identity, address := b.elector.Leader()
+	ft.AssertEqual(t, identity, "broker-a")
+	ft.AssertEqual(t, address, "https://broker-a:1338")
+
+	// a stopped leader releases the lead straight away
+	close(a.stop)
+	waitFor(t, a.stopped, "broker-a to stop leading")
+	waitFor(t, b.started, "broker-b to lead")
+	ft.AssertFalse(t, a.elector.IsLeader())
+	ft.AssertTrue(t, b.elector.IsLeader())
+
+	record, err := (&ConfigMapLock{Namespace: "broker", Name: "broker-leader", Client: b.client}).Get()
+	ft.AssertNil(t, err)
+	ft.AssertEqual(t, record.HolderIdentity, "broker-b")
+	ft.AssertEqual(t, record.LeaderTransitions, 1)
+	close(b.stop)
+	waitFor(t, b.done, "broker-b to stop")
+}
+
+func TestElectorFailoverOnLostLease(t *testing.T) {
+	store := &configMapStore{configMaps: map[string]*v1.ConfigMap{}}
+	a := newReplica(t, store, "broker-a")
+	b := newReplica(t, store, "broker-b")
+
+	a.run()
+	waitFor(t, a.started, "broker-a to lead")
+	b.run()
+
+	// the leader gives up the lead once it can not renew its lease, the
+	// follower takes over once the lease expired
+	a.client.partition(true)
+	waitFor(t, a.stopped, "broker-a to stop leading")
+	waitFor(t, a.done, "broker-a to return")
+	waitFor(t, b.started, "broker-b to lead")
+	identity, _ := b.elector.Leader()
+	ft.AssertEqual(t, identity, "broker-b")
+	close(b.stop)
+	waitFor(t, b.done, "broker-b to stop")
+}
+
+func TestElectorWaitsForLeaseToExpire(t *testing.T) {
+	store := &configMapStore{configMaps: map[string]*v1.ConfigMap{}}
+	a := newReplica(t, store, "broker-a")
+	b := newReplica(t, store, "broker-b")
+
+	ft.AssertTrue(t, a.elector.tryAcquireOrRenew())
+	ft.AssertFalse(t, b.elector.tryAcquireOrRenew())
+
+	// the lease is timed from when b first saw the record
+	now := time.Now()
+	b.elector.now = func() time.Time { return now.Add(time.Second) }
+	ft.AssertTrue(t, b.elector.tryAcquireOrRenew())
+	ft.AssertTrue(t, b.elector.IsLeader())
+	ft.AssertFalse(t, a.elector.tryAcquireOrRenew())
+	ft.AssertFalse(t, a.elector.IsLeader())
+}
+
+func TestConfigMapLockConflict(t *testing.T) {
+	store := &configMapStore{configMaps: map[string]*v1.ConfigMap{}}
+	first := &ConfigMapLock{Namespace: "broker", Name: "broker-leader", Client: &fakeConfigMaps{store: store}}
+	second := &ConfigMapLock{Namespace: "broker", Name: "broker-leader", Client: &fakeConfigMaps{store: store}}
+
+	_, err := first.Get()
+	ft.AssertEqual(t, err, ErrorNoRecord)
+	ft.AssertNil(t, first.Create(Record{HolderIdentity: "broker-a"}))
+
+	_, err = first.Get()
+	ft.AssertNil(t, err)
+	_, err = second.Get()
+	ft.AssertNil(t, err)
+	ft.AssertNil(t, first.Update(Record{HolderIdentity: "broker-a"}))
+	err = second.Update(Record{HolderIdentity: "broker-b"})
+	ft.AssertTrue(t, apierrors.IsConflict(err))
+
+	record, err := second.Get()
+	ft.AssertNil(t, err)
+	ft.AssertEqual(t, record.HolderIdentity, "broker-a")
+}
+
+func TestNewElector(t *testing.T) {
+	lock := &ConfigMapLock{}
+	valid := Config{
+		Lock:          lock,
+		Identity:      "broker-a",
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+	}
+	_, err := NewElector(valid)
+	ft.AssertNil(t, err)
+
+	noIdentity := valid
+	noIdentity.Identity = ""
+	_, err = NewElector(noIdentity)
+	ft.AssertNotNil(t, err)
+
+	shortLease := valid
+	shortLease.LeaseDuration = 5 * time.Second
+	_, err = NewElector(shortLease)
+	ft.AssertNotNil(t, err)
+}
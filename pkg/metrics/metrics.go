@@ -17,6 +17,8 @@
 package metrics
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
@@ -84,12 +86,55 @@ var (
 			Help:      "How many unbinding jobs are actively in the buffer.",
 		})
 
+	queuedJobs = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Subsystem: subsystem,
+			Name:      "queued_jobs",
+			Help:      "How many jobs are waiting for an available worker.",
+		})
+
 	requests = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Subsystem: subsystem,
 			Name:      "actions_requested",
 			Help:      "How many actions have been made.",
 		}, []string{"action"})
+
+	reconciledJobs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: subsystem,
+			Name:      "reconciled_jobs_total",
+			Help:      "How many jobs the reconciler resumed, finalized, failed or stopped.",
+		}, []string{"action"})
+
+	daoCacheReads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: subsystem,
+			Name:      "dao_cache_reads_total",
+			Help:      "How many reads of the dao were served from the cache or the API server.",
+		}, []string{"resource", "source"})
+
+	daoCacheLag = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Subsystem: subsystem,
+			Name:      "dao_cache_lag_seconds",
+			Help:      "How long the cache took to observe a write of the dao.",
+			Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"resource"})
+
+	daoCachePendingWrites = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: subsystem,
+			Name:      "dao_cache_pending_writes",
+			Help:      "How many writes of the dao the cache has not observed yet.",
+		}, []string{"resource"})
+
+	daoCacheStaleness = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: subsystem,
+			Name:      "dao_cache_staleness_seconds",
+			Help:      "The age of the oldest write of the dao the cache has not observed yet.",
+		}, []string{"resource"})
 )
 
 func init() {
@@ -99,7 +144,13 @@ func init() {
 	prometheus.MustRegister(provisionJob)
 	prometheus.MustRegister(deprovisionJob)
 	prometheus.MustRegister(updateJob)
+	prometheus.MustRegister(queuedJobs)
 	prometheus.MustRegister(requests)
+	prometheus.MustRegister(reconciledJobs)
+	prometheus.MustRegister(daoCacheReads)
+	prometheus.MustRegister(daoCacheLag)
+	prometheus.MustRegister(daoCachePendingWrites)
+	prometheus.MustRegister(daoCacheStaleness)
 }
 
 // We will never want to panic our app because of metric saving.
@@ -189,8 +240,42 @@ func UnbindJobFinished() {
 	unbindingJob.Dec()
 }
 
+// JobsQueued - Set the number of jobs waiting for an available worker.
+func JobsQueued(count int) {
+	defer recoverMetricPanic()
+	queuedJobs.Set(float64(count))
+}
+
 // ActionStarted - Registers that an action has been started.
 func ActionStarted(action string) {
 	defer recoverMetricPanic()
 	requests.WithLabelValues(action).Inc()
 }
+
+// JobReconciled - Registers that the reconciler acted on a job.
+func JobReconciled(action string) {
+	defer recoverMetricPanic()
+	reconciledJobs.WithLabelValues(action).Inc()
+}
+
+// DaoCacheRead - Registers that a read of the dao was served from the cache
+// or the API server.
+func DaoCacheRead(resource string, source string) {
+	defer recoverMetricPanic()
+	daoCacheReads.WithLabelValues(resource, source).Inc()
+}
+
+// DaoCacheWriteObserved - Registers how long the cache took to observe a
+// write of the dao.
+func DaoCacheWriteObserved(resource string, lag time.Duration) {
+	defer recoverMetricPanic()
+	daoCacheLag.WithLabelValues(resource).Observe(lag.Seconds())
+}
+
+// DaoCacheStaleness - Set the writes of the dao the cache has not observed
+// yet and the age of the oldest one.
+func DaoCacheStaleness(resource string, pending int, oldest time.Duration) {
+	defer recoverMetricPanic()
+	daoCachePendingWrites.WithLabelValues(resource).Set(float64(pending))
+	daoCacheStaleness.WithLabelValues(resource).Set(oldest.Seconds())
+}
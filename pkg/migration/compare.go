@@ -0,0 +1,121 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package migration
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+)
+
+// compare - a mismatchError if the fields of the records differ once encoded
+// as json, so that maps are compared regardless of their order and numbers
+// regardless of their type.
+func compare(expected interface{}, actual interface{}) error {
+	e, err := json.Marshal(expected)
+	if err != nil {
+		return err
+	}
+	a, err := json.Marshal(actual)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(e, a) {
+		return mismatchError{fmt.Sprintf("expected %s, got %s", e, a)}
+	}
+	return nil
+}
+
+// The fields of the records every dao keeps, the same as the conformance
+// suite of the daos checks. The rest may be dropped or filled in by a dao.
+
+func specFields(s *bundle.Spec) interface{} {
+	plans := []string{}
+	for _, plan := range s.Plans {
+		plans = append(plans, fmt.Sprintf("%s/%s", plan.ID, plan.Name))
+	}
+	return struct {
+		ID          string
+		FQName      string
+		Image       string
+		Runtime     int
+		Version     string
+		Bindable    bool
+		Description string
+		Tags        []string
+		Metadata    map[string]interface{}
+		Plans       []string
+	}{s.ID, s.FQName, s.Image, s.Runtime, s.Version, s.Bindable, s.Description, s.Tags, s.Metadata, plans}
+}
+
+func serviceInstanceFields(si *bundle.ServiceInstance) interface{} {
+	specID := ""
+	if si.Spec != nil {
+		specID = si.Spec.ID
+	}
+	return struct {
+		ID           string
+		SpecID       string
+		Context      *bundle.Context
+		Parameters   *bundle.Parameters
+		DashboardURL string
+		Bindings     []string
+	}{si.ID.String(), specID, si.Context, si.Parameters, si.DashboardURL, boundIDs(si.BindingIDs)}
+}
+
+func bindInstanceFields(bi *bundle.BindInstance) interface{} {
+	return struct {
+		ID         string
+		ServiceID  string
+		Parameters *bundle.Parameters
+	}{bi.ID.String(), bi.ServiceID.String(), bi.Parameters}
+}
+
+func jobStateFields(js bundle.JobState) interface{} {
+	return struct {
+		Token       string
+		State       bundle.State
+		Method      bundle.JobMethod
+		Podname     string
+		Description string
+		Error       string
+	}{js.Token, js.State, js.Method, js.Podname, js.Description, js.Error}
+}
+
+func deadLetterFields(l *types.DeadLetter) interface{} {
+	payload := l.Payload
+	compacted := &bytes.Buffer{}
+	if json.Compact(compacted, l.Payload) == nil {
+		payload = compacted.Bytes()
+	}
+	return struct {
+		ID           string
+		SubscriberID string
+		Topic        string
+		JobToken     string
+		Payload      string
+		Error        string
+		Attempts     int
+		CreatedAt    time.Time
+		NextAttempt  time.Time
+	}{l.ID, l.SubscriberID, l.Topic, l.JobToken, string(payload), l.Error, l.Attempts,
+		l.CreatedAt.UTC(), l.NextAttempt.UTC()}
+}
@@ -0,0 +1,137 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package migration
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/automationbroker/bundle-lib/clients"
+	"github.com/automationbroker/config"
+	"github.com/coreos/etcd/client"
+	etcdtransport "github.com/coreos/etcd/pkg/transport"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	etcd "github.com/openshift/ansible-service-broker/pkg/dao/etcd"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// NewDao - the dao configured by the dao section of a broker config file.
+// The etcd client of bundle-lib is a singleton, an etcd dao gets a client of
+// its own so that two daos can use different etcd servers.
+func NewDao(file string) (dao.Dao, error) {
+	c, err := config.CreateConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if daoType := strings.ToLower(c.GetString("dao.type")); daoType != "crd" && daoType != "memory" && daoType != "sql" {
+		kapi, err := etcdKeysAPI(clients.EtcdConfig{
+			EtcdHost:       c.GetString("dao.etcd_host"),
+			EtcdPort:       c.GetInt("dao.etcd_port"),
+			EtcdCaFile:     c.GetString("dao.etcd_ca_file"),
+			EtcdClientKey:  c.GetString("dao.etcd_client_key"),
+			EtcdClientCert: c.GetString("dao.etcd_client_cert"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return etcd.NewDaoWithKeysAPI(kapi), nil
+	}
+	return dao.NewDao(c)
+}
+
+// etcdKeysAPI - a kvp API of a new etcd client, set up the way bundle-lib
+// sets up the client of the broker.
+func etcdKeysAPI(ec clients.EtcdConfig) (client.KeysAPI, error) {
+	scheme := "http"
+	transport := client.DefaultTransport
+	if ec.EtcdCaFile != "" || ec.EtcdClientCert != "" || ec.EtcdClientKey != "" {
+		info := etcdtransport.TLSInfo{CAFile: ec.EtcdCaFile}
+		if ec.EtcdClientCert != "" && ec.EtcdClientKey != "" {
+			info.CertFile = ec.EtcdClientCert
+			info.KeyFile = ec.EtcdClientKey
+		}
+		tlsConfig, err := info.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			Dial: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).Dial,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     tlsConfig,
+		}
+	}
+	if ec.EtcdCaFile != "" {
+		scheme = "https"
+	}
+	c, err := client.New(client.Config{
+		Endpoints:               []string{fmt.Sprintf("%s://%s:%v", scheme, ec.EtcdHost, ec.EtcdPort)},
+		Transport:               transport,
+		HeaderTimeoutPerRequest: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client.NewKeysAPI(c), nil
+}
+
+// SecretCredentials - the secrets of a namespace holding the extracted
+// credentials. A CredentialStore, and the one of the backups.
+type SecretCredentials struct {
+	k8scli    *clients.KubernetesClient
+	namespace string
+}
+
+// NewSecretCredentials - the secrets of the namespace holding the extracted
+// credentials.
+func NewSecretCredentials(k8scli *clients.KubernetesClient, namespace string) SecretCredentials {
+	return SecretCredentials{k8scli: k8scli, namespace: namespace}
+}
+
+// Save - saves the extracted credentials of the instance or binding.
+func (s SecretCredentials) Save(id string, credentials map[string]interface{}, labels map[string]string) error {
+	err := s.k8scli.SaveExtractedCredentialSecret(id, s.namespace, credentials, labels)
+	if errors.IsAlreadyExists(err) {
+		return s.k8scli.UpdateExtractedCredentialSecret(id, s.namespace, credentials, labels)
+	}
+	return err
+}
+
+// Get - the extracted credentials of the instance or binding.
+func (s SecretCredentials) Get(id string) (map[string]interface{}, error) {
+	return s.k8scli.GetExtractedCredentialSecretData(id, s.namespace)
+}
+
+// Namespace - the namespace of the secrets.
+func (s SecretCredentials) Namespace() string {
+	return s.namespace
+}
+
+// Exists - whether there is a secret for the instance or binding.
+func (s SecretCredentials) Exists(id string) (bool, error) {
+	_, err := s.k8scli.GetExtractedCredentialSecretData(id, s.namespace)
+	if err == clients.ErrCredentialsNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
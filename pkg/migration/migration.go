@@ -0,0 +1,446 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package migration - copies the records of the broker from one dao.Dao to
+// another, e.g. from etcd to CRDs, and verifies the copy.
+package migration
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kind - a kind of record of the broker.
+type Kind string
+
+const (
+	// KindSpec - the spec of a bundle.
+	KindSpec Kind = "spec"
+	// KindServiceInstance - a provisioned service instance.
+	KindServiceInstance Kind = "service instance"
+	// KindBindInstance - a binding of a service instance.
+	KindBindInstance Kind = "bind instance"
+	// KindJobState - the state of a job of an instance or a binding.
+	KindJobState Kind = "job state"
+	// KindDeadLetter - a job message no subscriber could handle.
+	KindDeadLetter Kind = "dead letter"
+	// KindExtractedCredentials - the credentials of an instance or a binding
+	// kept in etcd by older brokers.
+	KindExtractedCredentials Kind = "extracted credentials"
+)
+
+// kinds - the kinds in the order they are migrated. A record is written after
+// the records it refers to.
+var kinds = []Kind{
+	KindSpec,
+	KindServiceInstance,
+	KindBindInstance,
+	KindJobState,
+	KindDeadLetter,
+	KindExtractedCredentials,
+}
+
+// listPageSize - how many job states are read from the source at once.
+const listPageSize = 500
+
+// RawGetter - a dao able to read any key, like the etcd dao.
+type RawGetter interface {
+	GetRaw(key string) (string, error)
+}
+
+// CredentialStore - where the extracted credentials kept in etcd by older
+// brokers are moved to, the secrets of the namespace of the broker.
+type CredentialStore interface {
+	Save(id string, credentials map[string]interface{}, labels map[string]string) error
+	Get(id string) (map[string]interface{}, error)
+}
+
+// record - a record of the source to write to the target.
+type record struct {
+	kind Kind
+	id   string
+	// write - saves the record to the target.
+	write func(target dao.Dao) error
+	// check - reads the record back from the target and compares it with
+	// the record of the source, a mismatchError if they differ.
+	check func(target dao.Dao) error
+}
+
+// key - identifies the record in the progress file.
+func (r record) key() string {
+	return fmt.Sprintf("%s/%s", r.kind, r.id)
+}
+
+// mismatchError - the record of the target differs from the source.
+type mismatchError struct {
+	reason string
+}
+
+func (e mismatchError) Error() string {
+	return e.reason
+}
+
+// Plan - the records to migrate, in the order they are written. The records
+// of the source left out are in the report of the plan.
+type Plan struct {
+	records []record
+	// Report - the records skipped or corrupted in the source.
+	Report *Report
+}
+
+func (p *Plan) add(r record) {
+	p.records = append(p.records, r)
+	p.Report.add(r.kind, r.id, OutcomePlanned, "")
+}
+
+// Write - prints the records of the plan.
+func (p *Plan) Write(w io.Writer) {
+	for _, r := range p.records {
+		fmt.Fprintf(w, "migrate %s %s\n", r.kind, r.id)
+	}
+	p.Report.Write(w)
+}
+
+// Migrator - migrates the records from the Source to the Target dao.
+type Migrator struct {
+	Source dao.Dao
+	Target dao.Dao
+	// Credentials - where the extracted credentials found in the Source are
+	// moved to. They are only looked for if the Source is a RawGetter.
+	Credentials CredentialStore
+	// Progress - the records already written by an interrupted migration,
+	// they are not written again. Optional.
+	Progress *Progress
+	// KeepTargetSpecs - the specs the Target already has are skipped rather
+	// than overwritten, the records referring to them are still migrated.
+	KeepTargetSpecs bool
+}
+
+// Plan - reads the records of the source. Records that cannot be read, or
+// that refer to records that do not exist, are reported and left out.
+func (m *Migrator) Plan() *Plan {
+	p := &Plan{Report: NewReport()}
+	specIDs := m.planSpecs(p)
+	instances := m.planServiceInstances(p, specIDs)
+	bindings := m.planBindInstances(p, instances)
+	owners := map[string]bool{}
+	for _, si := range instances {
+		owners[si.ID.String()] = true
+	}
+	for _, bi := range bindings {
+		owners[bi.ID.String()] = true
+	}
+	m.planJobStates(p, owners)
+	m.planDeadLetters(p)
+	m.planExtractedCredentials(p, instances, bindings)
+	return p
+}
+
+func (m *Migrator) planSpecs(p *Plan) map[string]bool {
+	specIDs := map[string]bool{}
+	specs, err := m.Source.BatchGetSpecs("/spec")
+	if err != nil && !m.Source.IsNotFoundError(err) {
+		p.Report.add(KindSpec, "*", OutcomeFailed, fmt.Sprintf("unable to list the specs - %v", err))
+		return specIDs
+	}
+	for _, spec := range specs {
+		if spec == nil || spec.ID == "" {
+			p.Report.add(KindSpec, "?", OutcomeCorrupted, "spec without an id")
+			continue
+		}
+		spec := spec
+		specIDs[spec.ID] = true
+		if m.KeepTargetSpecs {
+			if _, err := m.Target.GetSpec(spec.ID); err == nil {
+				p.Report.add(KindSpec, spec.ID, OutcomeSkipped, "the spec exists in the target")
+				continue
+			} else if !m.Target.IsNotFoundError(err) {
+				p.Report.add(KindSpec, spec.ID, OutcomeFailed, fmt.Sprintf("unable to read the spec of the target - %v", err))
+				continue
+			}
+		}
+		p.add(record{
+			kind:  KindSpec,
+			id:    spec.ID,
+			write: func(target dao.Dao) error { return target.SetSpec(spec.ID, spec) },
+			check: func(target dao.Dao) error {
+				got, err := target.GetSpec(spec.ID)
+				if err != nil {
+					return err
+				}
+				return compare(specFields(spec), specFields(got))
+			},
+		})
+	}
+	return specIDs
+}
+
+func (m *Migrator) planServiceInstances(p *Plan, specIDs map[string]bool) []*bundle.ServiceInstance {
+	planned := []*bundle.ServiceInstance{}
+	instances, err := m.Source.BatchGetBundleInstances()
+	if err != nil && !m.Source.IsNotFoundError(err) {
+		p.Report.add(KindServiceInstance, "*", OutcomeFailed, fmt.Sprintf("unable to list the service instances - %v", err))
+		return planned
+	}
+	for _, si := range instances {
+		switch {
+		case si == nil || si.ID == nil:
+			p.Report.add(KindServiceInstance, "?", OutcomeCorrupted, "service instance without an id")
+			continue
+		case si.Spec == nil:
+			p.Report.add(KindServiceInstance, si.ID.String(), OutcomeCorrupted, "service instance without a spec")
+			continue
+		case !specIDs[si.Spec.ID]:
+			p.Report.add(KindServiceInstance, si.ID.String(), OutcomeSkipped,
+				fmt.Sprintf("spec %s of the service instance is not migrated", si.Spec.ID))
+			continue
+		}
+		si := si
+		id := si.ID.String()
+		planned = append(planned, si)
+		p.add(record{
+			kind:  KindServiceInstance,
+			id:    id,
+			write: func(target dao.Dao) error { return target.SetServiceInstance(id, si) },
+			check: func(target dao.Dao) error {
+				got, err := target.GetServiceInstance(id)
+				if err != nil {
+					return err
+				}
+				return compare(serviceInstanceFields(si), serviceInstanceFields(got))
+			},
+		})
+	}
+	return planned
+}
+
+func (m *Migrator) planBindInstances(p *Plan, instances []*bundle.ServiceInstance) []*bundle.BindInstance {
+	planned := []*bundle.BindInstance{}
+	for _, si := range instances {
+		for _, id := range boundIDs(si.BindingIDs) {
+			bi, err := m.Source.GetBindInstance(id)
+			switch {
+			case m.Source.IsNotFoundError(err):
+				p.Report.add(KindBindInstance, id, OutcomeSkipped,
+					fmt.Sprintf("listed by service instance %s but does not exist", si.ID))
+				continue
+			case err != nil:
+				p.Report.add(KindBindInstance, id, OutcomeCorrupted, err.Error())
+				continue
+			}
+			id, bi := id, bi
+			planned = append(planned, bi)
+			p.add(record{
+				kind:  KindBindInstance,
+				id:    id,
+				write: func(target dao.Dao) error { return target.SetBindInstance(id, bi) },
+				check: func(target dao.Dao) error {
+					got, err := target.GetBindInstance(id)
+					if err != nil {
+						return err
+					}
+					return compare(bindInstanceFields(bi), bindInstanceFields(got))
+				},
+			})
+		}
+	}
+	return planned
+}
+
+// planJobStates - the job states of the instances and bindings migrated, the
+// others are skipped since no dao can keep a job without its owner.
+func (m *Migrator) planJobStates(p *Plan, owners map[string]bool) {
+	statuses, err := types.AllJobStates(m.Source, types.JobStateFilter{}, listPageSize)
+	if err != nil {
+		p.Report.add(KindJobState, "*", OutcomeFailed, fmt.Sprintf("unable to list the job states - %v", err))
+		return
+	}
+	for _, status := range statuses {
+		owner, js, id := status.InstanceID.String(), status.State, jobStateID(status)
+		switch {
+		case js.Token == "":
+			p.Report.add(KindJobState, id, OutcomeCorrupted, "job state without a token")
+			continue
+		case !owners[owner]:
+			p.Report.add(KindJobState, id, OutcomeSkipped,
+				fmt.Sprintf("%s is not a migrated instance or binding", owner))
+			continue
+		}
+		p.add(record{
+			kind: KindJobState,
+			id:   id,
+			write: func(target dao.Dao) error {
+				_, err := target.SetState(owner, js)
+				return err
+			},
+			check: func(target dao.Dao) error {
+				got, err := target.GetState(owner, js.Token)
+				if err != nil {
+					return err
+				}
+				return compare(jobStateFields(js), jobStateFields(got))
+			},
+		})
+	}
+}
+
+func (m *Migrator) planDeadLetters(p *Plan) {
+	letters, err := m.Source.BatchGetDeadLetters()
+	if err != nil && !m.Source.IsNotFoundError(err) {
+		p.Report.add(KindDeadLetter, "*", OutcomeFailed, fmt.Sprintf("unable to list the dead letters - %v", err))
+		return
+	}
+	for _, letter := range letters {
+		if letter == nil || letter.ID == "" {
+			p.Report.add(KindDeadLetter, "?", OutcomeCorrupted, "dead letter without an id")
+			continue
+		}
+		letter := letter
+		p.add(record{
+			kind:  KindDeadLetter,
+			id:    letter.ID,
+			write: func(target dao.Dao) error { return target.SetDeadLetter(letter) },
+			check: func(target dao.Dao) error {
+				got, err := target.GetDeadLetter(letter.ID)
+				if err != nil {
+					return err
+				}
+				return compare(deadLetterFields(letter), deadLetterFields(got))
+			},
+		})
+	}
+}
+
+// planExtractedCredentials - the credentials older brokers kept in etcd under
+// the id of an instance or binding. A binding without credentials of its own
+// uses those of its instance.
+func (m *Migrator) planExtractedCredentials(
+	p *Plan, instances []*bundle.ServiceInstance, bindings []*bundle.BindInstance,
+) {
+	raw, ok := m.Source.(RawGetter)
+	if !ok || m.Credentials == nil {
+		return
+	}
+	for _, si := range instances {
+		labels := map[string]string{"apbAction": "provision", "apbName": si.Spec.FQName}
+		m.planCredentials(p, raw, si.ID.String(), si.ID.String(), labels)
+	}
+	for _, bi := range bindings {
+		labels := map[string]string{"apbAction": "bind"}
+		if !m.planCredentials(p, raw, bi.ID.String(), bi.ID.String(), labels) {
+			m.planCredentials(p, raw, bi.ID.String(), bi.ServiceID.String(), labels)
+		}
+	}
+}
+
+// planCredentials - plans to save the credentials kept under the key of from
+// as those of id, false if there are none.
+func (m *Migrator) planCredentials(p *Plan, raw RawGetter, id string, from string, labels map[string]string) bool {
+	payload, err := raw.GetRaw(fmt.Sprintf("/extracted_credentials/%s", from))
+	if m.Source.IsNotFoundError(err) {
+		return false
+	} else if err != nil {
+		p.Report.add(KindExtractedCredentials, id, OutcomeFailed, err.Error())
+		return true
+	}
+	ec := bundle.ExtractedCredentials{}
+	if err := json.Unmarshal([]byte(payload), &ec); err != nil {
+		p.Report.add(KindExtractedCredentials, id, OutcomeCorrupted, err.Error())
+		return true
+	}
+	p.add(record{
+		kind:  KindExtractedCredentials,
+		id:    id,
+		write: func(dao.Dao) error { return m.Credentials.Save(id, ec.Credentials, labels) },
+		check: func(dao.Dao) error {
+			got, err := m.Credentials.Get(id)
+			if err != nil {
+				return err
+			}
+			return compare(ec.Credentials, got)
+		},
+	})
+	return true
+}
+
+// Migrate - writes the records of the plan to the target, except those
+// already written according to the progress. A record that cannot be written
+// is reported and the migration goes on.
+func (m *Migrator) Migrate(plan *Plan) *Report {
+	report := NewReport()
+	for i, r := range plan.records {
+		if m.Progress != nil && m.Progress.Done(r.key()) {
+			report.add(r.kind, r.id, OutcomeResumed, "")
+			continue
+		}
+		if err := r.write(m.Target); err != nil {
+			log.Errorf("[%d/%d] unable to migrate %s %s - %v", i+1, len(plan.records), r.kind, r.id, err)
+			report.add(r.kind, r.id, OutcomeFailed, err.Error())
+			continue
+		}
+		if m.Progress != nil {
+			if err := m.Progress.MarkDone(r.key()); err != nil {
+				log.Warningf("unable to record the progress of %s %s - %v", r.kind, r.id, err)
+			}
+		}
+		log.Infof("[%d/%d] migrated %s %s", i+1, len(plan.records), r.kind, r.id)
+		report.add(r.kind, r.id, OutcomeMigrated, "")
+	}
+	return report
+}
+
+// Verify - compares every record of the plan with the one of the target.
+func (m *Migrator) Verify(plan *Plan) *Report {
+	report := NewReport()
+	for _, r := range plan.records {
+		err := r.check(m.Target)
+		switch e := err.(type) {
+		case nil:
+			report.add(r.kind, r.id, OutcomeVerified, "")
+		case mismatchError:
+			report.add(r.kind, r.id, OutcomeMismatch, e.reason)
+		default:
+			if r.kind != KindExtractedCredentials && m.Target.IsNotFoundError(err) {
+				report.add(r.kind, r.id, OutcomeMismatch, "missing from the target")
+				continue
+			}
+			report.add(r.kind, r.id, OutcomeFailed, err.Error())
+		}
+	}
+	return report
+}
+
+func jobStateID(status bundle.RecoverStatus) string {
+	return fmt.Sprintf("%s/%s", status.InstanceID, status.State.Token)
+}
+
+func boundIDs(bindings map[string]bool) []string {
+	ids := []string{}
+	for id, bound := range bindings {
+		if bound {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
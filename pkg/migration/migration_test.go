@@ -0,0 +1,302 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package migration
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao"
+	memory "github.com/openshift/ansible-service-broker/pkg/dao/memory"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMemoryDao(t *testing.T) *memory.Dao {
+	d, err := memory.NewDao("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// fixture - the records saved to the source.
+type fixture struct {
+	spec     *bundle.Spec
+	instance *bundle.ServiceInstance
+	binding  *bundle.BindInstance
+	jobs     []bundle.JobState
+	letter   *types.DeadLetter
+}
+
+func newFixture(t *testing.T, d dao.Dao) fixture {
+	f := fixture{
+		spec: &bundle.Spec{ID: "spec-1", FQName: "dh-postgresql", Image: "postgresql-apb",
+			Plans: []bundle.Plan{{ID: "spec-1-dev", Name: "dev"}}},
+		letter: &types.DeadLetter{ID: uuid.New(), SubscriberID: "jobstate", Payload: []byte(`{"a": 1}`)},
+	}
+	f.instance = &bundle.ServiceInstance{
+		ID:         uuid.NewRandom(),
+		Spec:       f.spec,
+		Context:    &bundle.Context{Platform: "kubernetes", Namespace: "project"},
+		Parameters: &bundle.Parameters{"plan": "dev"},
+		BindingIDs: map[string]bool{},
+	}
+	f.binding = &bundle.BindInstance{ID: uuid.NewRandom(), ServiceID: f.instance.ID}
+	f.instance.AddBinding(f.binding.ID)
+	f.jobs = []bundle.JobState{
+		{Token: uuid.New(), State: bundle.StateSucceeded, Method: bundle.JobMethodProvision},
+		{Token: uuid.New(), State: bundle.StateInProgress, Method: bundle.JobMethodUpdate},
+	}
+
+	assert.NoError(t, d.SetSpec(f.spec.ID, f.spec))
+	assert.NoError(t, d.SetServiceInstance(f.instance.ID.String(), f.instance))
+	assert.NoError(t, d.SetBindInstance(f.binding.ID.String(), f.binding))
+	for _, js := range f.jobs {
+		_, err := d.SetState(f.instance.ID.String(), js)
+		assert.NoError(t, err)
+	}
+	_, err := d.SetState(f.binding.ID.String(), bundle.JobState{
+		Token: uuid.New(), State: bundle.StateSucceeded, Method: bundle.JobMethodBind,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, d.SetDeadLetter(f.letter))
+	return f
+}
+
+func TestMigrateAndVerify(t *testing.T) {
+	source, target := newMemoryDao(t), newMemoryDao(t)
+	f := newFixture(t, source)
+	m := &Migrator{Source: source, Target: target}
+
+	plan := m.Plan()
+	assert.Empty(t, plan.Report.Problems)
+	assert.Equal(t, 1, plan.Report.Count(KindSpec, OutcomePlanned))
+	assert.Equal(t, 1, plan.Report.Count(KindServiceInstance, OutcomePlanned))
+	assert.Equal(t, 1, plan.Report.Count(KindBindInstance, OutcomePlanned))
+	assert.Equal(t, 3, plan.Report.Count(KindJobState, OutcomePlanned))
+	assert.Equal(t, 1, plan.Report.Count(KindDeadLetter, OutcomePlanned))
+	_, err := target.GetSpec(f.spec.ID)
+	assert.True(t, target.IsNotFoundError(err), "planning does not write to the target")
+
+	report := m.Migrate(plan)
+	assert.False(t, report.Failed(), "%v", report.Problems)
+	assert.Equal(t, 7, report.Total(OutcomeMigrated))
+
+	report = m.Verify(plan)
+	assert.False(t, report.Failed(), "%v", report.Problems)
+	assert.Equal(t, 7, report.Total(OutcomeVerified))
+	si, err := target.GetServiceInstance(f.instance.ID.String())
+	if assert.NoError(t, err) {
+		assert.True(t, si.BindingIDs[f.binding.ID.String()])
+	}
+	js, err := target.GetState(f.instance.ID.String(), f.jobs[1].Token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, bundle.StateInProgress, js.State)
+	}
+}
+
+func TestPlanReportsSkippedAndCorruptedRecords(t *testing.T) {
+	source := newMemoryDao(t)
+	f := newFixture(t, source)
+
+	orphan := &bundle.ServiceInstance{ID: uuid.NewRandom(), Spec: &bundle.Spec{ID: "removed-spec"}}
+	assert.NoError(t, source.SetServiceInstance(orphan.ID.String(), orphan))
+	missing := uuid.NewRandom()
+	f.instance.AddBinding(missing)
+	assert.NoError(t, source.SetServiceInstance(f.instance.ID.String(), f.instance))
+	_, err := source.SetState(orphan.ID.String(), bundle.JobState{
+		Token: uuid.New(), State: bundle.StateFailed, Method: bundle.JobMethodProvision,
+	})
+	assert.NoError(t, err)
+	_, err = source.SetState(f.instance.ID.String(), bundle.JobState{State: bundle.StateFailed})
+	assert.NoError(t, err)
+
+	plan := (&Migrator{Source: source, Target: newMemoryDao(t)}).Plan()
+	assert.Equal(t, 1, plan.Report.Count(KindServiceInstance, OutcomeSkipped))
+	assert.Equal(t, 1, plan.Report.Count(KindServiceInstance, OutcomePlanned))
+	assert.Equal(t, 1, plan.Report.Count(KindBindInstance, OutcomeSkipped))
+	assert.Equal(t, 1, plan.Report.Count(KindJobState, OutcomeSkipped))
+	assert.Equal(t, 1, plan.Report.Count(KindJobState, OutcomeCorrupted))
+	assert.Equal(t, 3, plan.Report.Count(KindJobState, OutcomePlanned))
+	assert.Len(t, plan.Report.Problems, 4)
+	assert.False(t, plan.Report.Failed(), "skipped and corrupted records do not fail the migration")
+
+	out := &bytes.Buffer{}
+	plan.Write(out)
+	assert.Contains(t, out.String(), fmt.Sprintf("migrate service instance %s", f.instance.ID))
+	assert.Contains(t, out.String(), fmt.Sprintf("skipped service instance %s: spec removed-spec", orphan.ID))
+}
+
+func TestKeepTargetSpecs(t *testing.T) {
+	source, target := newMemoryDao(t), newMemoryDao(t)
+	f := newFixture(t, source)
+	kept := &bundle.Spec{ID: f.spec.ID, FQName: "dh-postgresql", Image: "postgresql-apb:other-namespace"}
+	assert.NoError(t, target.SetSpec(kept.ID, kept))
+	m := &Migrator{Source: source, Target: target, KeepTargetSpecs: true}
+
+	plan := m.Plan()
+	assert.Equal(t, 1, plan.Report.Count(KindSpec, OutcomeSkipped))
+	assert.Equal(t, 1, plan.Report.Count(KindServiceInstance, OutcomePlanned))
+	report := m.Migrate(plan)
+	assert.False(t, report.Failed(), "%v", report.Problems)
+	spec, err := target.GetSpec(f.spec.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, kept.Image, spec.Image)
+	}
+	_, err = target.GetServiceInstance(f.instance.ID.String())
+	assert.NoError(t, err)
+}
+
+// failingDao - a dao failing to save bindings.
+type failingDao struct {
+	dao.Dao
+}
+
+func (d failingDao) SetBindInstance(string, *bundle.BindInstance) error {
+	return errors.New("unavailable")
+}
+
+func TestMigrateResumesAndGoesOnAfterFailures(t *testing.T) {
+	source, target := newMemoryDao(t), newMemoryDao(t)
+	f := newFixture(t, source)
+	path := filepath.Join(t.TempDir(), "progress")
+
+	progress, err := OpenProgress(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	m := &Migrator{Source: source, Target: failingDao{target}, Progress: progress}
+	plan := m.Plan()
+	report := m.Migrate(plan)
+	assert.True(t, report.Failed())
+	assert.Equal(t, 1, report.Count(KindBindInstance, OutcomeFailed))
+	assert.Equal(t, 6, report.Total(OutcomeMigrated))
+	assert.NoError(t, progress.Close())
+
+	// the second run only writes what is left
+	progress, err = OpenProgress(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer progress.Close()
+	assert.Equal(t, 6, progress.Len())
+	m = &Migrator{Source: source, Target: target, Progress: progress}
+	report = m.Migrate(plan)
+	assert.False(t, report.Failed(), "%v", report.Problems)
+	assert.Equal(t, 6, report.Total(OutcomeResumed))
+	assert.Equal(t, 1, report.Count(KindBindInstance, OutcomeMigrated))
+	_, err = target.GetBindInstance(f.binding.ID.String())
+	assert.NoError(t, err)
+}
+
+func TestVerifyReportsMismatches(t *testing.T) {
+	source, target := newMemoryDao(t), newMemoryDao(t)
+	f := newFixture(t, source)
+	m := &Migrator{Source: source, Target: target}
+	plan := m.Plan()
+	m.Migrate(plan)
+
+	f.instance.DashboardURL = "https://changed.example.com"
+	assert.NoError(t, target.SetServiceInstance(f.instance.ID.String(), f.instance))
+	assert.NoError(t, target.DeleteDeadLetter(f.letter.ID))
+
+	report := m.Verify(plan)
+	assert.True(t, report.Failed())
+	assert.Equal(t, 2, report.Total(OutcomeMismatch))
+	assert.Equal(t, 5, report.Total(OutcomeVerified))
+	for _, p := range report.Problems {
+		switch p.Kind {
+		case KindServiceInstance:
+			assert.Contains(t, p.Reason, "changed.example.com")
+		case KindDeadLetter:
+			assert.Equal(t, "missing from the target", p.Reason)
+		default:
+			t.Errorf("unexpected problem %v", p)
+		}
+	}
+}
+
+// rawDao - a dao keeping the extracted credentials of older brokers.
+type rawDao struct {
+	*memory.Dao
+	raw map[string]string
+}
+
+func (d rawDao) GetRaw(key string) (string, error) {
+	payload, ok := d.raw[key]
+	if !ok {
+		_, err := d.GetSpec("missing")
+		return "", err
+	}
+	return payload, nil
+}
+
+type fakeCredentials map[string]map[string]interface{}
+
+func (c fakeCredentials) Save(id string, credentials map[string]interface{}, labels map[string]string) error {
+	c[id] = credentials
+	return nil
+}
+
+func (c fakeCredentials) Get(id string) (map[string]interface{}, error) {
+	credentials, ok := c[id]
+	if !ok {
+		return nil, errors.New("credentials not found")
+	}
+	return credentials, nil
+}
+
+func TestMigrateExtractedCredentials(t *testing.T) {
+	source := rawDao{Dao: newMemoryDao(t), raw: map[string]string{}}
+	f := newFixture(t, source)
+	source.raw["/extracted_credentials/"+f.instance.ID.String()] = `{"credentials": {"user": "admin"}}`
+	credentials := fakeCredentials{}
+
+	m := &Migrator{Source: source, Target: newMemoryDao(t), Credentials: credentials}
+	plan := m.Plan()
+	assert.Equal(t, 2, plan.Report.Count(KindExtractedCredentials, OutcomePlanned))
+	m.Migrate(plan)
+	report := m.Verify(plan)
+	assert.False(t, report.Failed(), "%v", report.Problems)
+	assert.Equal(t, map[string]interface{}{"user": "admin"}, credentials[f.instance.ID.String()])
+	assert.Equal(t, credentials[f.instance.ID.String()], credentials[f.binding.ID.String()],
+		"a binding without credentials uses those of its instance")
+
+	source.raw["/extracted_credentials/"+f.binding.ID.String()] = `{"credentials": `
+	plan = m.Plan()
+	assert.Equal(t, 1, plan.Report.Count(KindExtractedCredentials, OutcomeCorrupted))
+}
+
+func TestProgressIgnoresBlankLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("spec/a\n\nspec/b\n"), 0600))
+	progress, err := OpenProgress(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer progress.Close()
+	assert.True(t, progress.Done("spec/a"))
+	assert.False(t, progress.Done("spec/c"))
+	assert.Equal(t, 2, progress.Len())
+}
@@ -0,0 +1,77 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package migration
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Progress - the records written to the target, kept in a file with one
+// record per line so that an interrupted migration is resumed where it
+// stopped.
+type Progress struct {
+	file *os.File
+	done map[string]bool
+}
+
+// OpenProgress - opens the progress file, creating it if it does not exist.
+func OpenProgress(path string) (*Progress, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	p := &Progress{file: f, done: map[string]bool{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			p.done[key] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to read the progress file %s - %v", path, err)
+	}
+	return p, nil
+}
+
+// Done - true if the record was written.
+func (p *Progress) Done(key string) bool {
+	return p.done[key]
+}
+
+// Len - the number of records written.
+func (p *Progress) Len() int {
+	return len(p.done)
+}
+
+// MarkDone - records that the record was written. The line is synced to disk
+// before returning so that it survives a crash.
+func (p *Progress) MarkDone(key string) error {
+	if _, err := fmt.Fprintln(p.file, key); err != nil {
+		return err
+	}
+	p.done[key] = true
+	return p.file.Sync()
+}
+
+// Close - closes the progress file.
+func (p *Progress) Close() error {
+	return p.file.Close()
+}
@@ -0,0 +1,139 @@
+//
+// Copyright (c) 2018 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package migration
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// Outcome - what happened to a record.
+type Outcome string
+
+const (
+	// OutcomePlanned - the record will be migrated.
+	OutcomePlanned Outcome = "planned"
+	// OutcomeMigrated - the record was written to the target.
+	OutcomeMigrated Outcome = "migrated"
+	// OutcomeResumed - the record was written by an earlier run.
+	OutcomeResumed Outcome = "resumed"
+	// OutcomeSkipped - the record refers to a record that is not migrated, or
+	// is a spec the target keeps.
+	OutcomeSkipped Outcome = "skipped"
+	// OutcomeCorrupted - the record of the source cannot be read or is
+	// incomplete.
+	OutcomeCorrupted Outcome = "corrupted"
+	// OutcomeFailed - the record could not be read or written.
+	OutcomeFailed Outcome = "failed"
+	// OutcomeVerified - the record of the target is the same as the source.
+	OutcomeVerified Outcome = "verified"
+	// OutcomeMismatch - the record of the target differs from the source.
+	OutcomeMismatch Outcome = "mismatch"
+)
+
+// outcomes - the columns of the report.
+var outcomes = []Outcome{
+	OutcomePlanned,
+	OutcomeMigrated,
+	OutcomeResumed,
+	OutcomeSkipped,
+	OutcomeCorrupted,
+	OutcomeFailed,
+	OutcomeVerified,
+	OutcomeMismatch,
+}
+
+// Problem - a record that was not migrated or verified.
+type Problem struct {
+	Kind    Kind
+	ID      string
+	Outcome Outcome
+	Reason  string
+}
+
+// Report - the outcome of every record of a step of the migration.
+type Report struct {
+	counts map[Kind]map[Outcome]int
+	// Problems - the records skipped, corrupted, failed or mismatched.
+	Problems []Problem
+}
+
+// NewReport - creates an empty report.
+func NewReport() *Report {
+	return &Report{counts: map[Kind]map[Outcome]int{}}
+}
+
+func (r *Report) add(kind Kind, id string, outcome Outcome, reason string) {
+	if r.counts[kind] == nil {
+		r.counts[kind] = map[Outcome]int{}
+	}
+	r.counts[kind][outcome]++
+	if reason != "" {
+		r.Problems = append(r.Problems, Problem{Kind: kind, ID: id, Outcome: outcome, Reason: reason})
+	}
+}
+
+// Count - the number of records of the kind with the outcome.
+func (r *Report) Count(kind Kind, outcome Outcome) int {
+	return r.counts[kind][outcome]
+}
+
+// Total - the number of records of any kind with the outcome.
+func (r *Report) Total(outcome Outcome) int {
+	total := 0
+	for _, counts := range r.counts {
+		total += counts[outcome]
+	}
+	return total
+}
+
+// Failed - true if records could not be read, written or verified. Skipped
+// and corrupted records are only reported.
+func (r *Report) Failed() bool {
+	return r.Total(OutcomeFailed) > 0 || r.Total(OutcomeMismatch) > 0
+}
+
+// Write - prints the counts of each kind of record, and the problems.
+func (r *Report) Write(w io.Writer) {
+	columns := []Outcome{}
+	for _, outcome := range outcomes {
+		if r.Total(outcome) > 0 {
+			columns = append(columns, outcome)
+		}
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "RECORD")
+	for _, outcome := range columns {
+		fmt.Fprintf(tw, "\t%s", outcome)
+	}
+	fmt.Fprintln(tw)
+	for _, kind := range kinds {
+		if r.counts[kind] == nil {
+			continue
+		}
+		fmt.Fprint(tw, kind)
+		for _, outcome := range columns {
+			fmt.Fprintf(tw, "\t%d", r.counts[kind][outcome])
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	for _, p := range r.Problems {
+		fmt.Fprintf(w, "%s %s %s: %s\n", p.Outcome, p.Kind, p.ID, p.Reason)
+	}
+}
@@ -1,11 +1,16 @@
 package mock
 
 import (
+	"errors"
 	"fmt"
 
 	apb "github.com/automationbroker/bundle-lib/bundle"
+	"github.com/openshift/ansible-service-broker/pkg/dao/types"
 )
 
+// errNotFound - returned by the getters when no object is set for them.
+var errNotFound = errors.New("not found")
+
 // SubscriberDAO is mock DAO
 type SubscriberDAO struct {
 	calls     map[string]int
@@ -43,6 +48,41 @@ func (mp *SubscriberDAO) SetState(id string, state apb.JobState) (string, error)
 
 }
 
+// GetStateVersion gets the JobState set in Object, not found if none is set
+func (mp *SubscriberDAO) GetStateVersion(id string, token string) (apb.JobState, types.Version, error) {
+	assert := mp.AssertOn["GetStateVersion"]
+	if nil != assert {
+		if err := assert(id, token); err != nil {
+			mp.assertErr = append(mp.assertErr, err)
+			return apb.JobState{}, types.NoVersion, err
+		}
+	}
+	mp.calls["GetStateVersion"]++
+	retOb := mp.Object["GetStateVersion"]
+	if nil == retOb {
+		return apb.JobState{}, types.NoVersion, errNotFound
+	}
+	return retOb.(apb.JobState), types.Version("1"), mp.Errs["GetStateVersion"]
+}
+
+// SetStateIf sets the JobState
+func (mp *SubscriberDAO) SetStateIf(id string, state apb.JobState, version types.Version) (string, types.Version, error) {
+	assert := mp.AssertOn["SetStateIf"]
+	if nil != assert {
+		if err := assert(id, state, version); err != nil {
+			mp.assertErr = append(mp.assertErr, err)
+			return id, types.NoVersion, err
+		}
+	}
+	mp.calls["SetStateIf"]++
+	return id, types.Version("2"), mp.Errs["SetStateIf"]
+}
+
+// IsNotFoundError is true for the errors of the getters without an object
+func (mp *SubscriberDAO) IsNotFoundError(err error) bool {
+	return err == errNotFound
+}
+
 // DeleteExtractedCredentials deletes extracted credentials
 func (mp *SubscriberDAO) DeleteExtractedCredentials(id string) error {
 	assert := mp.AssertOn["DeleteExtractedCredentials"]
@@ -112,6 +152,38 @@ func (mp *SubscriberDAO) SetServiceInstance(id string, serviceInstance *apb.Serv
 	return mp.Errs["SetServiceInstance"]
 }
 
+// GetServiceInstanceVersion gets a serviceInstance by id
+func (mp *SubscriberDAO) GetServiceInstanceVersion(id string) (*apb.ServiceInstance, types.Version, error) {
+	assert := mp.AssertOn["GetServiceInstanceVersion"]
+	if nil != assert {
+		if err := assert(id); err != nil {
+			mp.assertErr = append(mp.assertErr, err)
+			return nil, types.NoVersion, err
+		}
+	}
+	mp.calls["GetServiceInstanceVersion"]++
+	retOb := mp.Object["GetServiceInstanceVersion"]
+	if nil == retOb {
+		return nil, types.NoVersion, mp.Errs["GetServiceInstanceVersion"]
+	}
+	return retOb.(*apb.ServiceInstance), types.Version("1"), mp.Errs["GetServiceInstanceVersion"]
+}
+
+// SetServiceInstanceIf mock impl
+func (mp *SubscriberDAO) SetServiceInstanceIf(
+	id string, serviceInstance *apb.ServiceInstance, version types.Version,
+) (types.Version, error) {
+	assert := mp.AssertOn["SetServiceInstanceIf"]
+	if nil != assert {
+		if err := assert(id, serviceInstance, version); err != nil {
+			mp.assertErr = append(mp.assertErr, err)
+			return types.NoVersion, err
+		}
+	}
+	mp.calls["SetServiceInstanceIf"]++
+	return types.Version("2"), mp.Errs["SetServiceInstanceIf"]
+}
+
 // GetBindInstance mock impl
 func (mp *SubscriberDAO) GetBindInstance(id string) (*apb.BindInstance, error) {
 	assert := mp.AssertOn["GetBindInstance"]
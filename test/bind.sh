@@ -41,6 +41,7 @@ curl \
     -H "Authorization: bearer $(oc whoami -t)" \
     -H "Content-type: application/json" \
     -H "Accept: application/json" \
+    -H "X-Broker-API-Version: 2.14" \
     -H "X-Broker-API-Originating-Identity: " \
     -d "$req" \
     "https://broker-automation-broker.$HOSTNAME.nip.io/osb/v2/service_instances/$INSTANCE_ID/service_bindings/$BINDING_ID?accepts_incomplete=true"
@@ -13,4 +13,5 @@ curl \
     -H "Authorization: bearer $(oc whoami -t)" \
     -H "Content-type: application/json" \
     -H "Accept: application/json" \
+    -H "X-Broker-API-Version: 2.14" \
     "https://broker-automation-broker.$HOSTNAME.nip.io/osb/v2/catalog"
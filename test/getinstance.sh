@@ -25,5 +25,6 @@ curl \
     -H "Authorization: bearer $(oc whoami -t)" \
     -H "Content-type: application/json" \
     -H "Accept: application/json" \
+    -H "X-Broker-API-Version: 2.14" \
     -H "X-Broker-API-Originating-Identity: " \
     "https://broker-automation-broker.$HOSTNAME.nip.io/osb/v2/service_instances/$INSTANCE_ID"